@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+)
+
+// startAdminServer serves the local admin API on --admin-listen and returns a
+// function that stops it.
+func (r *Runner) startAdminServer() (func(), error) {
+	ln, err := net.Listen("tcp", r.cfg.AdminListen)
+	if err != nil {
+		return nil, fmt.Errorf("admin listen %s: %w", r.cfg.AdminListen, err)
+	}
+	srv := &http.Server{Handler: r.adminHandler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[agent:%s] admin server stopped: %v", r.cfg.AgentID, err)
+		}
+	}()
+	log.Printf("[agent:%s] admin server listening on %s", r.cfg.AgentID, ln.Addr())
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}, nil
+}
+
+func (r *Runner) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/status", r.requireAdminToken(r.handleAdminStatus))
+	mux.HandleFunc("POST /admin/shutdown", r.requireAdminToken(r.handleAdminShutdown))
+	return mux
+}
+
+// requireAdminToken only lets requests carrying --admin-token as a bearer
+// token through, and refuses everything when no token is configured.
+func (r *Runner) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.cfg.AdminToken == "" {
+			http.Error(w, "admin token not configured (--admin-token)", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.cfg.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// adminStatus is the body of GET /admin/status.
+type adminStatus struct {
+	AgentID   string                 `json:"agentId"`
+	BackendID int                    `json:"backendId"`
+	Version   string                 `json:"version"`
+	LockPath  string                 `json:"lockPath,omitempty"`
+	InstallID string                 `json:"installId"`
+	Config    map[string]interface{} `json:"config"`
+	// DuplicateAgent is set while the master reports another install
+	// heartbeating with this agent ID.
+	DuplicateAgent *duplicateAgent `json:"duplicateAgent,omitempty"`
+}
+
+// handleAdminStatus reports who this instance is and the configuration it
+// runs with, secrets redacted as in dump-config.
+func (r *Runner) handleAdminStatus(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	lockPath := r.lockPath
+	installID := r.installID
+	duplicate := r.duplicate
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(adminStatus{
+		AgentID:        r.cfg.AgentID,
+		BackendID:      r.cfg.BackendID,
+		Version:        config.AgentVersion,
+		LockPath:       lockPath,
+		InstallID:      installID,
+		Config:         r.cfg.Effective(),
+		DuplicateAgent: duplicate,
+	})
+}
+
+// handleAdminShutdown stops the runner the same way SIGTERM does: collection
+// stops, the queue gets its final flush and Run returns.
+func (r *Runner) handleAdminShutdown(w http.ResponseWriter, req *http.Request) {
+	log.Printf("[agent:%s] shutdown requested via admin API from %s", r.cfg.AgentID, req.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]bool{"stopping": true})
+	r.shutdown()
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"strings"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+const (
+	granularityFlow   = "flow"
+	granularitySource = "source"
+)
+
+// trafficBucket accumulates deltas for one (sourceIP, chain) key between
+// report ticks.
+type trafficBucket struct {
+	sourceIP    string
+	chains      []string
+	upload      int64
+	download    int64
+	connections int64
+}
+
+// buckets is keyed by sourceIP and chain list; sourceIP is empty for the
+// per-chain totals kept while sampling.
+type buckets map[string]*trafficBucket
+
+func (b buckets) add(sourceIP string, chains []string, up, down, connections int64) {
+	key := sourceIP + "\x00" + strings.Join(chains, "\x00")
+	t := b[key]
+	if t == nil {
+		t = &trafficBucket{sourceIP: sourceIP, chains: cloneStringSlice(chains)}
+		b[key] = t
+	}
+	t.upload += up
+	t.download += down
+	t.connections += connections
+}
+
+// merge adds the totals of other to b.
+func (b buckets) merge(other buckets) {
+	for _, t := range other {
+		b.add(t.sourceIP, t.chains, t.upload, t.download, t.connections)
+	}
+}
+
+// drain empties b and returns one update per bucket.
+func (b buckets) drain(timestampMs int64, aggregate bool) []domain.TrafficUpdate {
+	if len(b) == 0 {
+		return nil
+	}
+	updates := make([]domain.TrafficUpdate, 0, len(b))
+	for key, t := range b {
+		updates = append(updates, domain.TrafficUpdate{
+			Chain:       firstChain(t.chains),
+			Chains:      t.chains,
+			Upload:      t.upload,
+			Download:    t.download,
+			Connections: t.connections,
+			SourceIP:    t.sourceIP,
+			TimestampMs: timestampMs,
+			Aggregate:   aggregate,
+		})
+		delete(b, key)
+	}
+	return updates
+}
+
+// queueSourceTotals queues the per-(sourceIP, chain) updates collected in
+// source granularity mode since the last report tick.
+func (r *Runner) queueSourceTotals() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queueSourceTotalsLocked()
+}
+
+func (r *Runner) queueSourceTotalsLocked() {
+	if len(r.sourceTotals) == 0 {
+		return
+	}
+	r.enqueueLocked(r.sourceTotals.drain(r.correctTimestamp(r.clock.Now().UnixMilli()), false))
+}
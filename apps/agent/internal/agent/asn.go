@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+	"github.com/foru17/neko-master/apps/agent/internal/mmdb"
+)
+
+// asnInfo is the autonomous system a destination IP belongs to.
+type asnInfo struct {
+	Number     int64
+	Org        string
+	Datacenter bool
+}
+
+// asnEnricher tags destination IPs with their ASN from a MaxMind GeoLite2-ASN
+// database and classifies them as datacenter ranges using an operator-supplied
+// ASN list. A nil *asnEnricher is valid and never tags anything.
+type asnEnricher struct {
+	lookup     func(addr netip.Addr) (int64, string)
+	datacenter map[int64]struct{}
+
+	mu     sync.Mutex
+	cache  map[string]asnInfo
+	hits   int64
+	misses int64
+}
+
+func newASNEnricher(cfg config.Config) *asnEnricher {
+	if cfg.ASNDB == "" {
+		return nil
+	}
+	db, err := mmdb.Open(cfg.ASNDB)
+	if err != nil {
+		log.Printf("[agent:%s] asn enrichment disabled: %v", cfg.AgentID, err)
+		return nil
+	}
+	a := &asnEnricher{
+		lookup: func(addr netip.Addr) (int64, string) {
+			rec, ok, err := db.Lookup(addr)
+			if err != nil || !ok {
+				return 0, ""
+			}
+			n, _ := mmdb.Path(rec, "autonomous_system_number").(uint64)
+			org, _ := mmdb.Path(rec, "autonomous_system_organization").(string)
+			return int64(n), org
+		},
+		cache: make(map[string]asnInfo, 256),
+	}
+	if cfg.DatacenterASNs != "" {
+		list, err := loadASNList(cfg.DatacenterASNs)
+		if err != nil {
+			log.Printf("[agent:%s] datacenter classification disabled: %v", cfg.AgentID, err)
+		} else {
+			a.datacenter = list
+		}
+	}
+	return a
+}
+
+// info returns the ASN details for ip; the zero value means unknown.
+func (a *asnEnricher) info(ip string) asnInfo {
+	if a == nil || ip == "" {
+		return asnInfo{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if info, ok := a.cache[ip]; ok {
+		a.hits++
+		return info
+	}
+	a.misses++
+
+	var info asnInfo
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		info.Number, info.Org = a.lookup(addr)
+		info.Org = domain.SanitizeString(info.Org, domain.MaxChainLen)
+		_, info.Datacenter = a.datacenter[info.Number]
+		info.Datacenter = info.Datacenter && info.Number != 0
+	}
+	if len(a.cache) >= geoCacheLimit {
+		a.cache = make(map[string]asnInfo, 256)
+	}
+	a.cache[ip] = info
+	return info
+}
+
+// cacheStats returns the lookup cache hit and miss counts since start.
+func (a *asnEnricher) cacheStats() (hits, misses int64) {
+	if a == nil {
+		return 0, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hits, a.misses
+}
+
+// loadASNList reads one ASN per line ("13335" or "AS13335"); blank lines and
+// text after '#' are ignored.
+func loadASNList(path string) (map[int64]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := make(map[int64]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if len(text) > 2 && strings.EqualFold(text[:2], "AS") {
+			text = text[2:]
+		}
+		n, err := strconv.ParseUint(text, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("%s:%d: invalid ASN %q", path, line, scanner.Text())
+		}
+		list[int64(n)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+)
+
+// retryReport handles a batch whose post failed with a transient error. It
+// goes back to its place at the head of the queue until it has failed
+// --max-report-attempts times; then, per --exhausted-reports, it is
+// dead-lettered or moved behind the updates queued since, so it stops holding
+// up fresher data. The returned error carries the attempt count for the
+// report error log.
+func (r *Runner) retryReport(pending *pendingReport, err error) error {
+	pending.attempts++
+	err = fmt.Errorf("report seq %d, attempt %d: %w", pending.seq, pending.attempts, err)
+	if r.cfg.MaxReportAttempts == 0 || pending.attempts < r.cfg.MaxReportAttempts {
+		r.requeue(pending, true)
+		return err
+	}
+	if r.cfg.ExhaustedReports == "deadletter" {
+		r.deadLetter(pending, err)
+		return err
+	}
+	r.mu.Lock()
+	r.queue.deferReport(pending)
+	r.trimQueueLocked()
+	r.mu.Unlock()
+	log.Printf("[agent:%s] report seq %d (%d updates) failed %d times; moved behind newer updates",
+		r.cfg.AgentID, pending.seq, len(pending.updates), pending.attempts)
+	return err
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// Paths whose posts are folded into the next /agent/batch envelope when
+// --batch-posts is on.
+const (
+	heartbeatPath   = "/agent/heartbeat"
+	policyStatePath = "/agent/policy-state"
+	batchPath       = "/agent/batch"
+)
+
+// batchItem is a heartbeat or policy-state post parked until the next report
+// tick. The posting goroutine blocks on done, so callers keep their usual
+// error handling and response decoding.
+type batchItem struct {
+	path    string
+	payload interface{}
+	out     interface{}
+	done    chan batchResult
+}
+
+type batchResult struct {
+	latencyMs int64
+	err       error
+}
+
+// batchEnvelope is the body of POST /agent/batch. Only parts that are due are
+// set; the report part keeps its requestId so retries dedupe as usual.
+type batchEnvelope struct {
+	BackendID   int                   `json:"backendId"`
+	AgentID     string                `json:"agentId"`
+	Report      *domain.ReportPayload `json:"report,omitempty"`
+	Heartbeat   interface{}           `json:"heartbeat,omitempty"`
+	PolicyState interface{}           `json:"policyState,omitempty"`
+}
+
+type batchResponse struct {
+	Heartbeat json.RawMessage `json:"heartbeat,omitempty"`
+}
+
+func isBatchable(path string) bool {
+	return path == heartbeatPath || path == policyStatePath
+}
+
+// batching reports whether posts should currently go through /agent/batch.
+func (r *Runner) batching() bool {
+	if !r.cfg.BatchPosts {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.batchUnsupported
+}
+
+// parkForBatch queues a post for the next envelope and waits for its result.
+func (r *Runner) parkForBatch(ctx context.Context, path string, payload, out interface{}) (int64, error) {
+	item := &batchItem{path: path, payload: payload, out: out, done: make(chan batchResult, 1)}
+	r.mu.Lock()
+	r.batchItems = append(r.batchItems, item)
+	r.mu.Unlock()
+
+	select {
+	case res := <-item.done:
+		return res.latencyMs, res.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (r *Runner) takeBatchItems() []*batchItem {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := r.batchItems
+	r.batchItems = nil
+	return items
+}
+
+// flushBatch sends the report batch together with any parked posts in one
+// request. A 404 means the master predates /agent/batch: batching is turned
+// off for good and everything is sent individually.
+func (r *Runner) flushBatch(ctx context.Context, report *domain.ReportPayload, items []*batchItem) error {
+	env := batchEnvelope{BackendID: r.cfg.BackendID, AgentID: r.cfg.AgentID, Report: report}
+	for _, item := range items {
+		switch item.path {
+		case heartbeatPath:
+			env.Heartbeat = item.payload
+		case policyStatePath:
+			env.PolicyState = item.payload
+		}
+	}
+
+	var resp batchResponse
+	latencyMs, err := r.postJSONWithLatency(ctx, batchPath, env, &resp)
+	var httpErr *serverHTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+		log.Printf("[agent:%s] master has no %s endpoint (404), posting individually", r.cfg.AgentID, batchPath)
+		r.mu.Lock()
+		r.batchUnsupported = true
+		r.mu.Unlock()
+		return r.flushIndividually(ctx, report, items)
+	}
+
+	for _, item := range items {
+		if err == nil && item.path == heartbeatPath && item.out != nil && len(resp.Heartbeat) > 0 {
+			_ = json.Unmarshal(resp.Heartbeat, item.out)
+		}
+		item.done <- batchResult{latencyMs: latencyMs, err: err}
+	}
+	return err
+}
+
+func (r *Runner) flushIndividually(ctx context.Context, report *domain.ReportPayload, items []*batchItem) error {
+	for _, item := range items {
+		latencyMs, err := r.postJSONWithLatency(ctx, item.path, item.payload, item.out)
+		item.done <- batchResult{latencyMs: latencyMs, err: err}
+	}
+	if report == nil {
+		return nil
+	}
+	return r.postReport(ctx, report)
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+const (
+	// blockedReportEvery bounds blocked updates per (domain, source IP): a
+	// device retrying a blocked host in a tight loop yields one update per
+	// window whose connections field carries the attempt count.
+	blockedReportEvery = time.Minute
+	blockedKeyLimit    = 4096
+)
+
+type blockedKey struct {
+	domain   string
+	sourceIP string
+}
+
+type blockedEntry struct {
+	lastSent time.Duration // monotonic
+	pending  int64
+}
+
+// recordBlockedLocked notes a newly seen rejected connection and returns the
+// zero-byte update to queue, if this key's window allows one. Callers must
+// hold r.flowMu.
+func (r *Runner) recordBlockedLocked(u domain.TrafficUpdate, mono time.Duration) (domain.TrafficUpdate, bool) {
+	r.blockedSeen.Add(1)
+	key := blockedKey{domain: defaultString(u.Domain, u.IP), sourceIP: u.SourceIP}
+	e, ok := r.blocked[key]
+	if ok && mono-e.lastSent < blockedReportEvery {
+		e.pending++
+		r.blockedSuppressed.Add(1)
+		return domain.TrafficUpdate{}, false
+	}
+	if !ok {
+		if len(r.blocked) >= blockedKeyLimit {
+			r.pruneBlockedLocked(mono)
+		}
+		e = &blockedEntry{}
+		r.blocked[key] = e
+	}
+	u.Blocked = true
+	u.Connections = 1 + e.pending
+	e.lastSent = mono
+	e.pending = 0
+	return u, true
+}
+
+// pruneBlockedLocked drops keys whose window has passed. Their pending
+// counts are lost; if everything is still in window the map is reset.
+func (r *Runner) pruneBlockedLocked(mono time.Duration) {
+	for k, e := range r.blocked {
+		if mono-e.lastSent >= blockedReportEvery {
+			delete(r.blocked, k)
+		}
+	}
+	if len(r.blocked) >= blockedKeyLimit {
+		r.blocked = make(map[blockedKey]*blockedEntry, 256)
+	}
+}
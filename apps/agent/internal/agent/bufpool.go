@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"sync"
+)
+
+// maxPooledBuffer keeps the odd huge body (a multi-megabyte config snapshot)
+// from pinning its buffer in the pool for the life of the process.
+const maxPooledBuffer = 4 << 20
+
+// bodyBuffers recycles the buffers master request bodies are encoded into;
+// every report tick would otherwise allocate a fresh batch-sized slice.
+var bodyBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// gzipWriters recycles compressors, whose internal state is several hundred
+// kilobytes per writer.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+func getBuffer() *bytes.Buffer {
+	buf := bodyBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bodyBuffers.Put(buf)
+	}
+}
+
+// gzipBody compresses body into a new buffer. The result is not pooled: the
+// HTTP transport may still be reading a request body after Do returns.
+func gzipBody(body []byte) (*bytes.Buffer, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)/4+512))
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/gateway"
+)
+
+// CheckResult is one row of the `neko-agent check` table.
+type CheckResult struct {
+	Name    string
+	OK      bool
+	Skipped bool
+	Detail  string
+}
+
+// Check validates the configuration end to end without starting any loops:
+// the gateway is polled and its config fetched once, and the master is asked
+// for a protocol version and sent one heartbeat to prove the token is
+// accepted. Every check runs even when an earlier one fails.
+func (r *Runner) Check(ctx context.Context) []CheckResult {
+	var results []CheckResult
+	add := func(name, detail string, err error) {
+		if err != nil {
+			results = append(results, CheckResult{Name: name, Detail: err.Error()})
+			return
+		}
+		results = append(results, CheckResult{Name: name, OK: true, Detail: detail})
+	}
+
+	if r.cfg.GatewayType == gateway.TypeAuto {
+		err := r.detectGatewayTypeOnce(ctx)
+		add("gateway type", "detected "+r.gatewayClient.Type(), err)
+	}
+
+	flows, err := r.gatewayClient.Collect(ctx)
+	add("gateway", fmt.Sprintf("%s %s: %d connections parsed", r.gatewayType(), r.cfg.GatewayEndpoint, len(flows)), err)
+
+	if snapshot, err := r.gatewayClient.GetConfigSnapshot(ctx); err != nil {
+		add("gateway config", "", err)
+	} else {
+		add("gateway config", fmt.Sprintf("%d rules, %d proxies, %d providers", len(snapshot.Rules), len(snapshot.Proxies), len(snapshot.Providers)), nil)
+	}
+
+	err = r.negotiateProtocol(ctx)
+	add("master", fmt.Sprintf("%s: protocol v%d", r.cfg.ServerAPIBase, r.protocol()), err)
+
+	// Posted directly rather than through sendHeartbeat so that neither
+	// batching nor commands in the response come into play.
+	body, err := json.Marshal(heartbeatForProtocol(r.buildHeartbeat()))
+	if err == nil {
+		var latencyMs int64
+		latencyMs, err = r.postBody(ctx, heartbeatPath, body, "application/json", nil)
+		add("master auth", fmt.Sprintf("heartbeat accepted for backend %d in %dms", r.cfg.BackendID, latencyMs), err)
+	} else {
+		add("master auth", "", err)
+	}
+
+	results = append(results, r.checkClock())
+	return results
+}
+
+// checkClock compares our clock with the Date headers of the master
+// responses seen so far.
+func (r *Runner) checkClock() CheckResult {
+	res := CheckResult{Name: "clock"}
+	r.skew.mu.Lock()
+	samples := r.skew.samples
+	r.skew.mu.Unlock()
+	if samples == 0 {
+		res.Skipped = true
+		res.Detail = "no Date header from master to compare against"
+		return res
+	}
+
+	offset := time.Duration(r.skew.offset()) * time.Millisecond
+	res.Detail = fmt.Sprintf("offset from master %v", offset)
+	res.OK = r.cfg.ClockSkewWarn <= 0 || time.Duration(abs64(offset.Milliseconds()))*time.Millisecond <= r.cfg.ClockSkewWarn
+	if !res.OK {
+		res.Detail += fmt.Sprintf(" exceeds --clock-skew-warn %v", r.cfg.ClockSkewWarn)
+	}
+	return res
+}
+
+// WriteCheckResults prints results as a table and reports whether every
+// check that ran passed.
+func WriteCheckResults(w io.Writer, results []CheckResult) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, res := range results {
+		mark := "✓"
+		switch {
+		case res.Skipped:
+			mark = "-"
+		case !res.OK:
+			mark = "✗"
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", mark, res.Name, res.Detail)
+	}
+	tw.Flush()
+	return ok
+}
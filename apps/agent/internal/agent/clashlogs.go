@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// runClashLogsLoop keeps the gateway's /logs stream open for --clash-logs,
+// reconnecting with backoff whenever it drops. Connections opened while it is
+// down just keep the chains /connections reports.
+func (r *Runner) runClashLogsLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	failures := 0
+	for {
+		start := time.Now()
+		err := r.gatewayClient.FollowClashLogs(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// A stream that stayed up a while was not a failed attempt.
+		if time.Since(start) > time.Minute {
+			failures = 0
+		}
+		delay := r.backoff(time.Second, failures, time.Minute)
+		failures++
+		log.Printf("[agent:%s] clash log stream ended: %v, reconnecting in %v", r.cfg.AgentID, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package agent
+
+import "time"
+
+// clock separates the wall clock, used only for timestamps sent to the
+// master, from a monotonic reading used for every elapsed-time decision, so
+// NTP steps or VM resumes cannot expire or pin flow state.
+type clock interface {
+	Now() time.Time
+	// Monotonic returns the time elapsed since an arbitrary fixed origin.
+	Monotonic() time.Duration
+}
+
+type systemClock struct {
+	start time.Time
+}
+
+func newSystemClock() systemClock {
+	return systemClock{start: time.Now()}
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) Monotonic() time.Duration {
+	// time.Since uses the monotonic reading carried by start.
+	return time.Since(c.start)
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// skewAlpha is the EWMA weight of a new sample. The Date header only has
+// second resolution, so individual samples are noisy and need smoothing.
+const skewAlpha = 0.2
+
+// skewEstimator tracks the smoothed offset between the master's clock and
+// ours, measured from the Date header of master responses.
+type skewEstimator struct {
+	mu       sync.Mutex
+	offsetMs float64
+	samples  int
+	warned   bool
+}
+
+// observe folds one response into the estimate. sent and received bracket the
+// exchange; the master stamped Date somewhere in between.
+func (s *skewEstimator) observe(date string, sent, received time.Time) (offsetMs int64, ok bool) {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return 0, false
+	}
+	mid := sent.Add(received.Sub(sent) / 2)
+	// Date is truncated to the second; on average the real instant is 500ms later.
+	sample := float64(serverTime.Add(500 * time.Millisecond).Sub(mid).Milliseconds())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.samples == 0 {
+		s.offsetMs = sample
+	} else {
+		s.offsetMs += skewAlpha * (sample - s.offsetMs)
+	}
+	s.samples++
+	return int64(math.Round(s.offsetMs)), true
+}
+
+func (s *skewEstimator) offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(math.Round(s.offsetMs))
+}
+
+// observeServerClock updates the skew estimate from a master response and
+// warns once each time the absolute skew crosses the configured threshold.
+func (r *Runner) observeServerClock(resp *http.Response, sent time.Time) {
+	offsetMs, ok := r.skew.observe(resp.Header.Get("Date"), sent, time.Now())
+	if !ok || r.cfg.ClockSkewWarn <= 0 {
+		return
+	}
+	over := time.Duration(abs64(offsetMs))*time.Millisecond > r.cfg.ClockSkewWarn
+
+	r.skew.mu.Lock()
+	changed := over != r.skew.warned
+	r.skew.warned = over
+	r.skew.mu.Unlock()
+
+	if changed && over {
+		log.Printf("[agent:%s] warning: local clock differs from master by %dms (threshold %v)", r.cfg.AgentID, offsetMs, r.cfg.ClockSkewWarn)
+	} else if changed {
+		log.Printf("[agent:%s] clock skew back within threshold (%dms)", r.cfg.AgentID, offsetMs)
+	}
+}
+
+// correctTimestamp shifts a local timestamp onto the master's clock when
+// --correct-clock-skew is enabled.
+func (r *Runner) correctTimestamp(ms int64) int64 {
+	if !r.cfg.CorrectClockSkew {
+		return ms
+	}
+	return ms + r.skew.offset()
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	commandCloseConnection = "close-connection"
+	commandSelectProxy     = "select-proxy"
+
+	commandTimeout = 10 * time.Second
+	// commandHistory bounds how many command results are remembered so a
+	// command re-delivered by the master before it saw the result is answered
+	// again rather than run twice.
+	commandHistory = 256
+)
+
+// agentCommand is an action queued by the master (e.g. from the dashboard)
+// and delivered in the heartbeat response. Which fields are set depends on
+// Type.
+type agentCommand struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	ConnectionID string `json:"connectionId,omitempty"`
+	Group        string `json:"group,omitempty"`
+	Proxy        string `json:"proxy,omitempty"`
+}
+
+type commandResult struct {
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type commandResultPayload struct {
+	BackendID int             `json:"backendId"`
+	AgentID   string          `json:"agentId"`
+	Results   []commandResult `json:"results"`
+}
+
+// handleCommands executes commands from a heartbeat response and reports the
+// outcome to POST /agent/commands/result. Without --allow-commands every
+// command is answered with an error so the dashboard can explain why. A
+// command the master sends again, because the result post was lost, is not
+// run again; its remembered result is re-sent. Heartbeats are sent one at a
+// time, so two calls never race on the same ID.
+func (r *Runner) handleCommands(ctx context.Context, commands []agentCommand) {
+	results := make([]commandResult, 0, len(commands))
+	for _, cmd := range commands {
+		if cmd.ID == "" {
+			continue
+		}
+		if res, ok := r.commandResult(cmd.ID); ok {
+			results = append(results, res)
+			continue
+		}
+		res := commandResult{ID: cmd.ID}
+		if err := r.executeCommand(ctx, cmd); err != nil {
+			res.Error = err.Error()
+			log.Printf("[agent:%s] command %s (%s) failed: %v", r.cfg.AgentID, cmd.ID, cmd.Type, err)
+		} else {
+			res.OK = true
+			log.Printf("[agent:%s] command %s (%s) done", r.cfg.AgentID, cmd.ID, cmd.Type)
+		}
+		r.rememberCommand(res)
+		results = append(results, res)
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	payload := commandResultPayload{BackendID: r.cfg.BackendID, AgentID: r.cfg.AgentID, Results: results}
+	if err := r.postJSON(ctx, "/agent/commands/result", payload); err != nil {
+		log.Printf("[agent:%s] failed to report command results: %v", r.cfg.AgentID, err)
+	}
+}
+
+func (r *Runner) executeCommand(ctx context.Context, cmd agentCommand) error {
+	if !r.cfg.AllowCommands {
+		return fmt.Errorf("remote commands are disabled on this agent (--allow-commands)")
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	switch cmd.Type {
+	case commandCloseConnection:
+		return r.gatewayClient.CloseConnection(ctx, cmd.ConnectionID)
+	case commandSelectProxy:
+		return r.selectProxy(ctx, cmd.Group, cmd.Proxy)
+	default:
+		return fmt.Errorf("unsupported command type %q", cmd.Type)
+	}
+}
+
+// selectProxy switches group to proxy after checking both exist in the
+// gateway's current policy state, then pushes the new state to the master.
+func (r *Runner) selectProxy(ctx context.Context, group, proxy string) error {
+	state, err := r.gatewayClient.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("read policy state: %w", err)
+	}
+	g, ok := state.Proxies[group]
+	if !ok {
+		return fmt.Errorf("unknown policy group %q", group)
+	}
+	if g.Now == "" {
+		return fmt.Errorf("%q is not a selectable group", group)
+	}
+	if _, ok := state.Proxies[proxy]; !ok {
+		return fmt.Errorf("unknown proxy %q", proxy)
+	}
+	if err := r.gatewayClient.SetGroupSelection(ctx, group, proxy); err != nil {
+		return err
+	}
+
+	if !r.cfg.DisablePolicySync {
+		if err := r.syncPolicyState(ctx); err != nil {
+			log.Printf("[agent:%s] policy state sync after selection failed: %v", r.cfg.AgentID, err)
+		}
+	}
+	return nil
+}
+
+// commandResult returns the remembered result of command id, if it ran.
+func (r *Runner) commandResult(id string) (commandResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, res := range r.commandResults {
+		if res.ID == id {
+			return res, true
+		}
+	}
+	return commandResult{}, false
+}
+
+// rememberCommand records the result of a command that ran, forgetting the
+// oldest beyond commandHistory.
+func (r *Runner) rememberCommand(res commandResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.commandResults) >= commandHistory {
+		r.commandResults = r.commandResults[1:]
+	}
+	r.commandResults = append(r.commandResults, res)
+}
@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// deadLetterHeader is the first line of a dead-letter file; one update per
+// line follows.
+type deadLetterHeader struct {
+	TimeMs    int64  `json:"timeMs"`
+	AgentID   string `json:"agentId"`
+	BackendID int    `json:"backendId"`
+	Seq       int64  `json:"seq"`
+	BatchID   string `json:"batchId"`
+	Status    int    `json:"status"`
+	Error     string `json:"error"`
+}
+
+// isPermanentReject reports whether the master refused a report in a way a
+// retry of the same batch cannot fix: a 4xx other than 401 (token, fixed
+// on the master), 408 and 429 (try later) and 409 (binding conflict).
+func isPermanentReject(err error) bool {
+	var httpErr *serverHTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode < 400 || httpErr.StatusCode >= 500 {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// deadLetter drops a permanently rejected batch from the queue so it cannot
+// block everything behind it, keeping a copy in --dead-letter-dir for
+// `neko-agent deadletter replay` once the master is fixed.
+func (r *Runner) deadLetter(pending *pendingReport, rejectErr error) {
+	r.mu.Lock()
+	r.deadLettered++
+	r.mu.Unlock()
+	// The batch is settled as far as the sequence goes; a replay is unsequenced.
+	r.ackReport(pending.seq)
+
+	if r.cfg.DeadLetterDir == "" {
+		log.Printf("[agent:%s] dropping report seq %d (%d updates) rejected by the master: %v; set --state-file or --dead-letter-dir to keep such batches",
+			r.cfg.AgentID, pending.seq, len(pending.updates), rejectErr)
+		return
+	}
+	path, err := r.writeDeadLetter(pending, rejectErr)
+	if err != nil {
+		log.Printf("[agent:%s] dropping report seq %d (%d updates) rejected by the master: %v; dead-letter write failed: %v",
+			r.cfg.AgentID, pending.seq, len(pending.updates), rejectErr, err)
+		return
+	}
+	log.Printf("[agent:%s] report seq %d (%d updates) rejected by the master: %v; moved to %s",
+		r.cfg.AgentID, pending.seq, len(pending.updates), rejectErr, path)
+	if err := pruneDeadLetters(r.cfg.DeadLetterDir, r.cfg.DeadLetterMaxBytes); err != nil {
+		log.Printf("[agent:%s] failed to prune %s: %v", r.cfg.AgentID, r.cfg.DeadLetterDir, err)
+	}
+}
+
+func (r *Runner) writeDeadLetter(pending *pendingReport, rejectErr error) (string, error) {
+	if err := os.MkdirAll(r.cfg.DeadLetterDir, 0o700); err != nil {
+		return "", err
+	}
+	header := deadLetterHeader{
+		TimeMs:    r.clock.Now().UnixMilli(),
+		AgentID:   r.cfg.AgentID,
+		BackendID: r.cfg.BackendID,
+		Seq:       pending.seq,
+		BatchID:   pending.batchID,
+		Error:     rejectErr.Error(),
+	}
+	var httpErr *serverHTTPError
+	if errors.As(rejectErr, &httpErr) {
+		header.Status = httpErr.StatusCode
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(header); err != nil {
+		return "", err
+	}
+	for i := range pending.updates {
+		if err := enc.Encode(&pending.updates[i]); err != nil {
+			return "", err
+		}
+	}
+	// Zero-padded times keep lexical order chronological for pruning and replay.
+	path := filepath.Join(r.cfg.DeadLetterDir, fmt.Sprintf("%013d-seq%d.ndjson", header.TimeMs, pending.seq))
+	return path, os.WriteFile(path, buf.Bytes(), 0o600)
+}
+
+// deadLetterFiles lists the dead-letter files in dir, oldest first.
+func deadLetterFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// pruneDeadLetters deletes the oldest files until dir fits in maxBytes.
+func pruneDeadLetters(dir string, maxBytes int64) error {
+	files, err := deadLetterFiles(dir)
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(files))
+	var total int64
+	for i, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(files) && total > maxBytes; i++ {
+		if err := os.Remove(files[i]); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// readDeadLetter loads a dead-letter file. Update lines that do not decode,
+// e.g. in a file cut short by a crash, are skipped and counted.
+func readDeadLetter(path string) (deadLetterHeader, []domain.TrafficUpdate, int, error) {
+	var header deadLetterHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	if !scanner.Scan() {
+		return header, nil, 0, fmt.Errorf("%s: empty file", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, 0, fmt.Errorf("%s: bad header: %w", path, err)
+	}
+	var updates []domain.TrafficUpdate
+	skipped := 0
+	for scanner.Scan() {
+		var u domain.TrafficUpdate
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			skipped++
+			continue
+		}
+		updates = append(updates, u)
+	}
+	return header, updates, skipped, scanner.Err()
+}
+
+// DeadLetterReplay summarizes a `neko-agent deadletter replay` run.
+type DeadLetterReplay struct {
+	Replayed int // files accepted by the master and deleted
+	Updates  int
+	Rejected []string // files the master rejected again, with the reason
+}
+
+func (s DeadLetterReplay) String() string {
+	out := fmt.Sprintf("replayed %d batches (%d updates)", s.Replayed, s.Updates)
+	if len(s.Rejected) > 0 {
+		out += fmt.Sprintf(", %d rejected again:\n  %s", len(s.Rejected), strings.Join(s.Rejected, "\n  "))
+	}
+	return out
+}
+
+// ReplayDeadLetters resubmits every batch in --dead-letter-dir, oldest first,
+// as a fresh unsequenced report so it cannot collide with the sequence of a
+// running agent. Accepted files are deleted; files rejected again are kept
+// and listed. A transient error stops the replay, leaving the rest in place.
+func (r *Runner) ReplayDeadLetters(ctx context.Context) (DeadLetterReplay, error) {
+	var summary DeadLetterReplay
+	if r.cfg.DeadLetterDir == "" {
+		return summary, errors.New("no dead-letter directory: set --dead-letter-dir or --state-file")
+	}
+	files, err := deadLetterFiles(r.cfg.DeadLetterDir)
+	if err != nil {
+		return summary, err
+	}
+	if len(files) > 0 && !r.cfg.DryRun {
+		if err := r.negotiateProtocol(ctx); err != nil {
+			return summary, err
+		}
+	}
+	for _, path := range files {
+		_, updates, skipped, err := readDeadLetter(path)
+		if err != nil {
+			summary.Rejected = append(summary.Rejected, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+			continue
+		}
+		if skipped > 0 {
+			log.Printf("[agent:%s] %s: skipped %d corrupt lines", r.cfg.AgentID, filepath.Base(path), skipped)
+		}
+		if len(updates) > 0 {
+			err = r.postReport(ctx, r.newReportPayload(newRequestID(), newBatchID(r.cfg.AgentID, 0, updates), 0, updates))
+		}
+		switch {
+		case err == nil:
+			// A dry run only logged the report, so the file must stay.
+			if !r.cfg.DryRun {
+				if err := os.Remove(path); err != nil {
+					return summary, err
+				}
+			}
+			summary.Replayed++
+			summary.Updates += len(updates)
+		case isPermanentReject(err):
+			summary.Rejected = append(summary.Rejected, fmt.Sprintf("%s: %v", filepath.Base(path), err))
+		default:
+			return summary, err
+		}
+	}
+	return summary, nil
+}
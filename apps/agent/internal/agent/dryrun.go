@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// dryRunSamples is how many updates of each report --dry-run logs in full.
+const dryRunSamples = 3
+
+// dryRunPost stands in for a master POST under --dry-run: it logs what would
+// have been sent and always succeeds, so queueing and batching behave as in a
+// real run.
+func (r *Runner) dryRunPost(path string, body []byte) {
+	log.Printf("[agent:%s] dry-run: POST %s (%d bytes)", r.cfg.AgentID, path, len(body))
+}
+
+func (r *Runner) dryRunReport(payload *domain.ReportPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	log.Printf("[agent:%s] dry-run: POST /agent/report (%d bytes, %d updates, seq %d)", r.cfg.AgentID, len(body), len(payload.Updates), payload.Seq)
+	for i := range payload.Updates[:min(dryRunSamples, len(payload.Updates))] {
+		sample, _ := json.Marshal(payload.Updates[i])
+		log.Printf("[agent:%s] dry-run:   %s", r.cfg.AgentID, sample)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package agent
+
+import "log"
+
+// duplicateAgent is the master's report that another install is heartbeating
+// with our agent ID, typically two hosts configured with the same backend
+// token. The two agents fight over the backend binding until one changes ID.
+type duplicateAgent struct {
+	Hostname   string `json:"hostname,omitempty"`
+	InstallID  string `json:"installId,omitempty"`
+	LastSeenMs int64  `json:"lastSeenMs,omitempty"`
+}
+
+// observeDuplicate records the duplicateAgent field of a heartbeat response,
+// nil once the master stops reporting it. A duplicate is logged on every
+// heartbeat it is reported for, as it silently corrupts the backend's data.
+func (r *Runner) observeDuplicate(dup *duplicateAgent) {
+	r.mu.Lock()
+	prev := r.duplicate
+	r.duplicate = dup
+	r.mu.Unlock()
+
+	switch {
+	case dup != nil:
+		log.Printf("[agent:%s] DUPLICATE AGENT: the master sees another install (host %q, install %s) using this agent ID for backend %d; give one of them a distinct --agent-id or use --agent-id-mode=machine",
+			r.cfg.AgentID, dup.Hostname, dup.InstallID, r.cfg.BackendID)
+	case prev != nil:
+		log.Printf("[agent:%s] the master no longer reports a duplicate agent", r.cfg.AgentID)
+	}
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+	"github.com/foru17/neko-master/apps/agent/internal/msgpack"
+)
+
+// msgpackProtocolVersion is the first protocol version whose reports may be
+// MessagePack-encoded.
+const msgpackProtocolVersion = 2
+
+// postReport sends a report batch using the most compact encoding the master
+// accepts. A 415 on MessagePack permanently falls back to JSON for this run.
+func (r *Runner) postReport(ctx context.Context, payload *domain.ReportPayload) error {
+	if r.cfg.DryRun {
+		return r.dryRunReport(payload)
+	}
+	ctx = withRequestID(ctx, payload.RequestID)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if r.useMsgpack() {
+		buf.Write(payload.AppendMsgpack(buf.AvailableBuffer()))
+		_, err := r.postBody(ctx, "/agent/report", buf.Bytes(), msgpack.ContentType, nil)
+		var httpErr *serverHTTPError
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnsupportedMediaType {
+			return err
+		}
+		log.Printf("[agent:%s] master rejected msgpack reports (415), falling back to JSON", r.cfg.AgentID)
+		r.mu.Lock()
+		r.msgpackRejected = true
+		r.mu.Unlock()
+	}
+
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(payload); err != nil {
+		return err
+	}
+	_, err := r.postBody(ctx, "/agent/report", buf.Bytes(), "application/json", nil)
+	return err
+}
+
+func (r *Runner) useMsgpack() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.protocolVersion >= msgpackProtocolVersion && r.msgpackAllowed && !r.msgpackRejected
+}
+
+// supportsEncoding reports whether the master's advertised encodings include
+// name. An empty list means the master did not say, so the protocol default
+// applies.
+func supportsEncoding(encodings []string, name string) bool {
+	if len(encodings) == 0 {
+		return true
+	}
+	for _, e := range encodings {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package agent
+
+// reportModeEvent flushes when traffic changes noticeably instead of on every
+// report tick; --report-interval then only bounds how long updates may wait.
+const reportModeEvent = "event"
+
+func (r *Runner) eventMode() bool {
+	return r.flushNow != nil
+}
+
+// requestFlush asks the report loop for an early flush without blocking; a
+// request already pending covers this one.
+func (r *Runner) requestFlush() {
+	select {
+	case r.flushNow <- struct{}{}:
+	default:
+	}
+}
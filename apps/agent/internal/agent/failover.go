@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// serverFailoverAfter is how many master requests in a row must fail
+	// before the agent switches to --server-url-fallback.
+	serverFailoverAfter = 3
+	// primaryProbeEvery is how often, while on the fallback, one request is
+	// sent to the primary to see whether it is back.
+	primaryProbeEvery = time.Minute
+)
+
+// serverEndpoints tracks whether master requests go to --server-url or
+// --server-url-fallback.
+type serverEndpoints struct {
+	mu        sync.Mutex
+	failures  int  // consecutive failed requests to the primary
+	fallback  bool // requests go to the fallback
+	switched  bool // the active master changed since takeSwitched
+	lastProbe time.Duration
+}
+
+// takeSwitched reports whether requests moved to the other master since the
+// last call.
+func (e *serverEndpoints) takeSwitched() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switched := e.switched
+	e.switched = false
+	return switched
+}
+
+// serverBase returns the API base for the next master request: the primary,
+// or while it is down the fallback, with a probe of the primary every
+// primaryProbeEvery.
+func (r *Runner) serverBase() string {
+	if r.cfg.ServerFallbackAPIBase == "" {
+		return r.cfg.ServerAPIBase
+	}
+	e := &r.endpoints
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.fallback {
+		return r.cfg.ServerAPIBase
+	}
+	if now := r.clock.Monotonic(); now-e.lastProbe >= primaryProbeEvery {
+		e.lastProbe = now
+		return r.cfg.ServerAPIBase
+	}
+	return r.cfg.ServerFallbackAPIBase
+}
+
+// observeServer records the outcome of a master request: a transport error
+// or a 5xx counts against the primary, any other status shows it working.
+// Requests to the fallback are not tracked; it is used for as long as the
+// primary is down, failing or not. Moving to either master drops back to
+// protocol v1 until the heartbeat loop negotiates with it.
+func (r *Runner) observeServer(u *url.URL, status int, err error) {
+	if r.cfg.ServerFallbackAPIBase == "" || !strings.HasPrefix(u.String(), r.cfg.ServerAPIBase+"/") || errors.Is(err, context.Canceled) {
+		return
+	}
+	e := &r.endpoints
+	e.mu.Lock()
+	wasFallback := e.fallback
+	if err == nil && status < 500 {
+		if e.fallback {
+			log.Printf("[agent:%s] primary master %s is back, leaving the fallback", r.cfg.AgentID, r.cfg.ServerAPIBase)
+		}
+		e.failures, e.fallback = 0, false
+	} else {
+		e.failures++
+		if !e.fallback && e.failures >= serverFailoverAfter {
+			log.Printf("[agent:%s] primary master failed %d requests in a row; switching to %s",
+				r.cfg.AgentID, e.failures, r.cfg.ServerFallbackAPIBase)
+			e.fallback = true
+			e.lastProbe = r.clock.Monotonic()
+		}
+	}
+	switched := e.fallback != wasFallback
+	e.switched = e.switched || switched
+	e.mu.Unlock()
+	if switched {
+		r.resetProtocol()
+	}
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// makeRoomForFlowsLocked keeps r.flows within --max-tracked-flows before a
+// poll's new flows are added, evicting the least recently seen flows the poll
+// does not list; flows it lists are never evicted for room. It returns how
+// many new flows may be tracked, or -1 for no limit. New flows beyond that are
+// left out of the poll and picked up once there is room; they have not been
+// counted, so nothing is lost but their timing. Callers must hold r.flowMu.
+func (r *Runner) makeRoomForFlowsLocked(snapshots []domain.FlowSnapshot, mono time.Duration) int {
+	limit := r.cfg.MaxTrackedFlows
+	if limit <= 0 || len(r.flows)+len(snapshots) <= limit {
+		return -1
+	}
+	listed := make(map[string]bool, len(snapshots))
+	added := 0
+	for _, s := range snapshots {
+		listed[s.ID] = true
+		if _, ok := r.flows[s.ID]; !ok {
+			added++
+		}
+	}
+	total := len(r.flows) + added
+	over := total - limit
+	if over <= 0 {
+		return -1
+	}
+
+	type candidate struct {
+		id       string
+		lastSeen time.Duration
+	}
+	idle := make([]candidate, 0, len(r.flows))
+	for id, f := range r.flows {
+		if !listed[id] {
+			idle = append(idle, candidate{id, f.LastSeen})
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastSeen < idle[j].lastSeen })
+	idle = idle[:min(over, len(idle))]
+	for _, c := range idle {
+		r.buryFlowLocked(c.id, r.flows[c.id], mono)
+		delete(r.flows, c.id)
+	}
+	r.capEvictions.Add(int64(len(idle)))
+
+	room := limit - len(r.flows)
+	log.Printf("[agent:%s] %d flows exceed --max-tracked-flows=%d; evicted %d least recently seen, %d new left untracked",
+		r.cfg.AgentID, total, limit, len(idle), max(added-room, 0))
+	return room
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/foru17/neko-master/apps/agent/internal/gateway"
+)
+
+// gatewayCore returns the cached Clash core info, re-reading /version when it
+// is older than gatewayModeRefresh, as a core is upgraded or swapped about as
+// rarely as its mode changes. Detecting mihomo switches the gateway client to
+// its extended endpoints. A failed read keeps the previous value; Surge
+// gateways report nothing.
+func (r *Runner) gatewayCore(ctx context.Context) (gateway.CoreInfo, bool) {
+	if r.gatewayClient.Type() != "clash" {
+		return gateway.CoreInfo{}, false
+	}
+	now := r.clock.Monotonic()
+	r.mu.Lock()
+	core, fetched, at := r.core, r.coreFetched, r.coreAt
+	r.mu.Unlock()
+	if fetched && now-at < gatewayModeRefresh {
+		return core, core != gateway.CoreInfo{}
+	}
+
+	next, err := r.gatewayClient.DetectCore(ctx)
+	r.mu.Lock()
+	r.coreFetched, r.coreAt = true, now
+	if err == nil {
+		r.core = next
+	}
+	r.mu.Unlock()
+	if err != nil {
+		log.Printf("[agent:%s] failed to read gateway core version: %v", r.cfg.AgentID, err)
+		return core, core != gateway.CoreInfo{}
+	}
+	if next != core {
+		log.Printf("[agent:%s] gateway core is %s %s", r.cfg.AgentID, next.Name(), next.Version)
+	}
+	return next, true
+}
+
+// addGatewayCore fills the core name, version and, for mihomo, memory use
+// into a heartbeat.
+func (r *Runner) addGatewayCore(ctx context.Context, payload *heartbeatPayload) {
+	core, ok := r.gatewayCore(ctx)
+	if !ok {
+		return
+	}
+	payload.GatewayCore, payload.GatewayVersion = core.Name(), core.Version
+	if !core.Meta {
+		return
+	}
+	inUse, err := r.gatewayClient.CoreMemory(ctx)
+	if err != nil {
+		if !errors.Is(err, gateway.ErrNoExtendedAPI) {
+			log.Printf("[agent:%s] failed to read gateway memory: %v", r.cfg.AgentID, err)
+		}
+		return
+	}
+	payload.GatewayMemory = inUse
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// gatewayModeRefresh is how often the Clash mode is re-read for heartbeats.
+// Mode switches are rare and manual, so polling /configs on every heartbeat
+// would be wasted requests.
+const gatewayModeRefresh = 5 * time.Minute
+
+// gatewayMode returns the cached Clash mode, refreshing it first when it is
+// older than gatewayModeRefresh. A failed refresh keeps the previous value
+// and is retried at the next refresh; Surge gateways always return "".
+func (r *Runner) gatewayMode(ctx context.Context) string {
+	if r.gatewayClient.Type() != "clash" {
+		return ""
+	}
+	now := r.clock.Monotonic()
+	r.mu.Lock()
+	mode, fetched, at := r.clashMode, r.clashModeFetched, r.clashModeAt
+	r.mu.Unlock()
+	if fetched && now-at < gatewayModeRefresh {
+		return mode
+	}
+
+	next, err := r.gatewayClient.GetClashMode(ctx)
+	r.mu.Lock()
+	r.clashModeFetched, r.clashModeAt = true, now
+	if err == nil {
+		r.clashMode = next
+	}
+	r.mu.Unlock()
+	if err != nil {
+		log.Printf("[agent:%s] failed to read clash mode: %v", r.cfg.AgentID, err)
+		return mode
+	}
+	if next != mode {
+		log.Printf("[agent:%s] clash mode is %s", r.cfg.AgentID, next)
+	}
+	return next
+}
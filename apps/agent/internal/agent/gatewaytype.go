@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/gateway"
+)
+
+// detectGatewayType resolves --gateway-type auto by probing the gateway,
+// retrying with backoff until it answers or ctx is done, as a gateway may
+// come up after the agent. It reports whether the gateway type is known;
+// explicit types are known from the start.
+func (r *Runner) detectGatewayType(ctx context.Context) bool {
+	for failures := 0; ; failures++ {
+		err := r.detectGatewayTypeOnce(ctx)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		delay := r.backoff(time.Second, failures, time.Minute)
+		log.Printf("[agent:%s] %v, retrying in %v", r.cfg.AgentID, err, delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// startGatewayLoops starts the loops that poll the gateway, once its type is
+// known.
+func (r *Runner) startGatewayLoops(ctx context.Context, wg *sync.WaitGroup) {
+	// Read up front so policy sync uses mihomo's endpoints from the start.
+	r.gatewayCore(ctx)
+
+	wg.Add(1)
+	go r.runCollectorLoop(ctx, wg)
+	if !r.cfg.DisableConfigSync && !r.cfg.DryRun {
+		wg.Add(1)
+		go r.runConfigSyncLoop(ctx, wg)
+	}
+	if !r.cfg.DisablePolicySync && !r.cfg.DryRun {
+		wg.Add(1)
+		go r.runPolicyStateSyncLoop(ctx, wg)
+	}
+	if r.cfg.ClashLogs {
+		if r.gatewayClient.Type() != "clash" {
+			log.Printf("[agent:%s] warning: --clash-logs ignored, the gateway is %s", r.cfg.AgentID, r.gatewayClient.Type())
+			return
+		}
+		wg.Add(1)
+		go r.runClashLogsLoop(ctx, wg)
+	}
+}
+
+// detectGatewayTypeOnce is a single detection attempt, for --once and check.
+func (r *Runner) detectGatewayTypeOnce(ctx context.Context) error {
+	if r.gatewayClient.Type() != gateway.TypeAuto {
+		return nil
+	}
+	gatewayType, err := r.gatewayClient.DetectType(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("[agent:%s] detected gateway type %s at %s", r.cfg.AgentID, gatewayType, r.cfg.GatewayEndpoint)
+	return nil
+}
+
+// gatewayType is the type heartbeats report: the configured one, or the
+// detected one for auto.
+func (r *Runner) gatewayType() string {
+	if r.cfg.GatewayType == gateway.TypeAuto {
+		return r.gatewayClient.Type()
+	}
+	return r.cfg.GatewayType
+}
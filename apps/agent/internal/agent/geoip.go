@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+	"github.com/foru17/neko-master/apps/agent/internal/mmdb"
+)
+
+// geoCacheLimit bounds the per-IP lookup cache; it is simply reset when full
+// since destination sets churn slowly compared to the poll interval.
+const geoCacheLimit = 8192
+
+// geoEnricher tags destination IPs with an ISO country code from a MaxMind
+// database. A nil *geoEnricher is valid and never tags anything.
+type geoEnricher struct {
+	db *mmdb.Reader
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newGeoEnricher(cfg config.Config) *geoEnricher {
+	if cfg.GeoIPDB == "" {
+		return nil
+	}
+	db, err := mmdb.Open(cfg.GeoIPDB)
+	if err != nil {
+		log.Printf("[agent:%s] geoip disabled: %v", cfg.AgentID, err)
+		return nil
+	}
+	return &geoEnricher{db: db, cache: make(map[string]string, 256)}
+}
+
+// country returns the ISO country code for ip, or "" when unknown.
+func (g *geoEnricher) country(ip string) string {
+	if g == nil || ip == "" {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if code, ok := g.cache[ip]; ok {
+		return code
+	}
+
+	code := ""
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		if rec, ok, err := g.db.Lookup(addr); err == nil && ok {
+			code, _ = mmdb.Path(rec, "country", "iso_code").(string)
+		}
+	}
+	if len(g.cache) >= geoCacheLimit {
+		g.cache = make(map[string]string, 256)
+	}
+	g.cache[ip] = code
+	return code
+}
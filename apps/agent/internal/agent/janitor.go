@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// staleFlowSweepChunk bounds how many flows one hold of r.flowMu checks
+	// for eviction, so a sweep of a huge flow map never stalls ingest.
+	staleFlowSweepChunk = 1024
+	// minJanitorInterval keeps a tiny --stale-flow-timeout from spinning the
+	// janitor.
+	minJanitorInterval = time.Second
+)
+
+// janitorInterval returns how often stale flows are swept: four times per
+// --stale-flow-timeout, so a flow is evicted at most a quarter late.
+func (r *Runner) janitorInterval() time.Duration {
+	if d := r.cfg.StaleFlowTimeout / 4; d > minJanitorInterval {
+		return d
+	}
+	return minJanitorInterval
+}
+
+// runJanitorLoop evicts stale flows on its own schedule rather than after
+// each ingest, so an unreachable gateway does not pin every flow it last
+// listed in memory for the length of the outage.
+func (r *Runner) runJanitorLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(r.janitorInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.sweepStaleFlows()
+		}
+	}
+}
+
+// sweepStaleFlows drops flows the gateway has not listed for
+// --stale-flow-timeout, keeping tombstones of their counters, and returns how
+// many went. The flow IDs are copied up front and then checked
+// staleFlowSweepChunk at a time, releasing r.flowMu in between; a flow listed
+// again meanwhile has a fresh LastSeen and stays.
+func (r *Runner) sweepStaleFlows() int {
+	mono := r.clock.Monotonic()
+	r.flowMu.Lock()
+	ids := make([]string, 0, len(r.flows))
+	for id := range r.flows {
+		ids = append(ids, id)
+	}
+	r.flowMu.Unlock()
+
+	evicted := 0
+	for len(ids) > 0 {
+		chunk := ids[:min(len(ids), staleFlowSweepChunk)]
+		ids = ids[len(chunk):]
+		r.flowMu.Lock()
+		for _, id := range chunk {
+			if f, ok := r.flows[id]; ok && mono-f.LastSeen > r.cfg.StaleFlowTimeout {
+				delete(r.flows, id)
+				r.buryFlowLocked(id, f, mono)
+				evicted++
+			}
+		}
+		r.flowMu.Unlock()
+	}
+
+	r.flowMu.Lock()
+	r.pruneTombstonesLocked(mono)
+	r.flowMu.Unlock()
+	r.staleEvictions.Add(int64(evicted))
+	return evicted
+}
@@ -0,0 +1,258 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+)
+
+// defaultLockDir is used when --lock-dir is not set. Unlike the temp dir it is
+// shared between systemd units with PrivateTmp=yes and is not touched by tmp
+// cleaners.
+const defaultLockDir = "/run/neko-agent"
+
+const (
+	takeoverPoll = 100 * time.Millisecond
+	// takeoverKillWait bounds how long a SIGKILL-ed holder may take to vanish.
+	takeoverKillWait = 5 * time.Second
+)
+
+// resolveLockDir returns the directory for the instance lock, creating it if
+// missing. An explicit dir must be usable; the default falls back to the temp
+// dir when /run is not writable (e.g. running unprivileged).
+func resolveLockDir(dir string) (string, error) {
+	if dir != "" {
+		if err := ensureLockDir(dir); err != nil {
+			return "", fmt.Errorf("lock dir %s: %w", dir, err)
+		}
+		return dir, nil
+	}
+	if err := ensureLockDir(defaultLockDir); err == nil {
+		return defaultLockDir, nil
+	}
+	return os.TempDir(), nil
+}
+
+// ensureLockDir creates dir (0755, so other users can see who holds a lock)
+// and checks that files can be created in it.
+func ensureLockDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (r *Runner) acquireLock() error {
+	lockDir, err := resolveLockDir(r.cfg.LockDir)
+	if err != nil {
+		return err
+	}
+	lockPath := filepath.Join(lockDir, fmt.Sprintf("neko-agent-backend-%d.lock", r.cfg.BackendID))
+
+	// Check if lock file exists and if its holder is still running
+	if holder, err := readLockHolder(lockPath); err == nil && holder.PID > 0 && holder.PID != os.Getpid() {
+		if holderAlive(lockPath, holder) {
+			if r.cfg.Takeover == "" {
+				return fmt.Errorf("another agent instance (PID %d) is already running for backend %d", holder.PID, r.cfg.BackendID)
+			}
+			if err := r.takeOver(lockPath, holder); err != nil {
+				return err
+			}
+		}
+		// The holder is gone; remove its lock unless it already did.
+		if current, err := readLockHolder(lockPath); err == nil && current == holder {
+			log.Printf("[agent:%s] removing stale lock file from PID %d", r.cfg.AgentID, holder.PID)
+			os.Remove(lockPath)
+		}
+	}
+
+	// Create lock file with exclusive flag (O_EXCL)
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("lock file already exists for backend %d", r.cfg.BackendID)
+		}
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+	// The flock is held for as long as file stays open; platforms without
+	// process identities use it to tell a live holder from a reused PID.
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return fmt.Errorf("failed to lock %s: %w", lockPath, err)
+	}
+
+	// Write PID and process identity to lock file
+	if _, err := file.WriteString(currentLockHolder().String()); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return fmt.Errorf("failed to write PID to lock file: %w", err)
+	}
+
+	r.mu.Lock()
+	r.lockFile = file
+	r.lockPath = lockPath
+	r.mu.Unlock()
+	log.Printf("[agent:%s] holding lock %s", r.cfg.AgentID, lockPath)
+	return nil
+}
+
+// lockHolder is the content of a lock file: the holder's PID on the first
+// line, followed by its start time and executable name where the platform
+// provides them, so a PID reused by an unrelated process after a reboot is
+// not mistaken for a running agent.
+type lockHolder struct {
+	PID       int
+	StartTime string
+	Exe       string
+}
+
+func currentLockHolder() lockHolder {
+	h := lockHolder{PID: os.Getpid()}
+	h.StartTime, h.Exe, _ = processIdentity(h.PID)
+	return h
+}
+
+func (h lockHolder) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", h.PID)
+	if h.StartTime != "" {
+		fmt.Fprintf(&b, "start=%s\nexe=%s\n", h.StartTime, h.Exe)
+	}
+	return b.String()
+}
+
+// readLockHolder parses the lock file at path. Lock files written by older
+// agents only contain the PID.
+func readLockHolder(path string) (lockHolder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return lockHolder{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return lockHolder{}, fmt.Errorf("malformed lock file %s: %w", path, err)
+	}
+	h := lockHolder{PID: pid}
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "start":
+			h.StartTime = value
+		case "exe":
+			h.Exe = value
+		}
+	}
+	return h, nil
+}
+
+// holderAlive reports whether h is still running and holding lockPath. When
+// the lock records a process identity, the running process must match it;
+// otherwise platforms without identities check the holder's flock.
+func holderAlive(lockPath string, h lockHolder) bool {
+	if !isProcessRunning(h.PID) {
+		return false
+	}
+	if h.StartTime != "" {
+		start, exe, err := processIdentity(h.PID)
+		if err != nil {
+			// Exited since the check above, or unreadable; stay conservative.
+			return isProcessRunning(h.PID)
+		}
+		return start == h.StartTime && exe == h.Exe
+	}
+	if processIdentitySupported {
+		// Written by an older agent that only recorded its PID.
+		return true
+	}
+	return lockFileLocked(lockPath)
+}
+
+// lockFileLocked reports whether some process holds the flock on path.
+func lockFileLocked(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return errors.Is(err, syscall.EWOULDBLOCK)
+	}
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// takeOver asks the instance pid holding lockPath to exit with SIGTERM, which
+// lets it flush and release the lock, and waits up to --takeover-grace for it
+// to go. With --takeover=force a holder that is still there is sent SIGKILL.
+func (r *Runner) takeOver(lockPath string, holder lockHolder) error {
+	pid := holder.PID
+	log.Printf("[agent:%s] taking over lock from PID %d, sending SIGTERM", r.cfg.AgentID, pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("signal agent instance (PID %d): %w", pid, err)
+	}
+	if waitLockReleased(lockPath, holder, r.cfg.TakeoverGrace) {
+		return nil
+	}
+	if r.cfg.Takeover != config.TakeoverForce {
+		return fmt.Errorf("agent instance (PID %d) did not exit within %s; use --takeover=force to kill it", pid, r.cfg.TakeoverGrace)
+	}
+
+	log.Printf("[agent:%s] PID %d still running after %s, sending SIGKILL", r.cfg.AgentID, pid, r.cfg.TakeoverGrace)
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("kill agent instance (PID %d): %w", pid, err)
+	}
+	if !waitLockReleased(lockPath, holder, takeoverKillWait) {
+		return fmt.Errorf("agent instance (PID %d) survived SIGKILL", pid)
+	}
+	return nil
+}
+
+// waitLockReleased polls until holder no longer holds lockPath, either
+// because it removed the lock or because it exited, and reports whether that
+// happened within timeout.
+func waitLockReleased(lockPath string, holder lockHolder, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if current, err := readLockHolder(lockPath); err != nil || current != holder || !holderAlive(lockPath, holder) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(takeoverPoll)
+	}
+}
+
+func (r *Runner) releaseLock() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lockFile != nil {
+		r.lockFile.Close()
+		os.Remove(r.lockPath)
+		r.lockFile = nil
+		r.lockPath = ""
+	}
+}
+
+// isProcessRunning checks if a process with given PID is running
+func isProcessRunning(pid int) bool {
+	// On Unix, use syscall.Kill with signal 0 to check if process exists
+	// Signal 0 performs error checking without actually sending a signal
+	err := syscall.Kill(pid, 0)
+	return err == nil
+}
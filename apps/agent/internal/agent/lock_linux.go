@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const processIdentitySupported = true
+
+// processIdentity returns the start time (in clock ticks since boot) and the
+// executable name of pid from /proc/<pid>/stat. Together with the PID they
+// identify a process across PID reuse.
+func processIdentity(pid int) (startTime, exe string, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", "", err
+	}
+	// The name is in parentheses and may itself contain spaces or ')', so
+	// split around the last ')'.
+	stat := string(data)
+	nameStart, nameEnd := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if nameStart < 0 || nameEnd < nameStart {
+		return "", "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	// Fields after the name start at field 3 (state); starttime is field 22.
+	fields := strings.Fields(stat[nameEnd+1:])
+	if len(fields) < 20 {
+		return "", "", fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields[19], stat[nameStart+1 : nameEnd], nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+// Without /proc there is no cheap way to identify a process across PID reuse,
+// so the lock's flock decides whether its holder is alive.
+const processIdentitySupported = false
+
+func processIdentity(int) (string, string, error) {
+	return "", "", errors.New("process identity is not available on this platform")
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// OnceSummary describes what a --once run did.
+type OnceSummary struct {
+	Flows   int   // connections listed by the gateway
+	Updates int64 // updates the master accepted
+	Bytes   int64 // upload+download carried by those updates
+}
+
+func (s OnceSummary) String() string {
+	return fmt.Sprintf("flows=%d updates=%d bytes=%d", s.Flows, s.Updates, s.Bytes)
+}
+
+// RunOnce performs a single gateway poll, reports every resulting update, and
+// sends one heartbeat and one config snapshot (unless disabled), for cron-style
+// use. Unlike Run it does not stop at the first failure; the returned error
+// joins every step that failed.
+func (r *Runner) RunOnce(ctx context.Context) (OnceSummary, error) {
+	var summary OnceSummary
+	// Parked --batch-posts posts wait for the report loop, which --once
+	// never starts, so everything is posted directly.
+	r.cfg.BatchPosts = false
+	if err := r.acquireLock(); err != nil {
+		return summary, err
+	}
+	defer r.releaseLock()
+	r.loadState()
+
+	var errs []error
+	step := func(name string, err error) {
+		if err != nil {
+			log.Printf("[agent:%s] %s failed: %v", r.cfg.AgentID, name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	if !r.cfg.DryRun {
+		if err := r.negotiateProtocol(ctx); errors.Is(err, ErrProtocolIncompatible) {
+			return summary, err
+		}
+	}
+
+	step("gateway detection", r.detectGatewayTypeOnce(ctx))
+	flows, _, err := r.collectOnce(ctx)
+	summary.Flows = flows
+	step("collect", err)
+	step("report", r.flushAll(ctx))
+
+	if !r.cfg.DisableHeartbeat && !r.cfg.DryRun {
+		step("heartbeat", r.sendHeartbeat(ctx))
+	}
+	if !r.cfg.DisableConfigSync && !r.cfg.DryRun {
+		step("config sync", r.syncConfig(ctx))
+	}
+
+	r.saveDirtyState()
+
+	r.mu.Lock()
+	summary.Updates, summary.Bytes = r.sentUpdates, r.sentBytes
+	r.mu.Unlock()
+	return summary, errors.Join(errs...)
+}
+
+// flushAll reports batches until the queue is empty or a post fails. The
+// first flush always runs so aggregated totals get queued.
+func (r *Runner) flushAll(ctx context.Context) error {
+	for {
+		if err := r.flush(ctx); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		empty := r.queue.len == 0
+		r.mu.Unlock()
+		if empty {
+			return nil
+		}
+	}
+}
+
+// recordSent counts updates the master accepted.
+func (r *Runner) recordSent(updates []domain.TrafficUpdate) {
+	var bytes int64
+	for i := range updates {
+		bytes += updates[i].Upload + updates[i].Download
+	}
+	r.mu.Lock()
+	r.sentUpdates += int64(len(updates))
+	r.sentBytes += bytes
+	r.mu.Unlock()
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"sort"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// updatesByTimeAndFlow orders one poll's updates by timestamp, then flow ID,
+// so queue order does not depend on the gateway's response order.
+type updatesByTimeAndFlow struct {
+	updates []domain.TrafficUpdate
+	flowIDs []string
+}
+
+func (s updatesByTimeAndFlow) Len() int { return len(s.updates) }
+
+func (s updatesByTimeAndFlow) Less(i, j int) bool {
+	if s.updates[i].TimestampMs != s.updates[j].TimestampMs {
+		return s.updates[i].TimestampMs < s.updates[j].TimestampMs
+	}
+	return s.flowIDs[i] < s.flowIDs[j]
+}
+
+func (s updatesByTimeAndFlow) Swap(i, j int) {
+	s.updates[i], s.updates[j] = s.updates[j], s.updates[i]
+	s.flowIDs[i], s.flowIDs[j] = s.flowIDs[j], s.flowIDs[i]
+}
+
+// sortUpdates sorts updates in place; flowIDs[i] is the flow of updates[i].
+func sortUpdates(updates []domain.TrafficUpdate, flowIDs []string) {
+	sort.Sort(updatesByTimeAndFlow{updates: updates, flowIDs: flowIDs})
+}
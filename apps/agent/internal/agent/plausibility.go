@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// maxPlausibleBytesPerSec is the throughput (10 Gbps) used to derive the
+// default per-poll delta ceiling when --max-poll-delta is not set.
+const maxPlausibleBytesPerSec = 10_000_000_000 / 8
+
+// deltaCeiling returns the largest per-flow delta accepted for a poll that
+// covers elapsed time since the flow was last seen.
+func (r *Runner) deltaCeiling(elapsed time.Duration) int64 {
+	if r.cfg.MaxPollDelta > 0 {
+		return r.cfg.MaxPollDelta
+	}
+	if elapsed < r.cfg.GatewayPollInterval {
+		elapsed = r.cfg.GatewayPollInterval
+	}
+	return int64(elapsed.Seconds() * maxPlausibleBytesPerSec)
+}
+
+// implausibleWarnInterval is how often a flow may log an implausible delta;
+// a gateway reporting garbage for a flow tends to do so on every poll.
+const implausibleWarnInterval = time.Minute
+
+// checkDelta guards the master against garbage counters, e.g. after a gateway
+// crash. Deltas above the ceiling are dropped or clamped per
+// --implausible-delta; saturated counters (toInt64 hit MaxInt64) are always
+// dropped. New flows are only checked for saturation, since their first delta
+// covers the whole connection lifetime; known ones, including flows revived
+// from a tombstone, get the ceiling for the time since prev was last seen.
+// It returns the checked deltas and the flow's new QuietUntil.
+func (r *Runner) checkDelta(s domain.FlowSnapshot, prev trackedFlow, known bool, mono time.Duration, up, down int64) (int64, int64, time.Duration) {
+	saturated := s.Upload == math.MaxInt64 || s.Download == math.MaxInt64
+	elapsed := mono - prev.LastSeen
+	ceiling := r.deltaCeiling(elapsed)
+	if !saturated && (!known || (up <= ceiling && down <= ceiling)) {
+		return up, down, prev.QuietUntil
+	}
+
+	r.implausibleDeltas.Add(1)
+	action := "dropped"
+	if r.cfg.ImplausibleDelta == "clamp" && !saturated {
+		action = "clamped"
+		up, down = min(up, ceiling), min(down, ceiling)
+	} else {
+		up, down = 0, 0
+	}
+	if mono < prev.QuietUntil {
+		return up, down, prev.QuietUntil
+	}
+	log.Printf("[agent:%s] implausible delta %s for %s: raw counters up=%d down=%d, ceiling %d bytes over %v",
+		r.cfg.AgentID, action, defaultString(s.Domain, s.IP), s.Upload, s.Download, ceiling, elapsed.Round(time.Millisecond))
+	return up, down, mono + implausibleWarnInterval
+}
@@ -0,0 +1,28 @@
+package agent
+
+import "time"
+
+// adaptivePolling reports whether --gateway-poll-max enables the adaptive
+// poll interval.
+func (r *Runner) adaptivePolling() bool {
+	return r.cfg.GatewayPollMax > 0
+}
+
+// nextPollInterval adapts the collector interval to gateway load: a Collect
+// slower than --slow-collect-threshold doubles the interval, one faster than
+// half the threshold shrinks it by a quarter, within the min/max flags.
+// Failure backoff is handled separately and does not feed into this.
+func (r *Runner) nextPollInterval(cur, took time.Duration) time.Duration {
+	if !r.adaptivePolling() {
+		return r.cfg.GatewayPollInterval
+	}
+	lo, hi := r.cfg.GatewayPollMin, r.cfg.GatewayPollMax
+	threshold := r.cfg.SlowCollectThreshold
+	switch {
+	case took > threshold:
+		cur *= 2
+	case took < threshold/2:
+		cur -= cur / 4
+	}
+	return min(max(cur, lo), hi)
+}
@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// reportFieldsProtocolVersion is the first protocol version whose reports and
+// heartbeats may carry fields beyond the v1 set kept by v1Update and
+// v1Heartbeat.
+const reportFieldsProtocolVersion = 2
+
+// ErrProtocolIncompatible is returned by Run when the master requires a
+// protocol version outside the range this agent build can speak.
+var ErrProtocolIncompatible = errors.New("protocol version incompatible with master")
+
+type protocolResponse struct {
+	ProtocolVersion    int      `json:"protocolVersion"`
+	MinProtocolVersion int      `json:"minProtocolVersion"`
+	MaxProtocolVersion int      `json:"maxProtocolVersion"`
+	Encodings          []string `json:"encodings"`
+	// MaxReportBytes is the largest report body the master accepts, if it
+	// says; --max-report-bytes is lowered to it.
+	MaxReportBytes int64 `json:"maxReportBytes"`
+}
+
+// negotiateProtocol asks the master which protocol version to use and stores
+// the result. Masters without the endpoint (404) are treated as v1-only.
+func (r *Runner) negotiateProtocol(ctx context.Context) error {
+	query := url.Values{}
+	query.Set("backendId", strconv.Itoa(r.cfg.BackendID))
+	query.Set("agentId", r.cfg.AgentID)
+	query.Set("minProtocolVersion", strconv.Itoa(config.AgentMinProtocolVersion))
+	query.Set("maxProtocolVersion", strconv.Itoa(config.AgentProtocolVersion))
+
+	var resp protocolResponse
+	if err := r.getServerJSON(ctx, "/agent/protocol?"+query.Encode(), &resp); err != nil {
+		var httpErr *serverHTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound {
+			r.setProtocolVersion(config.AgentMinProtocolVersion, false)
+			return nil
+		}
+		return err
+	}
+
+	version, err := selectProtocolVersion(resp)
+	if err != nil {
+		return err
+	}
+	if prev := r.protocol(); prev != version {
+		log.Printf("[agent:%s] negotiated protocol version %d", r.cfg.AgentID, version)
+	}
+	r.setProtocolVersion(version, supportsEncoding(resp.Encodings, "msgpack"))
+	if resp.MaxReportBytes > 0 {
+		r.lowerReportLimit(resp.MaxReportBytes, "advertised by the master")
+	}
+	return nil
+}
+
+// selectProtocolVersion picks the version to speak from the master's answer,
+// which is either an explicit protocolVersion or an accepted range.
+func selectProtocolVersion(resp protocolResponse) (int, error) {
+	lo, hi := config.AgentMinProtocolVersion, config.AgentProtocolVersion
+	if v := resp.ProtocolVersion; v > 0 {
+		if v < lo || v > hi {
+			return 0, fmt.Errorf("%w: master requires v%d, agent supports v%d-v%d", ErrProtocolIncompatible, v, lo, hi)
+		}
+		return v, nil
+	}
+
+	masterLo, masterHi := resp.MinProtocolVersion, resp.MaxProtocolVersion
+	if masterLo <= 0 {
+		masterLo = 1
+	}
+	if masterHi <= 0 {
+		masterHi = hi
+	}
+	v := min(hi, masterHi)
+	if v < lo || v < masterLo {
+		return 0, fmt.Errorf("%w: master accepts v%d-v%d, agent supports v%d-v%d", ErrProtocolIncompatible, masterLo, masterHi, lo, hi)
+	}
+	return v, nil
+}
+
+// protocol returns the negotiated protocol version. Payload builders must gate
+// any field introduced after v1 on this value so older masters never see it.
+func (r *Runner) protocol() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.protocolVersion
+}
+
+// runProtocolRetryLoop retries a negotiation that failed at startup until it
+// succeeds, instead of leaving the agent on v1 until the master next drops
+// out and comes back.
+func (r *Runner) runProtocolRetryLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for failures := 0; ; failures++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.backoff(5*time.Second, failures, 5*time.Minute)):
+		}
+		err := r.negotiateProtocol(ctx)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrProtocolIncompatible) {
+			r.failProtocol(ctx, err)
+			return
+		}
+		log.Printf("[agent:%s] protocol negotiation error: %v", r.cfg.AgentID, err)
+	}
+}
+
+// newReportPayload builds a report for the negotiated protocol version,
+// leaving out the fields a v1 master has never seen. updates is not modified,
+// as a retry may go to a renegotiated master.
+func (r *Runner) newReportPayload(requestID, batchID string, seq int64, updates []domain.TrafficUpdate) *domain.ReportPayload {
+	payload := &domain.ReportPayload{
+		BackendID:       r.cfg.BackendID,
+		RequestID:       requestID,
+		AgentID:         r.cfg.AgentID,
+		AgentVersion:    config.AgentVersion,
+		ProtocolVersion: r.protocol(),
+		Updates:         updates,
+	}
+	if payload.ProtocolVersion >= reportFieldsProtocolVersion {
+		payload.BatchID, payload.Seq = batchID, seq
+		return payload
+	}
+	payload.Updates = make([]domain.TrafficUpdate, len(updates))
+	for i := range updates {
+		payload.Updates[i] = v1Update(&updates[i])
+	}
+	return payload
+}
+
+// v1Update copies the fields of u that v1 masters know. Fields added to
+// TrafficUpdate later are left out by construction.
+func v1Update(u *domain.TrafficUpdate) domain.TrafficUpdate {
+	return domain.TrafficUpdate{
+		Domain:      u.Domain,
+		IP:          u.IP,
+		Chain:       u.Chain,
+		Chains:      u.Chains,
+		Rule:        u.Rule,
+		RulePayload: u.RulePayload,
+		Upload:      u.Upload,
+		Download:    u.Download,
+		Connections: u.Connections,
+		SourceIP:    u.SourceIP,
+		TimestampMs: u.TimestampMs,
+	}
+}
+
+// heartbeatForProtocol returns hb as it should be sent at hb.ProtocolVersion.
+// Below reportFieldsProtocolVersion only the v1 fields are kept, plus
+// protocolError, which is sent precisely when no version could be agreed on.
+func heartbeatForProtocol(hb heartbeatPayload) heartbeatPayload {
+	if hb.ProtocolVersion >= reportFieldsProtocolVersion {
+		return hb
+	}
+	return heartbeatPayload{
+		BackendID:        hb.BackendID,
+		AgentID:          hb.AgentID,
+		Hostname:         hb.Hostname,
+		Version:          hb.Version,
+		AgentVersion:     hb.AgentVersion,
+		ProtocolVersion:  hb.ProtocolVersion,
+		GatewayType:      hb.GatewayType,
+		GatewayURL:       hb.GatewayURL,
+		GatewayLatencyMs: hb.GatewayLatencyMs,
+		ServerLatencyMs:  hb.ServerLatencyMs,
+		ProtocolError:    hb.ProtocolError,
+	}
+}
+
+// resetProtocol goes back to v1 after a switch between --server-url and
+// --server-url-fallback. The other master may speak a different version or
+// encodings, and a 415 from one says nothing about the other.
+func (r *Runner) resetProtocol() {
+	r.mu.Lock()
+	r.protocolVersion = config.AgentMinProtocolVersion
+	r.msgpackAllowed, r.msgpackRejected = false, false
+	r.mu.Unlock()
+}
+
+func (r *Runner) setProtocolVersion(v int, msgpackAllowed bool) {
+	r.mu.Lock()
+	r.protocolVersion = v
+	r.msgpackAllowed = msgpackAllowed
+	r.mu.Unlock()
+}
+
+// failProtocol tells the master why the agent is going away and stops Run
+// with ErrProtocolIncompatible.
+func (r *Runner) failProtocol(ctx context.Context, err error) {
+	log.Printf("[agent:%s] fatal: %v", r.cfg.AgentID, err)
+	hb := r.buildHeartbeat()
+	hb.ProtocolError = err.Error()
+	if postErr := r.postJSON(ctx, "/agent/heartbeat", heartbeatForProtocol(hb)); postErr != nil {
+		log.Printf("[agent:%s] failed to report protocol error: %v", r.cfg.AgentID, postErr)
+	}
+	r.fail(err)
+}
+
+func (r *Runner) getServerJSON(ctx context.Context, path string, out interface{}) error {
+	req, traceID, err := r.newServerRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.doServer(req)
+	if err != nil {
+		return fmt.Errorf("%s [request-id=%s]: %w", path, traceID, err)
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		msg := string(body)
+		if msg == "" {
+			msg = resp.Status
+		}
+		return &serverHTTPError{StatusCode: resp.StatusCode, RequestID: traceID, Message: msg}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(out); err != nil {
+		return fmt.Errorf("decode %s response: %w", path, err)
+	}
+	return nil
+}
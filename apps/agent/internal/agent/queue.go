@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// updateQueue holds the updates waiting to be reported as a deque of
+// segments in enqueue order. Each ingest appends a segment; a report batch
+// that fails goes back as a segment of its own at the position of its first
+// update, so the queue stays in the order updates were produced however
+// posts fail, split or overlap. The master's time buckets rely on that order.
+type updateQueue struct {
+	segments []*segment
+	len      int    // updates in all segments
+	next     uint64 // enqueue order of the next update
+}
+
+// segment is a run of updates with their enqueue orders. Updates already
+// reported, expired or in flight leave gaps in the orders, so each update
+// keeps its own. report is set for a failed batch awaiting retry; such a
+// segment is never merged into a larger batch.
+type segment struct {
+	updates []domain.TrafficUpdate
+	orders  []uint64
+	report  *pendingReport
+}
+
+// push appends freshly produced updates.
+func (q *updateQueue) push(updates []domain.TrafficUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	q.segments = append(q.segments, &segment{updates: updates, orders: q.assign(len(updates))})
+	q.len += len(updates)
+}
+
+// assign hands out the next n enqueue orders.
+func (q *updateQueue) assign(n int) []uint64 {
+	orders := make([]uint64, n)
+	for i := range orders {
+		orders[i] = q.next
+		q.next++
+	}
+	return orders
+}
+
+// requeue puts a batch whose post failed back at its original position. With
+// keepIDs the segment keeps the report's ids for the retry.
+func (q *updateQueue) requeue(report *pendingReport, keepIDs bool) {
+	if len(report.updates) == 0 {
+		return
+	}
+	seg := &segment{updates: report.updates, orders: report.orders}
+	if keepIDs {
+		seg.report = report
+	}
+	i := len(q.segments)
+	for i > 0 && q.segments[i-1].orders[0] > seg.orders[0] {
+		i--
+	}
+	q.segments = append(q.segments, nil)
+	copy(q.segments[i+1:], q.segments[i:])
+	q.segments[i] = seg
+	q.len += len(seg.updates)
+}
+
+// deferReport moves a failed batch behind everything queued so far, as if
+// just produced.
+func (q *updateQueue) deferReport(report *pendingReport) {
+	report.orders = q.assign(len(report.updates))
+	q.segments = append(q.segments, &segment{updates: report.updates, orders: report.orders, report: report})
+	q.len += len(report.updates)
+}
+
+// takeReport pops the head segment if it is a failed batch, dropping updates
+// older than cutoff and counting them in expired. The batch may come back
+// empty.
+func (q *updateQueue) takeReport(cutoff int64) (report *pendingReport, expired int64) {
+	if len(q.segments) == 0 || q.segments[0].report == nil {
+		return nil, 0
+	}
+	seg := q.popFront()
+	q.len -= len(seg.updates)
+	report = seg.report
+	report.updates = report.updates[:0:0]
+	report.orders = report.orders[:0:0]
+	for i, u := range seg.updates {
+		if u.TimestampMs < cutoff {
+			expired++
+			continue
+		}
+		report.updates = append(report.updates, u)
+		report.orders = append(report.orders, seg.orders[i])
+	}
+	return report, expired
+}
+
+// take removes up to limit updates from the head of the queue, stopping at a
+// failed batch and once their estimated encoded size would exceed maxBytes
+// (0 = no byte limit). Updates older than cutoff are dropped and counted.
+// The first update is always taken so one oversized update cannot stall the
+// queue.
+//
+// A batch only runs into the next segment if its orders follow on. A gap may
+// be another batch in flight; spanning it would leave no single position to
+// requeue this batch at should it fail.
+func (q *updateQueue) take(limit int, maxBytes, cutoff int64) (out []domain.TrafficUpdate, orders []uint64, size, expired int64) {
+	var cur *segment
+	var last uint64
+	for len(out) < limit && len(q.segments) > 0 && q.segments[0].report == nil {
+		seg := q.segments[0]
+		if cur != nil && seg != cur && seg.orders[0] != last+1 {
+			break
+		}
+		cur, last = seg, seg.orders[0]
+		u := seg.updates[0]
+		if u.TimestampMs >= cutoff {
+			n := updateSize(u)
+			if maxBytes > 0 && len(out) > 0 && size+n > maxBytes {
+				break
+			}
+			out = append(out, u)
+			orders = append(orders, seg.orders[0])
+			size += n
+		} else {
+			expired++
+		}
+		seg.updates = seg.updates[1:]
+		seg.orders = seg.orders[1:]
+		q.len--
+		if len(seg.updates) == 0 {
+			q.popFront()
+		}
+	}
+	return out, orders, size, expired
+}
+
+// trim drops the oldest segments, whole, until at most max updates remain and
+// returns how many were dropped. A single segment over max is cut from its
+// head instead, since dropping it would empty the queue.
+func (q *updateQueue) trim(max int) int {
+	dropped := 0
+	for q.len > max {
+		if len(q.segments) == 1 {
+			seg := q.segments[0]
+			n := q.len - max
+			seg.updates = seg.updates[n:]
+			seg.orders = seg.orders[n:]
+			seg.report = nil // no longer the batch its ids describe
+			q.len -= n
+			return dropped + n
+		}
+		seg := q.popFront()
+		dropped += len(seg.updates)
+		q.len -= len(seg.updates)
+	}
+	return dropped
+}
+
+func (q *updateQueue) popFront() *segment {
+	seg := q.segments[0]
+	q.segments[0] = nil
+	q.segments = q.segments[1:]
+	return seg
+}
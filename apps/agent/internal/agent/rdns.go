@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+const (
+	rdnsQueueSize   = 256
+	rdnsCacheLimit  = 8192
+	rdnsLookupEvery = 100 * time.Millisecond // at most 10 PTR queries per second
+	rdnsPositiveTTL = time.Hour
+	rdnsNegativeTTL = 10 * time.Minute
+)
+
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// domainSourceRDNS marks TrafficUpdate.Domain values that came from a PTR
+// lookup rather than the gateway's sniffed host.
+const domainSourceRDNS = "rdns"
+
+// reverseResolver fills Domain for IP-only flows from PTR records. Lookups run
+// on a small worker pool sharing one rate limit, each bounded by a timeout;
+// callers only ever hit the cache and enqueue misses, so reporting is never
+// delayed. A nil *reverseResolver resolves nothing.
+type reverseResolver struct {
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	now     func() time.Time
+	queue   chan string
+	workers int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	cache   map[string]rdnsEntry
+	pending map[string]struct{}
+}
+
+func newReverseResolver(cfg config.Config) *reverseResolver {
+	if !cfg.ReverseDNS {
+		return nil
+	}
+	return &reverseResolver{
+		lookup:  net.DefaultResolver.LookupAddr,
+		now:     time.Now,
+		queue:   make(chan string, rdnsQueueSize),
+		workers: max(cfg.ReverseDNSWorkers, 1),
+		timeout: cfg.ReverseDNSTimeout,
+		cache:   make(map[string]rdnsEntry, 256),
+		pending: make(map[string]struct{}),
+	}
+}
+
+// name returns the cached PTR name for ip, scheduling a lookup on a miss.
+func (rr *reverseResolver) name(ip string) string {
+	if rr == nil || ip == "" {
+		return ""
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if e, ok := rr.cache[ip]; ok && rr.now().Before(e.expires) {
+		return e.name
+	}
+	if _, ok := rr.pending[ip]; ok {
+		return ""
+	}
+	select {
+	case rr.queue <- ip:
+		rr.pending[ip] = struct{}{}
+	default:
+		// Queue full: try again on a later poll.
+	}
+	return ""
+}
+
+// run starts the lookup workers and blocks until ctx is done.
+func (rr *reverseResolver) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	limiter := time.NewTicker(rdnsLookupEvery)
+	defer limiter.Stop()
+	var workers sync.WaitGroup
+	for i := 0; i < rr.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			rr.work(ctx, limiter.C)
+		}()
+	}
+	workers.Wait()
+}
+
+func (rr *reverseResolver) work(ctx context.Context, limiter <-chan time.Time) {
+	for {
+		var ip string
+		select {
+		case <-ctx.Done():
+			return
+		case ip = <-rr.queue:
+		}
+
+		timeout := rr.timeout
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		names, err := rr.lookup(lookupCtx, ip)
+		cancel()
+
+		// Failures (NXDOMAIN, timeouts) are cached too so unresolvable IPs
+		// are not retried on every poll.
+		entry := rdnsEntry{expires: rr.now().Add(rdnsNegativeTTL)}
+		if err == nil && len(names) > 0 {
+			entry = rdnsEntry{
+				name:    domain.SanitizeString(strings.TrimSuffix(names[0], "."), domain.MaxDomainLen),
+				expires: rr.now().Add(rdnsPositiveTTL),
+			}
+		}
+
+		rr.mu.Lock()
+		if len(rr.cache) >= rdnsCacheLimit {
+			rr.cache = make(map[string]rdnsEntry, 256)
+		}
+		rr.cache[ip] = entry
+		delete(rr.pending, ip)
+		rr.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-limiter:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// minReportBytes is how far a 413 can lower the report byte limit, so a
+// misbehaving proxy cannot shrink batches to nothing.
+const minReportBytes = 16 << 10
+
+// updateSize estimates the encoded size of an update in a report. JSON is the
+// larger of the two report encodings, so the estimate also bounds msgpack.
+func updateSize(u domain.TrafficUpdate) int64 {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data)) + 1 // separating comma
+}
+
+// lowerReportLimit reduces the byte budget of report batches to limit, never
+// below minReportBytes. The configured --max-report-bytes is only ever
+// lowered, by the master's advertised limit or by a 413.
+func (r *Runner) lowerReportLimit(limit int64, reason string) {
+	limit = max(limit, minReportBytes)
+	r.mu.Lock()
+	cur := r.reportByteLimit
+	if cur > 0 && limit >= cur {
+		r.mu.Unlock()
+		return
+	}
+	r.reportByteLimit = limit
+	r.mu.Unlock()
+	log.Printf("[agent:%s] report byte limit lowered to %d (%s)", r.cfg.AgentID, limit, reason)
+}
+
+// isTooLarge reports whether err is the master or a proxy in front of it
+// refusing a request body as too large.
+func isTooLarge(err error) bool {
+	var httpErr *serverHTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusRequestEntityTooLarge
+}
+
+// splitRejectedBatch handles a report rejected with 413: the byte limit drops
+// to half the batch and its updates go back to the head of the queue, to be
+// sent as smaller batches with new sequence numbers. A batch of one update
+// cannot be split and is dead-lettered instead.
+func (r *Runner) splitRejectedBatch(pending *pendingReport) bool {
+	if len(pending.updates) < 2 {
+		return false
+	}
+	r.lowerReportLimit(pending.bytes/2, fmt.Sprintf("413 for a report of about %d bytes", pending.bytes))
+	r.requeue(pending, false)
+	return true
+}
+
+// recordReportSize feeds the average report size in heartbeat stats.
+func (r *Runner) recordReportSize(bytes int64) {
+	r.mu.Lock()
+	r.reportPosts++
+	r.reportPostBytes += bytes
+	r.mu.Unlock()
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ruleStatsInterval = time.Minute
+
+type ruleStatKey struct {
+	Rule        string
+	RulePayload string
+	Chain       string
+}
+
+type ruleStat struct {
+	Upload   int64
+	Download int64
+	Flows    int64
+}
+
+type ruleStatEntry struct {
+	Rule        string `json:"rule"`
+	RulePayload string `json:"rulePayload,omitempty"`
+	Chain       string `json:"chain"`
+	Upload      int64  `json:"upload"`
+	Download    int64  `json:"download"`
+	Flows       int64  `json:"flows"`
+}
+
+// ruleStatsPayload is the body of POST /agent/stats: exact per-rule totals
+// for [WindowStartMs, WindowEndMs), so the master need not derive rule hits
+// from individual traffic updates.
+type ruleStatsPayload struct {
+	BackendID     int             `json:"backendId"`
+	AgentID       string          `json:"agentId"`
+	WindowStartMs int64           `json:"windowStartMs"`
+	WindowEndMs   int64           `json:"windowEndMs"`
+	Rules         []ruleStatEntry `json:"rules"`
+}
+
+// recordRuleStat adds a flow delta to the current window. Callers must hold r.flowMu.
+func (r *Runner) recordRuleStat(rule, rulePayload, chain string, up, down, newFlows int64) {
+	if r.ruleStats == nil {
+		r.ruleStats = make(map[ruleStatKey]*ruleStat)
+		r.ruleStatsStartMs = r.clock.Now().UnixMilli()
+	}
+	key := ruleStatKey{Rule: rule, RulePayload: rulePayload, Chain: chain}
+	st := r.ruleStats[key]
+	if st == nil {
+		st = &ruleStat{}
+		r.ruleStats[key] = st
+	}
+	st.Upload += up
+	st.Download += down
+	st.Flows += newFlows
+}
+
+func (r *Runner) runRuleStatsLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(ruleStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.flushRuleStats(ctx); err != nil {
+				log.Printf("[agent:%s] rule stats error: %v", r.cfg.AgentID, err)
+			}
+		}
+	}
+}
+
+// flushRuleStats posts the current window. The window is only reset after the
+// master accepts it; on failure its counters are merged back and the next
+// attempt covers the longer window.
+func (r *Runner) flushRuleStats(ctx context.Context) error {
+	r.flowMu.Lock()
+	stats, startMs := r.ruleStats, r.ruleStatsStartMs
+	r.ruleStats = nil
+	r.flowMu.Unlock()
+	if len(stats) == 0 {
+		return nil
+	}
+
+	payload := ruleStatsPayload{
+		BackendID:     r.cfg.BackendID,
+		AgentID:       r.cfg.AgentID,
+		WindowStartMs: r.correctTimestamp(startMs),
+		WindowEndMs:   r.correctTimestamp(r.clock.Now().UnixMilli()),
+		Rules:         make([]ruleStatEntry, 0, len(stats)),
+	}
+	for k, st := range stats {
+		payload.Rules = append(payload.Rules, ruleStatEntry{
+			Rule:        k.Rule,
+			RulePayload: k.RulePayload,
+			Chain:       k.Chain,
+			Upload:      st.Upload,
+			Download:    st.Download,
+			Flows:       st.Flows,
+		})
+	}
+	sort.Slice(payload.Rules, func(i, j int) bool {
+		a, b := payload.Rules[i], payload.Rules[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.RulePayload != b.RulePayload {
+			return a.RulePayload < b.RulePayload
+		}
+		return a.Chain < b.Chain
+	})
+
+	if err := r.postJSON(ctx, "/agent/stats", payload); err != nil {
+		r.flowMu.Lock()
+		for k, st := range stats {
+			if cur := r.ruleStats[k]; cur != nil {
+				st.Upload += cur.Upload
+				st.Download += cur.Download
+				st.Flows += cur.Flows
+			}
+		}
+		r.ruleStats = stats
+		r.ruleStatsStartMs = startMs
+		r.flowMu.Unlock()
+		return err
+	}
+	return nil
+}
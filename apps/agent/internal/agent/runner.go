@@ -2,20 +2,23 @@ package agent
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
-	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	mrand "math/rand/v2"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/foru17/neko-master/apps/agent/internal/config"
@@ -23,39 +26,99 @@ import (
 	"github.com/foru17/neko-master/apps/agent/internal/gateway"
 )
 
+// dnsModeFakeIP is the Clash dnsMode of flows whose destination IP came from
+// the fake-IP pool, as normalized by the gateway client.
+const dnsModeFakeIP = "fakeip"
+
+// Periods of the config and policy-state sync loops, before --interval-jitter.
+const (
+	configSyncInterval = 2 * time.Minute
+	policySyncInterval = 30 * time.Second
+)
+
 type trackedFlow struct {
-	LastUpload  int64
-	LastDown    int64
-	LastSeenMs  int64
-	Counted     bool
-	Domain      string
-	IP          string
-	SourceIP    string
-	Chains      []string
-	Rule        string
-	RulePayload string
-}
-
-type reportPayload struct {
-	BackendID       int                    `json:"backendId"`
-	RequestID       string                 `json:"requestId,omitempty"`
-	AgentID         string                 `json:"agentId"`
-	AgentVersion    string                 `json:"agentVersion,omitempty"`
-	ProtocolVersion int                    `json:"protocolVersion"`
-	Updates         []domain.TrafficUpdate `json:"updates"`
+	LastUpload   int64
+	LastDown     int64
+	LastSeen     time.Duration // monotonic, see clock
+	FirstSeen    time.Duration // monotonic, see clock
+	FirstSeenMs  int64         // wall clock, reported to the master
+	Counted      bool
+	Domain       string
+	DomainSource string
+	HostSource   string
+	DomainASCII  string
+	IP           string
+	SourceIP     string
+	Chains       []string
+	Rule         string
+	RulePayload  string
+	Country      string
+	ASN          asnInfo
+	DNSMode      string
+	SpecialProxy string
+	Transport    string
+	AppProtocol  string
+	Process      string
+	EventBytes   int64         // bytes since the flow last triggered an event flush
+	QuietUntil   time.Duration // monotonic; implausible-delta warnings muted before it
 }
 
 type heartbeatPayload struct {
-	BackendID        int    `json:"backendId"`
-	AgentID          string `json:"agentId"`
-	Hostname         string `json:"hostname,omitempty"`
-	Version          string `json:"version,omitempty"`
-	AgentVersion     string `json:"agentVersion,omitempty"`
-	ProtocolVersion  int    `json:"protocolVersion"`
-	GatewayType      string `json:"gatewayType,omitempty"`
-	GatewayURL       string `json:"gatewayUrl,omitempty"`
-	GatewayLatencyMs int64  `json:"gatewayLatencyMs,omitempty"`
-	ServerLatencyMs  int64  `json:"serverLatencyMs,omitempty"`
+	BackendID        int             `json:"backendId"`
+	AgentID          string          `json:"agentId"`
+	Hostname         string          `json:"hostname,omitempty"`
+	InstallID        string          `json:"installId,omitempty"`
+	Version          string          `json:"version,omitempty"`
+	AgentVersion     string          `json:"agentVersion,omitempty"`
+	ProtocolVersion  int             `json:"protocolVersion"`
+	GatewayType      string          `json:"gatewayType,omitempty"`
+	GatewayAuto      bool            `json:"gatewayTypeAuto,omitempty"` // GatewayType was detected
+	GatewayURL       string          `json:"gatewayUrl,omitempty"`
+	GatewayMode      string          `json:"gatewayMode,omitempty"`
+	GatewayCore      string          `json:"gatewayCore,omitempty"`
+	GatewayVersion   string          `json:"gatewayVersion,omitempty"`
+	GatewayMemory    int64           `json:"gatewayMemoryBytes,omitempty"`
+	GatewayLatencyMs int64           `json:"gatewayLatencyMs,omitempty"`
+	ServerLatencyMs  int64           `json:"serverLatencyMs,omitempty"`
+	ProtocolError    string          `json:"protocolError,omitempty"`
+	Warnings         []string        `json:"warnings,omitempty"`
+	CommandsEnabled  bool            `json:"commandsEnabled,omitempty"`
+	Stats            *heartbeatStats `json:"stats,omitempty"`
+}
+
+// heartbeatStats carries agent-side counters for troubleshooting. Fields are
+// omitempty so masters that don't read them see little payload growth.
+type heartbeatStats struct {
+	ServerConnReused  int64 `json:"serverConnReused,omitempty"`
+	ServerConnNew     int64 `json:"serverConnNew,omitempty"`
+	ClockOffsetMs     int64 `json:"clockOffsetMs,omitempty"`
+	Expired           int64 `json:"expired,omitempty"`
+	ImplausibleDeltas int64 `json:"implausibleDeltas,omitempty"`
+	InvalidUpdates    int64 `json:"invalidUpdates,omitempty"`
+	ASNCacheHits      int64 `json:"asnCacheHits,omitempty"`
+	ASNCacheMisses    int64 `json:"asnCacheMisses,omitempty"`
+	Blocked           int64 `json:"blocked,omitempty"`
+	BlockedSuppressed int64 `json:"blockedSuppressed,omitempty"`
+	AvgReportBytes    int64 `json:"avgReportBytes,omitempty"`
+	ReportByteLimit   int64 `json:"reportByteLimit,omitempty"`
+	DeadLettered      int64 `json:"deadLettered,omitempty"`
+	RevivedFlows      int64 `json:"revivedFlows,omitempty"`
+	SkippedPolls      int64 `json:"skippedPolls,omitempty"`
+	StaleEvictions    int64 `json:"staleEvictions,omitempty"`
+	CapEvictions      int64 `json:"capEvictions,omitempty"`
+}
+
+// heartbeatResponse is the optional body returned by the master for a heartbeat.
+// Masters that do not announce updates simply leave these fields empty.
+type heartbeatResponse struct {
+	LatestVersion string `json:"latestVersion"`
+	DownloadURL   string `json:"downloadUrl"`
+	SHA256        string `json:"sha256"`
+	Force         bool   `json:"force"`
+
+	Commands []agentCommand `json:"commands"`
+
+	DuplicateAgent *duplicateAgent `json:"duplicateAgent,omitempty"`
 }
 
 type configPayload struct {
@@ -73,126 +136,259 @@ type policyStatePayload struct {
 type Runner struct {
 	cfg           config.Config
 	httpClient    *http.Client
+	gatewayHTTP   *http.Client
+	conns         connStats
+	skew          skewEstimator
+	clock         clock
+	geo           *geoEnricher
+	asn           *asnEnricher
+	rdns          *reverseResolver
+	proxyCount    proxyCountMonitor
 	gatewayClient *gateway.Client
 	hostname      string
 	lockFile      *os.File
-
-	mu         sync.Mutex
-	queue      []domain.TrafficUpdate
-	flows      map[string]trackedFlow
-	dropped    int64
-	retryBatch []domain.TrafficUpdate
-	retryID    string
+	lockPath      string
+	stop          context.CancelFunc
+	updating      int32
+	postSlots     chan struct{} // bounds concurrent report posts
+	flushNow      chan struct{} // event mode: ingestion asks for a flush
+	stateMu       sync.Mutex    // serializes --state-file writes
+	endpoints     serverEndpoints
+	executable    func() (string, error) // os.Executable; self-update replaces it
+
+	// flowMu guards the collector's per-flow state, so a long ingest pass
+	// does not hold up the reporter. When both are needed, flowMu is taken
+	// before mu.
+	flowMu           sync.Mutex
+	flows            map[string]trackedFlow
+	tombstones       map[string]tombstone
+	tombstoneOrder   []tombstoneRef // eviction order, oldest first
+	blocked          map[blockedKey]*blockedEntry
+	ruleStats        map[ruleStatKey]*ruleStat
+	ruleStatsStartMs int64
+	lastIngest       time.Duration // monotonic time of the last decoded poll
+
+	// Collector counters, read by the heartbeat without either lock.
+	revivedFlows      atomic.Int64
+	implausibleDeltas atomic.Int64
+	invalidUpdates    atomic.Int64
+	blockedSeen       atomic.Int64
+	blockedSuppressed atomic.Int64
+	skippedPolls      atomic.Int64
+	staleEvictions    atomic.Int64
+	capEvictions      atomic.Int64
+
+	mu              sync.Mutex
+	queue           updateQueue
+	dropped         int64
+	expired         int64
+	chainTotals     buckets
+	sourceTotals    buckets
+	granularity     string
+	sentUpdates     int64
+	sentBytes       int64
+	reportSeq       int64 // last sequence number assigned to a report
+	ackedSeq        int64 // highest sequence number the master accepted
+	stateDirty      bool  // ackedSeq changed since --state-file was written
+	reportByteLimit int64 // current --max-report-bytes, lowered by the master
+	reportPosts     int64 // accepted reports, for avgReportBytes
+	reportPostBytes int64
+	deadLettered    int64 // report batches dropped after a permanent rejection
+	installID       string
+	duplicate       *duplicateAgent // set while the master reports a duplicate
 
 	lastConfigHash   string
 	lastPolicyHash   string
 	gatewayLatencyMs int64
 	serverLatencyMs  int64
+	clashMode        string
+	clashModeAt      time.Duration // monotonic time of the last mode fetch
+	clashModeFetched bool
+	core             gateway.CoreInfo
+	coreFetched      bool
+	coreAt           time.Duration // monotonic time of the last /version fetch
+	restartPath      string
+	protocolVersion  int
+	msgpackAllowed   bool
+	msgpackRejected  bool
+	fatalErr         error
+	commandResults   []commandResult
+	batchItems       []*batchItem
+	batchUnsupported bool
+}
+
+// Option customizes a Runner built by NewRunner.
+type Option func(*Runner)
+
+// WithServerTransport replaces the transport used for master requests, e.g.
+// with a mock http.RoundTripper in tests.
+func WithServerTransport(rt http.RoundTripper) Option {
+	return func(r *Runner) { r.httpClient.Transport = rt }
+}
+
+// WithGatewayTransport replaces the transport used for gateway requests.
+func WithGatewayTransport(rt http.RoundTripper) Option {
+	return func(r *Runner) { r.gatewayHTTP.Transport = rt }
 }
 
-func NewRunner(cfg config.Config) *Runner {
-	httpClient := &http.Client{Timeout: cfg.RequestTimeout}
+// WithGatewayClient replaces the gateway client, e.g. with one from
+// gateway.NewReplayClient.
+func WithGatewayClient(c *gateway.Client) Option {
+	return func(r *Runner) { r.gatewayClient = c }
+}
+
+func NewRunner(cfg config.Config, opts ...Option) *Runner {
+	httpClient := &http.Client{Timeout: cfg.RequestTimeout, Transport: newServerTransport(cfg)}
+	gatewayHTTPClient := &http.Client{Timeout: cfg.RequestTimeout}
 	hostname, _ := os.Hostname()
 	if hostname == "" {
 		hostname = "unknown-host"
 	}
 
-	return &Runner{
-		cfg:           cfg,
-		httpClient:    httpClient,
-		gatewayClient: gateway.NewClient(httpClient, cfg.GatewayType, cfg.GatewayEndpoint, cfg.GatewayToken),
-		hostname:      hostname,
-		queue:         make([]domain.TrafficUpdate, 0, cfg.ReportBatchSize*2),
-		flows:         make(map[string]trackedFlow, 2048),
+	gatewayClient := gateway.NewClient(gatewayHTTPClient, cfg.GatewayType, cfg.GatewayEndpoint, cfg.GatewayToken)
+	if cfg.GatewayBasicUser != "" {
+		gatewayClient.SetBasicAuth(cfg.GatewayBasicUser, cfg.GatewayBasicPass)
 	}
-}
-
-func (r *Runner) acquireLock() error {
-	// Use OS temp directory for lock file
-	lockDir := os.TempDir()
-	lockPath := fmt.Sprintf("%s/neko-agent-backend-%d.lock", lockDir, r.cfg.BackendID)
-
-	// Check if lock file exists and if process is still running
-	if data, err := os.ReadFile(lockPath); err == nil {
-		var pid int
-		if _, err := fmt.Sscanf(string(data), "%d", &pid); err == nil {
-			// Check if process is still running
-			if pid > 0 && pid != os.Getpid() {
-				if isProcessRunning(pid) {
-					return fmt.Errorf("another agent instance (PID %d) is already running for backend %d", pid, r.cfg.BackendID)
-				}
-				// Process is not running, stale lock file
-				log.Printf("[agent:%s] removing stale lock file from PID %d", r.cfg.AgentID, pid)
-				os.Remove(lockPath)
-			}
+	gatewayClient.SetSurgeRequestSource(cfg.SurgeRequestSource)
+	gatewayClient.SetPolicyProviders(cfg.ClashPolicyProviders)
+	gatewayClient.SetFlavor(cfg.GatewayFlavor)
+	gatewayClient.SetClashLogs(cfg.ClashLogs)
+	gatewayClient.SetMaxResponseBytes(cfg.GatewayMaxResponseBytes)
+	gatewayClient.SetSkipUnchanged(true)
+	if cfg.RecordDir != "" {
+		logf := func(format string, args ...interface{}) {
+			log.Printf("[agent:%s] "+format, append([]interface{}{cfg.AgentID}, args...)...)
 		}
-	}
-
-	// Create lock file with exclusive flag (O_EXCL)
-	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
-	if err != nil {
-		if os.IsExist(err) {
-			return fmt.Errorf("lock file already exists for backend %d", r.cfg.BackendID)
+		if rec, err := gateway.NewRecorder(cfg.RecordDir, cfg.RecordMaxBytes, logf); err != nil {
+			log.Printf("[agent:%s] gateway recording disabled: %v", cfg.AgentID, err)
+		} else {
+			gatewayClient.SetRecorder(rec)
 		}
-		return fmt.Errorf("failed to create lock file: %w", err)
 	}
 
-	// Write PID to lock file
-	pid := fmt.Sprintf("%d", os.Getpid())
-	if _, err := file.WriteString(pid); err != nil {
-		file.Close()
-		os.Remove(lockPath)
-		return fmt.Errorf("failed to write PID to lock file: %w", err)
+	r := &Runner{
+		cfg:             cfg,
+		httpClient:      httpClient,
+		gatewayHTTP:     gatewayHTTPClient,
+		gatewayClient:   gatewayClient,
+		geo:             newGeoEnricher(cfg),
+		asn:             newASNEnricher(cfg),
+		rdns:            newReverseResolver(cfg),
+		clock:           newSystemClock(),
+		hostname:        hostname,
+		installID:       newRequestID(),
+		executable:      os.Executable,
+		reportByteLimit: cfg.MaxReportBytes,
+		flows:           make(map[string]trackedFlow, 2048),
+		tombstones:      make(map[string]tombstone),
+		chainTotals:     make(buckets),
+		sourceTotals:    make(buckets),
+		blocked:         make(map[blockedKey]*blockedEntry),
+		granularity:     defaultString(cfg.ReportGranularity, granularityFlow),
+		postSlots:       make(chan struct{}, max(cfg.MaxInflightPosts, 1)),
+
+		protocolVersion: config.AgentMinProtocolVersion,
 	}
-
-	r.lockFile = file
-	return nil
-}
-
-func (r *Runner) releaseLock() {
-	if r.lockFile != nil {
-		lockPath := r.lockFile.Name()
-		r.lockFile.Close()
-		os.Remove(lockPath)
-		r.lockFile = nil
+	if cfg.ReportMode == reportModeEvent {
+		r.flushNow = make(chan struct{}, 1)
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
-// isProcessRunning checks if a process with given PID is running
-func isProcessRunning(pid int) bool {
-	// On Unix, use syscall.Kill with signal 0 to check if process exists
-	// Signal 0 performs error checking without actually sending a signal
-	err := syscall.Kill(pid, 0)
-	return err == nil
-}
+// Run blocks until ctx is cancelled or the runner stops itself, returning a
+// non-nil error when the agent should exit with a failure status.
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	r.mu.Lock()
+	r.stop = stop
+	r.mu.Unlock()
 
-func (r *Runner) Run(ctx context.Context) {
 	log.Printf("[agent:%s] starting, backend=%d, gateway_type=%s, server=%s", r.cfg.AgentID, r.cfg.BackendID, r.cfg.GatewayType, r.cfg.ServerAPIBase)
+	if r.cfg.ServerFallbackAPIBase != "" {
+		log.Printf("[agent:%s] fallback server=%s", r.cfg.AgentID, r.cfg.ServerFallbackAPIBase)
+	}
 
 	// Acquire singleton lock to prevent multiple instances for same backend
 	if err := r.acquireLock(); err != nil {
 		log.Printf("[agent:%s] failed to acquire lock: %v", r.cfg.AgentID, err)
 		log.Printf("[agent:%s] hint: another agent instance may be running for backend %d", r.cfg.AgentID, r.cfg.BackendID)
-		return
+		return err
 	}
 	defer r.releaseLock()
+	r.loadState()
 
+	if r.cfg.AdminListen != "" {
+		stopAdmin, err := r.startAdminServer()
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
+	}
+
+	negotiationFailed := false
+	if r.cfg.DryRun {
+		log.Printf("[agent:%s] dry-run: collecting without contacting the master", r.cfg.AgentID)
+	} else if err := r.negotiateProtocol(ctx); err != nil {
+		if errors.Is(err, ErrProtocolIncompatible) {
+			r.failProtocol(ctx, err)
+			return err
+		}
+		log.Printf("[agent:%s] protocol negotiation error: %v", r.cfg.AgentID, err)
+		negotiationFailed = true
+	}
+
+	// The report, janitor and heartbeat loops never touch the gateway, so
+	// they start before --gateway-type auto is resolved: an agent whose
+	// gateway is down at startup still heartbeats and reports what it
+	// restored. The report and janitor loops are mandatory; the sync loops
+	// are optional for masters that ignore them or gateways that can't spare
+	// the requests, and have nothing to show in a dry run.
 	var wg sync.WaitGroup
-	wg.Add(5)
-	go r.runCollectorLoop(ctx, &wg)
+	wg.Add(2)
 	go r.runReportLoop(ctx, &wg)
-	go r.runHeartbeatLoop(ctx, &wg)
-	go r.runConfigSyncLoop(ctx, &wg)
-	go r.runPolicyStateSyncLoop(ctx, &wg)
+	go r.runJanitorLoop(ctx, &wg)
+	if !r.cfg.DisableHeartbeat && !r.cfg.DryRun {
+		wg.Add(1)
+		go r.runHeartbeatLoop(ctx, &wg)
+	}
+	if r.rdns != nil {
+		wg.Add(1)
+		go r.rdns.run(ctx, &wg)
+	}
+	if r.cfg.StateFile != "" && !r.cfg.DryRun {
+		wg.Add(1)
+		go r.runStateSaveLoop(ctx, &wg)
+	}
+	if negotiationFailed {
+		wg.Add(1)
+		go r.runProtocolRetryLoop(ctx, &wg)
+	}
+	if r.cfg.ReportRuleStats {
+		wg.Add(1)
+		go r.runRuleStatsLoop(ctx, &wg)
+	}
+	if r.detectGatewayType(ctx) {
+		r.startGatewayLoops(ctx, &wg)
+	}
 
 	<-ctx.Done()
 	log.Printf("[agent:%s] stopping...", r.cfg.AgentID)
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	if err := r.flushOnce(shutdownCtx); err != nil {
+	if err := r.flushFinal(shutdownCtx); err != nil {
 		log.Printf("[agent:%s] final flush failed: %v", r.cfg.AgentID, err)
 	}
+	r.saveDirtyState()
+	if r.cfg.ReportRuleStats {
+		if err := r.flushRuleStats(shutdownCtx); err != nil {
+			log.Printf("[agent:%s] final rule stats flush failed: %v", r.cfg.AgentID, err)
+		}
+	}
 
 	wg.Wait()
 	pending, dropped := r.queueStats()
@@ -202,27 +398,66 @@ func (r *Runner) Run(ctx context.Context) {
 	if dropped > 0 {
 		log.Printf("[agent:%s] dropped updates due to queue overflow: %d", r.cfg.AgentID, dropped)
 	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fatalErr
+}
+
+// shutdown stops Run the way SIGTERM does: collection stops and the queue
+// gets its final flush.
+func (r *Runner) shutdown() {
+	r.mu.Lock()
+	stop := r.stop
+	r.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// fail records err as the reason Run exits and stops the runner.
+func (r *Runner) fail(err error) {
+	r.mu.Lock()
+	if r.fatalErr == nil {
+		r.fatalErr = err
+	}
+	stop := r.stop
+	r.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
 }
 
 func (r *Runner) runCollectorLoop(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	failures := 0
+	interval := r.cfg.GatewayPollInterval
 	for {
-		t0 := time.Now()
-		snapshots, err := r.gatewayClient.Collect(ctx)
-		delay := r.cfg.GatewayPollInterval
+		_, took, err := r.collectOnce(ctx)
+		if errors.Is(err, gateway.ErrReplayFinished) {
+			log.Printf("[agent:%s] replay finished, stopping", r.cfg.AgentID)
+			r.shutdown()
+			return
+		}
+		delay := interval
 		if err != nil {
 			failures++
-			delay = calculateBackoff(r.cfg.GatewayPollInterval, failures, 60*time.Second)
-			log.Printf("[agent:%s] collector error (%d): %v", r.cfg.AgentID, failures, err)
+			delay = r.backoff(r.cfg.GatewayPollInterval, failures, 60*time.Second)
+			var truncated *gateway.TruncatedError
+			if errors.As(err, &truncated) {
+				log.Printf("[agent:%s] collector error (%d): gateway %s response is larger than --gateway-max-response-bytes %d; raise it (0 = unlimited)",
+					r.cfg.AgentID, failures, truncated.Path, truncated.Limit)
+			} else {
+				log.Printf("[agent:%s] collector error (%d): %v", r.cfg.AgentID, failures, err)
+			}
 		} else {
 			failures = 0
-			latencyMs := time.Since(t0).Milliseconds()
-			r.mu.Lock()
-			r.gatewayLatencyMs = latencyMs
-			r.mu.Unlock()
-			r.ingestSnapshots(snapshots, time.Now().UnixMilli())
+			if next := r.nextPollInterval(interval, took); next != interval {
+				log.Printf("[agent:%s] gateway poll interval %v -> %v (collect took %v)", r.cfg.AgentID, interval, next, took.Round(time.Millisecond))
+				interval = next
+			}
+			delay = r.jittered(interval)
 		}
 
 		select {
@@ -233,19 +468,61 @@ func (r *Runner) runCollectorLoop(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// collectOnce polls the gateway once and ingests the result, returning how
+// many flows the gateway listed and how long the poll took.
+func (r *Runner) collectOnce(ctx context.Context) (int, time.Duration, error) {
+	t0 := time.Now()
+	snapshots, err := r.gatewayClient.Collect(ctx)
+	took := time.Since(t0)
+	if err != nil && !errors.Is(err, gateway.ErrUnchanged) {
+		return 0, took, err
+	}
+	r.mu.Lock()
+	r.gatewayLatencyMs = took.Milliseconds()
+	r.mu.Unlock()
+	if err != nil {
+		r.skippedPolls.Add(1)
+		return r.refreshUnchangedFlows(), took, nil
+	}
+	r.ingestSnapshots(snapshots)
+	return len(snapshots), took, nil
+}
+
 func (r *Runner) runReportLoop(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
-	ticker := time.NewTicker(r.cfg.ReportInterval)
+	ticker := time.NewTicker(r.jittered(r.cfg.ReportInterval))
 	defer ticker.Stop()
 
+	// In event mode ingestion requests flushes through r.flushNow; requests
+	// arriving sooner than --event-min-interval after a flush are coalesced
+	// into one delayed flush. r.flushNow is nil in periodic mode.
+	var last time.Time
+	var coalesce <-chan time.Time
+	report := func() {
+		last = time.Now()
+		if err := r.flushOnce(ctx); err != nil {
+			log.Printf("[agent:%s] report error: %v", r.cfg.AgentID, err)
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := r.flushOnce(ctx); err != nil {
-				log.Printf("[agent:%s] report error: %v", r.cfg.AgentID, err)
+			ticker.Reset(r.jittered(r.cfg.ReportInterval))
+			report()
+		case <-r.flushNow:
+			if coalesce != nil {
+				continue
+			}
+			if wait := r.cfg.EventMinInterval - time.Since(last); wait > 0 {
+				coalesce = time.After(wait)
+				continue
 			}
+			report()
+		case <-coalesce:
+			coalesce = nil
+			report()
 		}
 	}
 }
@@ -253,11 +530,32 @@ func (r *Runner) runReportLoop(ctx context.Context, wg *sync.WaitGroup) {
 func (r *Runner) runHeartbeatLoop(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	if err := r.sendHeartbeat(ctx); err != nil {
-		log.Printf("[agent:%s] heartbeat error: %v", r.cfg.AgentID, err)
+	// Renegotiate the protocol whenever the master becomes reachable again,
+	// since it may have been upgraded or rolled back while we were cut off,
+	// and whenever requests moved between --server-url and its fallback.
+	serverDown := false
+	beat := func() {
+		if err := r.sendHeartbeat(ctx); err != nil {
+			serverDown = true
+			log.Printf("[agent:%s] heartbeat error: %v", r.cfg.AgentID, err)
+			return
+		}
+		if switched := r.endpoints.takeSwitched(); !serverDown && !switched {
+			return
+		}
+		serverDown = false
+		if err := r.negotiateProtocol(ctx); err != nil {
+			if errors.Is(err, ErrProtocolIncompatible) {
+				r.failProtocol(ctx, err)
+				return
+			}
+			log.Printf("[agent:%s] protocol negotiation error: %v", r.cfg.AgentID, err)
+		}
 	}
 
-	ticker := time.NewTicker(r.cfg.HeartbeatInterval)
+	beat()
+
+	ticker := time.NewTicker(r.jittered(r.cfg.HeartbeatInterval))
 	defer ticker.Stop()
 
 	for {
@@ -265,9 +563,8 @@ func (r *Runner) runHeartbeatLoop(ctx context.Context, wg *sync.WaitGroup) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := r.sendHeartbeat(ctx); err != nil {
-				log.Printf("[agent:%s] heartbeat error: %v", r.cfg.AgentID, err)
-			}
+			ticker.Reset(r.jittered(r.cfg.HeartbeatInterval))
+			beat()
 		}
 	}
 }
@@ -288,10 +585,20 @@ func (r *Runner) runConfigSyncLoop(ctx context.Context, wg *sync.WaitGroup) {
 			log.Printf("[agent:%s] init config sync failed after %d retries: %v", r.cfg.AgentID, maxRetries, err)
 		} else {
 			// Check if it's a binding conflict (409)
-			if strings.Contains(err.Error(), "409") || strings.Contains(err.Error(), "AGENT_TOKEN_ALREADY_BOUND") {
+			if isBindingConflict(err) {
+				// Binding conflicts keep their linear 5s, 10s, 15s, 20s
+				// schedule; jitter only spreads out agents that hit one
+				// together.
 				backoff := time.Duration(i+1) * 5 * time.Second
+				if r.cfg.BackoffJitter {
+					backoff = jitterBetween(5*time.Second, backoff)
+				}
 				log.Printf("[agent:%s] config sync binding conflict, retrying in %v... (%d/%d)", r.cfg.AgentID, backoff, i+1, maxRetries)
-				time.Sleep(backoff)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
 			} else {
 				// Non-binding error, log and continue with ticker
 				log.Printf("[agent:%s] init config sync error: %v", r.cfg.AgentID, err)
@@ -301,7 +608,7 @@ func (r *Runner) runConfigSyncLoop(ctx context.Context, wg *sync.WaitGroup) {
 	}
 
 	// Then every 2 minutes
-	ticker := time.NewTicker(2 * time.Minute)
+	ticker := time.NewTicker(r.jittered(configSyncInterval))
 	defer ticker.Stop()
 
 	for {
@@ -309,6 +616,7 @@ func (r *Runner) runConfigSyncLoop(ctx context.Context, wg *sync.WaitGroup) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			ticker.Reset(r.jittered(configSyncInterval))
 			if err := r.syncConfig(ctx); err != nil {
 				log.Printf("[agent:%s] config sync error: %v", r.cfg.AgentID, err)
 			}
@@ -321,15 +629,20 @@ func (r *Runner) syncConfig(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	r.checkProxyCount(snap)
 
 	// Calculate a simple hash to avoid sending if unmodified
-	data, _ := json.Marshal(snap)
-	hash := fmt.Sprintf("%x", md5.Sum(data))
-	if hash == r.lastConfigHash {
+	hash := snapshotHash(snap)
+
+	r.mu.Lock()
+	unchanged := hash == r.lastConfigHash
+	r.mu.Unlock()
+
+	if unchanged {
 		return nil
 	}
 	snap.Hash = hash
-	snap.Timestamp = time.Now().UnixMilli()
+	snap.Timestamp = r.correctTimestamp(time.Now().UnixMilli())
 
 	payload := configPayload{
 		BackendID: r.cfg.BackendID,
@@ -361,7 +674,7 @@ func (r *Runner) runPolicyStateSyncLoop(ctx context.Context, wg *sync.WaitGroup)
 	}
 
 	// Then every 30 seconds
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(r.jittered(policySyncInterval))
 	defer ticker.Stop()
 
 	for {
@@ -369,6 +682,7 @@ func (r *Runner) runPolicyStateSyncLoop(ctx context.Context, wg *sync.WaitGroup)
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			ticker.Reset(r.jittered(policySyncInterval))
 			if err := r.syncPolicyState(ctx); err != nil {
 				log.Printf("[agent:%s] policy state sync error: %v", r.cfg.AgentID, err)
 			}
@@ -383,8 +697,7 @@ func (r *Runner) syncPolicyState(ctx context.Context) error {
 	}
 
 	// Skip POST when policy state is unchanged (same as syncConfig dedup pattern)
-	data, _ := json.Marshal(snap)
-	hash := fmt.Sprintf("%x", md5.Sum(data))
+	hash := snapshotHash(snap)
 
 	r.mu.Lock()
 	unchanged := hash == r.lastPolicyHash
@@ -394,7 +707,7 @@ func (r *Runner) syncPolicyState(ctx context.Context) error {
 		return nil
 	}
 
-	snap.Timestamp = time.Now().UnixMilli()
+	snap.Timestamp = r.correctTimestamp(time.Now().UnixMilli())
 
 	payload := policyStatePayload{
 		BackendID:   r.cfg.BackendID,
@@ -402,7 +715,7 @@ func (r *Runner) syncPolicyState(ctx context.Context) error {
 		PolicyState: snap,
 	}
 
-	if err := r.postJSON(ctx, "/agent/policy-state", payload); err != nil {
+	if err := r.postJSON(ctx, policyStatePath, payload); err != nil {
 		return err
 	}
 
@@ -412,41 +725,135 @@ func (r *Runner) syncPolicyState(ctx context.Context) error {
 	return nil
 }
 
-func (r *Runner) ingestSnapshots(snapshots []domain.FlowSnapshot, nowMs int64) {
-	active := make(map[string]struct{}, len(snapshots))
+// dedupeSnapshots collapses snapshots sharing an ID (seen from some mihomo
+// builds during a reload) into the one with the larger cumulative counters, so
+// the duplicate cannot overwrite the tracked flow with a bogus delta. Order of
+// first appearance is kept.
+func (r *Runner) dedupeSnapshots(snapshots []domain.FlowSnapshot) []domain.FlowSnapshot {
+	index := make(map[string]int, len(snapshots))
+	out := snapshots[:0:0]
+	dupes := 0
+	for _, s := range snapshots {
+		i, ok := index[s.ID]
+		if !ok {
+			index[s.ID] = len(out)
+			out = append(out, s)
+			continue
+		}
+		dupes++
+		if s.Upload+s.Download > out[i].Upload+out[i].Download {
+			out[i] = s
+		}
+	}
+	if dupes == 0 {
+		return snapshots
+	}
+	log.Printf("[agent:%s] warning: gateway returned %d duplicate connection IDs in one poll; kept the larger counters", r.cfg.AgentID, dupes)
+	return out
+}
+
+func (r *Runner) ingestSnapshots(snapshots []domain.FlowSnapshot) {
+	snapshots = r.dedupeSnapshots(snapshots)
+	loggedClamp := false // one line per poll is enough to spot a bad clock
+	nowMs := r.clock.Now().UnixMilli()
+	masterNowMs := r.correctTimestamp(nowMs)
+	mono := r.clock.Monotonic()
 	updates := make([]domain.TrafficUpdate, 0, len(snapshots))
+	flowIDs := make([]string, 0, len(snapshots))
+	flushEvent := false
 
+	// Per-pass totals are merged on enqueue, so a report tick draining them
+	// never waits for the pass.
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	granularity := r.granularity
+	r.mu.Unlock()
+	sourceTotals, chainTotals := make(buckets), make(buckets)
 
-	for _, s := range snapshots {
-		active[s.ID] = struct{}{}
+	r.flowMu.Lock()
+	defer r.flowMu.Unlock()
+	room := r.makeRoomForFlowsLocked(snapshots, mono)
 
+	for _, s := range snapshots {
 		prev, hasPrev := r.flows[s.ID]
+		if !hasPrev && room >= 0 {
+			if room == 0 {
+				continue
+			}
+			room--
+		}
 		counted := false
+		firstSeenMs := nowMs
+		firstSeen := mono
+		revived := false
 		if hasPrev {
 			counted = prev.Counted
+			firstSeenMs = prev.FirstSeenMs
+			firstSeen = prev.FirstSeen
+		} else if t, ok := r.reviveFlowLocked(s, mono); ok {
+			// Count only what the flow moved since it was evicted.
+			revived = true
+			counted = t.counted
+			prev.LastUpload, prev.LastDown, prev.LastSeen = t.lastUpload, t.lastDown, t.lastSeen
 		}
-		domainName := strings.TrimSpace(s.Domain)
-		ip := strings.TrimSpace(s.IP)
-		sourceIP := strings.TrimSpace(s.SourceIP)
-		chains := normalizeChains(s.Chains)
-		rule := defaultString(strings.TrimSpace(s.Rule), "Match")
-		rulePayload := strings.TrimSpace(s.RulePayload)
+		var domainName, domainSource, domainASCII, ip, sourceIP, rule, rulePayload, country string
+		var hostSource, dnsMode, specialProxy, transport, appProtocol, process string
+		var chains []string
+		var asn asnInfo
 		if hasPrev {
 			// Keep per-flow metadata stable once first seen, matching direct mode
 			// semantics in collector (existing connection fields are reused).
 			domainName = prev.Domain
+			domainSource = prev.DomainSource
+			hostSource = prev.HostSource
+			domainASCII = prev.DomainASCII
 			ip = prev.IP
 			sourceIP = prev.SourceIP
 			chains = cloneStringSlice(prev.Chains)
 			rule = defaultString(prev.Rule, "Match")
 			rulePayload = prev.RulePayload
+			country = prev.Country
+			asn = prev.ASN
+			dnsMode = prev.DNSMode
+			specialProxy = prev.SpecialProxy
+			transport = prev.Transport
+			appProtocol = prev.AppProtocol
+			process = prev.Process
+		} else {
+			// Sanitize once on first sight; gateway strings are untrusted.
+			domainName = domain.SanitizeString(s.Domain, domain.MaxDomainLen)
+			if ascii := domain.SanitizeString(s.DomainASCII, domain.MaxDomainLen); ascii != domainName {
+				domainASCII = ascii
+			}
+			ip = domain.NormalizeIP(s.IP)
+			hostSource = domain.SanitizeString(s.HostSource, domain.MaxChainLen)
+			dnsMode = domain.SanitizeString(s.DNSMode, domain.MaxChainLen)
+			specialProxy = domain.SanitizeString(s.SpecialProxy, domain.MaxChainLen)
+			transport = domain.SanitizeString(s.Transport, domain.MaxChainLen)
+			appProtocol = domain.SanitizeString(s.AppProtocol, domain.MaxChainLen)
+			process = domain.SanitizeString(s.Process, domain.MaxChainLen)
+			if r.cfg.SuppressFakeIP && dnsMode == dnsModeFakeIP && domainName == "" {
+				// A fake-IP address without a sniffed host says nothing about
+				// the destination and would pollute per-IP statistics.
+				ip = ""
+			}
+			sourceIP = domain.NormalizeIP(s.SourceIP)
+			chains = gateway.NormalizeChains(s.Chains)
+			rule = defaultString(domain.SanitizeString(s.Rule, domain.MaxChainLen), "Match")
+			rulePayload = domain.SanitizeString(s.RulePayload, domain.MaxRulePayloadLen)
+			country = r.geo.country(ip)
+			asn = r.asn.info(ip)
+		}
+		if domainName == "" {
+			// Cache-only: a miss schedules a lookup and this update goes out
+			// IP-only rather than waiting.
+			if name := r.rdns.name(ip); name != "" {
+				domainName, domainSource = name, domainSourceRDNS
+			}
 		}
 
 		deltaUp := s.Upload
 		deltaDown := s.Download
-		if hasPrev {
+		if hasPrev || revived {
 			if s.Upload >= prev.LastUpload {
 				deltaUp = s.Upload - prev.LastUpload
 			} else {
@@ -458,6 +865,8 @@ func (r *Runner) ingestSnapshots(snapshots []domain.FlowSnapshot, nowMs int64) {
 				deltaDown = 0
 			}
 		}
+		deltaUp, deltaDown, quietUntil := r.checkDelta(s, prev, hasPrev || revived, mono, deltaUp, deltaDown)
+		speedUp, speedDown := flowSpeeds(s, hasPrev, mono-prev.LastSeen, deltaUp, deltaDown)
 
 		connections := int64(0)
 		if (deltaUp > 0 || deltaDown > 0) && !counted {
@@ -465,136 +874,355 @@ func (r *Runner) ingestSnapshots(snapshots []domain.FlowSnapshot, nowMs int64) {
 			counted = true
 		}
 
+		eventBytes := prev.EventBytes + deltaUp + deltaDown
+		if r.eventMode() && (connections > 0 || eventBytes >= r.cfg.EventThreshold) {
+			flushEvent = true
+			eventBytes = 0
+		}
+
 		r.flows[s.ID] = trackedFlow{
-			LastUpload:  s.Upload,
-			LastDown:    s.Download,
-			LastSeenMs:  nowMs,
-			Counted:     counted,
-			Domain:      domainName,
-			IP:          ip,
-			SourceIP:    sourceIP,
-			Chains:      cloneStringSlice(chains),
-			Rule:        rule,
-			RulePayload: rulePayload,
+			LastUpload:   s.Upload,
+			LastDown:     s.Download,
+			LastSeen:     mono,
+			FirstSeen:    firstSeen,
+			FirstSeenMs:  firstSeenMs,
+			Counted:      counted,
+			Domain:       domainName,
+			DomainSource: domainSource,
+			HostSource:   hostSource,
+			DomainASCII:  domainASCII,
+			IP:           ip,
+			SourceIP:     sourceIP,
+			Chains:       cloneStringSlice(chains),
+			Rule:         rule,
+			RulePayload:  rulePayload,
+			Country:      country,
+			DNSMode:      dnsMode,
+			SpecialProxy: specialProxy,
+			Transport:    transport,
+			AppProtocol:  appProtocol,
+			Process:      process,
+			ASN:          asn,
+			EventBytes:   eventBytes,
+			QuietUntil:   quietUntil,
+		}
+		if s.Blocked && !hasPrev && r.cfg.ReportBlocked {
+			u, ok := r.recordBlockedLocked(domain.TrafficUpdate{
+				Domain:      domainName,
+				IP:          ip,
+				Chain:       firstChain(chains),
+				Chains:      cloneStringSlice(chains),
+				Rule:        rule,
+				RulePayload: rulePayload,
+				SourceIP:    sourceIP,
+				TimestampMs: r.correctTimestamp(nowMs),
+			}, mono)
+			if ok {
+				flowIDs = append(flowIDs, s.ID)
+				updates = append(updates, u)
+			}
 		}
 		if deltaUp <= 0 && deltaDown <= 0 {
 			continue
 		}
+		if r.cfg.ReportRuleStats {
+			r.recordRuleStat(rule, rulePayload, firstChain(chains), deltaUp, deltaDown, connections)
+		}
+		if granularity == granularitySource {
+			// Per-connection state above stays exact; only the queued
+			// representation is collapsed to (sourceIP, chain).
+			sourceTotals.add(sourceIP, chains, deltaUp, deltaDown, connections)
+			continue
+		}
+		if domainName == "" && ip == "" && !(r.cfg.SuppressFakeIP && dnsMode == dnsModeFakeIP) {
+			// Nothing the master could attribute this traffic to.
+			r.invalidUpdates.Add(1)
+			continue
+		}
 
+		sampleRate := 0.0
+		if r.samplingEnabled() {
+			chainTotals.add("", chains, deltaUp, deltaDown, connections)
+			if !r.sampled(s.ID) {
+				continue
+			}
+			sampleRate = r.cfg.SamplingRate
+			deltaUp, deltaDown = r.scaleSampled(deltaUp), r.scaleSampled(deltaDown)
+			connections = r.scaleSampled(connections)
+			speedUp, speedDown = r.scaleSampled(speedUp), r.scaleSampled(speedDown)
+		}
+
+		// Only agent-clock timestamps are shifted onto the master's clock;
+		// the gateway's own clock says nothing about ours.
 		ts := s.TimestampMs
-		if ts <= 0 {
-			ts = nowMs
+		if ts <= 0 || r.cfg.TimestampSource == "agent" {
+			// An unsynced router clock would otherwise skew server charts.
+			ts = masterNowMs
+		} else if skew := r.cfg.MaxTimestampSkew.Milliseconds(); skew > 0 && (ts < masterNowMs-skew || ts > masterNowMs+skew) {
+			if !loggedClamp {
+				log.Printf("[agent:%s] gateway timestamp %d for flow %s is more than %s from local time; using local time", r.cfg.AgentID, ts, s.ID, r.cfg.MaxTimestampSkew)
+			}
+			loggedClamp = true
+			ts = masterNowMs
 		}
 
+		flowIDs = append(flowIDs, s.ID)
 		updates = append(updates, domain.TrafficUpdate{
-			Domain:      domainName,
-			IP:          ip,
-			Chain:       firstChain(chains),
-			Chains:      cloneStringSlice(chains),
-			Rule:        rule,
-			RulePayload: rulePayload,
-			Upload:      deltaUp,
-			Download:    deltaDown,
-			Connections: connections,
-			SourceIP:    sourceIP,
-			TimestampMs: ts,
+			Domain:           domainName,
+			IP:               ip,
+			Chain:            firstChain(chains),
+			Chains:           cloneStringSlice(chains),
+			Rule:             rule,
+			RulePayload:      rulePayload,
+			Upload:           deltaUp,
+			Download:         deltaDown,
+			UploadSpeedBps:   speedUp,
+			DownloadSpeedBps: speedDown,
+			Connections:      connections,
+			SourceIP:         sourceIP,
+			TimestampMs:      ts,
+			FirstSeenMs:      r.correctTimestamp(firstSeenMs),
+			DurationMs:       (mono - firstSeen).Milliseconds(),
+			Country:          country,
+			DNSMode:          dnsMode,
+			SpecialProxy:     specialProxy,
+			Transport:        transport,
+			AppProtocol:      appProtocol,
+			Process:          process,
+			DestASN:          asn.Number,
+			DestASOrg:        asn.Org,
+			DestDatacenter:   asn.Datacenter,
+			DomainSource:     domainSource,
+			HostSource:       hostSource,
+			DomainASCII:      domainASCII,
+			Sampled:          sampleRate > 0,
+			SampleRate:       sampleRate,
 		})
 	}
 
+	r.lastIngest = mono
+
+	if !r.cfg.PreserveGatewayOrder {
+		sortUpdates(updates, flowIDs)
+	}
+
+	r.mu.Lock()
+	r.sourceTotals.merge(sourceTotals)
+	r.chainTotals.merge(chainTotals)
+	r.enqueueLocked(updates)
+	r.mu.Unlock()
+	if flushEvent && len(updates) > 0 {
+		r.requestFlush()
+	}
+}
+
+// refreshUnchangedFlows stands in for an ingest when the gateway's response
+// is identical to the last decoded one: the flows that poll listed are seen
+// again with the same counters, so only their LastSeen moves, keeping speeds
+// and the janitor's stale-flow eviction as if the poll had been decoded. It
+// returns how many flows were listed.
+func (r *Runner) refreshUnchangedFlows() int {
+	mono := r.clock.Monotonic()
+	r.flowMu.Lock()
+	defer r.flowMu.Unlock()
+	listed := 0
 	for id, f := range r.flows {
-		if _, ok := active[id]; ok {
-			continue
-		}
-		if nowMs-f.LastSeenMs > r.cfg.StaleFlowTimeout.Milliseconds() {
-			delete(r.flows, id)
+		if f.LastSeen == r.lastIngest {
+			f.LastSeen = mono
+			r.flows[id] = f
+			listed++
 		}
 	}
+	r.lastIngest = mono
+	return listed
+}
+
+// enqueueLocked appends updates to the queue, dropping the oldest entries
+// beyond --max-pending-updates. Callers must hold r.mu.
+func (r *Runner) enqueueLocked(updates []domain.TrafficUpdate) {
+	r.queue.push(updates)
+	r.trimQueueLocked()
+}
+
+// trimQueueLocked enforces --max-pending-updates by dropping the oldest
+// segments of the queue. Callers must hold r.mu.
+func (r *Runner) trimQueueLocked() {
+	r.dropped += int64(r.queue.trim(r.cfg.MaxPendingUpdates))
+}
 
-	if len(updates) == 0 {
-		return
+// flushOnce posts one report batch unless --max-inflight-posts posts are
+// already running (a slow master outlasting the report interval), in which
+// case the tick is skipped; the updates stay queued for the next one.
+func (r *Runner) flushOnce(ctx context.Context) error {
+	select {
+	case r.postSlots <- struct{}{}:
+	default:
+		log.Printf("[agent:%s] skipping report tick: %d posts still in flight", r.cfg.AgentID, cap(r.postSlots))
+		return nil
 	}
+	defer func() { <-r.postSlots }()
+	return r.flush(ctx)
+}
 
-	r.queue = append(r.queue, updates...)
-	if len(r.queue) > r.cfg.MaxPendingUpdates {
-		overflow := len(r.queue) - r.cfg.MaxPendingUpdates
-		r.queue = r.queue[overflow:]
-		r.dropped += int64(overflow)
+// flushFinal is the shutdown flush; it waits for a free slot instead of
+// skipping so the last batch is not lost.
+func (r *Runner) flushFinal(ctx context.Context) error {
+	select {
+	case r.postSlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+	defer func() { <-r.postSlots }()
+	return r.flush(ctx)
 }
 
-func (r *Runner) flushOnce(ctx context.Context) error {
-	batch, requestID := r.takePendingBatch()
-	if len(batch) == 0 {
+func (r *Runner) flush(ctx context.Context) error {
+	if r.samplingEnabled() {
+		r.queueChainTotals()
+	}
+	r.queueSourceTotals()
+	pending := r.takePendingBatch()
+	items := r.takeBatchItems()
+	if pending == nil && len(items) == 0 {
 		return nil
 	}
 
-	payload := reportPayload{
-		BackendID:       r.cfg.BackendID,
-		RequestID:       requestID,
-		AgentID:         r.cfg.AgentID,
-		AgentVersion:    config.AgentVersion,
-		ProtocolVersion: config.AgentProtocolVersion,
-		Updates:         batch,
+	var payload *domain.ReportPayload
+	if pending != nil {
+		payload = r.newReportPayload(pending.requestID, pending.batchID, pending.seq, pending.updates)
 	}
 
-	if err := r.postJSON(ctx, "/agent/report", payload); err != nil {
-		r.setRetryBatch(batch, requestID)
-		return err
+	// Without parked posts the report goes out alone so it can use msgpack.
+	var err error
+	switch {
+	case len(items) == 0:
+		err = r.postReport(ctx, payload)
+	case r.batching():
+		err = r.flushBatch(ctx, payload, items)
+	default:
+		err = r.flushIndividually(ctx, payload, items)
 	}
-	return nil
+	if pending != nil {
+		switch {
+		case err == nil:
+			r.ackReport(pending.seq)
+			r.recordSent(pending.updates)
+			r.recordReportSize(pending.bytes)
+		case isTooLarge(err) && r.splitRejectedBatch(pending):
+		case isPermanentReject(err):
+			r.deadLetter(pending, err)
+		default:
+			err = r.retryReport(pending, err)
+		}
+	}
+	return err
 }
 
-// takePendingBatch returns the retry batch (with its original requestId) if one
-// exists, otherwise dequeues a fresh batch from the queue and generates a new id.
-func (r *Runner) takePendingBatch() ([]domain.TrafficUpdate, string) {
+// pendingReport is a batch of updates together with the idempotency keys and
+// sequence number it was first sent with; all are reused for every retry of
+// the batch, so the master only sees a gap in seq when a batch is abandoned.
+type pendingReport struct {
+	updates   []domain.TrafficUpdate
+	requestID string
+	batchID   string
+	seq       int64
+	bytes     int64    // estimated encoded size of updates, see updateSize
+	attempts  int      // failed posts so far, see retryReport
+	orders    []uint64 // enqueue order of each update, see updateQueue
+}
+
+// takePendingBatch returns the failed batch at the head of the queue (with
+// its original ids) if there is one, otherwise dequeues a fresh batch and
+// generates new ids for it.
+func (r *Runner) takePendingBatch() *pendingReport {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if len(r.retryBatch) > 0 {
-		batch := r.retryBatch
-		id := r.retryID
-		r.retryBatch = nil
-		r.retryID = ""
-		return batch, id
+	for {
+		retry, expired := r.queue.takeReport(r.expiryCutoffLocked())
+		r.expired += expired
+		if retry == nil {
+			break
+		}
+		if len(retry.updates) > 0 {
+			return retry
+		}
 	}
-	if len(r.queue) == 0 {
-		return nil, ""
+	out, size, orders := r.dequeueLocked(r.cfg.ReportBatchSize, r.reportByteLimit)
+	if len(out) == 0 {
+		return nil
 	}
-	limit := r.cfg.ReportBatchSize
-	if limit > len(r.queue) {
-		limit = len(r.queue)
+	r.reportSeq++
+	return &pendingReport{
+		updates:   out,
+		requestID: newRequestID(),
+		batchID:   newBatchID(r.cfg.AgentID, r.reportSeq, out),
+		seq:       r.reportSeq,
+		bytes:     size,
+		orders:    orders,
 	}
-	out := make([]domain.TrafficUpdate, limit)
-	copy(out, r.queue[:limit])
-	r.queue = r.queue[limit:]
-	return out, newRequestID()
 }
 
-func (r *Runner) setRetryBatch(batch []domain.TrafficUpdate, id string) {
+// requeue puts a batch whose post failed back at its place in the queue.
+// With keepIDs it is retried as the same report; otherwise its updates are
+// batched afresh.
+func (r *Runner) requeue(pending *pendingReport, keepIDs bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.retryBatch = batch
-	r.retryID = id
+	r.queue.requeue(pending, keepIDs)
+	r.trimQueueLocked()
 }
 
-func (r *Runner) sendHeartbeat(ctx context.Context) error {
-	r.mu.Lock()
-	gatewayLatencyMs := r.gatewayLatencyMs
-	serverLatencyMs := r.serverLatencyMs
-	r.mu.Unlock()
+func (r *Runner) buildHeartbeat() heartbeatPayload {
+	stats := &heartbeatStats{}
+	stats.ServerConnReused, stats.ServerConnNew = r.conns.snapshot()
+	stats.ClockOffsetMs = r.skew.offset()
+	stats.ASNCacheHits, stats.ASNCacheMisses = r.asn.cacheStats()
+	var warnings []string
+	if w := r.proxyCount.current(); w != "" {
+		warnings = append(warnings, w)
+	}
 
-	payload := heartbeatPayload{
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats.Expired = r.expired
+	stats.ImplausibleDeltas = r.implausibleDeltas.Load()
+	stats.InvalidUpdates = r.invalidUpdates.Load()
+	stats.Blocked = r.blockedSeen.Load()
+	stats.BlockedSuppressed = r.blockedSuppressed.Load()
+	if r.reportPosts > 0 {
+		stats.AvgReportBytes = r.reportPostBytes / r.reportPosts
+	}
+	stats.ReportByteLimit = r.reportByteLimit
+	stats.DeadLettered = r.deadLettered
+	stats.RevivedFlows = r.revivedFlows.Load()
+	stats.SkippedPolls = r.skippedPolls.Load()
+	stats.StaleEvictions = r.staleEvictions.Load()
+	stats.CapEvictions = r.capEvictions.Load()
+	return heartbeatPayload{
 		BackendID:        r.cfg.BackendID,
 		AgentID:          r.cfg.AgentID,
 		Hostname:         r.hostname,
+		InstallID:        r.installID,
 		Version:          config.AgentVersion,
 		AgentVersion:     config.AgentVersion,
-		ProtocolVersion:  config.AgentProtocolVersion,
-		GatewayType:      r.cfg.GatewayType,
+		ProtocolVersion:  r.protocolVersion,
+		GatewayType:      r.gatewayType(),
+		GatewayAuto:      r.cfg.GatewayType == gateway.TypeAuto,
 		GatewayURL:       r.cfg.GatewayEndpoint,
-		GatewayLatencyMs: gatewayLatencyMs,
-		ServerLatencyMs:  serverLatencyMs,
+		GatewayLatencyMs: r.gatewayLatencyMs,
+		ServerLatencyMs:  r.serverLatencyMs,
+		Warnings:         warnings,
+		CommandsEnabled:  r.cfg.AllowCommands,
+		Stats:            stats,
 	}
-	latencyMs, err := r.postJSONWithLatency(ctx, "/agent/heartbeat", payload)
+}
+
+func (r *Runner) sendHeartbeat(ctx context.Context) error {
+	payload := r.buildHeartbeat()
+	payload.GatewayMode = r.gatewayMode(ctx)
+	r.addGatewayCore(ctx, &payload)
+	var resp heartbeatResponse
+	latencyMs, err := r.postJSONWithLatency(ctx, heartbeatPath, heartbeatForProtocol(payload), &resp)
 	if err != nil {
 		return err
 	}
@@ -602,54 +1230,132 @@ func (r *Runner) sendHeartbeat(ctx context.Context) error {
 	r.mu.Lock()
 	r.serverLatencyMs = latencyMs
 	r.mu.Unlock()
+	r.observeDuplicate(resp.DuplicateAgent)
+
+	if len(resp.Commands) > 0 {
+		r.handleCommands(ctx, resp.Commands)
+	}
+	if r.cfg.SelfUpdate && resp.LatestVersion != "" {
+		// The download can take minutes; heartbeats carry on meanwhile.
+		go r.maybeSelfUpdate(ctx, resp)
+	}
 	return nil
 }
 
+// snapshotHash fingerprints a gateway snapshot for change detection: SHA-256
+// over its canonical JSON, streamed into the hash rather than built up in
+// memory first. encoding/json writes map keys sorted, so the proxy and
+// provider maps hash the same whatever order they were filled in. The
+// snapshot's own Timestamp and Hash are left out.
+func snapshotHash(snap interface{}) string {
+	switch s := snap.(type) {
+	case *domain.GatewayConfigSnapshot:
+		c := *s
+		c.Timestamp, c.Hash = 0, ""
+		snap = &c
+	case *domain.PolicyStateSnapshot:
+		c := *s
+		c.Timestamp = 0
+		snap = &c
+	}
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode(snap)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (r *Runner) postJSON(ctx context.Context, path string, payload interface{}) error {
-	_, err := r.postJSONWithLatency(ctx, path, payload)
+	_, err := r.postJSONWithLatency(ctx, path, payload, nil)
 	return err
 }
 
-func (r *Runner) postJSONWithLatency(ctx context.Context, path string, payload interface{}) (int64, error) {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return 0, err
+// postJSONWithLatency posts payload and, when out is non-nil, decodes a JSON
+// response body into it. Undecodable bodies are ignored so older masters that
+// reply with plain text keep working.
+func (r *Runner) postJSONWithLatency(ctx context.Context, path string, payload interface{}, out interface{}) (int64, error) {
+	if isBatchable(path) && r.batching() {
+		return r.parkForBatch(ctx, path, payload, out)
 	}
-
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	if _, err = gz.Write(body); err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(payload); err != nil {
 		return 0, err
 	}
-	if err = gz.Close(); err != nil {
+	if r.cfg.DryRun {
+		r.dryRunPost(path, buf.Bytes())
+		return 0, nil
+	}
+	return r.postBody(ctx, path, buf.Bytes(), "application/json", out)
+}
+
+// postBody gzips body and posts it to the master with the given content type.
+func (r *Runner) postBody(ctx context.Context, path string, body []byte, contentType string, out interface{}) (int64, error) {
+	buf, err := gzipBody(body)
+	if err != nil {
 		return 0, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.ServerAPIBase+path, &buf)
+	req, traceID, err := r.newServerRequest(ctx, http.MethodPost, path, buf)
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Authorization", "Bearer "+r.cfg.BackendToken)
+	if r.cfg.ReportClientID != "" {
+		req.Header.Set(clientIDHeader, r.cfg.ReportClientID)
+	}
+
+	if r.cfg.VerboseHTTP {
+		r.logHTTPRequest(req, traceID, body)
+	}
 
 	requestAt := time.Now()
-	resp, err := r.httpClient.Do(req)
+	resp, err := r.doServer(req)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("%s [request-id=%s]: %w", path, traceID, err)
+	}
+	defer drainAndClose(resp.Body)
+	latencyMs := time.Since(requestAt).Milliseconds()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if r.cfg.VerboseHTTP {
+		r.logHTTPResponse(resp, traceID, respBody)
+	} else {
+		log.Printf("[agent:%s] POST %s: %d [request-id=%s] %dms", r.cfg.AgentID, path, resp.StatusCode, traceID, latencyMs)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		return time.Since(requestAt).Milliseconds(), nil
+		if out != nil {
+			_ = json.NewDecoder(bytes.NewReader(respBody)).Decode(out)
+		}
+		return latencyMs, nil
 	}
 
-	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
-	msg := string(bytes.TrimSpace(respBody))
+	msg := string(bytes.TrimSpace(respBody[:min(len(respBody), 2048)]))
 	if msg == "" {
 		msg = resp.Status
 	}
-	return 0, fmt.Errorf("server http %d: %s", resp.StatusCode, msg)
+	return 0, &serverHTTPError{StatusCode: resp.StatusCode, RequestID: traceID, Message: msg}
+}
+
+// serverHTTPError is returned for non-2xx master responses so callers can
+// branch on the status code instead of matching error strings.
+type serverHTTPError struct {
+	StatusCode int
+	RequestID  string
+	Message    string
+}
+
+func (e *serverHTTPError) Error() string {
+	return fmt.Sprintf("server http %d [request-id=%s]: %s", e.StatusCode, e.RequestID, e.Message)
+}
+
+// isBindingConflict reports whether err is the master refusing the token
+// because another agent ID is bound to it.
+func isBindingConflict(err error) bool {
+	var httpErr *serverHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusConflict || strings.Contains(httpErr.Message, "AGENT_TOKEN_ALREADY_BOUND")
+	}
+	return false
 }
 
 func newRequestID() string {
@@ -658,46 +1364,61 @@ func newRequestID() string {
 	return hex.EncodeToString(b)
 }
 
+// newBatchID derives a stable content key for a report batch from the agent
+// ID, the batch's sequence number and its encoded updates. The sequence keeps
+// two identical batches apart; the content hash keeps ids from colliding after
+// a restart resets the sequence.
+func newBatchID(agentID string, seq int64, updates []domain.TrafficUpdate) string {
+	h := sha256.New()
+	h.Write([]byte(agentID))
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(seq))
+	h.Write(b[:])
+	buf := make([]byte, 0, 256)
+	for i := range updates {
+		buf = updates[i].AppendMsgpack(buf[:0])
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
 func (r *Runner) takeBatch(limit int) []domain.TrafficUpdate {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if len(r.queue) == 0 {
+	out, _, _ := r.dequeueLocked(limit, 0)
+	if len(out) == 0 {
 		return nil
 	}
-	if limit > len(r.queue) {
-		limit = len(r.queue)
-	}
-	out := make([]domain.TrafficUpdate, limit)
-	copy(out, r.queue[:limit])
-	r.queue = r.queue[limit:]
 	return out
 }
 
-func (r *Runner) requeueFront(batch []domain.TrafficUpdate) {
-	if len(batch) == 0 {
-		return
-	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	newQueue := make([]domain.TrafficUpdate, 0, len(batch)+len(r.queue))
-	newQueue = append(newQueue, batch...)
-	newQueue = append(newQueue, r.queue...)
+// dequeueLocked removes up to limit unexpired updates from the head of the
+// queue, stopping early once their estimated encoded size would exceed
+// maxBytes (0 = no byte limit), and returns them with that size and their
+// enqueue orders. See updateQueue.take. Callers must hold r.mu.
+func (r *Runner) dequeueLocked(limit int, maxBytes int64) ([]domain.TrafficUpdate, int64, []uint64) {
+	out, orders, size, expired := r.queue.take(limit, maxBytes, r.expiryCutoffLocked())
+	r.expired += expired
+	return out, size, orders
+}
 
-	if len(newQueue) > r.cfg.MaxPendingUpdates {
-		overflow := len(newQueue) - r.cfg.MaxPendingUpdates
-		newQueue = newQueue[overflow:]
-		r.dropped += int64(overflow)
+// expiryCutoffLocked is the timestamp before which updates are older than
+// --max-update-age, or math.MinInt64 without a limit. Callers must hold r.mu.
+func (r *Runner) expiryCutoffLocked() int64 {
+	if r.cfg.MaxUpdateAge <= 0 {
+		return math.MinInt64
 	}
-	r.queue = newQueue
+	return r.correctTimestamp(r.clock.Now().Add(-r.cfg.MaxUpdateAge).UnixMilli())
 }
 
 func (r *Runner) queueStats() (pending int, dropped int64) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return len(r.queue), r.dropped
+	return r.queue.len, r.dropped
 }
 
+// firstChain returns the outbound that carried the flow; chains are exit-first
+// for every gateway type.
 func firstChain(chains []string) string {
 	if len(chains) == 0 {
 		return "DIRECT"
@@ -708,27 +1429,6 @@ func firstChain(chains []string) string {
 	return strings.TrimSpace(chains[0])
 }
 
-func normalizeChains(chains []string) []string {
-	if len(chains) == 0 {
-		return []string{"DIRECT"}
-	}
-	out := make([]string, 0, len(chains))
-	for _, chain := range chains {
-		trimmed := strings.TrimSpace(chain)
-		if trimmed == "" {
-			continue
-		}
-		out = append(out, trimmed)
-		if len(out) >= 12 {
-			break
-		}
-	}
-	if len(out) == 0 {
-		return []string{"DIRECT"}
-	}
-	return out
-}
-
 func cloneStringSlice(values []string) []string {
 	if len(values) == 0 {
 		return nil
@@ -745,6 +1445,36 @@ func defaultString(v string, fallback string) string {
 	return strings.TrimSpace(v)
 }
 
+// backoff is calculateBackoff with optional full jitter, so agents that fail
+// together (shared gateway or master outage) don't retry in lockstep. Every
+// exponential retry path should go through it.
+func (r *Runner) backoff(base time.Duration, failures int, max time.Duration) time.Duration {
+	delay := calculateBackoff(base, failures, max)
+	if !r.cfg.BackoffJitter {
+		return delay
+	}
+	return jitterBetween(base, delay)
+}
+
+// jittered spreads a loop period uniformly over +/- --interval-jitter, so
+// agents started together drift apart while each loop still averages the
+// configured period. It is drawn anew for every tick.
+func (r *Runner) jittered(d time.Duration) time.Duration {
+	j := r.cfg.IntervalJitter
+	if j <= 0 || d <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + j*(2*mrand.Float64()-1)))
+}
+
+// jitterBetween returns a uniformly random duration in [lo, hi].
+func jitterBetween(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return hi
+	}
+	return lo + mrand.N(hi-lo+1)
+}
+
 func calculateBackoff(base time.Duration, failures int, max time.Duration) time.Duration {
 	if failures <= 0 {
 		return base
@@ -1,11 +1,42 @@
 package agent
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"github.com/foru17/neko-master/apps/agent/internal/config"
 	"github.com/foru17/neko-master/apps/agent/internal/domain"
+	"github.com/foru17/neko-master/apps/agent/internal/gateway"
 )
 
 func TestIngestSnapshotsDeltaCalculation(t *testing.T) {
@@ -24,14 +55,17 @@ func TestIngestSnapshotsDeltaCalculation(t *testing.T) {
 		MaxPendingUpdates:   1000,
 		StaleFlowTimeout:    time.Minute,
 	})
+	clk := newFakeClock(1000)
+	runner.clock = clk
 
 	runner.ingestSnapshots([]domain.FlowSnapshot{{
 		ID:       "flow-1",
+		Domain:   "example.com",
 		Upload:   10,
 		Download: 20,
 		Chains:   []string{"Proxy"},
 		Rule:     "MATCH",
-	}}, 1000)
+	}})
 
 	first := runner.takeBatch(10)
 	if len(first) != 1 {
@@ -44,13 +78,15 @@ func TestIngestSnapshotsDeltaCalculation(t *testing.T) {
 		t.Fatalf("expected first connections 1, got %d", first[0].Connections)
 	}
 
+	clk.advance(time.Second)
 	runner.ingestSnapshots([]domain.FlowSnapshot{{
 		ID:       "flow-1",
+		Domain:   "example.com",
 		Upload:   25,
 		Download: 50,
 		Chains:   []string{"Proxy"},
 		Rule:     "MATCH",
-	}}, 2000)
+	}})
 
 	second := runner.takeBatch(10)
 	if len(second) != 1 {
@@ -62,14 +98,19 @@ func TestIngestSnapshotsDeltaCalculation(t *testing.T) {
 	if second[0].Connections != 0 {
 		t.Fatalf("expected second connections 0, got %d", second[0].Connections)
 	}
+	if second[0].FirstSeenMs != 1000 || second[0].DurationMs != 1000 {
+		t.Fatalf("expected first seen 1000 and duration 1000, got %d/%d", second[0].FirstSeenMs, second[0].DurationMs)
+	}
 
+	clk.advance(time.Second)
 	runner.ingestSnapshots([]domain.FlowSnapshot{{
 		ID:       "flow-1",
+		Domain:   "example.com",
 		Upload:   5,
 		Download: 3,
 		Chains:   []string{"Proxy"},
 		Rule:     "MATCH",
-	}}, 3000)
+	}})
 
 	third := runner.takeBatch(10)
 	if len(third) != 0 {
@@ -93,26 +134,31 @@ func TestIngestSnapshotsFirstTrafficAfterZeroCarriesConnection(t *testing.T) {
 		MaxPendingUpdates:   1000,
 		StaleFlowTimeout:    time.Minute,
 	})
+	clk := newFakeClock(1000)
+	runner.clock = clk
 
 	runner.ingestSnapshots([]domain.FlowSnapshot{{
 		ID:       "flow-2",
+		IP:       "1.1.1.1",
 		Upload:   0,
 		Download: 0,
 		Chains:   []string{"DIRECT"},
 		Rule:     "Match",
-	}}, 1000)
+	}})
 
 	if batch := runner.takeBatch(10); len(batch) != 0 {
 		t.Fatalf("expected no batch for zero traffic, got %d", len(batch))
 	}
 
+	clk.advance(time.Second)
 	runner.ingestSnapshots([]domain.FlowSnapshot{{
 		ID:       "flow-2",
+		IP:       "1.1.1.1",
 		Upload:   8,
 		Download: 5,
 		Chains:   []string{"DIRECT"},
 		Rule:     "Match",
-	}}, 2000)
+	}})
 
 	second := runner.takeBatch(10)
 	if len(second) != 1 {
@@ -125,3 +171,3507 @@ func TestIngestSnapshotsFirstTrafficAfterZeroCarriesConnection(t *testing.T) {
 		t.Fatalf("expected connections 1 for first non-zero traffic, got %d", second[0].Connections)
 	}
 }
+
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func newFakeClock(wallMs int64) *fakeClock {
+	return &fakeClock{wall: time.UnixMilli(wallMs)}
+}
+
+func (c *fakeClock) Now() time.Time           { return c.wall }
+func (c *fakeClock) Monotonic() time.Duration { return c.mono }
+
+// advance moves both clocks forward, as on a healthy host.
+func (c *fakeClock) advance(d time.Duration) {
+	c.wall = c.wall.Add(d)
+	c.mono += d
+}
+
+// jump steps only the wall clock, as an NTP correction or VM resume does.
+func (c *fakeClock) jump(d time.Duration) {
+	c.wall = c.wall.Add(d)
+}
+
+func newClockTestRunner(clk clock) *Runner {
+	runner := NewRunner(config.Config{
+		ServerAPIBase:       "http://localhost:3000/api",
+		BackendID:           1,
+		BackendToken:        "token",
+		AgentID:             "agent-test",
+		GatewayType:         "clash",
+		GatewayEndpoint:     "http://127.0.0.1:9090",
+		ReportInterval:      time.Second,
+		HeartbeatInterval:   time.Second,
+		GatewayPollInterval: time.Second,
+		RequestTimeout:      time.Second,
+		ReportBatchSize:     100,
+		MaxPendingUpdates:   1000,
+		StaleFlowTimeout:    time.Minute,
+	})
+	runner.clock = clk
+	return runner
+}
+
+func TestEvictedFlowReappearingIsNotCountedTwice(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.TombstoneTTL = 10 * time.Minute
+
+	flow := domain.FlowSnapshot{ID: "flow-1", Domain: "example.com", Upload: 100, Download: 200}
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	_ = runner.takeBatch(10)
+
+	// The gateway stops listing the flow long enough for it to be evicted.
+	clk.advance(2 * time.Minute)
+	runner.sweepStaleFlows()
+	if len(runner.flows) != 0 || len(runner.tombstones) != 1 {
+		t.Fatalf("expected the flow evicted to a tombstone, got %d flows, %d tombstones", len(runner.flows), len(runner.tombstones))
+	}
+
+	clk.advance(time.Second)
+	flow.Upload, flow.Download = 150, 200
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	batch := runner.takeBatch(10)
+	if len(batch) != 1 || batch[0].Upload != 50 || batch[0].Download != 0 || batch[0].Connections != 0 {
+		t.Fatalf("expected only the delta since eviction, got %+v", batch)
+	}
+	if got := runner.buildHeartbeat().Stats.RevivedFlows; got != 1 {
+		t.Fatalf("expected 1 revived flow, got %d", got)
+	}
+
+	// Past the TTL the tombstone is gone and the counters count in full.
+	clk.advance(2 * time.Minute)
+	runner.sweepStaleFlows()
+	clk.advance(11 * time.Minute)
+	runner.sweepStaleFlows()
+	if len(runner.tombstones) != 0 || len(runner.tombstoneOrder) != 0 {
+		t.Fatalf("expected expired tombstones pruned, got %d", len(runner.tombstones))
+	}
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	if batch := runner.takeBatch(10); len(batch) != 1 || batch[0].Upload != 150 {
+		t.Fatalf("expected full counters after the TTL, got %+v", batch)
+	}
+}
+
+func TestJanitorEvictsStaleFlowsWhileGatewayIsDown(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+
+	snapshots := make([]domain.FlowSnapshot, 3*staleFlowSweepChunk+5)
+	for i := range snapshots {
+		snapshots[i] = domain.FlowSnapshot{ID: fmt.Sprintf("flow-%d", i), Domain: "example.com", Upload: 1, Download: 1}
+	}
+	runner.ingestSnapshots(snapshots)
+	_ = runner.takeBatch(len(snapshots))
+
+	// No poll succeeds from here on; within the timeout nothing goes.
+	clk.advance(30 * time.Second)
+	if n := runner.sweepStaleFlows(); n != 0 {
+		t.Fatalf("expected no eviction within --stale-flow-timeout, got %d", n)
+	}
+
+	clk.advance(time.Minute)
+	if n := runner.sweepStaleFlows(); n != len(snapshots) {
+		t.Fatalf("expected all %d flows evicted across chunks, got %d", len(snapshots), n)
+	}
+	if len(runner.flows) != 0 || len(runner.tombstones) != len(snapshots) {
+		t.Fatalf("expected every flow in a tombstone, got %d flows, %d tombstones", len(runner.flows), len(runner.tombstones))
+	}
+
+	// Once the gateway is back the flows revive from their tombstones rather
+	// than counting from zero.
+	snapshots[0].Upload = 5
+	runner.ingestSnapshots(snapshots[:1])
+	if batch := runner.takeBatch(10); len(batch) != 1 || batch[0].Upload != 4 || batch[0].Connections != 0 {
+		t.Fatalf("expected only the delta since eviction, got %+v", batch)
+	}
+}
+
+func TestMaxTrackedFlowsEvictsIdleFlowsFirst(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.MaxTrackedFlows = 3
+	flow := func(id string, up int64) domain.FlowSnapshot {
+		return domain.FlowSnapshot{ID: id, Domain: id + ".example", Upload: up}
+	}
+
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow("a", 1), flow("b", 1), flow("c", 1)})
+	clk.advance(time.Second)
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow("b", 2), flow("c", 2)})
+	clk.advance(time.Second)
+	// a and c are idle; a was seen least recently, so it makes room for d.
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow("b", 3), flow("d", 1)})
+	_ = runner.takeBatch(100)
+	if _, ok := runner.flows["a"]; ok || len(runner.flows) != 3 {
+		t.Fatalf("expected a evicted to make room for d, got %v", runner.flows)
+	}
+	if _, ok := runner.tombstones["a"]; !ok {
+		t.Fatal("expected the evicted flow kept as a tombstone")
+	}
+
+	// Every tracked flow is listed: none is dropped for the new one, which
+	// waits until there is room.
+	clk.advance(time.Second)
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow("b", 4), flow("c", 3), flow("d", 2), flow("e", 5)})
+	if _, ok := runner.flows["e"]; ok || len(runner.flows) != 3 {
+		t.Fatalf("expected e left untracked while listed flows fill the limit, got %v", runner.flows)
+	}
+	for _, u := range runner.takeBatch(100) {
+		if u.Domain == "e.example" {
+			t.Fatalf("expected no update for an untracked flow, got %+v", u)
+		}
+	}
+
+	clk.advance(2 * time.Minute)
+	runner.sweepStaleFlows()
+	stats := runner.buildHeartbeat().Stats
+	if stats.CapEvictions != 1 || stats.StaleEvictions != 3 {
+		t.Fatalf("expected 1 cap eviction and 3 stale evictions, got %d and %d", stats.CapEvictions, stats.StaleEvictions)
+	}
+}
+
+func TestTombstonesAreBounded(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+
+	for i := 0; i < tombstoneLimit+10; i++ {
+		runner.buryFlowLocked(fmt.Sprintf("flow-%d", i), trackedFlow{LastUpload: 1}, clk.Monotonic())
+	}
+	if len(runner.tombstones) != tombstoneLimit || len(runner.tombstoneOrder) != tombstoneLimit {
+		t.Fatalf("expected %d tombstones, got %d", tombstoneLimit, len(runner.tombstones))
+	}
+	if _, ok := runner.tombstones["flow-0"]; ok {
+		t.Fatalf("expected the oldest tombstone evicted first")
+	}
+
+	// Counters below the tombstone's belong to a new flow reusing the ID.
+	if _, ok := runner.reviveFlowLocked(domain.FlowSnapshot{ID: "flow-20", Upload: 0}, clk.Monotonic()); ok {
+		t.Fatalf("expected lower counters not to revive the tombstone")
+	}
+}
+
+func TestStaleFlowsSurviveForwardClockJump(t *testing.T) {
+	clk := newFakeClock(1_000_000)
+	runner := newClockTestRunner(clk)
+
+	flow := domain.FlowSnapshot{ID: "flow-1", Domain: "example.com", Upload: 100, Download: 100, Chains: []string{"Proxy"}}
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	runner.takeBatch(10)
+
+	// Wall clock leaps two hours ahead while only one poll interval passes;
+	// the flow is briefly missing from the gateway response.
+	clk.jump(2 * time.Hour)
+	clk.advance(time.Second)
+	runner.ingestSnapshots(nil)
+
+	clk.advance(time.Second)
+	flow.Upload, flow.Download = 150, 120
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+
+	batch := runner.takeBatch(10)
+	if len(batch) != 1 {
+		t.Fatalf("expected one update, got %d", len(batch))
+	}
+	if batch[0].Upload != 50 || batch[0].Download != 20 {
+		t.Fatalf("expected incremental delta 50/20 after clock jump, got %d/%d", batch[0].Upload, batch[0].Download)
+	}
+	if batch[0].Connections != 0 {
+		t.Fatalf("expected flow not to be re-counted, got %d connections", batch[0].Connections)
+	}
+	if batch[0].DurationMs != 2000 {
+		t.Fatalf("expected monotonic duration 2000ms, got %d", batch[0].DurationMs)
+	}
+	if want := time.UnixMilli(1_000_000).Add(2*time.Hour + 2*time.Second).UnixMilli(); batch[0].TimestampMs != want {
+		t.Fatalf("expected wall-clock timestamp %d, got %d", want, batch[0].TimestampMs)
+	}
+}
+
+func TestStaleFlowsExpireAfterBackwardClockJump(t *testing.T) {
+	clk := newFakeClock(10_000_000)
+	runner := newClockTestRunner(clk)
+
+	runner.ingestSnapshots([]domain.FlowSnapshot{{ID: "flow-1", Upload: 1, Download: 1}})
+
+	// Wall clock steps back an hour; with wall-clock expiry the flow would be
+	// pinned until the clock caught up again.
+	clk.jump(-time.Hour)
+	clk.advance(2 * time.Minute)
+	runner.sweepStaleFlows()
+
+	runner.mu.Lock()
+	_, tracked := runner.flows["flow-1"]
+	runner.mu.Unlock()
+	if tracked {
+		t.Fatal("expected stale flow to expire by monotonic time after backward clock jump")
+	}
+}
+
+func TestShouldApplyUpdate(t *testing.T) {
+	cases := []struct {
+		current, target string
+		force           bool
+		want            bool
+	}{
+		{"agent-v1.3.2", "v1.4.0", false, true},
+		{"agent-v1.3.2", "agent-v1.3.2", false, false},
+		{"agent-v1.4.0", "v1.3.9", false, false},
+		{"agent-v1.4.0", "v1.3.9", true, true},
+		{"dev", "v1.4.0", false, false},
+		{"v1.2", "v1.2.1", false, true},
+		{"v1.2.0", "", true, false},
+	}
+	for _, c := range cases {
+		if got := shouldApplyUpdate(c.current, c.target, c.force); got != c.want {
+			t.Fatalf("shouldApplyUpdate(%q, %q, %v) = %v, want %v", c.current, c.target, c.force, got, c.want)
+		}
+	}
+}
+
+// newUpdateTestRunner returns a runner whose executable is a file holding
+// "old" in a temp dir, and a server that serves "new" as the update.
+func newUpdateTestRunner(t *testing.T) (*Runner, string, *httptest.Server, *atomic.Int32) {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "neko-agent")
+	if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		downloads.Add(1)
+		_, _ = io.WriteString(w, "new")
+	}))
+	t.Cleanup(srv.Close)
+	r := NewRunner(config.Config{AgentID: "agent-test", RequestTimeout: time.Second})
+	r.executable = func() (string, error) { return exe, nil }
+	return r, exe, srv, &downloads
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestInstallUpdateSwapsBinaryKeepingOld(t *testing.T) {
+	r, exe, srv, _ := newUpdateTestRunner(t)
+	got, err := r.installUpdate(context.Background(), heartbeatResponse{DownloadURL: srv.URL + "/neko-agent", SHA256: strings.ToUpper(sha256Hex("new"))})
+	if err != nil || got != exe {
+		t.Fatalf("installUpdate = %q, %v", got, err)
+	}
+	if b := readFile(t, exe); b != "new" {
+		t.Fatalf("expected the new binary installed, got %q", b)
+	}
+	if b := readFile(t, exe+".old"); b != "old" {
+		t.Fatalf("expected the previous binary kept as .old, got %q", b)
+	}
+	if fi, err := os.Stat(exe); err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("expected the new binary to be executable, got %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestInstallUpdateChecksumMismatchKeepsBinary(t *testing.T) {
+	r, exe, srv, downloads := newUpdateTestRunner(t)
+	_, err := r.installUpdate(context.Background(), heartbeatResponse{DownloadURL: srv.URL + "/neko-agent", SHA256: sha256Hex("tampered")})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if downloads.Load() != 1 {
+		t.Fatalf("expected one download, got %d", downloads.Load())
+	}
+	if b := readFile(t, exe); b != "old" {
+		t.Fatalf("expected the binary untouched, got %q", b)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(exe))
+	if len(entries) != 1 {
+		t.Fatalf("expected no .old or temp file left behind, got %v", entries)
+	}
+}
+
+func TestInstallUpdateRequiresSHA256(t *testing.T) {
+	r, exe, srv, downloads := newUpdateTestRunner(t)
+	for _, sum := range []string{"", "   ", sha256Hex("new")[:63], "abc"} {
+		_, err := r.installUpdate(context.Background(), heartbeatResponse{DownloadURL: srv.URL + "/neko-agent", SHA256: sum})
+		if err == nil || !strings.Contains(err.Error(), "sha256") {
+			t.Fatalf("sha256 %q: expected it to be rejected, got %v", sum, err)
+		}
+	}
+	if _, err := r.installUpdate(context.Background(), heartbeatResponse{SHA256: sha256Hex("new")}); err == nil {
+		t.Fatal("expected a missing downloadUrl to be rejected")
+	}
+	if downloads.Load() != 0 || readFile(t, exe) != "old" {
+		t.Fatalf("expected nothing downloaded or replaced, got %d downloads", downloads.Load())
+	}
+}
+
+func TestDownloadToRejectsHTTPErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	r := NewRunner(config.Config{AgentID: "agent-test", RequestTimeout: time.Second})
+	var buf strings.Builder
+	if _, err := r.downloadTo(context.Background(), srv.URL, &buf); err == nil || !strings.Contains(err.Error(), "http 404") {
+		t.Fatalf("expected the 404 to fail the download, got %v", err)
+	}
+}
+
+func TestSelfUpdateDoesNotBlockHeartbeat(t *testing.T) {
+	release := make(chan struct{})
+	var downloads atomic.Int32
+	download := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		downloads.Add(1)
+		<-release
+		_, _ = io.WriteString(w, "new")
+	}))
+	defer download.Close()
+	defer close(release)
+
+	exe := filepath.Join(t.TempDir(), "neko-agent")
+	if err := os.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	heartbeat := fmt.Sprintf(`{"latestVersion":"v99.0.0","force":true,"downloadUrl":%q,"sha256":%q}`, download.URL, sha256Hex("new"))
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusOK, heartbeat), nil
+	})
+	r := NewRunner(config.Config{
+		ServerAPIBase:  "http://master.invalid/api",
+		AgentID:        "agent-test",
+		RequestTimeout: time.Second,
+		SelfUpdate:     true,
+	}, WithServerTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// The download shares the master transport.
+		if req.URL.Host == "master.invalid" {
+			return serverRT(req)
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})))
+	r.executable = func() (string, error) { return exe, nil }
+	stopped := make(chan struct{})
+	r.stop = func() { close(stopped) }
+
+	for i := 0; i < 2; i++ {
+		if err := r.sendHeartbeat(context.Background()); err != nil {
+			t.Fatalf("sendHeartbeat returned error: %v", err)
+		}
+	}
+	waitFor(t, func() bool { return downloads.Load() == 1 })
+	if r.PendingRestart() != "" {
+		t.Fatal("expected no restart before the download finished")
+	}
+
+	release <- struct{}{}
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the runner to stop after installing the update")
+	}
+	if r.PendingRestart() != exe || readFile(t, exe) != "new" || downloads.Load() != 1 {
+		t.Fatalf("expected one download installed at %s, got %q after %d downloads", exe, r.PendingRestart(), downloads.Load())
+	}
+}
+
+// TestReexecProcess is not a real test: TestReexecKeepsArguments re-runs the
+// test binary with it to call Reexec in a process of its own.
+func TestReexecProcess(t *testing.T) {
+	exe := os.Getenv("NEKO_AGENT_REEXEC")
+	if exe == "" {
+		return
+	}
+	err := Reexec(exe)
+	fmt.Println("error:", err)
+	os.Exit(1)
+}
+
+func TestReexecKeepsArguments(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no exec on windows")
+	}
+	script := filepath.Join(t.TempDir(), "next")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$NEKO_AGENT_REEXEC_MARK\" \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReexecProcess$")
+	cmd.Env = append(os.Environ(), "NEKO_AGENT_REEXEC="+script, "NEKO_AGENT_REEXEC_MARK=replaced")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("reexec child: %v, output %q", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != "replaced -test.run=^TestReexecProcess$" {
+		t.Fatalf("expected the new binary to run with the original arguments and environment, got %q", got)
+	}
+}
+
+func TestSelectProtocolVersion(t *testing.T) {
+	if v, err := selectProtocolVersion(protocolResponse{ProtocolVersion: config.AgentProtocolVersion}); err != nil || v != config.AgentProtocolVersion {
+		t.Fatalf("expected explicit version to be accepted, got %d, %v", v, err)
+	}
+	if v, err := selectProtocolVersion(protocolResponse{MinProtocolVersion: 1, MaxProtocolVersion: 99}); err != nil || v != config.AgentProtocolVersion {
+		t.Fatalf("expected highest shared version, got %d, %v", v, err)
+	}
+	if _, err := selectProtocolVersion(protocolResponse{ProtocolVersion: config.AgentProtocolVersion + 1}); !errors.Is(err, ErrProtocolIncompatible) {
+		t.Fatalf("expected incompatible error for newer required version, got %v", err)
+	}
+	if _, err := selectProtocolVersion(protocolResponse{MinProtocolVersion: config.AgentProtocolVersion + 1}); !errors.Is(err, ErrProtocolIncompatible) {
+		t.Fatalf("expected incompatible error when master minimum is too new, got %v", err)
+	}
+}
+
+func TestPostReportFallsBackToJSONOn415(t *testing.T) {
+	var contentTypes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentTypes = append(contentTypes, req.Header.Get("Content-Type"))
+		if req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     server.URL,
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	})
+	runner.setProtocolVersion(2, true)
+
+	payload := &domain.ReportPayload{BackendID: 1, AgentID: "agent-test", ProtocolVersion: 2}
+	for i := 0; i < 2; i++ {
+		if err := runner.postReport(context.Background(), payload); err != nil {
+			t.Fatalf("postReport returned error: %v", err)
+		}
+	}
+
+	want := []string{"application/msgpack", "application/json", "application/json"}
+	if strings.Join(contentTypes, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected content types %v, got %v", want, contentTypes)
+	}
+}
+
+func TestBackoffJitterStaysWithinBounds(t *testing.T) {
+	runner := NewRunner(config.Config{GatewayType: "clash", ReportBatchSize: 1, BackoffJitter: true})
+	for failures := 0; failures < 8; failures++ {
+		upper := calculateBackoff(time.Second, failures, 30*time.Second)
+		for i := 0; i < 50; i++ {
+			d := runner.backoff(time.Second, failures, 30*time.Second)
+			if d < time.Second || d > upper {
+				t.Fatalf("backoff(%d) = %v, want within [1s, %v]", failures, d, upper)
+			}
+		}
+	}
+}
+
+func TestIntervalJitterAveragesToConfiguredPeriod(t *testing.T) {
+	const period = 2 * time.Second
+	runner := NewRunner(config.Config{GatewayType: "clash", ReportBatchSize: 1, IntervalJitter: 0.1})
+
+	const samples = 20000
+	var sum time.Duration
+	lo, hi := period, period
+	for i := 0; i < samples; i++ {
+		d := runner.jittered(period)
+		if d < period*9/10 || d > period*11/10 {
+			t.Fatalf("jittered(%v) = %v, want within +/-10%%", period, d)
+		}
+		sum += d
+		lo, hi = min(lo, d), max(hi, d)
+	}
+	// The mean of 20000 uniform draws over +/-200ms has a standard error
+	// under 1ms, so 20ms is far outside chance.
+	if mean := sum / samples; mean < period-20*time.Millisecond || mean > period+20*time.Millisecond {
+		t.Fatalf("mean period %v, want about %v", mean, period)
+	}
+	if lo > period*96/100 || hi < period*104/100 {
+		t.Fatalf("expected draws to spread across the range, got [%v, %v]", lo, hi)
+	}
+
+	runner.cfg.IntervalJitter = 0
+	if d := runner.jittered(period); d != period {
+		t.Fatalf("expected no jitter when disabled, got %v", d)
+	}
+}
+
+func TestServerRequestsReuseConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:             server.URL,
+		GatewayType:               "clash",
+		RequestTimeout:            time.Second,
+		ReportBatchSize:           10,
+		ServerMaxIdleConnsPerHost: 2,
+		ServerIdleConnTimeout:     time.Minute,
+	})
+	for i := 0; i < 3; i++ {
+		if err := runner.postJSON(context.Background(), "/agent/heartbeat", map[string]int{"i": i}); err != nil {
+			t.Fatalf("postJSON returned error: %v", err)
+		}
+	}
+	reused, fresh := runner.conns.snapshot()
+	if fresh != 1 || reused != 2 {
+		t.Fatalf("expected 1 new and 2 reused connections, got %d new and %d reused", fresh, reused)
+	}
+}
+
+func TestSkewEstimatorSmoothsDateHeaderSamples(t *testing.T) {
+	var s skewEstimator
+	local := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	serverDate := local.Add(90 * time.Second).Format(http.TimeFormat)
+
+	first, ok := s.observe(serverDate, local, local)
+	if !ok || first != 90500 {
+		t.Fatalf("expected first sample 90500ms, got %d (ok=%v)", first, ok)
+	}
+	// A single outlier only moves the estimate by skewAlpha of the difference.
+	outlier := local.Add(190 * time.Second).Format(http.TimeFormat)
+	if got, _ := s.observe(outlier, local, local); got != 110500 {
+		t.Fatalf("expected smoothed offset 110500ms, got %d", got)
+	}
+	if _, ok := s.observe("not a date", local, local); ok {
+		t.Fatal("expected invalid Date header to be ignored")
+	}
+}
+
+func TestReverseResolverCachesNamesFailuresAndTimeouts(t *testing.T) {
+	rr := newReverseResolver(config.Config{ReverseDNS: true, ReverseDNSWorkers: 2, ReverseDNSTimeout: 20 * time.Millisecond})
+	var callsMu sync.Mutex
+	calls := map[string]int{}
+	rr.lookup = func(ctx context.Context, addr string) ([]string, error) {
+		callsMu.Lock()
+		calls[addr]++
+		callsMu.Unlock()
+		switch addr {
+		case "1.1.1.1":
+			return []string{"one.one.one.one."}, nil
+		case "192.0.2.1":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("no such host")
+	}
+
+	ips := []string{"1.1.1.1", "10.0.0.1", "192.0.2.1"}
+	for _, ip := range ips {
+		if name := rr.name(ip); name != "" {
+			t.Fatalf("expected no name before lookup completes, got %q", name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go rr.run(ctx, &wg)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rr.mu.Lock()
+		n := len(rr.cache)
+		rr.mu.Unlock()
+		if n == len(ips) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if got := rr.name("1.1.1.1"); got != "one.one.one.one" {
+		t.Fatalf("expected PTR name one.one.one.one, got %q", got)
+	}
+	if got := rr.name("10.0.0.1"); got != "" {
+		t.Fatalf("expected failed lookup to resolve to nothing, got %q", got)
+	}
+	if got := rr.name("192.0.2.1"); got != "" {
+		t.Fatalf("expected timed-out lookup to resolve to nothing, got %q", got)
+	}
+	if calls["10.0.0.1"] != 1 || calls["192.0.2.1"] != 1 || len(rr.queue) != 0 {
+		t.Fatalf("expected failures to be negatively cached, got calls %v and %d queued", calls, len(rr.queue))
+	}
+}
+
+func TestIngestFillsDomainFromReverseDNSCache(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+	r.rdns = newReverseResolver(config.Config{ReverseDNS: true, ReverseDNSWorkers: 1, ReverseDNSTimeout: time.Second})
+	r.rdns.cache["1.1.1.1"] = rdnsEntry{name: "one.one.one.one", expires: time.Now().Add(time.Hour)}
+
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", IP: "1.1.1.1", Chains: []string{"DIRECT"}, Upload: 10},
+		{ID: "b", IP: "9.9.9.9", Domain: "dns.quad9.net", Chains: []string{"DIRECT"}, Upload: 10},
+	})
+	clk.advance(time.Second)
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", IP: "1.1.1.1", Chains: []string{"DIRECT"}, Upload: 20},
+		{ID: "b", IP: "9.9.9.9", Domain: "dns.quad9.net", Chains: []string{"DIRECT"}, Upload: 20},
+	})
+	batch := r.takeBatch(10)
+	if len(batch) != 4 {
+		t.Fatalf("expected 4 updates, got %d", len(batch))
+	}
+	for _, u := range batch {
+		switch u.IP {
+		case "1.1.1.1":
+			if u.Domain != "one.one.one.one" || u.DomainSource != domainSourceRDNS {
+				t.Fatalf("expected rdns domain, got %q (%q)", u.Domain, u.DomainSource)
+			}
+		default:
+			if u.Domain != "dns.quad9.net" || u.DomainSource != "" {
+				t.Fatalf("expected gateway domain untagged, got %q (%q)", u.Domain, u.DomainSource)
+			}
+		}
+	}
+}
+
+func TestTakeBatchDropsExpiredUpdates(t *testing.T) {
+	clk := newFakeClock(10_000_000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.MaxUpdateAge = time.Minute
+
+	now := clk.Now().UnixMilli()
+	runner.queue.push([]domain.TrafficUpdate{
+		{Domain: "old-1", TimestampMs: now - 2*time.Minute.Milliseconds()},
+		{Domain: "old-2", TimestampMs: now - 61*time.Second.Milliseconds()},
+		{Domain: "fresh-1", TimestampMs: now - 30*time.Second.Milliseconds()},
+		{Domain: "fresh-2", TimestampMs: now},
+		{Domain: "fresh-3", TimestampMs: now},
+	})
+
+	batch := runner.takeBatch(2)
+	if len(batch) != 2 || batch[0].Domain != "fresh-1" || batch[1].Domain != "fresh-2" {
+		t.Fatalf("expected batch [fresh-1 fresh-2], got %+v", batch)
+	}
+	if got := runner.buildHeartbeat().Stats.Expired; got != 2 {
+		t.Fatalf("expected 2 expired updates in heartbeat stats, got %d", got)
+	}
+	if rest := runner.takeBatch(10); len(rest) != 1 || rest[0].Domain != "fresh-3" {
+		t.Fatalf("expected remaining [fresh-3], got %+v", rest)
+	}
+}
+
+func TestProxyCountMonitorWarnsOnSharpDrop(t *testing.T) {
+	snap := &domain.GatewayConfigSnapshot{Proxies: map[string]domain.GatewayProxy{
+		"GLOBAL": {Name: "GLOBAL", Type: "Selector", Now: "HK-01"},
+		"DIRECT": {Name: "DIRECT", Type: "Direct"},
+		"Auto":   {Name: "Auto", Type: "URLTest", Now: "JP-01"},
+	}}
+	for i := 0; i < 20; i++ {
+		name := "node-" + strconv.Itoa(i)
+		snap.Proxies[name] = domain.GatewayProxy{Name: name, Type: "Shadowsocks"}
+	}
+	if n := countLeafProxies(snap); n != 20 {
+		t.Fatalf("expected 20 leaf proxies, got %d", n)
+	}
+
+	var m proxyCountMonitor
+	for _, count := range []int{20, 21, 19, 20} {
+		if w, _ := m.observe(count, 0.5); w != "" {
+			t.Fatalf("expected no warning for count %d, got %q", count, w)
+		}
+	}
+	w, changed := m.observe(3, 0.5)
+	if w == "" || !changed {
+		t.Fatalf("expected warning on drop to 3, got %q (changed=%v)", w, changed)
+	}
+	if w, changed = m.observe(3, 0.5); w == "" || changed {
+		t.Fatalf("expected persistent unchanged warning, got %q (changed=%v)", w, changed)
+	}
+	if w, changed = m.observe(20, 0.5); w != "" || !changed {
+		t.Fatalf("expected warning to clear on recovery, got %q (changed=%v)", w, changed)
+	}
+	if w, _ = m.observe(3, 0); w != "" {
+		t.Fatalf("expected threshold 0 to disable warnings, got %q", w)
+	}
+}
+
+func TestIngestSnapshotsRejectsImplausibleDeltas(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.MaxPollDelta = 1000
+
+	flow := domain.FlowSnapshot{ID: "flow-1", Domain: "example.com", Upload: 5000, Download: 10}
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	if batch := runner.takeBatch(10); len(batch) != 1 || batch[0].Upload != 5000 {
+		t.Fatalf("expected first-seen delta to bypass the ceiling, got %+v", batch)
+	}
+
+	clk.advance(time.Second)
+	flow.Upload, flow.Download = 5000+1<<40, 20
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	if batch := runner.takeBatch(10); len(batch) != 0 {
+		t.Fatalf("expected oversized delta to be dropped, got %+v", batch)
+	}
+
+	runner.cfg.ImplausibleDelta = "clamp"
+	clk.advance(time.Second)
+	flow.Upload, flow.Download = flow.Upload+5000, 30
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	batch := runner.takeBatch(10)
+	if len(batch) != 1 || batch[0].Upload != 1000 || batch[0].Download != 10 {
+		t.Fatalf("expected clamped delta 1000/10, got %+v", batch)
+	}
+
+	clk.advance(time.Second)
+	runner.ingestSnapshots([]domain.FlowSnapshot{{ID: "flow-2", Upload: math.MaxInt64, Download: 1}})
+	if batch := runner.takeBatch(10); len(batch) != 0 {
+		t.Fatalf("expected saturated counter to be dropped even when clamping, got %+v", batch)
+	}
+	if got := runner.buildHeartbeat().Stats.ImplausibleDeltas; got != 3 {
+		t.Fatalf("expected 3 implausible deltas counted, got %d", got)
+	}
+}
+
+func TestRevivedFlowDeltaIsChecked(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.MaxPollDelta = 1000
+	runner.cfg.TombstoneTTL = 10 * time.Minute
+
+	flow := domain.FlowSnapshot{ID: "flow-1", Domain: "example.com", Upload: 100, Download: 200}
+	runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+	_ = runner.takeBatch(10)
+	clk.advance(2 * time.Minute)
+	runner.sweepStaleFlows()
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Three garbage jumps: the first revives the flow, the second is within a
+	// minute of the first warning and the third after it.
+	for _, wait := range []time.Duration{time.Second, time.Second, time.Minute} {
+		clk.advance(wait)
+		flow.Upload += 1 << 40
+		runner.ingestSnapshots([]domain.FlowSnapshot{flow})
+		if batch := runner.takeBatch(10); len(batch) != 0 {
+			t.Fatalf("expected the oversized delta dropped, got %+v", batch)
+		}
+	}
+	if got := runner.buildHeartbeat().Stats.ImplausibleDeltas; got != 3 {
+		t.Fatalf("expected 3 implausible deltas counted, got %d", got)
+	}
+	if got := strings.Count(logs.String(), "implausible delta"); got != 2 {
+		t.Fatalf("expected 2 warnings with a minute between them, got %d:\n%s", got, logs.String())
+	}
+}
+
+func TestDeltaCeilingDefaultsToTenGbps(t *testing.T) {
+	runner := newClockTestRunner(newFakeClock(0))
+	if got, want := runner.deltaCeiling(0), int64(1_250_000_000); got != want {
+		t.Fatalf("expected ceiling %d for one poll interval, got %d", want, got)
+	}
+	if got, want := runner.deltaCeiling(4*time.Second), int64(5_000_000_000); got != want {
+		t.Fatalf("expected ceiling %d after a 4s gap, got %d", want, got)
+	}
+}
+
+func TestHeartbeatCommandsRunOnceAndReportResults(t *testing.T) {
+	var gatewayCalls []string
+	gatewayServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/configs":
+			// Read by the heartbeat for the Clash mode.
+			_, _ = w.Write([]byte(`{"mode":"rule"}`))
+			return
+		case "/version":
+			// Read by the heartbeat for the core version.
+			_, _ = w.Write([]byte(`{"version":"1.0.0"}`))
+			return
+		}
+		gatewayCalls = append(gatewayCalls, req.Method+" "+req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer gatewayServer.Close()
+
+	var results []commandResult
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/agent/heartbeat":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"commands":[{"id":"c1","type":"close-connection","connectionId":"conn-1"},{"id":"c2","type":"reboot"}]}`))
+		case "/agent/commands/result":
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Errorf("result body is not gzip: %v", err)
+				return
+			}
+			var payload commandResultPayload
+			if err := json.NewDecoder(zr).Decode(&payload); err != nil {
+				t.Errorf("decode results: %v", err)
+			}
+			results = append(results, payload.Results...)
+		}
+	}))
+	defer master.Close()
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     master.URL,
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   gatewayServer.URL,
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+		AllowCommands:     true,
+	})
+	for i := 0; i < 2; i++ {
+		if err := runner.sendHeartbeat(context.Background()); err != nil {
+			t.Fatalf("sendHeartbeat returned error: %v", err)
+		}
+	}
+
+	if len(gatewayCalls) != 1 || gatewayCalls[0] != "DELETE /connections/conn-1" {
+		t.Fatalf("expected a single DELETE /connections/conn-1, got %v", gatewayCalls)
+	}
+	// The second heartbeat delivered both again: neither runs twice, and both
+	// results are sent again.
+	if len(results) != 4 || !results[0].OK || results[1].OK || results[1].Error == "" || !reflect.DeepEqual(results[2:], results[:2]) {
+		t.Fatalf("expected c1 ok and c2 failed, twice, got %+v", results)
+	}
+}
+
+func TestCommandResultResentAfterLostPost(t *testing.T) {
+	var deletes atomic.Int32
+	gatewayServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			deletes.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	defer gatewayServer.Close()
+
+	resultPosts := 0
+	var delivered []commandResult
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/agent/heartbeat") {
+			// The master keeps delivering c1 until it has its result.
+			if len(delivered) > 0 {
+				return jsonResponse(req, http.StatusOK, `{}`), nil
+			}
+			return jsonResponse(req, http.StatusOK, `{"commands":[{"id":"c1","type":"close-connection","connectionId":"conn-1"}]}`), nil
+		}
+		resultPosts++
+		if resultPosts == 1 {
+			return jsonResponse(req, http.StatusBadGateway, "bad gateway"), nil
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		var payload commandResultPayload
+		if err := json.NewDecoder(zr).Decode(&payload); err != nil {
+			return nil, err
+		}
+		delivered = payload.Results
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	runner := NewRunner(config.Config{
+		ServerAPIBase:   "http://master.invalid/api",
+		BackendID:       1,
+		AgentID:         "agent-test",
+		GatewayType:     "clash",
+		GatewayEndpoint: gatewayServer.URL,
+		RequestTimeout:  time.Second,
+		AllowCommands:   true,
+	}, WithServerTransport(serverRT))
+
+	for i := 0; i < 3; i++ {
+		if err := runner.sendHeartbeat(context.Background()); err != nil {
+			t.Fatalf("sendHeartbeat returned error: %v", err)
+		}
+	}
+	if n := deletes.Load(); n != 1 {
+		t.Fatalf("expected c1 to run once, got %d DELETEs", n)
+	}
+	if resultPosts != 2 || len(delivered) != 1 || delivered[0].ID != "c1" || !delivered[0].OK {
+		t.Fatalf("expected c1's result re-sent after the lost post, got %d posts delivering %+v", resultPosts, delivered)
+	}
+}
+
+func TestHeartbeatReportsMihomoCore(t *testing.T) {
+	gatewayServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/version":
+			_, _ = w.Write([]byte(`{"meta":true,"version":"v1.18.5"}`))
+		case "/memory":
+			_, _ = w.Write([]byte("{\"inuse\":0}\n{\"inuse\":1048576}\n"))
+		case "/configs":
+			_, _ = w.Write([]byte(`{"mode":"rule"}`))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer gatewayServer.Close()
+
+	var heartbeat heartbeatPayload
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			t.Errorf("heartbeat body is not gzip: %v", err)
+			return
+		}
+		if err := json.NewDecoder(zr).Decode(&heartbeat); err != nil {
+			t.Errorf("decode heartbeat: %v", err)
+		}
+	}))
+	defer master.Close()
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     master.URL,
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   gatewayServer.URL,
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	})
+	runner.setProtocolVersion(2, false)
+	if err := runner.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat returned error: %v", err)
+	}
+	if heartbeat.GatewayType != "clash" || heartbeat.GatewayCore != "mihomo" || heartbeat.GatewayVersion != "v1.18.5" {
+		t.Fatalf("expected the mihomo core reported, got %+v", heartbeat)
+	}
+	if heartbeat.GatewayMemory != 1048576 {
+		t.Fatalf("expected core memory 1048576, got %d", heartbeat.GatewayMemory)
+	}
+}
+
+func TestIngestSnapshotsSanitizesUpdates(t *testing.T) {
+	runner := newClockTestRunner(newFakeClock(1000))
+	chains := make([]string, 20)
+	for i := range chains {
+		chains[i] = strings.Repeat("c", 100)
+	}
+	runner.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "bad", Domain: " \x00 ", IP: "not-an-ip", Upload: 1},
+		{ID: "ok", Domain: "exa\tmple.com", IP: "::ffff:10.0.0.1", Chains: chains, RulePayload: strings.Repeat("p", 600), Upload: 1},
+	})
+
+	batch := runner.takeBatch(10)
+	if len(batch) != 1 {
+		t.Fatalf("expected the update without domain or IP to be dropped, got %d updates", len(batch))
+	}
+	u := batch[0]
+	if u.Domain != "example.com" || u.IP != "10.0.0.1" {
+		t.Fatalf("expected sanitized domain/IP example.com/10.0.0.1, got %q/%q", u.Domain, u.IP)
+	}
+	if len(u.Chains) != domain.MaxChains || len(u.Chains[0]) != domain.MaxChainLen || len(u.RulePayload) != domain.MaxRulePayloadLen {
+		t.Fatalf("expected capped chains and rule payload, got %d chains of %d bytes, payload %d bytes", len(u.Chains), len(u.Chains[0]), len(u.RulePayload))
+	}
+	if got := runner.buildHeartbeat().Stats.InvalidUpdates; got != 1 {
+		t.Fatalf("expected 1 invalid update counted, got %d", got)
+	}
+}
+
+func TestSelectProxyValidatesAgainstPolicyState(t *testing.T) {
+	var puts []string
+	gatewayServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			body, _ := io.ReadAll(req.Body)
+			puts = append(puts, req.URL.Path+" "+string(body))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"proxies":{
+			"GLOBAL":{"name":"GLOBAL","type":"Selector","now":"HK"},
+			"HK":{"name":"HK","type":"Shadowsocks"},
+			"JP":{"name":"JP","type":"Shadowsocks"}}}`))
+	}))
+	defer gatewayServer.Close()
+
+	runner := NewRunner(config.Config{
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   gatewayServer.URL,
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+		AllowCommands:     true,
+		DisablePolicySync: true,
+	})
+	ctx := context.Background()
+
+	if err := runner.executeCommand(ctx, agentCommand{Type: "select-proxy", Group: "GLOBAL", Proxy: "JP"}); err != nil {
+		t.Fatalf("expected selection to succeed, got %v", err)
+	}
+	for _, cmd := range []agentCommand{
+		{Type: "select-proxy", Group: "GLOBAL", Proxy: "US"},
+		{Type: "select-proxy", Group: "Nope", Proxy: "JP"},
+		{Type: "select-proxy", Group: "HK", Proxy: "JP"},
+	} {
+		if err := runner.executeCommand(ctx, cmd); err == nil {
+			t.Fatalf("expected %s -> %s to be rejected", cmd.Group, cmd.Proxy)
+		}
+	}
+	if len(puts) != 1 || puts[0] != `/proxies/GLOBAL {"name":"JP"}` {
+		t.Fatalf("expected a single PUT selecting JP, got %v", puts)
+	}
+}
+
+func TestSamplingScalesFlowsAndKeepsExactChainTotals(t *testing.T) {
+	runner := newClockTestRunner(newFakeClock(1000))
+	runner.cfg.SamplingRate = 0.25
+
+	snapshots := make([]domain.FlowSnapshot, 400)
+	for i := range snapshots {
+		snapshots[i] = domain.FlowSnapshot{ID: "flow-" + strconv.Itoa(i), Domain: "example.com", Upload: 100, Download: 10, Chains: []string{"Proxy"}}
+	}
+	runner.ingestSnapshots(snapshots)
+	runner.queueChainTotals()
+
+	var sampled int
+	var aggregate *domain.TrafficUpdate
+	for _, u := range runner.takeBatch(1000) {
+		switch {
+		case u.Aggregate:
+			u := u
+			aggregate = &u
+		case u.Sampled:
+			sampled++
+			if u.SampleRate != 0.25 || u.Upload != 400 || u.Download != 40 || u.Connections != 4 {
+				t.Fatalf("expected scaled sampled update 400/40 x4 at rate 0.25, got %+v", u)
+			}
+		default:
+			t.Fatalf("expected only sampled or aggregate updates, got %+v", u)
+		}
+	}
+	if sampled < 60 || sampled > 140 {
+		t.Fatalf("expected roughly 100 of 400 flows sampled, got %d", sampled)
+	}
+	if aggregate == nil || aggregate.Chain != "Proxy" || aggregate.Upload != 40000 || aggregate.Download != 4000 || aggregate.Connections != 400 {
+		t.Fatalf("expected exact Proxy aggregate 40000/4000 x400, got %+v", aggregate)
+	}
+}
+
+func TestNextPollIntervalAdaptsToCollectDuration(t *testing.T) {
+	runner := newClockTestRunner(newFakeClock(0))
+	if got := runner.nextPollInterval(2*time.Second, time.Minute); got != time.Second {
+		t.Fatalf("expected fixed interval when adaptive polling is off, got %v", got)
+	}
+
+	runner.cfg.GatewayPollMin = 2 * time.Second
+	runner.cfg.GatewayPollMax = 10 * time.Second
+	runner.cfg.SlowCollectThreshold = 400 * time.Millisecond
+
+	cur := 2 * time.Second
+	for _, want := range []time.Duration{4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if cur = runner.nextPollInterval(cur, time.Second); cur != want {
+			t.Fatalf("expected slow collect to grow interval to %v, got %v", want, cur)
+		}
+	}
+	if got := runner.nextPollInterval(cur, 300*time.Millisecond); got != cur {
+		t.Fatalf("expected moderate collect to keep %v, got %v", cur, got)
+	}
+	for _, want := range []time.Duration{7500 * time.Millisecond, 5625 * time.Millisecond} {
+		if cur = runner.nextPollInterval(cur, 50*time.Millisecond); cur != want {
+			t.Fatalf("expected fast collect to shrink interval to %v, got %v", want, cur)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		cur = runner.nextPollInterval(cur, 50*time.Millisecond)
+	}
+	if cur != 2*time.Second {
+		t.Fatalf("expected interval to settle at the 2s minimum, got %v", cur)
+	}
+}
+
+func TestSourceGranularityAggregatesBySourceAndChain(t *testing.T) {
+	clk := newFakeClock(1000)
+	runner := newClockTestRunner(clk)
+	runner.granularity = granularitySource
+
+	runner.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", SourceIP: "192.168.1.2", Upload: 10, Download: 100, Chains: []string{"Proxy"}},
+		{ID: "b", Domain: "b.com", SourceIP: "192.168.1.2", Upload: 5, Download: 50, Chains: []string{"Proxy"}},
+		{ID: "c", Domain: "c.com", SourceIP: "192.168.1.3", Upload: 1, Download: 1, Chains: []string{"DIRECT"}},
+	})
+	clk.advance(time.Second)
+	runner.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", SourceIP: "192.168.1.2", Upload: 20, Download: 200, Chains: []string{"Proxy"}},
+	})
+	if batch := runner.takeBatch(10); len(batch) != 0 {
+		t.Fatalf("expected nothing queued before the report tick, got %+v", batch)
+	}
+
+	runner.queueSourceTotals()
+	got := map[string]domain.TrafficUpdate{}
+	for _, u := range runner.takeBatch(10) {
+		got[u.SourceIP+"|"+u.Chain] = u
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 source buckets, got %+v", got)
+	}
+	if u := got["192.168.1.2|Proxy"]; u.Upload != 25 || u.Download != 250 || u.Connections != 2 || u.Domain != "" {
+		t.Fatalf("expected 192.168.1.2/Proxy 25/250 x2 without domain, got %+v", u)
+	}
+	if u := got["192.168.1.3|DIRECT"]; u.Upload != 1 || u.Download != 1 || u.Connections != 1 {
+		t.Fatalf("expected 192.168.1.3/DIRECT 1/1 x1, got %+v", u)
+	}
+}
+
+func TestIngestSnapshotsSortsUpdatesDeterministically(t *testing.T) {
+	snapshots := []domain.FlowSnapshot{
+		{ID: "c", Domain: "c.com", Upload: 1, TimestampMs: 2000},
+		{ID: "b", Domain: "b.com", Upload: 1, TimestampMs: 1000},
+		{ID: "a", Domain: "a.com", Upload: 1, TimestampMs: 2000},
+	}
+	order := func(preserve bool) string {
+		runner := newClockTestRunner(newFakeClock(5000))
+		runner.cfg.PreserveGatewayOrder = preserve
+		runner.ingestSnapshots(snapshots)
+		var ids []string
+		for _, u := range runner.takeBatch(10) {
+			ids = append(ids, u.Domain)
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := order(false); got != "b.com,a.com,c.com" {
+		t.Fatalf("expected sorted order b.com,a.com,c.com, got %s", got)
+	}
+	if got := order(true); got != "c.com,b.com,a.com" {
+		t.Fatalf("expected gateway order c.com,b.com,a.com, got %s", got)
+	}
+}
+
+func TestRuleStatsWindowResetsOnlyAfterSuccess(t *testing.T) {
+	fail := true
+	var got ruleStatsPayload
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		zr, _ := gzip.NewReader(req.Body)
+		_ = json.NewDecoder(zr).Decode(&got)
+	}))
+	defer master.Close()
+
+	clk := newFakeClock(60_000)
+	runner := newClockTestRunner(clk)
+	runner.cfg.ServerAPIBase = master.URL
+	runner.cfg.ReportRuleStats = true
+
+	runner.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", Rule: "DomainSuffix", RulePayload: "a.com", Chains: []string{"Proxy"}, Upload: 10, Download: 100},
+		{ID: "b", Domain: "b.com", Rule: "Match", Chains: []string{"DIRECT"}, Upload: 1, Download: 2},
+	})
+	clk.advance(time.Minute)
+	if err := runner.flushRuleStats(context.Background()); err == nil {
+		t.Fatal("expected flush to fail against 502")
+	}
+
+	runner.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", Rule: "DomainSuffix", RulePayload: "a.com", Chains: []string{"Proxy"}, Upload: 15, Download: 150},
+	})
+	clk.advance(time.Minute)
+	fail = false
+	if err := runner.flushRuleStats(context.Background()); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+
+	if got.WindowStartMs != 60_000 || got.WindowEndMs != 180_000 {
+		t.Fatalf("expected window 60000-180000 spanning the failed attempt, got %d-%d", got.WindowStartMs, got.WindowEndMs)
+	}
+	want := []ruleStatEntry{
+		{Rule: "DomainSuffix", RulePayload: "a.com", Chain: "Proxy", Upload: 15, Download: 150, Flows: 1},
+		{Rule: "Match", Chain: "DIRECT", Upload: 1, Download: 2, Flows: 1},
+	}
+	if !reflect.DeepEqual(got.Rules, want) {
+		t.Fatalf("expected rules %+v, got %+v", want, got.Rules)
+	}
+
+	runner.mu.Lock()
+	pending := len(runner.ruleStats)
+	runner.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected window reset after success, %d entries left", pending)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func jsonResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+func TestRunnerWithInjectedTransports(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/connections" {
+			t.Errorf("unexpected gateway request %s", req.URL.Path)
+		}
+		return jsonResponse(req, http.StatusOK, `{"connections":[{"id":"c1","upload":10,"download":20,"chains":["Proxy"],"rule":"Match","metadata":{"host":"example.com"}}]}`), nil
+	})
+	var reported domain.ReportPayload
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.NewDecoder(zr).Decode(&reported); err != nil {
+			return nil, err
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   "http://gateway.invalid",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	snapshots, err := runner.gatewayClient.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	runner.ingestSnapshots(snapshots)
+	if err := runner.flushOnce(context.Background()); err != nil {
+		t.Fatalf("flushOnce returned error: %v", err)
+	}
+	if len(reported.Updates) != 1 || reported.Updates[0].Domain != "example.com" || reported.Updates[0].Download != 20 {
+		t.Fatalf("expected one example.com update with 20 bytes down, got %+v", reported.Updates)
+	}
+}
+
+func TestSnapshotHashIgnoresMapOrder(t *testing.T) {
+	names := make([]string, 200)
+	for i := range names {
+		names[i] = fmt.Sprintf("proxy-%03d", i)
+	}
+	build := func(order []string, ts int64) *domain.GatewayConfigSnapshot {
+		snap := &domain.GatewayConfigSnapshot{
+			Rules:     []domain.GatewayRule{{Type: "Match", Proxy: "Proxy", Raw: "MATCH,Proxy"}},
+			Proxies:   make(map[string]domain.GatewayProxy),
+			Providers: make(map[string]domain.GatewayProvider),
+			Timestamp: ts,
+		}
+		for _, name := range order {
+			snap.Proxies[name] = domain.GatewayProxy{Name: name, Type: "Shadowsocks"}
+			snap.Providers[name] = domain.GatewayProvider{Name: name, Type: "HTTP"}
+		}
+		return snap
+	}
+	want := snapshotHash(build(names, 1))
+	if len(want) != 64 {
+		t.Fatalf("expected a hex SHA-256, got %q", want)
+	}
+
+	reversed := make([]string, len(names))
+	for i, name := range names {
+		reversed[len(names)-1-i] = name
+	}
+	for i := 0; i < 10; i++ {
+		order := reversed
+		if i%2 == 1 {
+			order = append([]string(nil), names...)
+			rand.New(rand.NewSource(int64(i))).Shuffle(len(order), func(a, b int) { order[a], order[b] = order[b], order[a] })
+		}
+		if got := snapshotHash(build(order, int64(i+2))); got != want {
+			t.Fatalf("hash changed with insertion order or timestamp: %s != %s", got, want)
+		}
+	}
+
+	changed := build(names, 1)
+	changed.Proxies["proxy-000"] = domain.GatewayProxy{Name: "proxy-000", Type: "Vmess"}
+	if snapshotHash(changed) == want {
+		t.Fatal("expected a changed proxy to change the hash")
+	}
+}
+
+func TestConfigAndPolicySyncsRunConcurrently(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/rules":
+			return jsonResponse(req, http.StatusOK, `{"rules":[{"type":"Match","payload":"","proxy":"Proxy"}]}`), nil
+		case "/proxies":
+			return jsonResponse(req, http.StatusOK, `{"proxies":{"Proxy":{"name":"Proxy","type":"Selector","now":"HK"},"HK":{"name":"HK","type":"Shadowsocks"}}}`), nil
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	var mu sync.Mutex
+	posts := make(map[string]int)
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		posts[strings.TrimPrefix(req.URL.Path, "/api")]++
+		mu.Unlock()
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   "http://gateway.invalid",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	// Run with -race: the hashes are shared between both syncs.
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := runner.syncConfig(ctx); err != nil {
+				t.Errorf("syncConfig returned error: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := runner.syncPolicyState(ctx); err != nil {
+				t.Errorf("syncPolicyState returned error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	configPosts, policyPosts := posts["/agent/config"], posts[policyStatePath]
+	mu.Unlock()
+	if configPosts == 0 || policyPosts == 0 {
+		t.Fatalf("expected both snapshots posted, got %v", posts)
+	}
+
+	// With the hashes recorded, unchanged snapshots are not posted again.
+	if err := runner.syncConfig(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.syncPolicyState(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if posts["/agent/config"] != configPosts || posts[policyStatePath] != policyPosts {
+		t.Fatalf("expected no posts for unchanged snapshots, got %v", posts)
+	}
+}
+
+func TestASNEnricherCachesAndClassifiesDatacenters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "datacenter.txt")
+	if err := os.WriteFile(path, []byte("# hosting\nAS16509\n14061 # DigitalOcean\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := loadASNList(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading ASN list: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 ASNs, got %d", len(list))
+	}
+
+	lookups := 0
+	a := &asnEnricher{
+		lookup: func(addr netip.Addr) (int64, string) {
+			lookups++
+			if addr.String() == "3.3.3.3" {
+				return 16509, "AMAZON-02"
+			}
+			return 0, ""
+		},
+		datacenter: list,
+		cache:      map[string]asnInfo{},
+	}
+	if got := a.info("3.3.3.3"); got != (asnInfo{Number: 16509, Org: "AMAZON-02", Datacenter: true}) {
+		t.Fatalf("unexpected info %+v", got)
+	}
+	a.info("3.3.3.3")
+	if got := a.info("10.0.0.1"); got != (asnInfo{}) {
+		t.Fatalf("expected unknown ASN, got %+v", got)
+	}
+	if hits, misses := a.cacheStats(); hits != 1 || misses != 2 || lookups != 2 {
+		t.Fatalf("expected 1 hit, 2 misses and 2 lookups, got %d, %d and %d", hits, misses, lookups)
+	}
+
+	if err := os.WriteFile(path, []byte("AS-foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadASNList(path); err == nil {
+		t.Fatal("expected invalid ASN line to be rejected")
+	}
+}
+
+func TestIngestSnapshotsCollapsesDuplicateIDs(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 100, Download: 100},
+	})
+	r.takeBatch(10)
+
+	clk.advance(time.Second)
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 150, Download: 200},
+		{ID: "b", Domain: "example.org", Chains: []string{"DIRECT"}, Upload: 5},
+		{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 10, Download: 10},
+	})
+	batch := r.takeBatch(10)
+	if len(batch) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(batch))
+	}
+	for _, u := range batch {
+		if u.Domain == "example.com" && (u.Upload != 50 || u.Download != 100) {
+			t.Fatalf("expected delta 50/100 from the larger duplicate, got %d/%d", u.Upload, u.Download)
+		}
+	}
+	if f := r.flows["a"]; f.LastUpload != 150 || f.LastDown != 200 {
+		t.Fatalf("expected tracked counters 150/200, got %d/%d", f.LastUpload, f.LastDown)
+	}
+}
+
+func TestTimestampSourceAgentIgnoresGatewayClock(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	snapshots := []domain.FlowSnapshot{
+		{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 1, TimestampMs: 946_684_800_000},
+	}
+
+	r := newClockTestRunner(clk)
+	r.ingestSnapshots(snapshots)
+	if got := r.takeBatch(10)[0].TimestampMs; got != 946_684_800_000 {
+		t.Fatalf("expected gateway timestamp by default, got %d", got)
+	}
+
+	r = newClockTestRunner(clk)
+	r.cfg.TimestampSource = "agent"
+	r.ingestSnapshots(snapshots)
+	if got := r.takeBatch(10)[0].TimestampMs; got != 1_700_000_000_000 {
+		t.Fatalf("expected agent timestamp, got %d", got)
+	}
+}
+
+func TestIngestClampsOutOfRangeGatewayTimestamps(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+	r.cfg.MaxTimestampSkew = time.Hour
+
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", Chains: []string{"DIRECT"}, Upload: 1, TimestampMs: 1_000},
+		{ID: "b", Domain: "b.com", Chains: []string{"DIRECT"}, Upload: 1, TimestampMs: 4_070_908_800_000},
+		{ID: "c", Domain: "c.com", Chains: []string{"DIRECT"}, Upload: 1, TimestampMs: 1_700_000_000_000 - 30*60*1000},
+	})
+	got := map[string]int64{}
+	for _, u := range r.takeBatch(10) {
+		got[u.Domain] = u.TimestampMs
+	}
+	if got["a.com"] != 1_700_000_000_000 || got["b.com"] != 1_700_000_000_000 {
+		t.Fatalf("expected out-of-range timestamps clamped to now, got %v", got)
+	}
+	if got["c.com"] != 1_700_000_000_000-30*60*1000 {
+		t.Fatalf("expected in-range gateway timestamp kept, got %d", got["c.com"])
+	}
+}
+
+func TestIngestCorrectsOnlyAgentClockTimestamps(t *testing.T) {
+	// The gateway clock is right; ours is an hour behind the master's.
+	clk := newFakeClock(1_700_000_000_000 - 3_600_000)
+	r := newClockTestRunner(clk)
+	r.cfg.CorrectClockSkew = true
+	r.cfg.MaxTimestampSkew = 2 * time.Hour
+	r.skew.observe(time.UnixMilli(1_700_000_000_000).UTC().Format(http.TimeFormat), clk.Now(), clk.Now())
+
+	r.ingestSnapshots([]domain.FlowSnapshot{
+		{ID: "a", Domain: "a.com", Chains: []string{"DIRECT"}, Upload: 1, TimestampMs: 1_700_000_000_000},
+		{ID: "b", Domain: "b.com", Chains: []string{"DIRECT"}, Upload: 1},
+	})
+	got := map[string]domain.TrafficUpdate{}
+	for _, u := range r.takeBatch(10) {
+		got[u.Domain] = u
+	}
+	if ts := got["a.com"].TimestampMs; ts != 1_700_000_000_000 {
+		t.Fatalf("expected gateway timestamp kept as is, got %d", ts)
+	}
+	// The Date header adds its 500ms truncation allowance.
+	if ts := got["b.com"].TimestampMs; ts != 1_700_000_000_500 {
+		t.Fatalf("expected agent timestamp shifted onto the master clock, got %d", ts)
+	}
+	if fs := got["a.com"].FirstSeenMs; fs != 1_700_000_000_500 {
+		t.Fatalf("expected first seen shifted onto the master clock, got %d", fs)
+	}
+}
+
+func TestServerTransportHTTPVersion(t *testing.T) {
+	if tr := newServerTransport(config.Config{ServerForceHTTP2: true, ServerHTTPVersion: "1.1"}); tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Fatal("expected HTTP/1.1 to disable HTTP/2 negotiation")
+	}
+
+	// The same pinned agent against an h2-only and an HTTP/1.1-only master.
+	var protos []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos = append(protos, req.Proto)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	var certs []byte
+	for _, srv := range []*httptest.Server{h2, h1} {
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})...)
+	}
+	if err := os.WriteFile(bundle, certs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Config{ServerAPIBase: h2.URL, BackendID: 1, AgentID: "agent-test", RequestTimeout: time.Second, ServerHTTPVersion: "2", ServerCABundle: bundle}
+	if err := NewRunner(cfg).postJSON(context.Background(), "/agent/heartbeat", struct{}{}); err != nil {
+		t.Fatalf("expected the h2 master to accept the heartbeat, got %v", err)
+	}
+	if len(protos) != 1 || protos[0] != "HTTP/2.0" {
+		t.Fatalf("expected the heartbeat sent over HTTP/2, got %v", protos)
+	}
+	cfg.ServerAPIBase = h1.URL
+	if err := NewRunner(cfg).postJSON(context.Background(), "/agent/heartbeat", struct{}{}); err == nil || !strings.Contains(err.Error(), "HTTP/1.1") {
+		t.Fatalf("expected an HTTP/1.1 answer to fail with --server-http-version 2, got %v", err)
+	}
+}
+
+func TestServerTransportTrustsCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Config{ServerAPIBase: srv.URL, BackendID: 1, AgentID: "agent-test", RequestTimeout: time.Second, ServerHTTPVersion: "auto"}
+	if err := NewRunner(cfg).postJSON(context.Background(), "/agent/heartbeat", struct{}{}); err == nil {
+		t.Fatal("expected the test server certificate to be untrusted without a bundle")
+	}
+	cfg.ServerCABundle = bundle
+	if err := NewRunner(cfg).postJSON(context.Background(), "/agent/heartbeat", struct{}{}); err != nil {
+		t.Fatalf("expected the CA bundle to be trusted, got %v", err)
+	}
+}
+
+func TestIngestSpeedUsesActualElapsedTime(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+	snap := func(up, down int64) []domain.FlowSnapshot {
+		return []domain.FlowSnapshot{{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: up, Download: down}}
+	}
+
+	r.ingestSnapshots(snap(1000, 1000))
+	if u := r.takeBatch(10)[0]; u.UploadSpeedBps != 0 || u.DownloadSpeedBps != 0 {
+		t.Fatalf("expected no speed on first sight, got %d/%d", u.UploadSpeedBps, u.DownloadSpeedBps)
+	}
+
+	clk.advance(time.Second)
+	r.ingestSnapshots(snap(3000, 5000))
+	if u := r.takeBatch(10)[0]; u.UploadSpeedBps != 2000 || u.DownloadSpeedBps != 4000 {
+		t.Fatalf("expected 2000/4000 B/s after 1s, got %d/%d", u.UploadSpeedBps, u.DownloadSpeedBps)
+	}
+
+	// A backoff stretches the gap to 8s; the rate must not be inflated 8x.
+	clk.advance(8 * time.Second)
+	r.ingestSnapshots(snap(7000, 5800))
+	if u := r.takeBatch(10)[0]; u.UploadSpeedBps != 500 || u.DownloadSpeedBps != 100 {
+		t.Fatalf("expected 500/100 B/s after 8s, got %d/%d", u.UploadSpeedBps, u.DownloadSpeedBps)
+	}
+
+	// A wall clock jump does not affect the monotonic elapsed time.
+	clk.jump(time.Hour)
+	clk.advance(2 * time.Second)
+	r.ingestSnapshots(snap(9000, 5800))
+	if u := r.takeBatch(10)[0]; u.UploadSpeedBps != 1000 {
+		t.Fatalf("expected 1000 B/s after a wall clock jump, got %d", u.UploadSpeedBps)
+	}
+
+	// Gateway-reported speeds are passed through.
+	clk.advance(time.Second)
+	r.ingestSnapshots([]domain.FlowSnapshot{{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 9100, Download: 5900, UploadSpeedBps: 123, DownloadSpeedBps: 456}})
+	if u := r.takeBatch(10)[0]; u.UploadSpeedBps != 123 || u.DownloadSpeedBps != 456 {
+		t.Fatalf("expected gateway speeds 123/456, got %d/%d", u.UploadSpeedBps, u.DownloadSpeedBps)
+	}
+}
+
+func TestBatchPostsCombineHeartbeatWithReport(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		var mu sync.Mutex
+		var paths []string
+		var envelope map[string]json.RawMessage
+		serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			body, _ := io.ReadAll(zr)
+			mu.Lock()
+			defer mu.Unlock()
+			paths = append(paths, req.URL.Path)
+			switch req.URL.Path {
+			case "/api/agent/batch":
+				if !supported {
+					return jsonResponse(req, http.StatusNotFound, `not found`), nil
+				}
+				_ = json.Unmarshal(body, &envelope)
+				return jsonResponse(req, http.StatusOK, `{"heartbeat":{"commands":[{"id":"c1","type":"noop"}]}}`), nil
+			case "/api/agent/heartbeat":
+				return jsonResponse(req, http.StatusOK, `{"commands":[{"id":"c1","type":"noop"}]}`), nil
+			}
+			return jsonResponse(req, http.StatusOK, `{"ok":true}`), nil
+		})
+
+		clk := newFakeClock(1_700_000_000_000)
+		r := newClockTestRunner(clk)
+		r.cfg.BatchPosts = true
+		r.httpClient.Transport = serverRT
+		r.ingestSnapshots([]domain.FlowSnapshot{{ID: "a", Domain: "example.com", Chains: []string{"DIRECT"}, Upload: 1}})
+
+		var resp heartbeatResponse
+		done := make(chan error, 1)
+		go func() {
+			_, err := r.postJSONWithLatency(context.Background(), heartbeatPath, r.buildHeartbeat(), &resp)
+			done <- err
+		}()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			r.mu.Lock()
+			n := len(r.batchItems)
+			r.mu.Unlock()
+			if n == 1 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if err := r.flushOnce(context.Background()); err != nil {
+			t.Fatalf("flushOnce returned error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("heartbeat returned error: %v", err)
+		}
+		if len(resp.Commands) != 1 || resp.Commands[0].ID != "c1" {
+			t.Fatalf("expected heartbeat response to be delivered, got %+v", resp)
+		}
+
+		mu.Lock()
+		if supported {
+			if !reflect.DeepEqual(paths, []string{"/api/agent/batch"}) {
+				t.Fatalf("expected a single batch request, got %v", paths)
+			}
+			if envelope["report"] == nil || envelope["heartbeat"] == nil {
+				t.Fatalf("expected report and heartbeat in the envelope, got %v", envelope)
+			}
+		} else {
+			if !reflect.DeepEqual(paths, []string{"/api/agent/batch", "/api/agent/heartbeat", "/api/agent/report"}) {
+				t.Fatalf("expected fallback to individual posts, got %v", paths)
+			}
+			if r.batching() {
+				t.Fatal("expected batching to be disabled after a 404")
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestIngestCarriesDNSModeAndSuppressesFakeIPs(t *testing.T) {
+	snapshots := []domain.FlowSnapshot{
+		{ID: "a", IP: "198.18.0.7", DNSMode: "fakeip", Chains: []string{"Proxy"}, Upload: 10},
+		{ID: "b", Domain: "example.com", IP: "198.18.0.8", DNSMode: "fakeip", Chains: []string{"Proxy"}, Upload: 10},
+		{ID: "c", IP: "1.1.1.1", DNSMode: "normal", SpecialProxy: "dns-hijack", Chains: []string{"DIRECT"}, Upload: 10},
+	}
+	for _, suppress := range []bool{false, true} {
+		r := newClockTestRunner(newFakeClock(1_700_000_000_000))
+		r.cfg.SuppressFakeIP = suppress
+		r.ingestSnapshots(snapshots)
+		got := map[string]domain.TrafficUpdate{}
+		for _, u := range r.takeBatch(10) {
+			got[u.DNSMode+"/"+u.Domain] = u
+		}
+		if len(got) != 3 {
+			t.Fatalf("suppress=%v: expected 3 updates, got %d", suppress, len(got))
+		}
+		wantIP := "198.18.0.7"
+		if suppress {
+			wantIP = ""
+		}
+		if ip := got["fakeip/"].IP; ip != wantIP {
+			t.Fatalf("suppress=%v: expected fake-IP flow ip %q, got %q", suppress, wantIP, ip)
+		}
+		if ip := got["fakeip/example.com"].IP; ip != "198.18.0.8" {
+			t.Fatalf("suppress=%v: expected sniffed flow to keep its ip, got %q", suppress, ip)
+		}
+		if sp := got["normal/"].SpecialProxy; sp != "dns-hijack" {
+			t.Fatalf("expected specialProxy dns-hijack, got %q", sp)
+		}
+	}
+}
+
+func TestFlushSkipsTickWhilePostInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	var posts int32
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&posts, 1)
+		started <- struct{}{}
+		<-release
+		return jsonResponse(req, http.StatusOK, `{"ok":true}`), nil
+	})
+	r := newClockTestRunner(newFakeClock(1_700_000_000_000))
+	r.httpClient.Transport = serverRT
+	r.ingestSnapshots([]domain.FlowSnapshot{{ID: "a", Domain: "a.com", Chains: []string{"DIRECT"}, Upload: 1}})
+
+	done := make(chan error, 1)
+	go func() { done <- r.flushOnce(context.Background()) }()
+	<-started
+
+	r.ingestSnapshots([]domain.FlowSnapshot{{ID: "b", Domain: "b.com", Chains: []string{"DIRECT"}, Upload: 1}})
+	if err := r.flushOnce(context.Background()); err != nil {
+		t.Fatalf("expected overlapping tick to be skipped quietly, got %v", err)
+	}
+	if pending, _ := r.queueStats(); pending != 1 {
+		t.Fatalf("expected skipped tick to leave 1 update queued, got %d", pending)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first flush returned error: %v", err)
+	}
+	if err := r.flushFinal(context.Background()); err != nil {
+		t.Fatalf("final flush returned error: %v", err)
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Fatalf("expected 2 posts, got %d", n)
+	}
+}
+
+func TestIngestReportsBlockedConnectionsRateLimited(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+	r.cfg.ReportBlocked = true
+	blocked := func(id string) domain.FlowSnapshot {
+		return domain.FlowSnapshot{ID: id, Domain: "ads.example", SourceIP: "192.168.1.9", Chains: []string{"REJECT"}, Rule: "DomainSuffix", Blocked: true}
+	}
+
+	r.ingestSnapshots([]domain.FlowSnapshot{blocked("1"), blocked("2")})
+	batch := r.takeBatch(10)
+	if len(batch) != 1 || !batch[0].Blocked || batch[0].Connections != 1 || batch[0].Upload != 0 {
+		t.Fatalf("expected one zero-byte blocked update, got %+v", batch)
+	}
+
+	// Still-open blocked flows are not reported again; new retries within the
+	// window are only counted.
+	clk.advance(10 * time.Second)
+	r.ingestSnapshots([]domain.FlowSnapshot{blocked("1"), blocked("2"), blocked("3")})
+	if batch := r.takeBatch(10); len(batch) != 0 {
+		t.Fatalf("expected retries within the window to be suppressed, got %d updates", len(batch))
+	}
+
+	clk.advance(time.Minute)
+	r.ingestSnapshots([]domain.FlowSnapshot{blocked("4")})
+	batch = r.takeBatch(10)
+	if len(batch) != 1 || batch[0].Connections != 3 {
+		t.Fatalf("expected next update to carry 3 attempts, got %+v", batch)
+	}
+	stats := r.buildHeartbeat().Stats
+	if stats.Blocked != 4 || stats.BlockedSuppressed != 2 {
+		t.Fatalf("expected 4 blocked and 2 suppressed, got %d and %d", stats.Blocked, stats.BlockedSuppressed)
+	}
+
+	r = newClockTestRunner(clk)
+	r.ingestSnapshots([]domain.FlowSnapshot{blocked("1")})
+	if batch := r.takeBatch(10); len(batch) != 0 {
+		t.Fatalf("expected no blocked updates with --report-blocked=false, got %d", len(batch))
+	}
+}
+
+func TestReportFieldsFollowNegotiatedProtocol(t *testing.T) {
+	protocolResp := `{"protocolVersion":2,"encodings":["json"]}`
+	var reported map[string]json.RawMessage
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/agent/protocol") {
+			if protocolResp == "" {
+				return jsonResponse(req, http.StatusNotFound, `not found`), nil
+			}
+			return jsonResponse(req, http.StatusOK, protocolResp), nil
+		}
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		reported = nil
+		if err := json.NewDecoder(zr).Decode(&reported); err != nil {
+			return nil, err
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	r := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	}, WithServerTransport(serverRT))
+	update := domain.TrafficUpdate{Domain: "example.com", HostSource: domain.HostSourceSniff, DomainSource: domainSourceRDNS, Chain: "Proxy", Upload: 10, TimestampMs: time.Now().UnixMilli()}
+
+	report := func() (map[string]json.RawMessage, map[string]json.RawMessage) {
+		t.Helper()
+		if err := r.negotiateProtocol(context.Background()); err != nil {
+			t.Fatalf("negotiateProtocol returned error: %v", err)
+		}
+		r.queue.push([]domain.TrafficUpdate{update})
+		if err := r.flushOnce(context.Background()); err != nil {
+			t.Fatalf("flush returned error: %v", err)
+		}
+		var updates []map[string]json.RawMessage
+		if err := json.Unmarshal(reported["updates"], &updates); err != nil || len(updates) != 1 {
+			t.Fatalf("unexpected updates %s: %v", reported["updates"], err)
+		}
+		return reported, updates[0]
+	}
+
+	payload, u := report()
+	for _, key := range []string{"batchId", "seq"} {
+		if _, ok := payload[key]; !ok {
+			t.Fatalf("expected %s in a v2 report, got %v", key, payload)
+		}
+	}
+	if _, ok := u["hostSource"]; !ok {
+		t.Fatalf("expected hostSource in a v2 update, got %v", u)
+	}
+
+	// A master without /agent/protocol only speaks v1.
+	protocolResp = ""
+	payload, u = report()
+	if string(payload["protocolVersion"]) != "1" {
+		t.Fatalf("expected protocolVersion 1, got %s", payload["protocolVersion"])
+	}
+	for _, key := range []string{"batchId", "seq"} {
+		if _, ok := payload[key]; ok {
+			t.Fatalf("expected no %s in a v1 report, got %v", key, payload)
+		}
+	}
+	for _, key := range []string{"hostSource", "domainSource"} {
+		if _, ok := u[key]; ok {
+			t.Fatalf("expected no %s in a v1 update, got %v", key, u)
+		}
+	}
+}
+
+// fillFields sets every exported field of the struct v points to to a
+// non-zero value, so that omitempty hides nothing when it is marshalled.
+func fillFields(v reflect.Value) {
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString("x")
+		case reflect.Int, reflect.Int64:
+			f.SetInt(1)
+		case reflect.Float64:
+			f.SetFloat(0.5)
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Slice:
+			f.Set(reflect.ValueOf([]string{"x"}))
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+			fillFields(f)
+		}
+	}
+}
+
+func jsonKeys(t *testing.T, v interface{}) map[string]bool {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal %T: %v", v, err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("unmarshal %s: %v", b, err)
+	}
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys
+}
+
+func TestV1PayloadsOmitLaterFields(t *testing.T) {
+	// Every field a v1 master has never seen. A field added to one of these
+	// payloads must be listed here, or the v1 check below fails.
+	laterFields := []struct {
+		payload, key string
+	}{
+		{"report", "batchId"},
+		{"report", "seq"},
+		{"update", "domainSource"},
+		{"update", "hostSource"},
+		{"update", "domainASCII"},
+		{"update", "uploadSpeedBps"},
+		{"update", "downloadSpeedBps"},
+		{"update", "firstSeenMs"},
+		{"update", "durationMs"},
+		{"update", "country"},
+		{"update", "dnsMode"},
+		{"update", "specialProxy"},
+		{"update", "transport"},
+		{"update", "appProtocol"},
+		{"update", "process"},
+		{"update", "destASN"},
+		{"update", "destASOrg"},
+		{"update", "destDatacenter"},
+		{"update", "sampled"},
+		{"update", "sampleRate"},
+		{"update", "aggregate"},
+		{"update", "blocked"},
+		{"heartbeat", "installId"},
+		{"heartbeat", "gatewayTypeAuto"},
+		{"heartbeat", "gatewayMode"},
+		{"heartbeat", "gatewayCore"},
+		{"heartbeat", "gatewayVersion"},
+		{"heartbeat", "gatewayMemoryBytes"},
+		{"heartbeat", "warnings"},
+		{"heartbeat", "commandsEnabled"},
+		{"heartbeat", "stats"},
+	}
+
+	r := NewRunner(config.Config{AgentID: "agent-test"})
+	var update domain.TrafficUpdate
+	fillFields(reflect.ValueOf(&update))
+	updates := []domain.TrafficUpdate{update}
+	var hb heartbeatPayload
+	fillFields(reflect.ValueOf(&hb))
+
+	keysAt := func(version int) map[string]map[string]bool {
+		r.setProtocolVersion(version, false)
+		report := r.newReportPayload("req", "batch", 1, updates)
+		hb.ProtocolVersion = version
+		return map[string]map[string]bool{
+			"report":    jsonKeys(t, report),
+			"update":    jsonKeys(t, report.Updates[0]),
+			"heartbeat": jsonKeys(t, heartbeatForProtocol(hb)),
+		}
+	}
+	v1, v2 := keysAt(1), keysAt(reportFieldsProtocolVersion)
+
+	for _, f := range laterFields {
+		if !v2[f.payload][f.key] {
+			t.Errorf("expected %s in a v2 %s", f.key, f.payload)
+		}
+		if v1[f.payload][f.key] {
+			t.Errorf("expected no %s in a v1 %s", f.key, f.payload)
+		}
+		delete(v2[f.payload], f.key)
+	}
+	for payload, keys := range v2 {
+		for key := range keys {
+			if !v1[payload][key] {
+				t.Errorf("%s.%s is missing from v1 but not listed as a later field", payload, key)
+			}
+		}
+	}
+	if updates[0].HostSource != "x" {
+		t.Fatalf("expected the caller's updates left intact, got hostSource %q", updates[0].HostSource)
+	}
+}
+
+func TestReportRetriesKeepXRequestID(t *testing.T) {
+	var mu sync.Mutex
+	var ids, requestIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var reported domain.ReportPayload
+		if zr, err := gzip.NewReader(req.Body); err == nil {
+			_ = json.NewDecoder(zr).Decode(&reported)
+		}
+		mu.Lock()
+		ids = append(ids, req.Header.Get("X-Request-ID"))
+		requestIDs = append(requestIDs, reported.RequestID)
+		first := len(ids) == 1
+		mu.Unlock()
+		if first {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r := NewRunner(config.Config{
+		ServerAPIBase:     srv.URL + "/api",
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+	})
+	r.queue.push([]domain.TrafficUpdate{{Domain: "example.com", Chain: "Proxy", Upload: 10, TimestampMs: time.Now().UnixMilli()}})
+	if err := r.flushOnce(context.Background()); err == nil {
+		t.Fatal("expected the first report to fail")
+	}
+	if err := r.flushOnce(context.Background()); err != nil {
+		t.Fatalf("retry returned error: %v", err)
+	}
+	if err := r.postJSON(context.Background(), "/agent/heartbeat", struct{}{}); err != nil {
+		t.Fatalf("heartbeat returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 3 || ids[0] == "" || ids[1] != ids[0] || ids[0] != requestIDs[0] {
+		t.Fatalf("expected both report attempts to send the report's requestId %q as X-Request-ID, got %q", requestIDs[0], ids)
+	}
+	if ids[2] == "" || ids[2] == ids[0] {
+		t.Fatalf("expected the heartbeat to get its own X-Request-ID, got %q", ids)
+	}
+}
+
+func TestFlushReusesBatchIDAndSeqOnRetry(t *testing.T) {
+	var ids []string
+	var seqs []int64
+	fail := true
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		var reported domain.ReportPayload
+		if err := json.NewDecoder(zr).Decode(&reported); err != nil {
+			return nil, err
+		}
+		ids = append(ids, reported.BatchID)
+		seqs = append(seqs, reported.Seq)
+		if fail {
+			fail = false
+			return nil, errors.New("connection reset after write")
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   "http://gateway.invalid",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+		StateFile:         filepath.Join(t.TempDir(), "agent.state"),
+	}, WithServerTransport(serverRT))
+	runner.setProtocolVersion(2, false)
+
+	update := domain.TrafficUpdate{Domain: "example.com", Chain: "Proxy", Upload: 10, TimestampMs: time.Now().UnixMilli()}
+	runner.queue.push([]domain.TrafficUpdate{update})
+	if err := runner.flushOnce(context.Background()); err == nil {
+		t.Fatalf("expected first flush to fail")
+	}
+	if err := runner.flushOnce(context.Background()); err != nil {
+		t.Fatalf("retry flush returned error: %v", err)
+	}
+	runner.queue.push([]domain.TrafficUpdate{update})
+	if err := runner.flushOnce(context.Background()); err != nil {
+		t.Fatalf("flush returned error: %v", err)
+	}
+
+	if len(ids) != 3 || ids[0] == "" || ids[0] != ids[1] {
+		t.Fatalf("expected the retry to reuse the batch id, got %q", ids)
+	}
+	if ids[2] == ids[0] {
+		t.Fatalf("expected an identical later batch to get a new id, got %q twice", ids[0])
+	}
+	if !reflect.DeepEqual(seqs, []int64{1, 1, 2}) {
+		t.Fatalf("expected seqs [1 1 2], got %v", seqs)
+	}
+
+	if _, err := os.Stat(runner.cfg.StateFile); !os.IsNotExist(err) {
+		t.Fatalf("expected acknowledged reports not to write the state file by themselves, got %v", err)
+	}
+	runner.saveDirtyState()
+
+	restarted := NewRunner(runner.cfg)
+	restarted.loadState()
+	restarted.queue.push([]domain.TrafficUpdate{update})
+	if pending := restarted.takePendingBatch(); pending == nil || pending.seq != 3 {
+		t.Fatalf("expected the restarted agent to continue at seq 3, got %+v", pending)
+	}
+}
+
+func TestAcquireLockUsesLockDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "locks")
+	r := NewRunner(config.Config{BackendID: 42, AgentID: "agent-test", LockDir: dir})
+	if err := r.acquireLock(); err != nil {
+		t.Fatalf("acquireLock returned error: %v", err)
+	}
+	want := filepath.Join(dir, "neko-agent-backend-42.lock")
+	if r.lockPath != want {
+		t.Fatalf("expected lock at %s, got %s", want, r.lockPath)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o755 {
+		t.Fatalf("expected lock dir to be created with 0755, got %v (%v)", info, err)
+	}
+
+	other := NewRunner(config.Config{BackendID: 42, AgentID: "agent-other", LockDir: dir})
+	if err := other.acquireLock(); err == nil {
+		t.Fatalf("expected a second instance to be refused the lock")
+	}
+	r.releaseLock()
+	if _, err := os.Stat(want); !os.IsNotExist(err) {
+		t.Fatalf("expected lock file to be removed on release, got %v", err)
+	}
+}
+
+func TestAcquireLockIgnoresReusedPID(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process identities are only recorded on Linux")
+	}
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "neko-agent-backend-42.lock")
+	parent := currentLockHolder()
+	parent.PID = os.Getppid()
+
+	// A live process whose start time does not match the lock is an unrelated
+	// process that reused the PID, e.g. after a reboot.
+	reused := parent
+	reused.StartTime = "1"
+	if err := os.WriteFile(lockPath, []byte(reused.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(config.Config{BackendID: 42, AgentID: "agent-test", LockDir: dir})
+	if err := r.acquireLock(); err != nil {
+		t.Fatalf("expected a lock with a reused PID to be treated as stale, got %v", err)
+	}
+	r.releaseLock()
+
+	// A PID-only lock from an older agent keeps the previous behaviour.
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(parent.PID)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.acquireLock(); err == nil {
+		t.Fatal("expected a PID-only lock naming a live process to be honoured")
+	}
+}
+
+// TestLockHolderProcess is not a real test: startLockHolder re-runs the test
+// binary with it to get a separate process holding the instance lock.
+func TestLockHolderProcess(t *testing.T) {
+	dir := os.Getenv("NEKO_AGENT_LOCK_HOLDER_DIR")
+	if dir == "" {
+		return
+	}
+	ctx := context.Background()
+	if os.Getenv("NEKO_AGENT_LOCK_HOLDER_IGNORE_TERM") != "" {
+		signal.Ignore(syscall.SIGTERM)
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = signal.NotifyContext(ctx, syscall.SIGTERM)
+		defer cancel()
+	}
+	r := NewRunner(config.Config{BackendID: 42, AgentID: "agent-holder", LockDir: dir})
+	if err := r.acquireLock(); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("ready")
+	select {
+	case <-ctx.Done():
+		r.releaseLock()
+		os.Exit(0)
+	case <-time.After(30 * time.Second):
+		os.Exit(1)
+	}
+}
+
+// startLockHolder starts a child process holding the backend 42 lock in dir
+// and returns once it holds it. The returned channel is closed when the child
+// has exited and been reaped.
+func startLockHolder(t *testing.T, dir string, ignoreTerm bool) (*exec.Cmd, <-chan struct{}) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHolderProcess$")
+	cmd.Env = append(os.Environ(), "NEKO_AGENT_LOCK_HOLDER_DIR="+dir)
+	if ignoreTerm {
+		cmd.Env = append(cmd.Env, "NEKO_AGENT_LOCK_HOLDER_IGNORE_TERM=1")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start lock holder: %v", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ready" {
+		_ = cmd.Process.Kill()
+		t.Fatalf("lock holder did not start: %q %v", line, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, stdout)
+		_ = cmd.Wait()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-done
+	})
+	return cmd, done
+}
+
+func TestAcquireLockTakeover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts child processes")
+	}
+	lockPath := func(dir string) string { return filepath.Join(dir, "neko-agent-backend-42.lock") }
+	newTakeoverRunner := func(dir, mode string) *Runner {
+		return NewRunner(config.Config{BackendID: 42, AgentID: "agent-new", LockDir: dir, Takeover: mode, TakeoverGrace: 500 * time.Millisecond})
+	}
+
+	t.Run("refused without takeover", func(t *testing.T) {
+		dir := t.TempDir()
+		cmd, _ := startLockHolder(t, dir, false)
+		if holder, err := readLockHolder(lockPath(dir)); err != nil || holder.PID != cmd.Process.Pid {
+			t.Fatalf("expected lock to name PID %d, got %d (%v)", cmd.Process.Pid, holder.PID, err)
+		}
+		if err := newTakeoverRunner(dir, "").acquireLock(); err == nil || !strings.Contains(err.Error(), strconv.Itoa(cmd.Process.Pid)) {
+			t.Fatalf("expected lock error naming the holder PID, got %v", err)
+		}
+	})
+
+	t.Run("graceful", func(t *testing.T) {
+		dir := t.TempDir()
+		_, done := startLockHolder(t, dir, false)
+		r := newTakeoverRunner(dir, config.TakeoverGraceful)
+		if err := r.acquireLock(); err != nil {
+			t.Fatalf("expected takeover to succeed, got %v", err)
+		}
+		defer r.releaseLock()
+		<-done
+		if holder, _ := readLockHolder(lockPath(dir)); holder.PID != os.Getpid() {
+			t.Fatalf("expected lock to name this process, got PID %d", holder.PID)
+		}
+	})
+
+	t.Run("holder ignores SIGTERM", func(t *testing.T) {
+		dir := t.TempDir()
+		startLockHolder(t, dir, true)
+		if err := newTakeoverRunner(dir, config.TakeoverGraceful).acquireLock(); err == nil || !strings.Contains(err.Error(), "--takeover=force") {
+			t.Fatalf("expected takeover to give up after the grace period, got %v", err)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		dir := t.TempDir()
+		startLockHolder(t, dir, true)
+		r := newTakeoverRunner(dir, config.TakeoverForce)
+		if err := r.acquireLock(); err != nil {
+			t.Fatalf("expected forced takeover to succeed, got %v", err)
+		}
+		defer r.releaseLock()
+		if holder, _ := readLockHolder(lockPath(dir)); holder.PID != os.Getpid() {
+			t.Fatalf("expected lock to name this process, got PID %d", holder.PID)
+		}
+	})
+}
+
+func TestAdminShutdownRequiresToken(t *testing.T) {
+	post := func(r *Runner, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/shutdown", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.adminHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	var stopped atomic.Bool
+	r := NewRunner(config.Config{AgentID: "agent-test"})
+	r.stop = func() { stopped.Store(true) }
+	if code := post(r, "anything"); code != http.StatusForbidden || stopped.Load() {
+		t.Fatalf("expected 403 without a configured token, got %d", code)
+	}
+
+	r.cfg.AdminToken = "s3cret"
+	if code := post(r, "wrong"); code != http.StatusUnauthorized || stopped.Load() {
+		t.Fatalf("expected 401 for a wrong token, got %d", code)
+	}
+	if code := post(r, "s3cret"); code != http.StatusAccepted || !stopped.Load() {
+		t.Fatalf("expected 202 and the runner stopped, got %d (stopped=%v)", code, stopped.Load())
+	}
+}
+
+func TestDryRunNeverContactsMaster(t *testing.T) {
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected master request %s %s in dry-run", req.Method, req.URL.Path)
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	stateFile := filepath.Join(t.TempDir(), "agent.state")
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   2,
+		MaxPendingUpdates: 3,
+		StateFile:         stateFile,
+		DryRun:            true,
+	}, WithServerTransport(serverRT))
+
+	now := time.Now().UnixMilli()
+	for i := 0; i < 5; i++ {
+		runner.enqueueLocked([]domain.TrafficUpdate{{Domain: fmt.Sprintf("%d.example", i), Chain: "Proxy", Upload: 1, TimestampMs: now}})
+	}
+	if pending, dropped := runner.queueStats(); pending != 3 || dropped != 2 {
+		t.Fatalf("expected the dry-run queue to stay capped at 3 (2 dropped), got %d pending and %d dropped", pending, dropped)
+	}
+	for i := 0; i < 2; i++ {
+		if err := runner.flushOnce(context.Background()); err != nil {
+			t.Fatalf("dry-run flush returned error: %v", err)
+		}
+	}
+	if pending, _ := runner.queueStats(); pending != 0 {
+		t.Fatalf("expected dry-run flushes to drain the queue, got %d pending", pending)
+	}
+	if err := runner.postJSON(context.Background(), "/agent/config", map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("dry-run post returned error: %v", err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("expected dry-run not to write the state file, got %v", err)
+	}
+}
+
+func TestRunOnceReportsAndJoinsStepErrors(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/connections" {
+			return jsonResponse(req, http.StatusOK, `{"connections":[{"id":"c1","upload":10,"download":20,"chains":["Proxy"],"rule":"Match","metadata":{"host":"example.com"}}]}`), nil
+		}
+		return jsonResponse(req, http.StatusNotFound, `{}`), nil
+	})
+	var mu sync.Mutex
+	var posted []string
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			mu.Lock()
+			posted = append(posted, strings.TrimPrefix(req.URL.Path, "/api"))
+			mu.Unlock()
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   "http://gateway.invalid",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+		LockDir:           t.TempDir(),
+		Once:              true,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	summary, err := runner.RunOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "config sync") {
+		t.Fatalf("expected the failing config sync to be reported, got %v", err)
+	}
+	if summary.Flows != 1 || summary.Updates != 1 || summary.Bytes != 30 {
+		t.Fatalf("expected flows=1 updates=1 bytes=30, got %s", summary)
+	}
+	if !reflect.DeepEqual(posted, []string{"/agent/report", "/agent/heartbeat"}) {
+		t.Fatalf("expected one report and one heartbeat, got %v", posted)
+	}
+}
+
+func TestRunOnceWithBatchPostsDoesNotPark(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusOK, `{"connections":[]}`), nil
+	})
+	var mu sync.Mutex
+	var posted []string
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			mu.Lock()
+			posted = append(posted, strings.TrimPrefix(req.URL.Path, "/api"))
+			mu.Unlock()
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		BackendID:         1,
+		AgentID:           "agent-test",
+		GatewayType:       "clash",
+		GatewayEndpoint:   "http://gateway.invalid",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   10,
+		MaxPendingUpdates: 100,
+		LockDir:           t.TempDir(),
+		Once:              true,
+		BatchPosts:        true,
+		DisableConfigSync: true,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := runner.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce returned error: %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("RunOnce only returned at the context deadline")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) == 0 || posted[len(posted)-1] != "/agent/heartbeat" {
+		t.Fatalf("expected the heartbeat posted directly, got %v", posted)
+	}
+}
+
+func TestEventModeRequestsFlushOnNewFlowsAndThreshold(t *testing.T) {
+	clk := newFakeClock(1_700_000_000_000)
+	r := newClockTestRunner(clk)
+	r.cfg.EventThreshold = 1000
+	r.flushNow = make(chan struct{}, 1)
+	flushRequested := func() bool {
+		select {
+		case <-r.flushNow:
+			return true
+		default:
+			return false
+		}
+	}
+	snap := func(up int64) []domain.FlowSnapshot {
+		return []domain.FlowSnapshot{{ID: "1", Domain: "example.com", Chains: []string{"Proxy"}, Upload: up}}
+	}
+
+	r.ingestSnapshots(snap(100))
+	if !flushRequested() {
+		t.Fatal("expected a new flow to request a flush")
+	}
+	clk.advance(time.Second)
+	r.ingestSnapshots(snap(600))
+	if flushRequested() {
+		t.Fatal("expected 500 bytes to stay below the threshold")
+	}
+	clk.advance(time.Second)
+	r.ingestSnapshots(snap(1200))
+	if !flushRequested() {
+		t.Fatal("expected crossing 1000 bytes since the last event to request a flush")
+	}
+	clk.advance(time.Second)
+	r.ingestSnapshots(snap(1300))
+	if flushRequested() {
+		t.Fatal("expected the byte count to restart after an event")
+	}
+}
+
+func TestEventModeCoalescesFlushRequests(t *testing.T) {
+	var posts atomic.Int32
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		posts.Add(1)
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	r := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportInterval:    time.Hour,
+		ReportBatchSize:   1,
+		MaxPendingUpdates: 100,
+		ReportMode:        reportModeEvent,
+		EventMinInterval:  100 * time.Millisecond,
+	}, WithServerTransport(serverRT))
+	enqueue := func() {
+		r.mu.Lock()
+		r.enqueueLocked([]domain.TrafficUpdate{{Domain: "example.com", Chain: "Proxy", Upload: 1, TimestampMs: time.Now().UnixMilli()}})
+		r.mu.Unlock()
+		r.requestFlush()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.runReportLoop(ctx, &wg)
+	defer func() { cancel(); wg.Wait() }()
+
+	enqueue()
+	waitFor(t, func() bool { return posts.Load() == 1 })
+	for i := 0; i < 5; i++ {
+		enqueue()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := posts.Load(); n != 1 {
+		t.Fatalf("expected requests within the minimum interval to wait, got %d posts", n)
+	}
+	waitFor(t, func() bool { return posts.Load() == 2 })
+	time.Sleep(150 * time.Millisecond)
+	if n := posts.Load(); n != 2 {
+		t.Fatalf("expected the burst to be coalesced into one flush, got %d posts", n)
+	}
+}
+
+// waitFor polls cond for up to two seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCheckReportsEachStep(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/connections" {
+			return jsonResponse(req, http.StatusOK, `{"connections":[{"id":"c1","upload":10,"download":20,"chains":["Proxy"],"rule":"Match","metadata":{"host":"example.com"}}]}`), nil
+		}
+		return jsonResponse(req, http.StatusNotFound, `{}`), nil
+	})
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var resp *http.Response
+		switch strings.TrimPrefix(req.URL.Path, "/api") {
+		case "/agent/heartbeat":
+			resp = jsonResponse(req, http.StatusUnauthorized, `{"error":"Invalid agent token"}`)
+		default:
+			resp = jsonResponse(req, http.StatusNotFound, `{}`)
+		}
+		resp.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		return resp, nil
+	})
+
+	runner := NewRunner(config.Config{
+		ServerAPIBase:   "http://master.invalid/api",
+		BackendID:       1,
+		AgentID:         "agent-test",
+		GatewayType:     "clash",
+		GatewayEndpoint: "http://gateway.invalid",
+		RequestTimeout:  time.Second,
+		ClockSkewWarn:   30 * time.Second,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	results := runner.Check(context.Background())
+	got := make(map[string]bool, len(results))
+	for _, res := range results {
+		got[res.Name] = res.OK
+	}
+	want := map[string]bool{"gateway": true, "gateway config": false, "master": true, "master auth": false, "clock": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %+v", want, results)
+	}
+
+	var out strings.Builder
+	if WriteCheckResults(&out, results) {
+		t.Fatalf("expected failing checks to fail the table")
+	}
+	if !strings.Contains(out.String(), "✓  gateway") || !strings.Contains(out.String(), "✗  master auth") {
+		t.Fatalf("unexpected table:\n%s", out.String())
+	}
+}
+
+func TestGatewayModeIsCachedBetweenRefreshes(t *testing.T) {
+	var fetches int
+	mode := "rule"
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		fetches++
+		return jsonResponse(req, http.StatusOK, `{"mode":"`+mode+`"}`), nil
+	})
+	clk := newFakeClock(1_700_000_000_000)
+	runner := NewRunner(config.Config{
+		AgentID:         "agent-test",
+		GatewayType:     "clash",
+		GatewayEndpoint: "http://gateway.invalid",
+		RequestTimeout:  time.Second,
+	}, WithGatewayTransport(gatewayRT))
+	runner.clock = clk
+
+	if got := runner.gatewayMode(context.Background()); got != "rule" {
+		t.Fatalf("expected mode rule, got %q", got)
+	}
+	mode = "direct"
+	clk.advance(time.Minute)
+	if got := runner.gatewayMode(context.Background()); got != "rule" || fetches != 1 {
+		t.Fatalf("expected the cached mode without a refetch, got %q after %d fetches", got, fetches)
+	}
+	clk.advance(gatewayModeRefresh)
+	if got := runner.gatewayMode(context.Background()); got != "direct" || fetches != 2 {
+		t.Fatalf("expected a refreshed mode direct, got %q after %d fetches", got, fetches)
+	}
+}
+
+func TestRunStopsWhenReplayFinishes(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := gateway.NewRecorder(dir, 1<<20, t.Logf)
+	if err != nil {
+		t.Fatalf("NewRecorder returned error: %v", err)
+	}
+	live := gateway.NewClient(&http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusOK, `{"connections":[{"id":"c1","upload":10,"download":20,"chains":["DIRECT"],"metadata":{"host":"example.com"}}]}`), nil
+	})}, "clash", "http://gateway.invalid", "")
+	live.SetRecorder(recorder)
+	for i := 0; i < 2; i++ {
+		if _, err := live.Collect(context.Background()); err != nil {
+			t.Fatalf("Collect returned error: %v", err)
+		}
+	}
+
+	replay, err := gateway.NewReplayClient(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplayClient returned error: %v", err)
+	}
+	runner := NewRunner(config.Config{
+		AgentID:             "agent-test",
+		BackendID:           1,
+		GatewayType:         config.GatewayReplay,
+		RequestTimeout:      time.Second,
+		ReportInterval:      time.Hour,
+		HeartbeatInterval:   time.Hour,
+		GatewayPollInterval: 10 * time.Millisecond,
+		ReportBatchSize:     10,
+		MaxPendingUpdates:   100,
+		LockDir:             t.TempDir(),
+		DryRun:              true,
+		DisableConfigSync:   true,
+		DisablePolicySync:   true,
+	}, WithGatewayClient(replay))
+
+	done := make(chan error, 1)
+	go func() { done <- runner.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean exit after the replay, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not stop after the replay finished")
+	}
+	if runner.sentUpdates != 1 || runner.sentBytes != 30 {
+		t.Fatalf("expected the replayed flow to be reported once, got %d updates / %d bytes", runner.sentUpdates, runner.sentBytes)
+	}
+}
+
+func TestRunHeartbeatsWhileGatewayTypeIsUndetected(t *testing.T) {
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusServiceUnavailable, `{}`), nil
+	})
+	heartbeats := make(chan heartbeatPayload, 4)
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/api/agent/heartbeat" {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			var hb heartbeatPayload
+			if err := json.NewDecoder(zr).Decode(&hb); err != nil {
+				return nil, err
+			}
+			select {
+			case heartbeats <- hb:
+			default:
+			}
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	runner := NewRunner(config.Config{
+		ServerAPIBase:       "http://master.invalid/api",
+		AgentID:             "agent-test",
+		BackendID:           1,
+		GatewayType:         gateway.TypeAuto,
+		GatewayEndpoint:     "http://gateway.invalid",
+		RequestTimeout:      time.Second,
+		ReportInterval:      time.Hour,
+		HeartbeatInterval:   time.Hour,
+		GatewayPollInterval: time.Hour,
+		ReportBatchSize:     10,
+		MaxPendingUpdates:   100,
+		LockDir:             t.TempDir(),
+		ClashLogs:           true,
+	}, WithServerTransport(serverRT), WithGatewayTransport(gatewayRT))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runner.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	select {
+	case hb := <-heartbeats:
+		if hb.GatewayType != gateway.TypeAuto || !hb.GatewayAuto {
+			t.Fatalf("expected an undetected auto gateway reported, got %+v", hb)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat while the gateway type was undetected")
+	}
+}
+
+func TestAdminStatusShowsRedactedConfig(t *testing.T) {
+	r := NewRunner(config.Config{AgentID: "agent-test", BackendID: 3, BackendToken: "backend-s3cret", AdminToken: "admin-s3cret", GatewayEndpoint: "http://router.lan/clash"})
+	req := httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+	req.Header.Set("Authorization", "Bearer admin-s3cret")
+	rec := httptest.NewRecorder()
+	r.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "s3cret") {
+		t.Fatalf("status leaks a secret: %s", body)
+	}
+
+	var status adminStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status.BackendID != 3 || status.Config["gatewayEndpoint"] != "http://router.lan/clash" || status.Config["backendToken"] != config.Fingerprint("backend-s3cret") {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestServerHeadersAreSentToMaster(t *testing.T) {
+	var got http.Header
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Clone()
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	headers := http.Header{}
+	headers.Add("CF-Access-Client-Id", "abc.access")
+	headers.Add("CF-Access-Client-Secret", "s3cret")
+	runner := NewRunner(config.Config{
+		ServerAPIBase:  "http://master.invalid/api",
+		BackendToken:   "token",
+		AgentID:        "agent-test",
+		RequestTimeout: time.Second,
+		ServerHeaders:  headers,
+		ReportClientID: "site-a/router-1",
+	}, WithServerTransport(serverRT))
+
+	if _, err := runner.postBody(context.Background(), heartbeatPath, []byte(`{}`), "application/json", nil); err != nil {
+		t.Fatalf("postBody returned error: %v", err)
+	}
+	if got.Get("Cf-Access-Client-Id") != "abc.access" || got.Get("Cf-Access-Client-Secret") != "s3cret" {
+		t.Fatalf("expected extra headers on the master request, got %v", got)
+	}
+	if got.Get("Authorization") != "Bearer token" || got.Get("Content-Type") != "application/json" || got.Get("X-Client-ID") != "site-a/router-1" {
+		t.Fatalf("expected agent-set headers to be kept, got %v", got)
+	}
+}
+
+func TestVerboseHTTPLogsRedactedExchange(t *testing.T) {
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusBadRequest, `{"error":"unknown field chainz"}`), nil
+	})
+	headers := http.Header{}
+	headers.Add("CF-Access-Client-Secret", "s3cret")
+	runner := NewRunner(config.Config{
+		ServerAPIBase:  "http://master.invalid/api",
+		BackendToken:   "token",
+		AgentID:        "agent-test",
+		RequestTimeout: time.Second,
+		ServerHeaders:  headers,
+		VerboseHTTP:    true,
+	}, WithServerTransport(serverRT))
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	body := []byte(`{"chainz":["` + strings.Repeat("x", 2*verboseHTTPBodyLimit) + `"]}`)
+	_, _ = runner.postBody(context.Background(), "/agent/report", body, "application/json", nil)
+
+	out := logs.String()
+	for _, want := range []string{
+		"http> POST /api/agent/report",
+		"Authorization: Bearer " + config.Fingerprint("token"),
+		"Cf-Access-Client-Secret: " + config.Fingerprint("s3cret"),
+		fmt.Sprintf("... (%d bytes)", len(body)),
+		"http< 400 Bad Request",
+		`{"error":"unknown field chainz"}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in verbose log:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Bearer token") || strings.Contains(out, "s3cret") || len(out) > 3*verboseHTTPBodyLimit {
+		t.Fatalf("expected secrets redacted and the body truncated:\n%s", out)
+	}
+}
+
+func TestDuplicateAgentReportedByMaster(t *testing.T) {
+	var installIDs []string
+	duplicate := true
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var hb heartbeatPayload
+		zr, _ := gzip.NewReader(req.Body)
+		_ = json.NewDecoder(zr).Decode(&hb)
+		installIDs = append(installIDs, hb.InstallID)
+		if duplicate {
+			return jsonResponse(req, http.StatusOK, `{"duplicateAgent":{"hostname":"router-b","installId":"other"}}`), nil
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	cfg := config.Config{
+		ServerAPIBase:   "http://master.invalid/api",
+		BackendID:       1,
+		AgentID:         "agent-test",
+		GatewayType:     "clash",
+		GatewayEndpoint: "http://gateway.invalid",
+		RequestTimeout:  time.Second,
+		ReportBatchSize: 1,
+		StateFile:       filepath.Join(t.TempDir(), "agent.state"),
+		AdminToken:      "admin",
+	}
+	r := NewRunner(cfg, WithServerTransport(serverRT), WithGatewayTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusNotFound, `{}`), nil
+	})))
+	r.loadState()
+	r.setProtocolVersion(2, false)
+
+	if err := r.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat returned error: %v", err)
+	}
+	if r.duplicate == nil || r.duplicate.Hostname != "router-b" {
+		t.Fatalf("expected the duplicate to be recorded, got %+v", r.duplicate)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	r.adminHandler().ServeHTTP(rec, req)
+	var status adminStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if status.DuplicateAgent == nil || status.DuplicateAgent.InstallID != "other" || status.InstallID != installIDs[0] {
+		t.Fatalf("expected the duplicate in the status endpoint, got %+v", status)
+	}
+
+	duplicate = false
+	if err := r.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat returned error: %v", err)
+	}
+	if r.duplicate != nil {
+		t.Fatalf("expected the duplicate to clear, got %+v", r.duplicate)
+	}
+
+	// The install ID survives a restart through the state file.
+	restarted := NewRunner(cfg, WithServerTransport(serverRT), WithGatewayTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusNotFound, `{}`), nil
+	})))
+	restarted.loadState()
+	restarted.setProtocolVersion(2, false)
+	if err := restarted.sendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("sendHeartbeat returned error: %v", err)
+	}
+	if installIDs[0] == "" || installIDs[2] != installIDs[0] {
+		t.Fatalf("expected a stable install ID across restarts, got %q", installIDs)
+	}
+}
+
+func TestReportBatchesLimitedBySize(t *testing.T) {
+	var accepted, rejected int
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/agent/protocol") {
+			return jsonResponse(req, http.StatusOK, `{"protocolVersion":1,"maxReportBytes":40000}`), nil
+		}
+		var payload domain.ReportPayload
+		zr, _ := gzip.NewReader(req.Body)
+		_ = json.NewDecoder(zr).Decode(&payload)
+		// A proxy in front of the master that refuses anything over 150 updates.
+		if len(payload.Updates) > 150 {
+			rejected++
+			return jsonResponse(req, http.StatusRequestEntityTooLarge, `too large`), nil
+		}
+		accepted += len(payload.Updates)
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	r := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   1000,
+		MaxPendingUpdates: 1000,
+		MaxReportBytes:    1 << 20,
+	}, WithServerTransport(serverRT))
+
+	update := domain.TrafficUpdate{Domain: "example.com", Chain: "Proxy", Chains: []string{"Proxy", "HK 01"}, Rule: "DOMAIN-SUFFIX", RulePayload: strings.Repeat("x", 100), Upload: 1, TimestampMs: time.Now().UnixMilli()}
+	size := updateSize(update)
+	for i := 0; i < 400; i++ {
+		r.queue.push([]domain.TrafficUpdate{update})
+	}
+
+	if err := r.negotiateProtocol(context.Background()); err != nil {
+		t.Fatalf("negotiateProtocol returned error: %v", err)
+	}
+	if r.reportByteLimit != 40000 {
+		t.Fatalf("expected the advertised limit to apply, got %d", r.reportByteLimit)
+	}
+	pending := r.takePendingBatch()
+	if want := int(40000 / size); len(pending.updates) != want || pending.bytes > 40000 {
+		t.Fatalf("expected %d updates within 40000 bytes, got %d updates of %d bytes", want, len(pending.updates), pending.bytes)
+	}
+	r.requeue(pending, false)
+
+	// The first batch is over 150 updates: it is split and the limit halved.
+	for i := 0; i < 10 && accepted < 400; i++ {
+		_ = r.flushOnce(context.Background())
+	}
+	if accepted != 400 || rejected != 1 {
+		t.Fatalf("expected every update delivered after one 413, got %d accepted, %d rejected", accepted, rejected)
+	}
+	if r.reportByteLimit != 40000/size*size/2 {
+		t.Fatalf("expected the limit to drop to half the rejected batch, got %d", r.reportByteLimit)
+	}
+	if stats := r.buildHeartbeat().Stats; stats.AvgReportBytes <= 0 || stats.AvgReportBytes > r.reportByteLimit {
+		t.Fatalf("expected average report size within the lowered limit, got %+v", stats)
+	}
+}
+
+func TestPermanentRejectIsDeadLettered(t *testing.T) {
+	status := http.StatusBadRequest
+	var accepted int
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/agent/protocol") {
+			return jsonResponse(req, http.StatusOK, `{"protocolVersion":1}`), nil
+		}
+		var payload domain.ReportPayload
+		zr, _ := gzip.NewReader(req.Body)
+		_ = json.NewDecoder(zr).Decode(&payload)
+		if payload.Updates[0].Domain == "bad.example" && status != http.StatusOK {
+			return jsonResponse(req, status, `{"error":"invalid update"}`), nil
+		}
+		accepted += len(payload.Updates)
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	dir := filepath.Join(t.TempDir(), "deadletter")
+	r := NewRunner(config.Config{
+		ServerAPIBase:      "http://master.invalid/api",
+		AgentID:            "agent-test",
+		RequestTimeout:     time.Second,
+		ReportBatchSize:    1,
+		MaxPendingUpdates:  10,
+		DeadLetterDir:      dir,
+		DeadLetterMaxBytes: 1 << 20,
+	}, WithServerTransport(serverRT))
+	now := time.Now().UnixMilli()
+	r.queue.push([]domain.TrafficUpdate{
+		{Domain: "bad.example", Upload: 1, TimestampMs: now},
+		{Domain: "good.example", Upload: 1, TimestampMs: now},
+	})
+
+	if err := r.flushOnce(context.Background()); err == nil {
+		t.Fatalf("expected the rejected report to return an error")
+	}
+	if r.queue.len != 1 {
+		t.Fatalf("expected a permanently rejected batch not to be retried, got %d queued", r.queue.len)
+	}
+	if err := r.flushOnce(context.Background()); err != nil || accepted != 1 {
+		t.Fatalf("expected the next batch to go through, got %d accepted, %v", accepted, err)
+	}
+	files, _ := deadLetterFiles(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected one dead-letter file, got %v", files)
+	}
+	header, updates, _, err := readDeadLetter(files[0])
+	if err != nil || header.Status != http.StatusBadRequest || len(updates) != 1 || updates[0].Domain != "bad.example" {
+		t.Fatalf("unexpected dead-letter file: %+v, %+v, %v", header, updates, err)
+	}
+	if got := r.buildHeartbeat().Stats.DeadLettered; got != 1 {
+		t.Fatalf("expected 1 dead-lettered batch in stats, got %d", got)
+	}
+
+	// Rate limiting is transient: the batch stays queued for retry.
+	status = http.StatusTooManyRequests
+	r.queue.push([]domain.TrafficUpdate{{Domain: "bad.example", Upload: 1, TimestampMs: now}})
+	_ = r.flushOnce(context.Background())
+	if len(r.queue.segments) != 1 || r.queue.segments[0].report == nil {
+		t.Fatalf("expected a 429 to keep the batch for retry")
+	}
+	r.queue = updateQueue{}
+
+	status = http.StatusOK
+	summary, err := r.ReplayDeadLetters(context.Background())
+	if err != nil || summary.Replayed != 1 || summary.Updates != 1 || len(summary.Rejected) != 0 {
+		t.Fatalf("unexpected replay result: %+v, %v", summary, err)
+	}
+	if files, _ := deadLetterFiles(dir); len(files) != 0 || accepted != 2 {
+		t.Fatalf("expected the replayed file deleted and its update delivered, got %v, %d accepted", files, accepted)
+	}
+}
+
+func TestExhaustedReportMovesBehindNewerData(t *testing.T) {
+	var sent []string
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/agent/protocol") {
+			return jsonResponse(req, http.StatusOK, `{"protocolVersion":1}`), nil
+		}
+		var payload domain.ReportPayload
+		zr, _ := gzip.NewReader(req.Body)
+		_ = json.NewDecoder(zr).Decode(&payload)
+		if payload.Updates[0].Domain == "stuck.example" {
+			return jsonResponse(req, http.StatusServiceUnavailable, `busy`), nil
+		}
+		sent = append(sent, payload.Updates[0].Domain)
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	r := NewRunner(config.Config{
+		ServerAPIBase:     "http://master.invalid/api",
+		AgentID:           "agent-test",
+		RequestTimeout:    time.Second,
+		ReportBatchSize:   1,
+		MaxPendingUpdates: 10,
+		MaxReportAttempts: 3,
+		ExhaustedReports:  "requeue",
+	}, WithServerTransport(serverRT))
+	now := time.Now().UnixMilli()
+	r.queue.push([]domain.TrafficUpdate{
+		{Domain: "stuck.example", Upload: 1, TimestampMs: now},
+		{Domain: "fresh.example", Upload: 1, TimestampMs: now},
+	})
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		err := r.flushOnce(context.Background())
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("attempt %d:", attempt)) {
+			t.Fatalf("expected attempt %d in the error, got %v", attempt, err)
+		}
+	}
+	if segs := r.queue.segments; len(segs) != 2 || segs[0].report != nil || segs[1].report == nil {
+		t.Fatalf("expected the batch deferred behind newer data after 3 attempts, got %d segments", len(segs))
+	}
+	if pending, _ := r.queueStats(); pending != 2 {
+		t.Fatalf("expected deferred updates to count as pending, got %d", pending)
+	}
+
+	if err := r.flushOnce(context.Background()); err != nil || len(sent) != 1 || sent[0] != "fresh.example" {
+		t.Fatalf("expected newer data to go first, got %v, %v", sent, err)
+	}
+	// Then the deferred batch is tried again and keeps its count.
+	err := r.flushOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "attempt 4:") || r.queue.len != 1 {
+		t.Fatalf("expected the deferred batch retried with its attempt count, got %v, %d queued", err, r.queue.len)
+	}
+
+	// Being the oldest segment now, it goes first on overflow.
+	r.mu.Lock()
+	r.enqueueLocked(make([]domain.TrafficUpdate, 10))
+	r.mu.Unlock()
+	if pending, dropped := r.queueStats(); pending != 10 || dropped != 1 {
+		t.Fatalf("expected the deferred batch dropped on overflow, got %d pending, %d dropped", pending, dropped)
+	}
+}
+
+// TestUpdateQueueStaysInEnqueueOrder drives the queue through random
+// interleavings of ingests, overlapping posts that succeed, fail or split,
+// and overflow. Updates carry their enqueue order in Upload.
+func TestUpdateQueueStaysInEnqueueOrder(t *testing.T) {
+	property := func(ops []uint16) bool {
+		var q updateQueue
+		var next, accepted, dropped int64
+		var inflight []*pendingReport
+		fail := func(format string, args ...interface{}) bool {
+			t.Logf(format, args...)
+			return false
+		}
+		for _, op := range ops {
+			arg := int(op >> 3)
+			switch op % 6 {
+			case 0:
+				updates := make([]domain.TrafficUpdate, arg%8+1)
+				for i := range updates {
+					updates[i].Upload = next
+					next++
+				}
+				q.push(updates)
+			case 1:
+				if len(inflight) == 3 {
+					continue
+				}
+				p, _ := q.takeReport(math.MinInt64)
+				if p == nil {
+					out, orders, _, _ := q.take(arg%5+1, 0, math.MinInt64)
+					if len(out) == 0 {
+						continue
+					}
+					p = &pendingReport{updates: out, orders: orders}
+				}
+				for i := range p.updates {
+					if uint64(p.updates[i].Upload) != p.orders[i] || (i > 0 && p.updates[i].Upload <= p.updates[i-1].Upload) {
+						return fail("batch out of order: %+v, orders %v", p.updates, p.orders)
+					}
+				}
+				for _, seg := range q.segments {
+					if seg.updates[0].Upload < p.updates[len(p.updates)-1].Upload {
+						return fail("dequeued %d while older %d was still queued", p.updates[len(p.updates)-1].Upload, seg.updates[0].Upload)
+					}
+				}
+				inflight = append(inflight, p)
+			case 2, 3, 4:
+				if len(inflight) == 0 {
+					continue
+				}
+				i := arg % len(inflight)
+				p := inflight[i]
+				inflight = append(inflight[:i], inflight[i+1:]...)
+				switch op % 6 {
+				case 2:
+					accepted += int64(len(p.updates))
+				case 3:
+					q.requeue(p, true)
+				case 4:
+					q.requeue(p, false)
+				}
+			case 5:
+				dropped += int64(q.trim(arg%20 + 1))
+			}
+
+			n, last := 0, int64(-1)
+			for _, seg := range q.segments {
+				for i, u := range seg.updates {
+					if uint64(u.Upload) != seg.orders[i] {
+						return fail("update %d has enqueue order %d", u.Upload, seg.orders[i])
+					}
+					if u.Upload <= last {
+						return fail("queue out of order: %d after %d", u.Upload, last)
+					}
+					last = u.Upload
+					n++
+				}
+			}
+			if n != q.len {
+				return fail("queue length %d, counted %d", q.len, n)
+			}
+		}
+		for _, p := range inflight {
+			accepted += int64(len(p.updates))
+		}
+		if accepted+dropped+int64(q.len) != next {
+			return fail("%d accepted, %d dropped and %d queued of %d enqueued", accepted, dropped, q.len, next)
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkTakeBatchDuringIngest measures how long the reporter waits to take
+// a batch while the collector ingests a large gateway in a loop. p99-ns and
+// max-ns are the tail latencies of takeBatch.
+func BenchmarkTakeBatchDuringIngest(b *testing.B) {
+	runner := newClockTestRunner(newSystemClock())
+	runner.cfg.MaxPendingUpdates = 100000
+	snapshots := make([]domain.FlowSnapshot, 20000)
+	for i := range snapshots {
+		snapshots[i] = domain.FlowSnapshot{ID: fmt.Sprintf("flow-%d", i), Domain: fmt.Sprintf("host-%d.example.com", i%500), IP: "203.0.113.7"}
+	}
+
+	ingest := func() {
+		batch := make([]domain.FlowSnapshot, len(snapshots))
+		for i := range snapshots {
+			snapshots[i].Upload += 1000
+			snapshots[i].Download += 4000
+			batch[i] = snapshots[i]
+		}
+		runner.ingestSnapshots(batch)
+	}
+	ingest()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				ingest()
+			}
+		}
+	}()
+
+	latencies := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := range latencies {
+		start := time.Now()
+		_ = runner.takeBatch(100)
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+	b.ReportMetric(float64(latencies[len(latencies)-1]), "max-ns")
+}
+
+// BenchmarkReportFlush measures the allocations of posting one full report
+// batch, the agent's main source of garbage.
+func BenchmarkReportFlush(b *testing.B) {
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		return jsonResponse(req, http.StatusOK, `{"success":true}`), nil
+	})
+	runner := NewRunner(config.Config{
+		ServerAPIBase:   "http://master.test/api",
+		BackendID:       1,
+		BackendToken:    "token",
+		AgentID:         "agent-test",
+		RequestTimeout:  time.Second,
+		ReportBatchSize: 1000,
+	}, WithServerTransport(serverRT))
+	updates := make([]domain.TrafficUpdate, 1000)
+	for i := range updates {
+		updates[i] = domain.TrafficUpdate{
+			Domain: fmt.Sprintf("host-%d.example.com", i), IP: "203.0.113.7", Chain: "Proxy", Chains: []string{"Proxy", "HK-01"},
+			Rule: "DomainSuffix", RulePayload: "example.com", Upload: 1200, Download: 48000, SourceIP: "192.168.1.20", TimestampMs: 1700000000000,
+		}
+	}
+	payload := &domain.ReportPayload{BackendID: 1, AgentID: "agent-test", Updates: updates}
+
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := runner.postReport(ctx, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPostsFailOverToFallbackAndBack(t *testing.T) {
+	var mu sync.Mutex
+	primaryDown := true
+	var hosts []string
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts = append(hosts, req.URL.Host)
+		if req.URL.Host == "primary.test" && primaryDown {
+			return jsonResponse(req, http.StatusBadGateway, "bad gateway"), nil
+		}
+		return jsonResponse(req, http.StatusOK, `{"success":true}`), nil
+	})
+	clk := newFakeClock(1000)
+	runner := NewRunner(config.Config{
+		ServerAPIBase:         "http://primary.test/api",
+		ServerFallbackAPIBase: "http://fallback.test/api",
+		BackendID:             1,
+		BackendToken:          "token",
+		AgentID:               "agent-test",
+		RequestTimeout:        time.Second,
+	}, WithServerTransport(serverRT))
+	runner.clock = clk
+
+	ctx := context.Background()
+	for i := 0; i < serverFailoverAfter; i++ {
+		if err := runner.postJSON(ctx, "/agent/heartbeat", map[string]int{"n": i}); err == nil {
+			t.Fatalf("post %d: expected the primary's 502", i)
+		}
+	}
+	if err := runner.postJSON(ctx, "/agent/heartbeat", map[string]int{}); err != nil {
+		t.Fatalf("expected the post to go to the fallback, got %v", err)
+	}
+
+	// The primary recovers; the next probe finds it and posts move back.
+	mu.Lock()
+	primaryDown = false
+	mu.Unlock()
+	clk.advance(primaryProbeEvery)
+	for i := 0; i < 2; i++ {
+		if err := runner.postJSON(ctx, "/agent/heartbeat", map[string]int{}); err != nil {
+			t.Fatalf("post after recovery: %v", err)
+		}
+	}
+
+	want := []string{"primary.test", "primary.test", "primary.test", "fallback.test", "primary.test", "primary.test"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("expected posts to %v, got %v", want, hosts)
+	}
+}
+
+func TestFailoverRenegotiatesWithEachMaster(t *testing.T) {
+	var mu sync.Mutex
+	primaryDown := true
+	var reportHost, reportType string
+	var report map[string]json.RawMessage
+	serverRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		primary := req.URL.Host == "primary.test"
+		if primary && primaryDown {
+			return jsonResponse(req, http.StatusBadGateway, "bad gateway"), nil
+		}
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/agent/protocol"):
+			if !primary {
+				// The fallback is an older, v1-only master.
+				return jsonResponse(req, http.StatusNotFound, "not found"), nil
+			}
+			return jsonResponse(req, http.StatusOK, `{"protocolVersion":2,"encodings":["json","msgpack"]}`), nil
+		case strings.HasSuffix(req.URL.Path, "/agent/report"):
+			reportHost, reportType = req.URL.Host, req.Header.Get("Content-Type")
+			report = nil
+			if zr, err := gzip.NewReader(req.Body); err == nil && reportType == "application/json" {
+				_ = json.NewDecoder(zr).Decode(&report)
+			}
+		}
+		return jsonResponse(req, http.StatusOK, `{}`), nil
+	})
+	clk := newFakeClock(1000)
+	runner := NewRunner(config.Config{
+		ServerAPIBase:         "http://primary.test/api",
+		ServerFallbackAPIBase: "http://fallback.test/api",
+		BackendID:             1,
+		AgentID:               "agent-test",
+		RequestTimeout:        time.Second,
+		HeartbeatInterval:     10 * time.Millisecond,
+		ReportBatchSize:       10,
+		MaxPendingUpdates:     100,
+	}, WithServerTransport(serverRT))
+	runner.clock = clk
+	// Negotiated with the primary before it went down; it had also refused
+	// msgpack once.
+	runner.setProtocolVersion(2, true)
+	runner.msgpackRejected = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go runner.runHeartbeatLoop(ctx, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	flush := func() {
+		t.Helper()
+		runner.queue.push([]domain.TrafficUpdate{{Domain: "example.com", Chain: "DIRECT", Upload: 1, TimestampMs: time.Now().UnixMilli()}})
+		if err := runner.flushOnce(context.Background()); err != nil {
+			t.Fatalf("flush returned error: %v", err)
+		}
+	}
+
+	waitFor(t, func() bool {
+		runner.endpoints.mu.Lock()
+		defer runner.endpoints.mu.Unlock()
+		return runner.endpoints.fallback && !runner.endpoints.switched
+	})
+	if v := runner.protocol(); v != 1 || runner.useMsgpack() {
+		t.Fatalf("expected v1 JSON against the v1-only fallback, got v%d msgpack=%v", v, runner.useMsgpack())
+	}
+	flush()
+	mu.Lock()
+	if reportHost != "fallback.test" || reportType != "application/json" || string(report["protocolVersion"]) != "1" || report["batchId"] != nil {
+		t.Fatalf("expected a v1 JSON report to the fallback, got %s %s %v", reportHost, reportType, report)
+	}
+	primaryDown = false
+	mu.Unlock()
+
+	// The primary's next probe succeeds; moving back renegotiates v2, and
+	// the msgpack refusal seen before the failover no longer applies.
+	clk.advance(primaryProbeEvery)
+	waitFor(t, func() bool { return runner.protocol() == 2 })
+	if !runner.useMsgpack() {
+		t.Fatal("expected msgpack to be offered again after moving back to the primary")
+	}
+	flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if reportHost != "primary.test" || reportType == "application/json" {
+		t.Fatalf("expected a msgpack report to the primary, got %s %s", reportHost, reportType)
+	}
+}
+
+func TestUnchangedPollRefreshesFlowsWithoutIngest(t *testing.T) {
+	body := `{"connections":[{"id":"a","upload":10,"download":20,"metadata":{"host":"a.example.com"}},{"id":"b","upload":1,"download":2,"metadata":{"host":"b.example.com"}}]}`
+	gatewayRT := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(req, http.StatusOK, body), nil
+	})
+	clk := newFakeClock(1000)
+	runner := NewRunner(config.Config{
+		ServerAPIBase:       "http://master.invalid/api",
+		BackendID:           1,
+		AgentID:             "agent-test",
+		GatewayType:         "clash",
+		GatewayEndpoint:     "http://gateway.invalid",
+		GatewayPollInterval: time.Second,
+		RequestTimeout:      time.Second,
+		ReportBatchSize:     10,
+		MaxPendingUpdates:   100,
+		StaleFlowTimeout:    time.Minute,
+	}, WithGatewayTransport(gatewayRT))
+	runner.clock = clk
+
+	ctx := context.Background()
+	if _, _, err := runner.collectOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Flow b closes; the gateway then idles with the same list poll after poll.
+	body = `{"connections":[{"id":"a","upload":10,"download":20,"metadata":{"host":"a.example.com"}}]}`
+	clk.advance(time.Second)
+	if _, _, err := runner.collectOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = runner.takeBatch(10)
+	for i := 0; i < 90; i++ {
+		clk.advance(time.Second)
+		n, _, err := runner.collectOnce(ctx)
+		if err != nil || n != 1 {
+			t.Fatalf("poll %d: expected the one listed flow refreshed, got %d, %v", i, n, err)
+		}
+	}
+
+	if got := runner.skippedPolls.Load(); got != 90 {
+		t.Fatalf("expected 90 skipped polls, got %d", got)
+	}
+	if f, ok := runner.flows["a"]; !ok || f.LastSeen != clk.Monotonic() {
+		t.Fatalf("expected flow a seen on the last poll, got %+v (tracked %v)", f, ok)
+	}
+	runner.sweepStaleFlows()
+	if _, ok := runner.flows["b"]; ok {
+		t.Fatal("expected flow b evicted after --stale-flow-timeout despite skipped polls")
+	}
+	if pending, _ := runner.queueStats(); pending != 0 {
+		t.Fatalf("expected no updates from unchanged polls, got %d", pending)
+	}
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// samplingEnabled reports whether --sampling-rate is below 1. A zero rate is
+// the unset value and means every flow is reported.
+func (r *Runner) samplingEnabled() bool {
+	return r.cfg.SamplingRate > 0 && r.cfg.SamplingRate < 1
+}
+
+// sampled reports whether the flow with this ID is kept at the configured
+// rate. Hashing the ID keeps the decision stable for the flow's lifetime.
+func (r *Runner) sampled(flowID string) bool {
+	if !r.samplingEnabled() {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(flowID))
+	return float64(h.Sum64())/float64(math.MaxUint64) < r.cfg.SamplingRate
+}
+
+// scaleSampled extrapolates a sampled delta by the inverse sampling rate.
+func (r *Runner) scaleSampled(v int64) int64 {
+	return int64(math.Round(float64(v) / r.cfg.SamplingRate))
+}
+
+// queueChainTotals turns the per-chain totals kept while sampling into
+// aggregate updates so the master keeps exact totals.
+func (r *Runner) queueChainTotals() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.chainTotals) == 0 {
+		return
+	}
+	r.enqueueLocked(r.chainTotals.drain(r.correctTimestamp(r.clock.Now().UnixMilli()), true))
+}
@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+)
+
+const selfUpdateDownloadTimeout = 5 * time.Minute
+
+// maybeSelfUpdate downloads and installs the version announced by the master,
+// then stops the runner so main can re-exec the new binary after the final flush.
+// It runs in its own goroutine; r.updating keeps a second heartbeat from
+// starting another download meanwhile.
+func (r *Runner) maybeSelfUpdate(ctx context.Context, info heartbeatResponse) {
+	target := strings.TrimSpace(info.LatestVersion)
+	if !shouldApplyUpdate(config.AgentVersion, target, info.Force) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&r.updating, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&r.updating, 0)
+
+	log.Printf("[agent:%s] self-update: %s -> %s", r.cfg.AgentID, config.AgentVersion, target)
+	exe, err := r.installUpdate(ctx, info)
+	if err != nil {
+		log.Printf("[agent:%s] self-update failed: %v", r.cfg.AgentID, err)
+		return
+	}
+
+	log.Printf("[agent:%s] self-update installed %s, restarting", r.cfg.AgentID, target)
+	r.mu.Lock()
+	r.restartPath = exe
+	stop := r.stop
+	r.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// installUpdate downloads the new binary next to the current executable,
+// verifies its checksum and swaps it in, keeping the previous binary as .old.
+func (r *Runner) installUpdate(ctx context.Context, info heartbeatResponse) (string, error) {
+	if strings.TrimSpace(info.DownloadURL) == "" {
+		return "", errors.New("missing downloadUrl")
+	}
+	expected := strings.ToLower(strings.TrimSpace(info.SHA256))
+	if len(expected) != sha256.Size*2 {
+		return "", errors.New("missing or invalid sha256")
+	}
+
+	exe, err := r.executable()
+	if err != nil {
+		return "", fmt.Errorf("locate executable: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), filepath.Base(exe)+".update-*")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	sum, err := r.downloadTo(ctx, strings.TrimSpace(info.DownloadURL), tmp)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if sum != expected {
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", expected, sum)
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return "", fmt.Errorf("chmod update: %w", err)
+	}
+
+	oldPath := exe + ".old"
+	_ = os.Remove(oldPath)
+	if err := os.Link(exe, oldPath); err != nil {
+		log.Printf("[agent:%s] self-update: could not keep previous binary: %v", r.cfg.AgentID, err)
+	}
+	if err := os.Rename(tmpPath, exe); err != nil {
+		return "", fmt.Errorf("replace executable: %w", err)
+	}
+	return exe, nil
+}
+
+func (r *Runner) downloadTo(ctx context.Context, url string, w io.Writer) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, selfUpdateDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	// Reuse the transport but not the short report timeout; binaries are large.
+	client := &http.Client{Transport: r.httpClient.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("download update: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("download update: http %d", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", fmt.Errorf("download update: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// PendingRestart returns the executable to re-exec after Run returns, or ""
+// when no self-update was installed.
+func (r *Runner) PendingRestart() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.restartPath
+}
+
+// Reexec replaces the current process with exe, keeping the original arguments
+// and environment. The caller must have released the instance lock.
+func Reexec(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// shouldApplyUpdate reports whether target should replace current. Downgrades
+// and unparseable versions (e.g. "dev" builds) are refused unless forced.
+func shouldApplyUpdate(current, target string, force bool) bool {
+	if target == "" || target == current {
+		return false
+	}
+	if force {
+		return true
+	}
+	cur, ok1 := parseVersion(current)
+	next, ok2 := parseVersion(target)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range cur {
+		if next[i] != cur[i] {
+			return next[i] > cur[i]
+		}
+	}
+	return false
+}
+
+// parseVersion accepts "1.2.3", "v1.2.3" and release tags like "agent-v1.2.3".
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimSpace(v)
+	v = strings.TrimPrefix(v, "agent-")
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// flowSpeeds returns the flow's current transfer rate in bytes per second.
+// Speeds reported by the gateway (Surge) win; otherwise the deltas are divided
+// by the time actually elapsed since the flow was last observed, which after a
+// backoff can be many poll intervals. A flow seen for the first time has no
+// previous observation and so no derived speed.
+func flowSpeeds(s domain.FlowSnapshot, hasPrev bool, elapsed time.Duration, deltaUp, deltaDown int64) (up, down int64) {
+	if s.UploadSpeedBps > 0 || s.DownloadSpeedBps > 0 {
+		return s.UploadSpeedBps, s.DownloadSpeedBps
+	}
+	if !hasPrev || elapsed <= 0 {
+		return 0, 0
+	}
+	ms := elapsed.Milliseconds()
+	if ms <= 0 {
+		return 0, 0
+	}
+	return deltaUp * 1000 / ms, deltaDown * 1000 / ms
+}
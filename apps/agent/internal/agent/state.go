@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval is how often acknowledged report sequences are written to
+// --state-file.
+const stateSaveInterval = time.Minute
+
+// agentState is what --state-file keeps across restarts.
+type agentState struct {
+	// ReportSeq is the highest report sequence number the master accepted.
+	ReportSeq int64 `json:"reportSeq"`
+	// InstallID is a random nonce identifying this install in heartbeats, so
+	// the master can tell two hosts sharing an agent ID from a restart.
+	InstallID string `json:"installId,omitempty"`
+}
+
+func readState(path string) (agentState, error) {
+	var st agentState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// writeState replaces the state file atomically so a crash mid-write leaves
+// the previous state intact.
+func writeState(path string, st agentState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores persisted counters. A missing file is a first start; an
+// unreadable one is logged and ignored rather than blocking startup. The
+// install ID generated by NewRunner is persisted on first start so it stays
+// stable across restarts.
+func (r *Runner) loadState() {
+	if r.cfg.StateFile == "" {
+		return
+	}
+	st, err := readState(r.cfg.StateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[agent:%s] ignoring state file %s: %v", r.cfg.AgentID, r.cfg.StateFile, err)
+		return
+	}
+	if err == nil {
+		r.mu.Lock()
+		r.reportSeq = st.ReportSeq
+		r.ackedSeq = st.ReportSeq
+		if st.InstallID != "" {
+			r.installID = st.InstallID
+		}
+		r.mu.Unlock()
+		log.Printf("[agent:%s] resuming report sequence after %d", r.cfg.AgentID, st.ReportSeq)
+	}
+	if st.InstallID == "" && !r.cfg.DryRun {
+		r.saveState()
+	}
+}
+
+// ackReport records that the master accepted the report with sequence seq.
+// The new high-water mark is only marked dirty: writing the file after every
+// report would wear out a router's flash, so saveDirtyState persists it on
+// stateSaveInterval and at shutdown. A crash in between resumes at an older
+// seq, which the master sees as retransmissions.
+func (r *Runner) ackReport(seq int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq <= r.ackedSeq {
+		return
+	}
+	r.ackedSeq = seq
+	// A dry run's reports never reached the master, so its sequence must not
+	// carry over into a real run.
+	r.stateDirty = r.cfg.StateFile != "" && !r.cfg.DryRun
+}
+
+// runStateSaveLoop persists acknowledged report sequences every
+// stateSaveInterval.
+func (r *Runner) runStateSaveLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.saveDirtyState()
+		}
+	}
+}
+
+// saveDirtyState writes --state-file if anything changed since the last write.
+func (r *Runner) saveDirtyState() {
+	r.mu.Lock()
+	dirty := r.stateDirty
+	r.stateDirty = false
+	r.mu.Unlock()
+	if dirty {
+		r.saveState()
+	}
+}
+
+// saveState writes the current state to --state-file.
+func (r *Runner) saveState() {
+	// Serialize writers and snapshot under stateMu so a slower concurrent
+	// post cannot overwrite a newer sequence with an older one.
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	r.mu.Lock()
+	st := agentState{ReportSeq: r.ackedSeq, InstallID: r.installID}
+	r.mu.Unlock()
+	if err := writeState(r.cfg.StateFile, st); err != nil {
+		log.Printf("[agent:%s] failed to write state file: %v", r.cfg.AgentID, err)
+	}
+}
@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+const (
+	// proxyBaselineAlpha weights new samples in the rolling proxy-count baseline.
+	proxyBaselineAlpha = 0.3
+	// proxyBaselineMin avoids warning on tiny hand-written configs where a
+	// single removed node looks like a sharp drop.
+	proxyBaselineMin = 4
+)
+
+// nonLeafProxyTypes are policy groups and built-in policies, which stay put
+// when a subscription expires and so must not count toward the proxy total.
+var nonLeafProxyTypes = map[string]struct{}{
+	"selector": {}, "urltest": {}, "fallback": {}, "loadbalance": {}, "relay": {},
+	"direct": {}, "reject": {}, "rejectdrop": {}, "compatible": {}, "pass": {},
+}
+
+// countLeafProxies counts actual proxy nodes in a config snapshot.
+func countLeafProxies(snap *domain.GatewayConfigSnapshot) int {
+	n := 0
+	for _, p := range snap.Proxies {
+		if p.Now != "" {
+			continue
+		}
+		if _, ok := nonLeafProxyTypes[strings.ToLower(p.Type)]; ok {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// proxyCountMonitor keeps a rolling baseline of the proxy count and flags a
+// sharp drop, which usually means a remote subscription expired and traffic is
+// silently falling back to DIRECT. While the warning is active the baseline is
+// frozen so a persistent drop keeps being reported.
+type proxyCountMonitor struct {
+	mu       sync.Mutex
+	baseline float64
+	samples  int
+	warning  string
+}
+
+// observe records count and returns the active warning and whether it changed.
+func (m *proxyCountMonitor) observe(count int, threshold float64) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.warning
+	switch {
+	case threshold <= 0:
+		m.warning = ""
+	case m.samples > 0 && m.baseline >= proxyBaselineMin && float64(count) < m.baseline*threshold:
+		m.warning = fmt.Sprintf("proxy count dropped from ~%d to %d; a subscription may have expired", int(math.Round(m.baseline)), count)
+	default:
+		m.warning = ""
+		if m.samples == 0 {
+			m.baseline = float64(count)
+		} else {
+			m.baseline += proxyBaselineAlpha * (float64(count) - m.baseline)
+		}
+		m.samples++
+	}
+	return m.warning, m.warning != prev
+}
+
+func (m *proxyCountMonitor) current() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.warning
+}
+
+func (r *Runner) checkProxyCount(snap *domain.GatewayConfigSnapshot) {
+	count := countLeafProxies(snap)
+	warning, changed := r.proxyCount.observe(count, r.cfg.ProxyDropThreshold)
+	if !changed {
+		return
+	}
+	if warning != "" {
+		log.Printf("[agent:%s] warning: %s", r.cfg.AgentID, warning)
+	} else {
+		log.Printf("[agent:%s] proxy count recovered (%d)", r.cfg.AgentID, count)
+	}
+}
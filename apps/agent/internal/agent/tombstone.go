@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+const (
+	// tombstoneTTLPolls derives the default --tombstone-ttl from the poll
+	// interval.
+	tombstoneTTLPolls = 150
+	// tombstoneLimit bounds the tombstones kept on high-churn gateways; the
+	// oldest go first.
+	tombstoneLimit = 16384
+)
+
+// tombstone keeps the last counters of a flow evicted by --stale-flow-timeout,
+// so a flow the gateway lists again (e.g. after a partial connection list) is
+// not counted from zero a second time.
+type tombstone struct {
+	lastUpload int64
+	lastDown   int64
+	counted    bool
+	lastSeen   time.Duration // monotonic
+	evictedAt  time.Duration // monotonic
+}
+
+type tombstoneRef struct {
+	id string
+	at time.Duration
+}
+
+// tombstoneTTL returns how long tombstones are kept: --tombstone-ttl, or
+// tombstoneTTLPolls poll intervals when it is not set.
+func (r *Runner) tombstoneTTL() time.Duration {
+	if r.cfg.TombstoneTTL > 0 {
+		return r.cfg.TombstoneTTL
+	}
+	return tombstoneTTLPolls * r.cfg.GatewayPollInterval
+}
+
+// buryFlowLocked records a tombstone for an evicted flow. Callers must hold
+// r.flowMu.
+func (r *Runner) buryFlowLocked(id string, f trackedFlow, mono time.Duration) {
+	for len(r.tombstoneOrder) >= tombstoneLimit {
+		r.popTombstoneLocked()
+	}
+	r.tombstones[id] = tombstone{lastUpload: f.LastUpload, lastDown: f.LastDown, counted: f.Counted, lastSeen: f.LastSeen, evictedAt: mono}
+	r.tombstoneOrder = append(r.tombstoneOrder, tombstoneRef{id: id, at: mono})
+}
+
+// reviveFlowLocked returns the tombstone of a flow that reappeared, if one is
+// still within the TTL. Counters below the tombstone's belong to a different
+// flow reusing the ID (a restarted Surge numbers requests from 1 again), so
+// that flow starts fresh. Callers must hold r.flowMu.
+func (r *Runner) reviveFlowLocked(s domain.FlowSnapshot, mono time.Duration) (tombstone, bool) {
+	t, ok := r.tombstones[s.ID]
+	if !ok {
+		return tombstone{}, false
+	}
+	delete(r.tombstones, s.ID)
+	if mono-t.evictedAt > r.tombstoneTTL() || s.Upload < t.lastUpload || s.Download < t.lastDown {
+		return tombstone{}, false
+	}
+	r.revivedFlows.Add(1)
+	return t, true
+}
+
+// pruneTombstonesLocked drops tombstones past the TTL. Evictions happen in
+// monotonic order, so the expired ones are at the head. Callers must hold
+// r.flowMu.
+func (r *Runner) pruneTombstonesLocked(mono time.Duration) {
+	ttl := r.tombstoneTTL()
+	for len(r.tombstoneOrder) > 0 && mono-r.tombstoneOrder[0].at > ttl {
+		r.popTombstoneLocked()
+	}
+}
+
+func (r *Runner) popTombstoneLocked() {
+	ref := r.tombstoneOrder[0]
+	r.tombstoneOrder[0] = tombstoneRef{}
+	r.tombstoneOrder = r.tombstoneOrder[1:]
+	// The flow may have been revived and evicted again since; only the
+	// matching tombstone goes.
+	if t, ok := r.tombstones[ref.id]; ok && t.evictedAt == ref.at {
+		delete(r.tombstones, ref.id)
+	}
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+)
+
+// newServerTransport builds the transport shared by every master-bound request
+// (report, heartbeat, config, policy state). Idle settings are tuned so the
+// 2s report cadence keeps reusing one warm connection instead of handshaking.
+// --server-http-version pins the protocol; the gateway transport is separate
+// and stays on HTTP/1.1.
+func newServerTransport(cfg config.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          cfg.ServerMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.ServerMaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.ServerIdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.ServerTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     cfg.ServerForceHTTP2,
+	}
+	if cfg.ServerCABundle != "" {
+		// Parse already loaded the bundle once; this only fails if the file
+		// changed in between, and requests to an internal CA then fail loudly.
+		if pool, err := config.LoadCABundle(cfg.ServerCABundle); err == nil {
+			t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		} else {
+			log.Printf("[agent:%s] failed to load server CA bundle: %v", cfg.AgentID, err)
+		}
+	}
+	switch cfg.ServerHTTPVersion {
+	case "1.1":
+		// A non-nil empty map disables the transport's HTTP/2 upgrade.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case "2":
+		// The transport appends http/1.1 back to NextProtos, so doServer
+		// also rejects responses that were not served over HTTP/2.
+		t.ForceAttemptHTTP2 = true
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+	return t
+}
+
+// connStats counts whether master requests reused a pooled connection, which
+// is how we confirm keep-alive actually works behind proxies.
+type connStats struct {
+	reused int64
+	fresh  int64
+}
+
+func (s *connStats) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&s.reused, 1)
+			} else {
+				atomic.AddInt64(&s.fresh, 1)
+			}
+		},
+	})
+}
+
+func (s *connStats) snapshot() (reused, fresh int64) {
+	return atomic.LoadInt64(&s.reused), atomic.LoadInt64(&s.fresh)
+}
+
+// clientIDHeader carries --report-client-id on posts so the master can
+// attribute them to a logical identity when it only sees a proxy's address.
+const clientIDHeader = "X-Client-ID"
+
+// requestIDKey carries an X-Request-ID chosen by the caller in a context.
+type requestIDKey struct{}
+
+// withRequestID makes master requests made with ctx send id as X-Request-ID,
+// so every retry of a report shows up under its requestId on both sides.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// newServerRequest builds a master request with auth, an X-Request-ID (fresh
+// unless set by withRequestID, so both sides can grep the same exchange) and
+// connection-reuse tracing.
+func (r *Runner) newServerRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, string, error) {
+	req, err := http.NewRequestWithContext(r.conns.trace(ctx), method, r.serverBase()+path, body)
+	if err != nil {
+		return nil, "", err
+	}
+	traceID, _ := ctx.Value(requestIDKey{}).(string)
+	if traceID == "" {
+		traceID = newRequestID()
+	}
+	for name, values := range r.cfg.ServerHeaders {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+r.cfg.BackendToken)
+	req.Header.Set("X-Request-ID", traceID)
+	return req, traceID, nil
+}
+
+// doServer sends a master request, feeds the response Date header into the
+// clock skew estimate and the outcome into --server-url-fallback selection.
+// With --server-http-version 2 a response over any other protocol is an error.
+func (r *Runner) doServer(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		r.observeServer(req.URL, 0, err)
+		return nil, err
+	}
+	if r.cfg.ServerHTTPVersion == "2" && resp.ProtoMajor != 2 {
+		drainAndClose(resp.Body)
+		err := fmt.Errorf("master answered over %s, but --server-http-version is 2", resp.Proto)
+		r.observeServer(req.URL, 0, err)
+		return nil, err
+	}
+	r.observeServer(req.URL, resp.StatusCode, nil)
+	r.observeServerClock(resp, sent)
+	return resp, nil
+}
+
+// drainAndClose consumes a bounded amount of the body so the connection can
+// go back to the idle pool.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64*1024))
+	body.Close()
+}
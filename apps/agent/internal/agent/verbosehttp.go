@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/foru17/neko-master/apps/agent/internal/config"
+)
+
+// verboseHTTPBodyLimit truncates request bodies logged by --verbose-http; a
+// full report can be megabytes.
+const verboseHTTPBodyLimit = 4096
+
+// logHTTPRequest logs a master post for --verbose-http, before gzip.
+func (r *Runner) logHTTPRequest(req *http.Request, traceID string, body []byte) {
+	log.Printf("[agent:%s] http> %s %s [request-id=%s] %s\n%s", r.cfg.AgentID, req.Method, req.URL.Path, traceID,
+		r.redactedHeaders(req.Header), verboseBody(req.Header.Get("Content-Type"), body, verboseHTTPBodyLimit))
+}
+
+// logHTTPResponse logs the master's reply for --verbose-http. body is as much
+// as the agent reads, so it is logged whole.
+func (r *Runner) logHTTPResponse(resp *http.Response, traceID string, body []byte) {
+	log.Printf("[agent:%s] http< %d %s [request-id=%s] %s\n%s", r.cfg.AgentID, resp.StatusCode, http.StatusText(resp.StatusCode), traceID,
+		r.redactedHeaders(resp.Header), verboseBody(resp.Header.Get("Content-Type"), body, len(body)))
+}
+
+// redactedHeaders renders headers on one line in sorted order. The backend
+// token and --server-header values are shown as fingerprints, as in
+// dump-config.
+func (r *Runner) redactedHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, v := range h[name] {
+			switch {
+			case name == "Authorization":
+				v = "Bearer " + config.Fingerprint(strings.TrimPrefix(v, "Bearer "))
+			case r.cfg.ServerHeaders[name] != nil:
+				v = config.Fingerprint(v)
+			}
+			parts = append(parts, name+": "+v)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// verboseBody returns body for logging, cut to limit bytes. Binary bodies
+// (msgpack reports) are summarized by size.
+func verboseBody(contentType string, body []byte, limit int) string {
+	if len(body) == 0 {
+		return "(empty body)"
+	}
+	if strings.Contains(contentType, "msgpack") || !utf8.Valid(body) {
+		return fmt.Sprintf("(%d bytes %s)", len(body), defaultString(contentType, "binary"))
+	}
+	if len(body) <= limit {
+		return string(body)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", body[:limit], len(body))
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Subcommands of neko-agent. Run is the default when no subcommand is given.
+const (
+	CommandRun        = "run"
+	CommandCheck      = "check"
+	CommandDumpConfig = "dump-config"
+	CommandVersion    = "version"
+	// CommandDeadLetterReplay is the two-word `deadletter replay` command.
+	CommandDeadLetterReplay = "deadletter replay"
+)
+
+const synopsis = "--server-url <url> --backend-id <id> --backend-token <token> --gateway-type <clash|surge> --gateway-url <url> [options]"
+
+// ParseCommand splits the subcommand off args and parses its flags. Without a
+// subcommand, or when args start with a flag, the command is run, so command
+// lines from before subcommands existed keep working unchanged.
+func ParseCommand(args []string) (string, Config, error) {
+	cmd := CommandRun
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd == "deadletter" {
+		if len(args) == 0 || args[0] != "replay" {
+			return CommandDeadLetterReplay, Config{}, errors.New("usage: neko-agent deadletter replay [options]")
+		}
+		cmd, args = CommandDeadLetterReplay, args[1:]
+	}
+
+	switch cmd {
+	case CommandRun:
+		cfg, err := Parse(args)
+		return cmd, cfg, err
+	case CommandCheck, CommandDumpConfig, CommandDeadLetterReplay:
+		fs := newFlagSet("neko-agent " + cmd)
+		o := registerFlags(fs)
+		if err := parseFlags(fs, args); err != nil {
+			return cmd, Config{}, err
+		}
+		cfg, err := o.config()
+		return cmd, cfg, err
+	case CommandVersion:
+		return cmd, Config{}, parseFlags(newFlagSet("neko-agent "+cmd), args)
+	default:
+		return cmd, Config{}, fmt.Errorf("unknown command %q (want run, check, dump-config, deadletter or version)", cmd)
+	}
+}
+
+// CommandUsage returns the help text of cmd.
+func CommandUsage(cmd string) string {
+	var lines []string
+	switch cmd {
+	case CommandCheck:
+		lines = append([]string{
+			"Usage:",
+			"  neko-agent check " + synopsis,
+			"",
+			"Poll the gateway and fetch its config once, negotiate with the master, send",
+			"one heartbeat and compare clocks, then print a table and exit non-zero if any",
+			"check failed. Accepts the flags of run except --once, --print-config and --version.",
+			"",
+		}, flagUsage...)
+	case CommandDumpConfig:
+		lines = append([]string{
+			"Usage:",
+			"  neko-agent dump-config " + synopsis,
+			"",
+			"Print the effective configuration as YAML, tokens shown as fingerprints, and exit.",
+			"Accepts the flags of run except --once, --print-config and --version.",
+			"",
+		}, flagUsage...)
+	case CommandDeadLetterReplay:
+		lines = append([]string{
+			"Usage:",
+			"  neko-agent deadletter replay " + synopsis,
+			"",
+			"Resubmit the batches in --dead-letter-dir that the master rejected, oldest first,",
+			"deleting each once accepted, and exit non-zero if any was rejected again.",
+			"Accepts the flags of run except --once, --print-config and --version.",
+			"",
+		}, flagUsage...)
+	case CommandVersion:
+		lines = []string{
+			"Usage:",
+			"  neko-agent version",
+			"",
+			"Print the agent version and exit.",
+		}
+	default:
+		lines = append([]string{
+			"Usage:",
+			"  neko-agent [run] " + synopsis,
+			"  neko-agent <command> [options]",
+			"",
+			"Commands:",
+			"  run                     collect and report traffic (default)",
+			"  check                   validate gateway and master connectivity, then exit",
+			"  dump-config             print the effective configuration as YAML and exit",
+			"  deadletter replay       resubmit report batches the master rejected",
+			"  version                 print version",
+			"",
+			"Run `neko-agent <command> --help` for the help of a command.",
+			"",
+		}, flagUsage...)
+		lines = append(lines, runFlagUsage...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
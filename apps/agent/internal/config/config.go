@@ -6,6 +6,10 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,11 +17,18 @@ import (
 // AgentVersion is set at build time via -ldflags "-X ...config.AgentVersion=<tag>"
 // Falls back to "dev" for local/untagged builds.
 var AgentVersion = "dev"
-const AgentProtocolVersion = 1
+
+// AgentProtocolVersion is the newest master protocol this build speaks and
+// AgentMinProtocolVersion the oldest; the runner negotiates within this range.
+const (
+	AgentProtocolVersion    = 2
+	AgentMinProtocolVersion = 1
+)
 
 var (
-	ErrHelp    = errors.New("help requested")
-	ErrVersion = errors.New("version requested")
+	ErrHelp        = errors.New("help requested")
+	ErrVersion     = errors.New("version requested")
+	ErrPrintConfig = errors.New("print config requested")
 )
 
 type Config struct {
@@ -25,77 +36,531 @@ type Config struct {
 	BackendID           int
 	BackendToken        string
 	AgentID             string
+	AgentIDMode         string
 	LogEnabled          bool
 	GatewayType         string
 	GatewayEndpoint     string
 	GatewayToken        string
+	GatewayBasicUser    string
+	GatewayBasicPass    string
+	SurgeRequestSource  string
+	GatewayFlavor       string
 	ReportInterval      time.Duration
 	HeartbeatInterval   time.Duration
 	GatewayPollInterval time.Duration
+	GatewayPollMin      time.Duration
+	GatewayPollMax      time.Duration
 	RequestTimeout      time.Duration
 	ReportBatchSize     int
+	MaxReportBytes      int64
+	MaxReportAttempts   int
+	ExhaustedReports    string
 	MaxPendingUpdates   int
 	StaleFlowTimeout    time.Duration
+	TombstoneTTL        time.Duration
+	MaxUpdateAge        time.Duration
+	SamplingRate        float64
+	ReportGranularity   string
+	MaxPollDelta        int64
+	ImplausibleDelta    string
+	TimestampSource     string
+	MaxTimestampSkew    time.Duration
+	SuppressFakeIP      bool
+	ReportBlocked       bool
+	SelfUpdate          bool
+	DisableConfigSync   bool
+	DisablePolicySync   bool
+	DisableHeartbeat    bool
+	BackoffJitter       bool
+	IntervalJitter      float64
+	BatchPosts          bool
+	MaxInflightPosts    int
+	LockDir             string
+	Takeover            string
+	TakeoverGrace       time.Duration
+	StateFile           string
+	DeadLetterDir       string
+	DeadLetterMaxBytes  int64
+	AdminListen         string
+	AdminToken          string
+	DryRun              bool
+	VerboseHTTP         bool
+	StrictConfig        bool
+	Once                bool
+	ReportMode          string
+	EventThreshold      int64
+	EventMinInterval    time.Duration
+	RecordDir           string
+	RecordMaxBytes      int64
+	ReplayDir           string
+	ReplaySpeed         float64
+
+	SlowCollectThreshold      time.Duration
+	GatewayMaxResponseBytes   int64
+	MaxTrackedFlows           int
+	ClashPolicyProviders      string
+	PreserveGatewayOrder      bool
+	ReportRuleStats           bool
+	ClashLogs                 bool
+	ServerMaxIdleConns        int
+	ServerMaxIdleConnsPerHost int
+	ServerIdleConnTimeout     time.Duration
+	ServerTLSHandshakeTimeout time.Duration
+	ServerForceHTTP2          bool
+	ServerHTTPVersion         string
+	ServerCABundle            string
+	ServerHeaders             http.Header
+	ServerFallbackAPIBase     string
+	ReportClientID            string
+	CorrectClockSkew          bool
+	ClockSkewWarn             time.Duration
+	GeoIPDB                   string
+	ASNDB                     string
+	DatacenterASNs            string
+	ReverseDNS                bool
+	ReverseDNSWorkers         int
+	ReverseDNSTimeout         time.Duration
+	ProxyDropThreshold        float64
+	AllowCommands             bool
 }
 
+// Parse parses the flags of the default run command.
 func Parse(args []string) (Config, error) {
-	fs := flag.NewFlagSet("neko-agent", flag.ContinueOnError)
-	fs.SetOutput(new(strings.Builder))
-
-	serverURL := fs.String("server-url", "", "Neko Master server URL, e.g. https://neko.example.com")
-	backendID := fs.Int("backend-id", 0, "Backend ID configured in Neko Master")
-	backendToken := fs.String("backend-token", "", "Backend token for agent authentication")
-	agentID := fs.String("agent-id", "", "Agent ID (optional, auto-generated from backend-token if not provided)")
-	gatewayType := fs.String("gateway-type", "clash", "Gateway type: clash or surge")
-	gatewayURL := fs.String("gateway-url", "", "Gateway control endpoint URL")
-	gatewayToken := fs.String("gateway-token", "", "Gateway secret token (optional)")
-	logEnabled := fs.Bool("log", true, "Enable runtime logs (set false to disable)")
-
-	reportInterval := fs.Duration("report-interval", 2*time.Second, "Report interval, e.g. 2s")
-	heartbeatInterval := fs.Duration("heartbeat-interval", 30*time.Second, "Heartbeat interval")
-	gatewayPollInterval := fs.Duration("gateway-poll-interval", 2*time.Second, "Gateway polling interval")
-	requestTimeout := fs.Duration("request-timeout", 15*time.Second, "HTTP request timeout")
-	reportBatchSize := fs.Int("report-batch-size", 1000, "Maximum updates per report request")
-	maxPending := fs.Int("max-pending-updates", 50000, "Maximum buffered updates in memory")
-	staleFlowTimeout := fs.Duration("stale-flow-timeout", 5*time.Minute, "Flow state stale timeout")
+	fs := newFlagSet("neko-agent")
+	o := registerFlags(fs)
+	once := fs.Bool("once", false, "Poll the gateway once, report, send one heartbeat and config snapshot, then exit")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration (secrets redacted) and exit")
 	showVersion := fs.Bool("version", false, "Print version and exit")
-	help := fs.Bool("help", false, "Show help")
 
+	if err := parseFlags(fs, args); err != nil {
+		return Config{}, err
+	}
+	if *showVersion {
+		return Config{}, ErrVersion
+	}
+
+	cfg, err := o.config()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.Once = *once
+	if *printConfig {
+		return cfg, ErrPrintConfig
+	}
+	return cfg, nil
+}
+
+// newFlagSet returns a FlagSet that reports errors to the caller instead of
+// printing them, with the --help flag every subcommand accepts.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	fs.Bool("help", false, "Show help")
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
-			return Config{}, ErrHelp
+			return ErrHelp
 		}
-		return Config{}, err
+		return err
+	}
+	if help := fs.Lookup("help"); help != nil && help.Value.String() == "true" {
+		return ErrHelp
 	}
+	return nil
+}
 
-	if *help {
-		return Config{}, ErrHelp
+// options holds the flags that make up a Config. registerFlags binds them to
+// a FlagSet so every subcommand that needs a Config accepts the same flags.
+type options struct {
+	serverURL                 *string
+	serverURLFallback         *string
+	backendID                 *int
+	backendToken              *string
+	agentID                   *string
+	agentIDMode               *string
+	gatewayType               *string
+	gatewayURL                *string
+	gatewayToken              *string
+	gatewayBasicUser          *string
+	gatewayBasicPass          *string
+	surgeRequestSource        *string
+	gatewayMaxResponseBytes   *int64
+	clashPolicyProviders      *string
+	gatewayFlavor             *string
+	logEnabled                *bool
+	reportInterval            *time.Duration
+	heartbeatInterval         *time.Duration
+	gatewayPollInterval       *time.Duration
+	gatewayPollMin            *time.Duration
+	gatewayPollMax            *time.Duration
+	slowCollectThreshold      *time.Duration
+	requestTimeout            *time.Duration
+	reportBatchSize           *int
+	maxReportBytes            *int64
+	maxReportAttempts         *int
+	exhaustedReports          *string
+	maxPending                *int
+	maxUpdateAge              *time.Duration
+	preserveOrder             *bool
+	reportRuleStats           *bool
+	clashLogs                 *bool
+	reportMode                *string
+	eventThreshold            *int64
+	eventMinInterval          *time.Duration
+	reportGranularity         *string
+	samplingRate              *float64
+	maxPollDelta              *int64
+	reportBlocked             *bool
+	suppressFakeIP            *bool
+	maxTimestampSkew          *time.Duration
+	timestampSource           *string
+	implausibleDelta          *string
+	staleFlowTimeout          *time.Duration
+	tombstoneTTL              *time.Duration
+	maxTrackedFlows           *int
+	selfUpdate                *bool
+	disableConfigSync         *bool
+	disablePolicySync         *bool
+	disableHeartbeat          *bool
+	maxInflightPosts          *int
+	batchPosts                *bool
+	backoffJitter             *bool
+	intervalJitter            *float64
+	serverMaxIdle             *int
+	serverMaxIdlePerHost      *int
+	serverIdleConnTimeout     *time.Duration
+	serverTLSHandshakeTimeout *time.Duration
+	serverForceHTTP2          *bool
+	serverHTTPVersion         *string
+	serverCABundle            *string
+	serverHeaders             headerList
+	reportClientID            *string
+	correctClockSkew          *bool
+	clockSkewWarn             *time.Duration
+	geoIPDB                   *string
+	asnDB                     *string
+	datacenterASNs            *string
+	reverseDNS                *bool
+	reverseDNSWorkers         *int
+	reverseDNSTimeout         *time.Duration
+	proxyDropThreshold        *float64
+	allowCommands             *bool
+	lockDir                   *string
+	takeover                  takeoverFlag
+	takeoverGrace             *time.Duration
+	stateFile                 *string
+	deadLetterDir             *string
+	deadLetterMaxBytes        *int64
+	adminListen               *string
+	adminToken                *string
+	dryRun                    *bool
+	verboseHTTP               *bool
+	strictConfig              *bool
+	recordDir                 *string
+	recordMaxBytes            *int64
+	replayDir                 *string
+	replaySpeed               *float64
+}
+
+// registerFlags is the flag-registration helper shared by run, check and
+// dump-config, so a command line that works for one works for the others.
+func registerFlags(fs *flag.FlagSet) *options {
+	o := &options{}
+	o.serverURL = fs.String("server-url", "", "Neko Master server URL, e.g. https://neko.example.com")
+	o.serverURLFallback = fs.String("server-url-fallback", "", "Secondary Neko Master URL used while --server-url keeps failing")
+	o.backendID = fs.Int("backend-id", 0, "Backend ID configured in Neko Master")
+	o.backendToken = fs.String("backend-token", "", "Backend token for agent authentication")
+	o.agentID = fs.String("agent-id", "", "Agent ID (optional, auto-generated from backend-token if not provided)")
+	o.agentIDMode = fs.String("agent-id-mode", AgentIDModeToken, "How the agent ID is generated without --agent-id: token (backend token hash) or machine (/etc/machine-id and backend ID)")
+	o.gatewayType = fs.String("gateway-type", GatewayAuto, "Gateway type: auto to detect clash or surge, clash, singbox, surge, quanx, or replay to play back --replay-dir")
+	o.gatewayURL = fs.String("gateway-url", "", "Gateway control endpoint URL")
+	o.gatewayToken = fs.String("gateway-token", "", "Gateway secret token (optional)")
+	o.gatewayBasicUser = fs.String("gateway-basic-user", "", "Gateway HTTP Basic auth username (optional)")
+	o.gatewayBasicPass = fs.String("gateway-basic-pass", "", "Gateway HTTP Basic auth password (optional)")
+	o.surgeRequestSource = fs.String("surge-request-source", "recent", "Surge request list to poll: recent, active or both")
+	o.gatewayFlavor = fs.String("gateway-flavor", "", "Clash-compatible app behind a clash gateway, stash or shadowrocket; reported as the gateway core, endpoint paths stay Clash's (default Clash or one of its cores)")
+	o.clashPolicyProviders = fs.String("clash-policy-providers", "type", "Clash policy-state providers: type (proxies grouped by type) or provider (real /providers/proxies membership)")
+	o.gatewayMaxResponseBytes = fs.Int64("gateway-max-response-bytes", 64<<20, "Fail a poll whose connection list response is larger than this (0 = unlimited)")
+	o.logEnabled = fs.Bool("log", true, "Enable runtime logs (set false to disable)")
+
+	o.reportInterval = fs.Duration("report-interval", 2*time.Second, "Report interval, e.g. 2s")
+	o.heartbeatInterval = fs.Duration("heartbeat-interval", 30*time.Second, "Heartbeat interval")
+	o.gatewayPollInterval = fs.Duration("gateway-poll-interval", 2*time.Second, "Gateway polling interval")
+	o.gatewayPollMin = fs.Duration("gateway-poll-min", 0, "Lower bound for the adaptive poll interval (default gateway-poll-interval)")
+	o.gatewayPollMax = fs.Duration("gateway-poll-max", 0, "Upper bound for the adaptive poll interval; enables adaptive polling (0 = fixed interval)")
+	o.slowCollectThreshold = fs.Duration("slow-collect-threshold", 500*time.Millisecond, "Collect duration above which the adaptive poll interval grows")
+	o.requestTimeout = fs.Duration("request-timeout", 15*time.Second, "HTTP request timeout")
+	o.reportBatchSize = fs.Int("report-batch-size", 1000, "Maximum updates per report request")
+	o.maxReportBytes = fs.Int64("max-report-bytes", 1<<20, "Maximum estimated JSON size of a report's updates; 0 disables the limit")
+	o.maxReportAttempts = fs.Int("max-report-attempts", 0, "Failed posts of one report batch before --exhausted-reports applies; 0 retries forever")
+	o.exhaustedReports = fs.String("exhausted-reports", "requeue", "What to do with a batch after --max-report-attempts: requeue behind newer data or deadletter")
+	o.maxPending = fs.Int("max-pending-updates", 50000, "Maximum buffered updates in memory")
+	o.maxUpdateAge = fs.Duration("max-update-age", 0, "Drop queued updates older than this instead of reporting them (0 = unlimited)")
+	o.preserveOrder = fs.Bool("preserve-gateway-order", false, "Queue each poll's updates in gateway response order instead of sorting by timestamp and flow ID")
+	o.clashLogs = fs.Bool("clash-logs", false, "Follow the Clash /logs stream for fuller chains of connections that report only part of theirs")
+	o.reportRuleStats = fs.Bool("report-rule-stats", false, "Post per-rule traffic and flow totals to /agent/stats every minute")
+	o.reportMode = fs.String("report-mode", "periodic", "When to report: periodic (every report-interval) or event (on new flows and byte thresholds)")
+	o.eventThreshold = fs.Int64("event-threshold", 1<<20, "Event mode: bytes a flow must transfer since its last event to trigger a flush")
+	o.eventMinInterval = fs.Duration("event-min-interval", time.Second, "Event mode: minimum time between event-triggered flushes")
+	o.reportGranularity = fs.String("report-granularity", "flow", "Report per flow, or aggregate per source IP and chain: flow or source")
+	o.samplingRate = fs.Float64("sampling-rate", 1, "Fraction of flows reported individually (0-1]; per-chain totals stay exact")
+	o.maxPollDelta = fs.Int64("max-poll-delta", 0, "Largest per-flow byte delta accepted per poll (0 = poll interval x 10 Gbps)")
+	o.reportBlocked = fs.Bool("report-blocked", true, "Report connections rejected by REJECT policies as zero-byte blocked updates")
+	o.suppressFakeIP = fs.Bool("suppress-fakeip-ip", false, "Clash: omit the destination IP of fake-IP flows without a sniffed host")
+	o.maxTimestampSkew = fs.Duration("max-timestamp-skew", time.Hour, "Replace gateway timestamps further than this from the agent clock with the agent clock (0 disables)")
+	o.timestampSource = fs.String("timestamp-source", "gateway", "Timestamp for updates: gateway (connection time when provided) or agent (always the agent clock)")
+	o.implausibleDelta = fs.String("implausible-delta", "drop", "What to do with deltas above --max-poll-delta: drop or clamp")
+	o.staleFlowTimeout = fs.Duration("stale-flow-timeout", 5*time.Minute, "Flow state stale timeout")
+	o.tombstoneTTL = fs.Duration("tombstone-ttl", 0, "How long counters of evicted flows are kept against double counting (0 = 150 poll intervals)")
+	o.maxTrackedFlows = fs.Int("max-tracked-flows", 100000, "Evict the least recently seen flows beyond this many tracked flows (0 = unlimited)")
+	o.selfUpdate = fs.Bool("self-update", false, "Apply agent updates announced by the master in heartbeat responses")
+	o.disableConfigSync = fs.Bool("disable-config-sync", false, "Do not sync gateway rules/proxies config to the master")
+	o.disablePolicySync = fs.Bool("disable-policy-sync", false, "Do not sync policy group selection state to the master")
+	o.disableHeartbeat = fs.Bool("disable-heartbeat", false, "Do not send heartbeats to the master")
+	o.maxInflightPosts = fs.Int("max-inflight-posts", 1, "Report posts allowed in flight at once; ticks beyond this are skipped")
+	o.batchPosts = fs.Bool("batch-posts", false, "Fold heartbeat and policy-state posts into the next report via /agent/batch")
+	o.backoffJitter = fs.Bool("backoff-jitter", false, "Randomize retry backoff delays (full jitter)")
+	o.intervalJitter = fs.Float64("interval-jitter", 0.1, "Randomize each loop period within +/- this fraction so agents started together drift apart (0 disables)")
+	o.serverMaxIdle = fs.Int("server-max-idle-conns", 16, "Idle keep-alive connections kept across all master hosts")
+	o.serverMaxIdlePerHost = fs.Int("server-max-idle-conns-per-host", 4, "Idle keep-alive connections kept per master host")
+	o.serverIdleConnTimeout = fs.Duration("server-idle-conn-timeout", 90*time.Second, "How long idle master connections are kept open")
+	o.serverTLSHandshakeTimeout = fs.Duration("server-tls-handshake-timeout", 10*time.Second, "TLS handshake timeout for master connections")
+	o.serverForceHTTP2 = fs.Bool("server-force-http2", true, "Attempt HTTP/2 to the master even with a customized transport")
+	o.serverHTTPVersion = fs.String("server-http-version", "auto", "HTTP version for master requests: auto, 1.1 or 2")
+	fs.Var(&o.serverHeaders, "server-header", "Extra \"Name: value\" header sent on every master request, repeatable; a value of @file is read from file")
+	o.reportClientID = fs.String("report-client-id", "", "Logical identity sent as X-Client-ID on every post to the master, for audit independent of the network path (optional)")
+	o.serverCABundle = fs.String("server-ca-bundle", "", "PEM file of extra CA certificates trusted for the master's HTTPS endpoint (optional)")
+	o.correctClockSkew = fs.Bool("correct-clock-skew", false, "Shift reported timestamps by the measured offset to the master's clock")
+	o.clockSkewWarn = fs.Duration("clock-skew-warn", 30*time.Second, "Warn when the local clock differs from the master by more than this (0 disables)")
+	o.geoIPDB = fs.String("geoip-db", "", "MaxMind GeoLite2/GeoIP2 Country .mmdb file used to tag destination IPs with a country (optional)")
+	o.asnDB = fs.String("asn-db", "", "MaxMind GeoLite2-ASN .mmdb file used to tag destination IPs with their ASN (optional)")
+	o.datacenterASNs = fs.String("datacenter-asns", "", "File listing datacenter/hosting ASNs, one per line; requires --asn-db (optional)")
+	o.reverseDNS = fs.Bool("reverse-dns", false, "Resolve PTR names for IP-only flows and report them as the domain")
+	o.reverseDNSWorkers = fs.Int("reverse-dns-workers", 4, "Concurrent PTR lookups for --reverse-dns")
+	o.reverseDNSTimeout = fs.Duration("reverse-dns-timeout", time.Second, "Timeout for each PTR lookup")
+	o.proxyDropThreshold = fs.Float64("proxy-drop-threshold", 0.5, "Warn when the proxy count falls below this fraction of its rolling baseline (0 disables)")
+	o.allowCommands = fs.Bool("allow-commands", false, "Execute remote commands (close connection, switch group proxy) sent by the master")
+	o.lockDir = fs.String("lock-dir", "", "Directory for the single-instance lock file (default /run/neko-agent when writable, else the temp dir)")
+	fs.Var(&o.takeover, "takeover", "Stop a running instance holding the lock with SIGTERM; force also sends SIGKILL after the grace period")
+	o.takeoverGrace = fs.Duration("takeover-grace", 10*time.Second, "How long --takeover waits for the running instance to release the lock")
+	o.stateFile = fs.String("state-file", "", "File that keeps the report sequence number across restarts (optional)")
+	o.deadLetterDir = fs.String("dead-letter-dir", "", "Directory for report batches the master permanently rejected (default: deadletter next to --state-file)")
+	o.deadLetterMaxBytes = fs.Int64("dead-letter-max-bytes", 10<<20, "Total size of --dead-letter-dir; the oldest batches are deleted beyond it")
+	o.adminListen = fs.String("admin-listen", "", "Address for the local admin API, e.g. 127.0.0.1:9099 (optional)")
+	o.adminToken = fs.String("admin-token", "", "Bearer token required by the admin API")
+	o.dryRun = fs.Bool("dry-run", false, "Collect and batch as usual but only log what would be sent to the master")
+	o.verboseHTTP = fs.Bool("verbose-http", false, "Log every post to the master and its response, with the body truncated and secrets redacted")
+	o.strictConfig = fs.Bool("strict-config", false, "Refuse to start on configuration warnings instead of logging them")
+	o.recordDir = fs.String("record-dir", "", "Write every raw gateway response body to this directory for debugging (optional)")
+	o.replayDir = fs.String("replay-dir", "", "Recording made with --record-dir to play back with --gateway-type=replay")
+	o.replaySpeed = fs.Float64("replay-speed", 0, "Replay polls at this multiple of the recorded pace (0 = as fast as polled)")
+	o.recordMaxBytes = fs.Int64("record-max-bytes", 100<<20, "Total size of recordings kept in --record-dir; the oldest are deleted beyond it")
+	return o
+}
+
+// config validates the parsed flags and builds the Config.
+func (o *options) config() (Config, error) {
+	gt := strings.ToLower(strings.TrimSpace(*o.gatewayType))
+	replayDir := strings.TrimSpace(*o.replayDir)
+	if gt == GatewayReplay {
+		if strings.TrimSpace(*o.serverURL) == "" || *o.backendID <= 0 || strings.TrimSpace(*o.backendToken) == "" || replayDir == "" {
+			return Config{}, errors.New("server-url, backend-id, backend-token, replay-dir are required")
+		}
+		if *o.replaySpeed < 0 {
+			return Config{}, errors.New("replay-speed must not be negative")
+		}
+	} else if strings.TrimSpace(*o.serverURL) == "" || *o.backendID <= 0 || strings.TrimSpace(*o.backendToken) == "" || strings.TrimSpace(*o.gatewayURL) == "" {
+		return Config{}, errors.New("server-url, backend-id, backend-token, gateway-url are required")
 	}
-	if *showVersion {
-		return Config{}, ErrVersion
+
+	fallbackAPIBase := ""
+	if strings.TrimSpace(*o.serverURLFallback) != "" {
+		fallbackAPIBase = normalizeServerAPIBase(*o.serverURLFallback)
+		if fallbackAPIBase == normalizeServerAPIBase(*o.serverURL) {
+			return Config{}, errors.New("server-url-fallback must differ from server-url")
+		}
 	}
 
-	if strings.TrimSpace(*serverURL) == "" || *backendID <= 0 || strings.TrimSpace(*backendToken) == "" || strings.TrimSpace(*gatewayURL) == "" {
-		return Config{}, errors.New("server-url, backend-id, backend-token, gateway-url are required")
+	if gt != GatewayAuto && gt != "clash" && gt != GatewaySingBox && gt != "surge" && gt != GatewayQuanX && gt != GatewayReplay {
+		return Config{}, fmt.Errorf("invalid gateway-type: %s", *o.gatewayType)
 	}
 
-	gt := strings.ToLower(strings.TrimSpace(*gatewayType))
-	if gt != "clash" && gt != "surge" {
-		return Config{}, fmt.Errorf("invalid gateway-type: %s", *gatewayType)
+	basicUser := strings.TrimSpace(*o.gatewayBasicUser)
+	requestSource := strings.ToLower(strings.TrimSpace(*o.surgeRequestSource))
+	if requestSource != "recent" && requestSource != "active" && requestSource != "both" {
+		return Config{}, fmt.Errorf("invalid surge-request-source: %s", *o.surgeRequestSource)
+	}
+	policyProviders := strings.ToLower(strings.TrimSpace(*o.clashPolicyProviders))
+	if policyProviders != "type" && policyProviders != "provider" {
+		return Config{}, fmt.Errorf("invalid clash-policy-providers: %s", *o.clashPolicyProviders)
+	}
+	if *o.clashLogs && gt != "clash" && gt != GatewayAuto {
+		return Config{}, errors.New("clash-logs requires gateway-type clash or auto")
+	}
+	flavor := strings.ToLower(strings.TrimSpace(*o.gatewayFlavor))
+	if flavor != "" && flavor != "stash" && flavor != "shadowrocket" {
+		return Config{}, fmt.Errorf("invalid gateway-flavor: %s", *o.gatewayFlavor)
+	}
+	if flavor != "" && gt != "clash" && gt != GatewayAuto {
+		return Config{}, errors.New("gateway-flavor requires gateway-type clash or auto")
+	}
+	if *o.gatewayMaxResponseBytes < 0 {
+		return Config{}, errors.New("gateway-max-response-bytes must not be negative")
+	}
+	if basicUser == "" && *o.gatewayBasicPass != "" {
+		return Config{}, errors.New("gateway-basic-pass requires gateway-basic-user")
+	}
+	if basicUser != "" && strings.TrimSpace(*o.gatewayToken) != "" {
+		return Config{}, errors.New("gateway-token and gateway-basic-user are mutually exclusive")
 	}
 
-	if *reportInterval <= 0 || *heartbeatInterval <= 0 || *gatewayPollInterval <= 0 || *requestTimeout <= 0 {
+	if *o.reportInterval <= 0 || *o.heartbeatInterval <= 0 || *o.gatewayPollInterval <= 0 || *o.requestTimeout <= 0 {
 		return Config{}, errors.New("interval and timeout flags must be positive")
 	}
-	if *reportBatchSize <= 0 || *maxPending <= 0 {
+	pollMin := *o.gatewayPollMin
+	if pollMin <= 0 {
+		pollMin = *o.gatewayPollInterval
+	}
+	if *o.gatewayPollMax < 0 || (*o.gatewayPollMax > 0 && (*o.gatewayPollMax < pollMin || *o.gatewayPollMax < *o.gatewayPollInterval)) {
+		return Config{}, errors.New("gateway-poll-max must be at least gateway-poll-min and gateway-poll-interval")
+	}
+	if *o.slowCollectThreshold <= 0 {
+		return Config{}, errors.New("slow-collect-threshold must be positive")
+	}
+	if *o.maxTrackedFlows < 0 {
+		return Config{}, errors.New("max-tracked-flows must not be negative")
+	}
+	if *o.tombstoneTTL < 0 {
+		return Config{}, errors.New("tombstone-ttl must not be negative")
+	}
+	if *o.maxUpdateAge < 0 {
+		return Config{}, errors.New("max-update-age must not be negative")
+	}
+	if *o.reverseDNSWorkers <= 0 || *o.reverseDNSTimeout <= 0 {
+		return Config{}, errors.New("reverse-dns-workers and reverse-dns-timeout must be positive")
+	}
+	if *o.proxyDropThreshold < 0 || *o.proxyDropThreshold >= 1 {
+		return Config{}, errors.New("proxy-drop-threshold must be in [0, 1)")
+	}
+	if *o.intervalJitter < 0 || *o.intervalJitter >= 1 {
+		return Config{}, errors.New("interval-jitter must be in [0, 1)")
+	}
+	mode := strings.ToLower(strings.TrimSpace(*o.reportMode))
+	if mode != "periodic" && mode != "event" {
+		return Config{}, fmt.Errorf("invalid report-mode: %s", *o.reportMode)
+	}
+	if *o.eventThreshold <= 0 || *o.eventMinInterval < 0 {
+		return Config{}, errors.New("event-threshold must be positive and event-min-interval must not be negative")
+	}
+	if *o.recordMaxBytes <= 0 {
+		return Config{}, errors.New("record-max-bytes must be positive")
+	}
+	if *o.deadLetterMaxBytes <= 0 {
+		return Config{}, errors.New("dead-letter-max-bytes must be positive")
+	}
+	stateFile := strings.TrimSpace(*o.stateFile)
+	deadLetterDir := strings.TrimSpace(*o.deadLetterDir)
+	if deadLetterDir == "" && stateFile != "" {
+		deadLetterDir = filepath.Join(filepath.Dir(stateFile), "deadletter")
+	}
+	granularity := strings.ToLower(strings.TrimSpace(*o.reportGranularity))
+	if granularity != "flow" && granularity != "source" {
+		return Config{}, fmt.Errorf("invalid report-granularity: %s", *o.reportGranularity)
+	}
+	if *o.samplingRate <= 0 || *o.samplingRate > 1 {
+		return Config{}, errors.New("sampling-rate must be in (0, 1]")
+	}
+	if strings.TrimSpace(*o.datacenterASNs) != "" && strings.TrimSpace(*o.asnDB) == "" {
+		return Config{}, errors.New("datacenter-asns requires asn-db")
+	}
+	if *o.maxPollDelta < 0 {
+		return Config{}, errors.New("max-poll-delta must not be negative")
+	}
+	tsSource := strings.ToLower(strings.TrimSpace(*o.timestampSource))
+	if tsSource != "gateway" && tsSource != "agent" {
+		return Config{}, fmt.Errorf("invalid timestamp-source: %s", *o.timestampSource)
+	}
+	if *o.maxTimestampSkew < 0 {
+		return Config{}, errors.New("max-timestamp-skew must not be negative")
+	}
+	deltaMode := strings.ToLower(strings.TrimSpace(*o.implausibleDelta))
+	if deltaMode != "drop" && deltaMode != "clamp" {
+		return Config{}, fmt.Errorf("invalid implausible-delta: %s", *o.implausibleDelta)
+	}
+	if *o.reportBatchSize <= 0 || *o.maxPending <= 0 {
 		return Config{}, errors.New("report-batch-size and max-pending-updates must be positive")
 	}
+	if *o.reportBatchSize > *o.maxPending {
+		// The queue would overflow long before a batch fills.
+		return Config{}, fmt.Errorf("report-batch-size (%d) must not exceed max-pending-updates (%d)", *o.reportBatchSize, *o.maxPending)
+	}
+	if *o.maxReportBytes < 0 {
+		return Config{}, errors.New("max-report-bytes must not be negative")
+	}
+	if *o.maxReportAttempts < 0 {
+		return Config{}, errors.New("max-report-attempts must not be negative")
+	}
+	exhausted := strings.ToLower(strings.TrimSpace(*o.exhaustedReports))
+	if exhausted != "requeue" && exhausted != "deadletter" {
+		return Config{}, fmt.Errorf("invalid exhausted-reports: %s", *o.exhaustedReports)
+	}
+	if *o.maxInflightPosts <= 0 {
+		return Config{}, errors.New("max-inflight-posts must be positive")
+	}
+	if *o.takeoverGrace <= 0 {
+		return Config{}, errors.New("takeover-grace must be positive")
+	}
+	if *o.serverMaxIdle <= 0 || *o.serverMaxIdlePerHost <= 0 || *o.serverIdleConnTimeout <= 0 || *o.serverTLSHandshakeTimeout <= 0 {
+		return Config{}, errors.New("server connection pool flags must be positive")
+	}
+
+	httpVersion := strings.TrimSpace(*o.serverHTTPVersion)
+	switch httpVersion {
+	case "auto", "1.1", "2":
+	case "3":
+		return Config{}, errors.New("server-http-version 3 is not supported: this build has no QUIC transport; use 2 for multiplexed reports")
+	default:
+		return Config{}, fmt.Errorf("invalid server-http-version: %s", *o.serverHTTPVersion)
+	}
+
+	caBundle := strings.TrimSpace(*o.serverCABundle)
+	if caBundle != "" {
+		if _, err := LoadCABundle(caBundle); err != nil {
+			return Config{}, fmt.Errorf("invalid server-ca-bundle: %w", err)
+		}
+	}
+	serverHeaders, err := ParseServerHeaders(o.serverHeaders)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid server-header: %w", err)
+	}
+	reportClientID := strings.TrimSpace(*o.reportClientID)
+	if strings.ContainsAny(reportClientID, "\r\n") {
+		return Config{}, errors.New("report-client-id must be a single line")
+	}
 
 	// Generate stable agent ID based on backend token
 	// This ensures the same agent always uses the same ID across restarts
-	backendTokenTrimmed := strings.TrimSpace(*backendToken)
-	finalAgentID := strings.TrimSpace(*agentID)
-	if finalAgentID == "" {
+	backendTokenTrimmed := strings.TrimSpace(*o.backendToken)
+	idMode := strings.ToLower(strings.TrimSpace(*o.agentIDMode))
+	if idMode != AgentIDModeToken && idMode != AgentIDModeMachine {
+		return Config{}, fmt.Errorf("invalid agent-id-mode: %s", *o.agentIDMode)
+	}
+	finalAgentID := strings.TrimSpace(*o.agentID)
+	if finalAgentID != "" {
+		// Explicit IDs end up in URLs and payloads
+		finalAgentID = sanitizeID(finalAgentID)
+	} else if idMode == AgentIDModeMachine {
+		// Hosts sharing a backend token still get distinct IDs
+		machineID, err := readMachineID()
+		if err != nil {
+			return Config{}, fmt.Errorf("agent-id-mode machine: %w", err)
+		}
+		hash := sha256.Sum256([]byte(machineID + ":" + strconv.Itoa(*o.backendID)))
+		finalAgentID = "agent-" + hex.EncodeToString(hash[:])[:16]
+	} else {
 		// Use first 16 chars of backend token hash as agent ID
 		// This is stable across restarts and unique per backend
 		hash := sha256.Sum256([]byte(backendTokenTrimmed))
@@ -106,51 +571,292 @@ func Parse(args []string) (Config, error) {
 		finalAgentID = finalAgentID[:128]
 	}
 
-	return Config{
-		ServerAPIBase:       normalizeServerAPIBase(*serverURL),
-		BackendID:           *backendID,
-		BackendToken:        strings.TrimSpace(*backendToken),
+	cfg := Config{
+		ServerAPIBase:       normalizeServerAPIBase(*o.serverURL),
+		BackendID:           *o.backendID,
+		BackendToken:        strings.TrimSpace(*o.backendToken),
 		AgentID:             finalAgentID,
-		LogEnabled:          *logEnabled,
+		AgentIDMode:         idMode,
+		LogEnabled:          *o.logEnabled,
 		GatewayType:         gt,
-		GatewayEndpoint:     normalizeGatewayEndpoint(gt, *gatewayURL),
-		GatewayToken:        strings.TrimSpace(*gatewayToken),
-		ReportInterval:      *reportInterval,
-		HeartbeatInterval:   *heartbeatInterval,
-		GatewayPollInterval: *gatewayPollInterval,
-		RequestTimeout:      *requestTimeout,
-		ReportBatchSize:     *reportBatchSize,
-		MaxPendingUpdates:   *maxPending,
-		StaleFlowTimeout:    *staleFlowTimeout,
-	}, nil
+		GatewayEndpoint:     normalizeGatewayEndpoint(gt, *o.gatewayURL),
+		GatewayToken:        strings.TrimSpace(*o.gatewayToken),
+		GatewayBasicUser:    basicUser,
+		GatewayBasicPass:    *o.gatewayBasicPass,
+		SurgeRequestSource:  requestSource,
+		GatewayFlavor:       flavor,
+		ReportInterval:      *o.reportInterval,
+		HeartbeatInterval:   *o.heartbeatInterval,
+		GatewayPollInterval: *o.gatewayPollInterval,
+		GatewayPollMin:      pollMin,
+		GatewayPollMax:      *o.gatewayPollMax,
+		RequestTimeout:      *o.requestTimeout,
+		ReportBatchSize:     *o.reportBatchSize,
+		MaxReportBytes:      *o.maxReportBytes,
+		MaxReportAttempts:   *o.maxReportAttempts,
+		ExhaustedReports:    exhausted,
+		MaxPendingUpdates:   *o.maxPending,
+		StaleFlowTimeout:    *o.staleFlowTimeout,
+		TombstoneTTL:        *o.tombstoneTTL,
+		MaxUpdateAge:        *o.maxUpdateAge,
+		SamplingRate:        *o.samplingRate,
+		ReportGranularity:   granularity,
+		MaxPollDelta:        *o.maxPollDelta,
+		ImplausibleDelta:    deltaMode,
+		TimestampSource:     tsSource,
+		MaxTimestampSkew:    *o.maxTimestampSkew,
+		SuppressFakeIP:      *o.suppressFakeIP,
+		ReportBlocked:       *o.reportBlocked,
+		SelfUpdate:          *o.selfUpdate,
+		DisableConfigSync:   *o.disableConfigSync,
+		DisablePolicySync:   *o.disablePolicySync,
+		DisableHeartbeat:    *o.disableHeartbeat,
+		BackoffJitter:       *o.backoffJitter,
+		IntervalJitter:      *o.intervalJitter,
+		BatchPosts:          *o.batchPosts,
+		MaxInflightPosts:    *o.maxInflightPosts,
+		LockDir:             strings.TrimSpace(*o.lockDir),
+		Takeover:            string(o.takeover),
+		TakeoverGrace:       *o.takeoverGrace,
+		StateFile:           stateFile,
+		DeadLetterDir:       deadLetterDir,
+		DeadLetterMaxBytes:  *o.deadLetterMaxBytes,
+		AdminListen:         strings.TrimSpace(*o.adminListen),
+		AdminToken:          strings.TrimSpace(*o.adminToken),
+		DryRun:              *o.dryRun,
+		VerboseHTTP:         *o.verboseHTTP,
+		StrictConfig:        *o.strictConfig,
+		ReportMode:          mode,
+		EventThreshold:      *o.eventThreshold,
+		EventMinInterval:    *o.eventMinInterval,
+		RecordDir:           strings.TrimSpace(*o.recordDir),
+		RecordMaxBytes:      *o.recordMaxBytes,
+		ReplayDir:           replayDir,
+		ReplaySpeed:         *o.replaySpeed,
+
+		SlowCollectThreshold:      *o.slowCollectThreshold,
+		GatewayMaxResponseBytes:   *o.gatewayMaxResponseBytes,
+		MaxTrackedFlows:           *o.maxTrackedFlows,
+		ClashPolicyProviders:      policyProviders,
+		PreserveGatewayOrder:      *o.preserveOrder,
+		ReportRuleStats:           *o.reportRuleStats,
+		ClashLogs:                 *o.clashLogs,
+		ServerMaxIdleConns:        *o.serverMaxIdle,
+		ServerMaxIdleConnsPerHost: *o.serverMaxIdlePerHost,
+		ServerIdleConnTimeout:     *o.serverIdleConnTimeout,
+		ServerTLSHandshakeTimeout: *o.serverTLSHandshakeTimeout,
+		ServerForceHTTP2:          *o.serverForceHTTP2,
+		ServerHTTPVersion:         httpVersion,
+		ServerCABundle:            caBundle,
+		ServerHeaders:             serverHeaders,
+		ServerFallbackAPIBase:     fallbackAPIBase,
+		ReportClientID:            reportClientID,
+		CorrectClockSkew:          *o.correctClockSkew,
+		ClockSkewWarn:             *o.clockSkewWarn,
+		GeoIPDB:                   strings.TrimSpace(*o.geoIPDB),
+		ASNDB:                     strings.TrimSpace(*o.asnDB),
+		DatacenterASNs:            strings.TrimSpace(*o.datacenterASNs),
+		ReverseDNS:                *o.reverseDNS,
+		ReverseDNSWorkers:         *o.reverseDNSWorkers,
+		ReverseDNSTimeout:         *o.reverseDNSTimeout,
+		ProxyDropThreshold:        *o.proxyDropThreshold,
+		AllowCommands:             *o.allowCommands,
+	}
+	if w := cfg.Warnings(); cfg.StrictConfig && len(w) > 0 {
+		return Config{}, fmt.Errorf("strict-config: %s", strings.Join(w, "; "))
+	}
+	return cfg, nil
+}
+
+// Warnings lists settings that are valid but probably not what was meant.
+// They are logged at startup, or rejected with --strict-config.
+func (c Config) Warnings() []string {
+	var warnings []string
+	if c.ReportInterval < c.GatewayPollMin {
+		// Most report ticks would find nothing new to send.
+		warnings = append(warnings, fmt.Sprintf("report-interval %s is shorter than the gateway poll interval %s", c.ReportInterval, c.GatewayPollMin))
+	}
+	return warnings
 }
 
+// Usage returns the help text of the default run command.
 func Usage() string {
-	lines := []string{
-		"Usage:",
-		"  neko-agent --server-url <url> --backend-id <id> --backend-token <token> --gateway-type <clash|surge> --gateway-url <url> [options]",
-		"",
-		"Required:",
-		"  --server-url            Neko Master server URL",
-		"  --backend-id            Backend ID in Neko Master",
-		"  --backend-token         Backend token",
-		"  --gateway-url           Gateway API URL",
-		"",
-		"Optional:",
-		"  --agent-id              Agent ID (auto-generated from backend-token if not set)",
-		"  --log                   enable runtime logs (default true, set --log=false to disable)",
-		"  --gateway-type          clash|surge (default clash)",
-		"  --gateway-token         Gateway secret",
-		"  --report-interval       default 2s",
-		"  --heartbeat-interval    default 30s",
-		"  --gateway-poll-interval default 2s",
-		"  --request-timeout       default 15s",
-		"  --report-batch-size     default 1000",
-		"  --max-pending-updates   default 50000",
-		"  --stale-flow-timeout    default 5m",
-		"  --version               print version",
-	}
-	return strings.Join(lines, "\n") + "\n"
+	return CommandUsage(CommandRun)
+}
+
+// flagUsage documents the flags registered by registerFlags.
+var flagUsage = []string{
+	"Required:",
+	"  --server-url            Neko Master server URL",
+	"  --backend-id            Backend ID in Neko Master",
+	"  --backend-token         Backend token",
+	"  --gateway-url           Gateway API URL",
+	"",
+	"Optional:",
+	"  --agent-id              Agent ID (auto-generated from backend-token if not set)",
+	"  --agent-id-mode         token|machine source of the generated agent ID (default token)",
+	"  --log                   enable runtime logs (default true, set --log=false to disable)",
+	"  --gateway-type          auto|clash|singbox|surge|quanx|replay (default auto)",
+	"  --gateway-token         Gateway secret",
+	"  --gateway-basic-user    Gateway HTTP Basic auth user (excludes --gateway-token)",
+	"  --gateway-basic-pass    Gateway HTTP Basic auth password",
+	"  --surge-request-source  recent|active|both Surge request lists (default recent)",
+	"  --gateway-max-response-bytes      cap on a connection list response (default 67108864, 0 = unlimited)",
+	"  --gateway-flavor        stash|shadowrocket app behind a clash gateway (default none)",
+	"  --clash-policy-providers          type|provider grouping of policy-state providers (default type)",
+	"  --report-interval       default 2s",
+	"  --heartbeat-interval    default 30s",
+	"  --gateway-poll-interval default 2s",
+	"  --gateway-poll-min      adaptive polling lower bound (default gateway-poll-interval)",
+	"  --gateway-poll-max      adaptive polling upper bound (default 0 = fixed interval)",
+	"  --slow-collect-threshold default 500ms",
+	"  --request-timeout       default 15s",
+	"  --report-batch-size     default 1000",
+	"  --max-report-bytes      estimated size cap of a report batch (default 1048576, 0 = unlimited)",
+	"  --max-report-attempts   failed posts of a batch before --exhausted-reports applies (default 0 = unlimited)",
+	"  --exhausted-reports     requeue|deadletter a batch out of attempts (default requeue)",
+	"  --max-pending-updates   default 50000",
+	"  --stale-flow-timeout    default 5m",
+	"  --max-tracked-flows     evict least recently seen flows beyond this (default 100000, 0 = unlimited)",
+	"  --tombstone-ttl         keep counters of evicted flows this long (default 0 = 150 poll intervals)",
+	"  --max-update-age        drop queued updates older than this (default 0 = unlimited)",
+	"  --preserve-gateway-order keep gateway response order within a poll (default false)",
+	"  --clash-logs            follow Clash /logs for fuller chains (default false)",
+	"  --report-rule-stats     post per-rule totals to /agent/stats every minute (default false)",
+	"  --report-mode         periodic|event (default periodic)",
+	"  --event-threshold     event mode per-flow byte trigger (default 1048576)",
+	"  --event-min-interval  event mode minimum flush spacing (default 1s)",
+	"  --report-granularity    flow|source (default flow)",
+	"  --sampling-rate         fraction of flows reported individually (default 1)",
+	"  --max-poll-delta        per-flow per-poll byte ceiling (default 0 = poll interval x 10 Gbps)",
+	"  --implausible-delta     drop|clamp deltas above the ceiling (default drop)",
+	"  --timestamp-source      gateway|agent clock for update timestamps (default gateway)",
+	"  --max-timestamp-skew    clamp gateway timestamps this far off to now (default 1h)",
+	"  --suppress-fakeip-ip    drop fake-IP destinations without a host (default false)",
+	"  --report-blocked        report REJECT-ed connections (default true)",
+	"  --self-update           apply updates announced by the master (default false)",
+	"  --disable-config-sync   skip the rules/proxies config sync loop",
+	"  --disable-policy-sync   skip the policy state sync loop",
+	"  --disable-heartbeat     skip the heartbeat loop",
+	"  --backoff-jitter        randomize retry backoff delays (default false)",
+	"  --interval-jitter       randomize loop periods within +/- this fraction (default 0.1)",
+	"  --batch-posts           combine heartbeat/policy-state with reports (default false)",
+	"  --max-inflight-posts    concurrent report posts; extra ticks are skipped (default 1)",
+	"  --server-max-idle-conns default 16",
+	"  --server-max-idle-conns-per-host  default 4",
+	"  --server-idle-conn-timeout        default 90s",
+	"  --server-tls-handshake-timeout    default 10s",
+	"  --server-force-http2    attempt HTTP/2 to the master (default true)",
+	"  --server-http-version   auto|1.1|2 for master requests (default auto)",
+	"  --server-ca-bundle      PEM CA certificates to trust for the master (in addition to system roots)",
+	"  --server-header         \"Name: value\" added to master requests, repeatable; value @file reads a file",
+	"  --server-url-fallback   secondary master URL used while --server-url is down",
+	"  --report-client-id      identity sent as X-Client-ID on posts to the master",
+	"  --correct-clock-skew    shift timestamps onto the master's clock (default false)",
+	"  --clock-skew-warn       default 30s (0 disables the warning)",
+	"  --geoip-db              GeoLite2/GeoIP2 Country .mmdb for destination country tags",
+	"  --asn-db                GeoLite2-ASN .mmdb for destination ASN tags",
+	"  --datacenter-asns       ASN list file marking destinations as datacenter",
+	"  --reverse-dns           fill domains of IP-only flows via PTR lookups (default false)",
+	"  --reverse-dns-workers   default 4",
+	"  --reverse-dns-timeout   default 1s",
+	"  --proxy-drop-threshold  warn below this fraction of the usual proxy count (default 0.5, 0 disables)",
+	"  --allow-commands        execute remote commands from the master (default false)",
+	"  --lock-dir            lock file directory (default /run/neko-agent, else temp dir)",
+	"  --takeover            stop a running instance holding the lock; =force kills it after the grace period",
+	"  --takeover-grace      default 10s",
+	"  --state-file          persist the report sequence number across restarts",
+	"  --dead-letter-dir     keep permanently rejected batches here (default deadletter next to --state-file)",
+	"  --dead-letter-max-bytes size cap of --dead-letter-dir, oldest deleted first (default 10485760)",
+	"  --admin-listen        local admin API address (default disabled)",
+	"  --admin-token         bearer token for the admin API",
+	"  --dry-run             collect and batch but never post to the master (default false)",
+	"  --verbose-http        log master posts and responses, secrets redacted (default false)",
+	"  --strict-config       fail on configuration warnings instead of logging them (default false)",
+	"  --record-dir          save raw gateway responses here for debugging (default disabled)",
+	"  --record-max-bytes    size cap of --record-dir, oldest deleted first (default 104857600)",
+	"  --replay-dir          recording played back by --gateway-type=replay",
+	"  --replay-speed        multiple of the recorded pace (default 0 = as fast as polled)",
+}
+
+// runFlagUsage documents the flags only the run command accepts.
+var runFlagUsage = []string{
+	"  --once                single poll and report, then exit non-zero if any step failed",
+	"  --print-config          print the effective configuration as JSON and exit (dump-config prints YAML)",
+	"  --version               print version (same as the version command)",
+}
+
+// GatewayReplay is the --gateway-type that plays back a --record-dir
+// recording instead of polling a live gateway.
+const GatewayReplay = "replay"
+
+// GatewayAuto is the default --gateway-type: the agent probes the gateway for
+// clash or surge at startup.
+const GatewayAuto = "auto"
+
+// GatewaySingBox is the --gateway-type for sing-box's Clash API. A clash
+// gateway that turns out to be sing-box is handled the same way.
+const GatewaySingBox = "singbox"
+
+// GatewayQuanX is the --gateway-type for Quantumult X's local HTTP API. It is
+// never picked by auto detection.
+const GatewayQuanX = "quanx"
+
+// Takeover modes for --takeover. An empty mode leaves a running instance alone.
+const (
+	TakeoverGraceful = "graceful"
+	TakeoverForce    = "force"
+)
+
+// takeoverFlag is a boolean-style flag that also accepts "force", so both
+// --takeover and --takeover=force work.
+type takeoverFlag string
+
+func (f *takeoverFlag) String() string { return string(*f) }
+
+func (f *takeoverFlag) IsBoolFlag() bool { return true }
+
+func (f *takeoverFlag) Set(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == TakeoverForce {
+		*f = TakeoverForce
+		return nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return errors.New("must be true, false or force")
+	}
+	*f = ""
+	if on {
+		*f = TakeoverGraceful
+	}
+	return nil
+}
+
+// Agent ID modes select what a generated agent ID is derived from.
+const (
+	AgentIDModeToken   = "token"
+	AgentIDModeMachine = "machine"
+)
+
+// machineIDPaths are tried in order by readMachineID; the dbus copy covers
+// older systems without systemd.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+func readMachineID() (string, error) {
+	var lastErr error
+	for _, path := range machineIDPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+		lastErr = fmt.Errorf("%s is empty", path)
+	}
+	return "", lastErr
 }
 
 func sanitizeID(v string) string {
@@ -182,12 +888,36 @@ func normalizeServerAPIBase(raw string) string {
 	return trimmed + "/api"
 }
 
+// gatewayAPISuffixes are API paths users commonly paste as the gateway URL;
+// they are stripped so that any reverse-proxy prefix before them is kept as
+// the base every API path is appended to.
+var gatewayAPISuffixes = map[string][]string{
+	"clash":        {"/connections", "/rules", "/proxies", "/configs", "/version"},
+	GatewaySingBox: {"/connections", "/rules", "/proxies", "/configs", "/version"},
+	"surge":        {"/v1/requests/recent", "/v1/requests/active", "/v1/policies", "/v1/rules", "/v1"},
+	GatewayQuanX:   {"/v1/connections", "/v1/policies", "/v1/filters", "/v1"},
+	// Surge's first, as "/v1/rules" also ends in Clash's "/rules".
+	GatewayAuto: {"/v1/requests/recent", "/v1/requests/active", "/v1/policies", "/v1/rules", "/v1",
+		"/connections", "/rules", "/proxies", "/configs", "/version"},
+}
+
 func normalizeGatewayEndpoint(gatewayType, raw string) string {
-	trimmed := strings.TrimRight(strings.TrimSpace(raw), "/")
-	if gatewayType == "clash" {
+	trimmed := strings.TrimSpace(raw)
+	// Surge has no WebSocket API, so an auto gateway given one is Clash.
+	if gatewayType == "clash" || gatewayType == GatewaySingBox || gatewayType == GatewayAuto {
 		trimmed = strings.Replace(trimmed, "ws://", "http://", 1)
 		trimmed = strings.Replace(trimmed, "wss://", "https://", 1)
-		return strings.TrimSuffix(trimmed, "/connections")
 	}
-	return strings.TrimSuffix(trimmed, "/v1/requests/recent")
+	// Query strings and fragments (e.g. a copied dashboard URL) would end
+	// up between the base and the API path, so drop them.
+	if i := strings.IndexAny(trimmed, "?#"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	trimmed = strings.TrimRight(trimmed, "/")
+	for _, suffix := range gatewayAPISuffixes[gatewayType] {
+		if strings.HasSuffix(trimmed, suffix) {
+			return strings.TrimRight(strings.TrimSuffix(trimmed, suffix), "/")
+		}
+	}
+	return trimmed
 }
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeGatewayEndpointKeepsPathPrefix(t *testing.T) {
+	cases := []struct {
+		gatewayType, raw, want string
+	}{
+		{"clash", "http://127.0.0.1:9090", "http://127.0.0.1:9090"},
+		{"clash", "http://127.0.0.1:9090/connections", "http://127.0.0.1:9090"},
+		{"clash", "https://router.lan/clash/", "https://router.lan/clash"},
+		{"clash", "https://router.lan/clash/connections", "https://router.lan/clash"},
+		{"clash", "wss://router.lan/api/clash/connections?token=x", "https://router.lan/api/clash"},
+		{"clash", "http://router.lan/clash/proxies/", "http://router.lan/clash"},
+		{"singbox", "ws://127.0.0.1:9090/connections", "http://127.0.0.1:9090"},
+		{"surge", "http://127.0.0.1:6171", "http://127.0.0.1:6171"},
+		{"surge", "http://127.0.0.1:6171/v1/requests/recent", "http://127.0.0.1:6171"},
+		{"surge", "https://mac.lan/surge/", "https://mac.lan/surge"},
+		{"surge", "https://mac.lan/surge/v1/requests/recent", "https://mac.lan/surge"},
+		{"surge", "https://mac.lan/surge/v1", "https://mac.lan/surge"},
+		{"auto", "wss://router.lan/clash/connections", "https://router.lan/clash"},
+		{"auto", "https://mac.lan/surge/v1/rules", "https://mac.lan/surge"},
+	}
+	for _, tc := range cases {
+		if got := normalizeGatewayEndpoint(tc.gatewayType, tc.raw); got != tc.want {
+			t.Fatalf("normalizeGatewayEndpoint(%q, %q) = %q, want %q", tc.gatewayType, tc.raw, got, tc.want)
+		}
+	}
+}
+
+func TestParseServerHTTPVersion(t *testing.T) {
+	base := []string{"--server-url", "https://master.example", "--backend-id", "1", "--backend-token", "t", "--gateway-type", "clash", "--gateway-url", "http://127.0.0.1:9090"}
+
+	cfg, err := Parse(append(base, "--server-http-version", "2"))
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if cfg.ServerHTTPVersion != "2" {
+		t.Fatalf("expected server http version 2, got %q", cfg.ServerHTTPVersion)
+	}
+	if _, err := Parse(append(base, "--server-http-version", "3")); err == nil {
+		t.Fatal("expected HTTP/3 to be rejected")
+	}
+	if _, err := Parse(append(base, "--server-http-version", "1.0")); err == nil {
+		t.Fatal("expected unknown version to be rejected")
+	}
+}
+
+func TestParseRejectsBatchLargerThanQueue(t *testing.T) {
+	base := []string{"--server-url", "https://master.example", "--backend-id", "1", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090"}
+
+	_, err := Parse(append(base, "--report-batch-size", "100000", "--max-pending-updates", "1000"))
+	if err == nil || !strings.Contains(err.Error(), "must not exceed max-pending-updates") {
+		t.Fatalf("expected batch size above the queue cap to be rejected, got %v", err)
+	}
+	if _, err := Parse(append(base, "--report-batch-size", "1000", "--max-pending-updates", "1000")); err != nil {
+		t.Fatalf("expected batch size equal to the queue cap to be accepted, got %v", err)
+	}
+}
+
+func TestReportIntervalShorterThanPollWarns(t *testing.T) {
+	base := []string{"--server-url", "https://master.example", "--backend-id", "1", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090",
+		"--report-interval", "1s", "--gateway-poll-interval", "5s"}
+
+	cfg, err := Parse(base)
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if w := cfg.Warnings(); len(w) != 1 || !strings.Contains(w[0], "report-interval 1s") {
+		t.Fatalf("expected a report-interval warning, got %q", w)
+	}
+	if _, err := Parse(append(base, "--strict-config")); err == nil {
+		t.Fatal("expected the warning to be an error under --strict-config")
+	}
+}
+
+func TestParseTakeover(t *testing.T) {
+	base := []string{"--server-url", "https://master.example", "--backend-id", "1", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090"}
+	for arg, want := range map[string]string{
+		"":                 "",
+		"--takeover":       TakeoverGraceful,
+		"--takeover=true":  TakeoverGraceful,
+		"--takeover=false": "",
+		"--takeover=FORCE": TakeoverForce,
+	} {
+		args := base
+		if arg != "" {
+			args = append(append([]string{}, base...), arg)
+		}
+		cfg, err := Parse(args)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", arg, err)
+		}
+		if cfg.Takeover != want {
+			t.Fatalf("Parse(%q): expected takeover %q, got %q", arg, want, cfg.Takeover)
+		}
+	}
+	if _, err := Parse(append(base, "--takeover=kill")); err == nil {
+		t.Fatal("expected unknown takeover mode to be rejected")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	base := []string{"--server-url", "https://master.example", "--backend-id", "1", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090"}
+
+	cases := []struct {
+		args    []string
+		wantCmd string
+		wantErr error
+	}{
+		{base, CommandRun, nil},
+		{append([]string{"run", "--once"}, base...), CommandRun, nil},
+		{append([]string{"check"}, base...), CommandCheck, nil},
+		{append([]string{"dump-config"}, base...), CommandDumpConfig, nil},
+		{append([]string{"deadletter", "replay"}, base...), CommandDeadLetterReplay, nil},
+		{[]string{"version"}, CommandVersion, nil},
+		{[]string{"--version"}, CommandRun, ErrVersion},
+		{[]string{"check", "--help"}, CommandCheck, ErrHelp},
+	}
+	for _, tc := range cases {
+		cmd, cfg, err := ParseCommand(tc.args)
+		if cmd != tc.wantCmd || !errors.Is(err, tc.wantErr) {
+			t.Fatalf("ParseCommand(%q) = %q, %v; want %q, %v", tc.args, cmd, err, tc.wantCmd, tc.wantErr)
+		}
+		if err == nil && cmd != CommandVersion && cfg.BackendID != 1 {
+			t.Fatalf("ParseCommand(%q): expected backend 1, got %d", tc.args, cfg.BackendID)
+		}
+	}
+
+	if _, _, err := ParseCommand(append([]string{"check", "--once"}, base...)); err == nil {
+		t.Fatalf("expected --once to be rejected by check")
+	}
+	if _, _, err := ParseCommand([]string{"serve"}); err == nil {
+		t.Fatalf("expected an unknown command to be rejected")
+	}
+	if _, _, err := ParseCommand(append([]string{"deadletter"}, base...)); err == nil {
+		t.Fatalf("expected deadletter without a subcommand to be rejected")
+	}
+	_, cfg, err := ParseCommand(append([]string{"run", "--state-file", "/var/lib/neko/state.json"}, base...))
+	if err != nil || cfg.DeadLetterDir != "/var/lib/neko/deadletter" {
+		t.Fatalf("expected dead-letter dir next to the state file, got %q, %v", cfg.DeadLetterDir, err)
+	}
+}
+
+func TestEffectiveYAMLRedactsSecrets(t *testing.T) {
+	cfg, err := Parse([]string{"--server-url", "https://master.example/", "--backend-id", "1", "--backend-token", "s3cret", "--gateway-url", "http://127.0.0.1:9090/connections", "--gateway-basic-user", "admin", "--gateway-basic-pass", "hunter2"})
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	out := string(cfg.EffectiveYAML())
+	if strings.Contains(out, "s3cret") || strings.Contains(out, "hunter2") {
+		t.Fatalf("secrets leaked:\n%s", out)
+	}
+	for _, line := range []string{
+		`backendToken: "` + Fingerprint("s3cret") + `"`,
+		`gatewayBasicPass: "<redacted>"`,
+		`gatewayEndpoint: "http://127.0.0.1:9090"`,
+		`agentID: "` + cfg.AgentID + `"`,
+		`backendID: 1`,
+		`reportInterval: "2s"`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("expected %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestParseServerHeaders(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "cf-secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	base := []string{"--server-url", "https://master.example/", "--backend-id", "1", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090"}
+
+	cfg, err := Parse(append(base, "--server-header", "CF-Access-Client-Id: abc.access", "--server-header", "cf-access-client-secret: @"+secret))
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if got := cfg.ServerHeaders.Get("CF-Access-Client-Id"); got != "abc.access" {
+		t.Fatalf("expected client id header, got %q", got)
+	}
+	if got := cfg.ServerHeaders.Get("CF-Access-Client-Secret"); got != "s3cret" {
+		t.Fatalf("expected secret read from file, got %q", got)
+	}
+	out := string(cfg.EffectiveYAML())
+	if strings.Contains(out, "s3cret") || !strings.Contains(out, "Cf-Access-Client-Secret: "+Fingerprint("s3cret")) {
+		t.Fatalf("expected fingerprinted header values in:\n%s", out)
+	}
+
+	for _, bad := range []string{"Authorization: Bearer x", "content-type: text/plain", "no-colon", ": empty", "X-Missing: @" + secret + ".missing"} {
+		if _, err := Parse(append(base, "--server-header", bad)); err == nil {
+			t.Fatalf("expected --server-header %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAgentIDSanitizationAndMachineMode(t *testing.T) {
+	base := []string{"--server-url", "https://master.example/", "--backend-id", "7", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090"}
+
+	cfg, err := Parse(append(base, "--agent-id", " living room/router 1 "))
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if cfg.AgentID != "living-room-router-1" {
+		t.Fatalf("expected explicit agent ID to be sanitized, got %q", cfg.AgentID)
+	}
+
+	machineID := filepath.Join(t.TempDir(), "machine-id")
+	if err := os.WriteFile(machineID, []byte("0123456789abcdef\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(paths []string) { machineIDPaths = paths }(machineIDPaths)
+	machineIDPaths = []string{machineID}
+
+	token, err := Parse(base)
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	machine, err := Parse(append(base, "--agent-id-mode", "machine"))
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	other, err := Parse([]string{"--server-url", "https://master.example/", "--backend-id", "8", "--backend-token", "t", "--gateway-url", "http://127.0.0.1:9090", "--agent-id-mode", "machine"})
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if !strings.HasPrefix(machine.AgentID, "agent-") || machine.AgentID == token.AgentID || machine.AgentID == other.AgentID {
+		t.Fatalf("expected a machine ID distinct per backend and from the token ID, got %q, %q, %q", machine.AgentID, token.AgentID, other.AgentID)
+	}
+
+	machineIDPaths = []string{machineID + ".missing"}
+	if _, err := Parse(append(base, "--agent-id-mode", "machine")); err == nil {
+		t.Fatalf("expected machine mode without a machine ID to fail")
+	}
+	if _, err := Parse(append(base, "--agent-id-mode", "host")); err == nil {
+		t.Fatalf("expected an unknown agent-id-mode to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// secretFields lists Config fields whose values must never be printed. Tokens
+// are shown as a fingerprint so two setups can be compared without revealing
+// them; passwords, which may be guessable, are hidden entirely.
+var secretFields = map[string]secretKind{
+	"BackendToken":     secretFingerprint,
+	"GatewayToken":     secretFingerprint,
+	"GatewayBasicPass": secretRedact,
+	"AdminToken":       secretFingerprint,
+}
+
+type secretKind int
+
+const (
+	secretRedact secretKind = iota + 1
+	secretFingerprint
+)
+
+// Fingerprint identifies a secret by the first 12 hex digits of its SHA-256.
+func Fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// EffectiveJSON renders the resolved configuration as indented JSON with
+// secrets redacted and durations in their human-readable form.
+func (c Config) EffectiveJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c.Effective()); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// EffectiveYAML renders the same view as EffectiveJSON as YAML, one key per
+// line in sorted order.
+func (c Config) EffectiveYAML() []byte {
+	m := c.Effective()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		value := m[k]
+		switch v := value.(type) {
+		case string:
+			// Double-quoted YAML accepts Go's escapes, and quoting keeps
+			// values like "no" or "1.1" strings.
+			value = strconv.Quote(v)
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		case []string:
+			quoted := make([]string, len(v))
+			for i, s := range v {
+				quoted[i] = strconv.Quote(s)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		}
+		fmt.Fprintf(&buf, "%s: %v\n", k, value)
+	}
+	return buf.Bytes()
+}
+
+// Effective returns the resolved configuration keyed by lower-camel field
+// name, with secrets redacted and durations in their human-readable form. It
+// includes derived values such as the agent ID and the normalized gateway
+// endpoint.
+func (c Config) Effective() map[string]interface{} {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i).Interface()
+		switch {
+		case secretFields[field.Name] != 0:
+			if s, _ := value.(string); s != "" {
+				value = "<redacted>"
+				if secretFields[field.Name] == secretFingerprint {
+					value = Fingerprint(s)
+				}
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			value = value.(time.Duration).String()
+		case field.Type == reflect.TypeOf(http.Header(nil)):
+			value = headerFingerprints(value.(http.Header))
+		}
+		out[lowerFirst(field.Name)] = value
+	}
+	return out
+}
+
+// headerFingerprints lists headers as "Name: <fingerprint>" in sorted order;
+// extra master headers usually carry credentials.
+func headerFingerprints(h http.Header) []string {
+	out := make([]string, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			out = append(out, name+": "+Fingerprint(v))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
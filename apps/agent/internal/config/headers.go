@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// reservedServerHeaders are set by the agent itself on every master request.
+var reservedServerHeaders = []string{"Authorization", "Content-Type"}
+
+// headerList collects the values of a repeatable flag.
+type headerList []string
+
+func (l *headerList) String() string { return strings.Join(*l, ", ") }
+
+func (l *headerList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// ParseServerHeaders turns "Name: value" entries into a header set. A value
+// starting with @ names a file whose trimmed contents are the value, so
+// secrets stay out of the process list.
+func ParseServerHeaders(entries []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not of the form \"Name: value\"", entry)
+		}
+		if strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		for _, reserved := range reservedServerHeaders {
+			if strings.EqualFold(name, reserved) {
+				return nil, fmt.Errorf("%s is set by the agent and cannot be overridden", reserved)
+			}
+		}
+		value = strings.TrimSpace(value)
+		if path, ok := strings.CutPrefix(value, "@"); ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			value = strings.TrimSpace(string(data))
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.New(name + ": value must be a single line")
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
@@ -0,0 +1,60 @@
+package domain
+
+import (
+	"net/netip"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Length caps applied to gateway-provided strings before they are queued, so a
+// misbehaving gateway cannot push oversized or binary values to the master.
+const (
+	MaxDomainLen      = 253 // longest valid DNS name
+	MaxChainLen       = 64  // per chain element and rule name
+	MaxChains         = 12  // chain elements kept per update
+	MaxRulePayloadLen = 512
+)
+
+// SanitizeString trims s, removes non-printable characters and truncates it
+// to at most max bytes without splitting a UTF-8 sequence.
+func SanitizeString(s string, max int) string {
+	s = strings.TrimSpace(s)
+	clean := true
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			clean = false
+			break
+		}
+	}
+	if !clean {
+		s = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r == utf8.RuneError || !unicode.IsPrint(r) {
+				return -1
+			}
+			return r
+		}, s))
+	}
+	if len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(s[:cut])
+}
+
+// NormalizeIP returns the canonical text form of an IP address (IPv4-mapped
+// IPv6 addresses are unmapped, zones dropped), or "" if s is not an address.
+func NormalizeIP(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), "[]")
+	if s == "" {
+		return ""
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().WithZone("").String()
+}
@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeStringLengthBoundaries(t *testing.T) {
+	cases := []struct {
+		name string
+		max  int
+	}{
+		{"domain", MaxDomainLen},
+		{"chain", MaxChainLen},
+		{"rulePayload", MaxRulePayloadLen},
+	}
+	for _, tc := range cases {
+		atLimit := strings.Repeat("a", tc.max)
+		if got := SanitizeString(atLimit, tc.max); got != atLimit {
+			t.Fatalf("%s: expected %d-byte value to be kept, got %d bytes", tc.name, tc.max, len(got))
+		}
+		if got := SanitizeString(atLimit+"b", tc.max); got != atLimit {
+			t.Fatalf("%s: expected %d+1-byte value to be cut to %d, got %d bytes", tc.name, tc.max, tc.max, len(got))
+		}
+	}
+}
+
+func TestSanitizeStringKeepsUTF8Intact(t *testing.T) {
+	// "é" is two bytes; a cut at an odd offset must back off to a rune start.
+	got := SanitizeString(strings.Repeat("é", 40), MaxChainLen+1)
+	if !utf8.ValidString(got) || len(got) != MaxChainLen {
+		t.Fatalf("expected valid %d-byte string, got %q (%d bytes)", MaxChainLen, got, len(got))
+	}
+}
+
+func TestSanitizeStringStripsNonPrintable(t *testing.T) {
+	if got := SanitizeString(" exa\x00mple.com\r\n\x1b[31m\xff ", MaxDomainLen); got != "example.com[31m" {
+		t.Fatalf("expected control and invalid bytes stripped, got %q", got)
+	}
+	if got := SanitizeString("\x00\x01", MaxDomainLen); got != "" {
+		t.Fatalf("expected only-control input to become empty, got %q", got)
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	cases := map[string]string{
+		" 1.2.3.4 ":      "1.2.3.4",
+		"::ffff:1.2.3.4": "1.2.3.4",
+		"[2001:DB8::1]":  "2001:db8::1",
+		"fe80::1%eth0":   "fe80::1",
+		"1.2.3.4.5":      "",
+		"example.com":    "",
+		"300.1.1.1":      "",
+		"":               "",
+	}
+	for in, want := range cases {
+		if got := NormalizeIP(in); got != want {
+			t.Fatalf("NormalizeIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
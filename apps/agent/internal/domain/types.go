@@ -1,28 +1,69 @@
 package domain
 
+// HostSource values: the host came from the DNS lookup or request target
+// (Clash metadata.host), from sniffing the TLS SNI or HTTP Host
+// (metadata.sniffHost), or the gateway only knew the destination IP.
+const (
+	HostSourceDNS   = "dns"
+	HostSourceSniff = "sniff"
+	HostSourceIP    = "ip"
+)
+
 type TrafficUpdate struct {
-	Domain      string   `json:"domain,omitempty"`
-	IP          string   `json:"ip,omitempty"`
-	Chain       string   `json:"chain"`
-	Chains      []string `json:"chains"`
-	Rule        string   `json:"rule"`
-	RulePayload string   `json:"rulePayload,omitempty"`
-	Upload      int64    `json:"upload"`
-	Download    int64    `json:"download"`
-	Connections int64    `json:"connections,omitempty"`
-	SourceIP    string   `json:"sourceIP,omitempty"`
-	TimestampMs int64    `json:"timestampMs"`
+	Domain           string   `json:"domain,omitempty"`
+	DomainSource     string   `json:"domainSource,omitempty"`
+	HostSource       string   `json:"hostSource,omitempty"`
+	DomainASCII      string   `json:"domainASCII,omitempty"`
+	IP               string   `json:"ip,omitempty"`
+	Chain            string   `json:"chain"`
+	Chains           []string `json:"chains"`
+	Rule             string   `json:"rule"`
+	RulePayload      string   `json:"rulePayload,omitempty"`
+	Upload           int64    `json:"upload"`
+	Download         int64    `json:"download"`
+	UploadSpeedBps   int64    `json:"uploadSpeedBps,omitempty"`
+	DownloadSpeedBps int64    `json:"downloadSpeedBps,omitempty"`
+	Connections      int64    `json:"connections,omitempty"`
+	SourceIP         string   `json:"sourceIP,omitempty"`
+	TimestampMs      int64    `json:"timestampMs"`
+	FirstSeenMs      int64    `json:"firstSeenMs,omitempty"`
+	DurationMs       int64    `json:"durationMs,omitempty"`
+	Country          string   `json:"country,omitempty"`
+	DNSMode          string   `json:"dnsMode,omitempty"`
+	SpecialProxy     string   `json:"specialProxy,omitempty"`
+	Transport        string   `json:"transport,omitempty"`
+	AppProtocol      string   `json:"appProtocol,omitempty"`
+	Process          string   `json:"process,omitempty"`
+	DestASN          int64    `json:"destASN,omitempty"`
+	DestASOrg        string   `json:"destASOrg,omitempty"`
+	DestDatacenter   bool     `json:"destDatacenter,omitempty"`
+	Sampled          bool     `json:"sampled,omitempty"`
+	SampleRate       float64  `json:"sampleRate,omitempty"`
+	Aggregate        bool     `json:"aggregate,omitempty"`
+	Blocked          bool     `json:"blocked,omitempty"`
 }
 
 type FlowSnapshot struct {
-	ID          string
-	Domain      string
-	IP          string
-	SourceIP    string
-	Chains      []string
-	Rule        string
-	RulePayload string
-	Upload      int64
-	Download    int64
-	TimestampMs int64
+	ID           string
+	Domain       string
+	DomainASCII  string // ASCII (punycode) form, set when it differs from Domain
+	HostSource   string // Clash: how the gateway knew Domain, see HostSourceDNS
+	IP           string
+	SourceIP     string
+	RemoteAddrs  []string // every address the gateway listed, for debugging
+	DNSMode      string   // Clash: normal, fakeip, redirhost, hosts
+	SpecialProxy string   // Clash: set when a special path (e.g. DNS hijack) handled the flow
+	Transport    string   // tcp or udp, when known
+	AppProtocol  string   // best-effort: quic, https, http, stun, dns
+	Process      string   // Surge for Mac: name of the originating process
+	Blocked      bool     // matched a REJECT policy or failed at the gateway
+	Chains       []string // exit-first: [0] carried the flow, last is the rule's policy
+	Rule         string
+	RulePayload  string
+	Upload       int64
+	Download     int64
+	// Current speeds in bytes per second when the gateway reports them.
+	UploadSpeedBps   int64
+	DownloadSpeedBps int64
+	TimestampMs      int64
 }
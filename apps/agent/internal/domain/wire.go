@@ -0,0 +1,75 @@
+package domain
+
+import "github.com/foru17/neko-master/apps/agent/internal/msgpack"
+
+// ReportPayload is the body of POST /agent/report. Protocol v1 sends it as
+// JSON; protocol v2 may send the same fields MessagePack-encoded by
+// AppendMsgpack, keyed by their JSON names.
+type ReportPayload struct {
+	BackendID       int             `json:"backendId"`
+	RequestID       string          `json:"requestId,omitempty"`
+	BatchID         string          `json:"batchId,omitempty"`
+	Seq             int64           `json:"seq,omitempty"`
+	AgentID         string          `json:"agentId"`
+	AgentVersion    string          `json:"agentVersion,omitempty"`
+	ProtocolVersion int             `json:"protocolVersion"`
+	Updates         []TrafficUpdate `json:"updates"`
+}
+
+// AppendMsgpack appends the MessagePack encoding of p to b.
+func (p *ReportPayload) AppendMsgpack(b []byte) []byte {
+	w := msgpack.BeginMap(b)
+	w.Int("backendId", int64(p.BackendID))
+	w.StringOmitEmpty("requestId", p.RequestID)
+	w.StringOmitEmpty("batchId", p.BatchID)
+	w.IntOmitEmpty("seq", p.Seq)
+	w.String("agentId", p.AgentID)
+	w.StringOmitEmpty("agentVersion", p.AgentVersion)
+	w.Int("protocolVersion", int64(p.ProtocolVersion))
+	w.Raw("updates", func(b []byte) []byte {
+		b = msgpack.AppendArrayHeader(b, len(p.Updates))
+		for i := range p.Updates {
+			b = p.Updates[i].AppendMsgpack(b)
+		}
+		return b
+	})
+	return w.End()
+}
+
+// AppendMsgpack appends the MessagePack encoding of u to b, honouring the same
+// omitempty rules as its JSON form. New TrafficUpdate fields must be added here.
+func (u *TrafficUpdate) AppendMsgpack(b []byte) []byte {
+	w := msgpack.BeginMap(b)
+	w.StringOmitEmpty("domain", u.Domain)
+	w.StringOmitEmpty("domainSource", u.DomainSource)
+	w.StringOmitEmpty("hostSource", u.HostSource)
+	w.StringOmitEmpty("domainASCII", u.DomainASCII)
+	w.StringOmitEmpty("ip", u.IP)
+	w.String("chain", u.Chain)
+	w.Strings("chains", u.Chains)
+	w.String("rule", u.Rule)
+	w.StringOmitEmpty("rulePayload", u.RulePayload)
+	w.Int("upload", u.Upload)
+	w.Int("download", u.Download)
+	w.IntOmitEmpty("uploadSpeedBps", u.UploadSpeedBps)
+	w.IntOmitEmpty("downloadSpeedBps", u.DownloadSpeedBps)
+	w.IntOmitEmpty("connections", u.Connections)
+	w.StringOmitEmpty("sourceIP", u.SourceIP)
+	w.Int("timestampMs", u.TimestampMs)
+	w.IntOmitEmpty("firstSeenMs", u.FirstSeenMs)
+	w.IntOmitEmpty("durationMs", u.DurationMs)
+	w.StringOmitEmpty("country", u.Country)
+	w.StringOmitEmpty("dnsMode", u.DNSMode)
+	w.StringOmitEmpty("specialProxy", u.SpecialProxy)
+	w.StringOmitEmpty("transport", u.Transport)
+	w.StringOmitEmpty("appProtocol", u.AppProtocol)
+	w.StringOmitEmpty("process", u.Process)
+	w.IntOmitEmpty("destASN", u.DestASN)
+	w.StringOmitEmpty("destASOrg", u.DestASOrg)
+	w.BoolOmitEmpty("destDatacenter", u.DestDatacenter)
+	w.BoolOmitEmpty("sampled", u.Sampled)
+	w.Float64OmitEmpty("sampleRate", u.SampleRate)
+	w.BoolOmitEmpty("aggregate", u.Aggregate)
+	w.BoolOmitEmpty("blocked", u.Blocked)
+	return w.End()
+}
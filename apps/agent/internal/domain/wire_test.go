@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/foru17/neko-master/apps/agent/internal/msgpack/msgpacktest"
+)
+
+// fillAll sets every exported field of v to a non-zero value so the round-trip
+// test fails when a new TrafficUpdate field is missing from AppendMsgpack.
+func fillAll(v reflect.Value, seed int) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(fmt.Sprintf("%s-%d", v.Type().Field(i).Name, seed))
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(1000*seed + i + 1))
+		case reflect.Float64:
+			f.SetFloat(float64(seed) + 0.5)
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() == reflect.String {
+				f.Set(reflect.ValueOf([]string{"a", fmt.Sprintf("b-%d", seed)}))
+			}
+		}
+	}
+}
+
+func sampleReport(n int) ReportPayload {
+	p := ReportPayload{
+		BackendID:       7,
+		RequestID:       "0123456789abcdef0123456789abcdef",
+		BatchID:         "fedcba9876543210fedcba9876543210",
+		Seq:             12,
+		AgentID:         "agent-0123456789abcdef",
+		AgentVersion:    "agent-v1.4.0",
+		ProtocolVersion: 2,
+		Updates:         make([]TrafficUpdate, n),
+	}
+	for i := range p.Updates {
+		fillAll(reflect.ValueOf(&p.Updates[i]).Elem(), i)
+	}
+	return p
+}
+
+func TestReportPayloadMsgpackRoundTrip(t *testing.T) {
+	for _, p := range []ReportPayload{
+		sampleReport(3),
+		{BackendID: 1, AgentID: "a", ProtocolVersion: 2, Updates: []TrafficUpdate{{Chain: "DIRECT", Rule: "Match", Upload: -1, Download: 1 << 40}}},
+	} {
+		decoded, err := msgpacktest.Decode(p.AppendMsgpack(nil))
+		if err != nil {
+			t.Fatalf("decode msgpack: %v", err)
+		}
+		// Route the generic msgpack value through JSON to compare with the
+		// struct's JSON form; this also proves the omitempty rules match.
+		viaMsgpack, err := json.Marshal(decoded)
+		if err != nil {
+			t.Fatalf("marshal decoded value: %v", err)
+		}
+		var got ReportPayload
+		if err := json.Unmarshal(viaMsgpack, &got); err != nil {
+			t.Fatalf("unmarshal decoded value: %v", err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, p)
+		}
+
+		var generic, want map[string]interface{}
+		direct, _ := json.Marshal(p)
+		_ = json.Unmarshal(direct, &want)
+		_ = json.Unmarshal(viaMsgpack, &generic)
+		if !reflect.DeepEqual(generic, want) {
+			t.Fatalf("msgpack keys differ from JSON keys:\n got %v\nwant %v", generic, want)
+		}
+	}
+}
+
+func BenchmarkReportPayloadJSON(b *testing.B) {
+	p := sampleReport(1000)
+	b.ReportAllocs()
+	var size int
+	for i := 0; i < b.N; i++ {
+		out, err := json.Marshal(&p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(out)
+	}
+	b.ReportMetric(float64(size), "payload-bytes")
+}
+
+func BenchmarkReportPayloadMsgpack(b *testing.B) {
+	p := sampleReport(1000)
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf = p.AppendMsgpack(buf[:0])
+	}
+	b.ReportMetric(float64(len(buf)), "payload-bytes")
+}
@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// Chain orientation
+//
+// Every snapshot's Chains is ordered exit-first: Chains[0] is the outbound
+// that actually carried the connection (a proxy node, DIRECT or REJECT) and
+// the last element is the policy the matching rule selected, with any nested
+// groups in between. This is the order Clash reports natively; Surge and
+// sing-box are converted to it here so the master sees the same orientation
+// from all of them.
+
+var policyPathRegex = regexp.MustCompile(`\[Rule\] Policy decision path: (.+)`)
+
+// clashChains cleans up a Clash chains list, which is already exit-first.
+func clashChains(chains []string) []string {
+	return NormalizeChains(chains)
+}
+
+// singBoxChains builds an exit-first chain from sing-box's Clash API, which
+// lists the rule's outbound first and follows group selections to the exit.
+func singBoxChains(chains []string) []string {
+	return NormalizeChains(reverseChains(chains))
+}
+
+// surgeChains builds an exit-first chain for a Surge request. policyName is
+// the policy that handled the request and originalPolicyName the one the rule
+// selected. The "Policy decision path" note, when present, lists the full path
+// rule-first; it is reversed, and re-oriented if its ends disagree with
+// policyName.
+func surgeChains(policyName, originalPolicyName string, notes []string) []string {
+	exit := strings.TrimSpace(policyName)
+	if path := extractPolicyPathFromNotes(notes); len(path) >= 2 {
+		return policyPathChains(path, exit)
+	}
+
+	chains := make([]string, 0, 2)
+	if exit != "" {
+		chains = append(chains, exit)
+	}
+	if o := strings.TrimSpace(originalPolicyName); o != "" && o != exit {
+		chains = append(chains, o)
+	}
+	return NormalizeChains(chains)
+}
+
+// policyPathChains builds an exit-first chain from a rule-first policy path,
+// as Surge's "Policy decision path" note and Clash's /logs give it, oriented
+// by the known exit policy.
+func policyPathChains(path []string, exit string) []string {
+	return NormalizeChains(orientExitFirst(reverseChains(path), exit))
+}
+
+// orientExitFirst reverses chains when the known exit policy sits at the end
+// rather than the start, i.e. when a gateway reported the path the other way
+// round. Without a known exit, or when it appears at neither end, chains is
+// returned unchanged.
+func orientExitFirst(chains []string, exit string) []string {
+	if exit == "" || len(chains) < 2 || chains[0] == exit || chains[len(chains)-1] != exit {
+		return chains
+	}
+	return reverseChains(chains)
+}
+
+func reverseChains(chains []string) []string {
+	out := make([]string, len(chains))
+	for i, c := range chains {
+		out[len(chains)-1-i] = c
+	}
+	return out
+}
+
+// extractPolicyPathFromNotes returns the segments of Surge's "Policy decision
+// path" note in the order Surge prints them (rule policy first).
+func extractPolicyPathFromNotes(notes []string) []string {
+	for _, note := range notes {
+		m := policyPathRegex.FindStringSubmatch(note)
+		if len(m) < 2 {
+			continue
+		}
+		segments := strings.Split(m[1], " -> ")
+		cleaned := make([]string, 0, len(segments))
+		for _, segment := range segments {
+			if s := strings.TrimSpace(segment); s != "" {
+				cleaned = append(cleaned, s)
+			}
+		}
+		if len(cleaned) >= 2 {
+			return cleaned
+		}
+	}
+	return nil
+}
+
+// NormalizeChains sanitizes chain names, drops empty ones and caps the list
+// at domain.MaxChains, defaulting to DIRECT when nothing is left. It keeps the
+// given orientation. The agent applies it to every snapshot's Chains as well,
+// since they may come from anywhere a FlowSnapshot is built.
+func NormalizeChains(chains []string) []string {
+	out := make([]string, 0, min(len(chains), domain.MaxChains))
+	for _, chain := range chains {
+		trimmed := domain.SanitizeString(chain, domain.MaxChainLen)
+		if trimmed == "" {
+			continue
+		}
+		out = append(out, trimmed)
+		if len(out) >= domain.MaxChains {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return []string{"DIRECT"}
+	}
+	return out
+}
+
+// exitChain returns the outbound that carried the connection.
+func exitChain(chains []string) string {
+	if len(chains) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(chains[0])
+}
+
+// ruleChain returns the policy the rule selected.
+func ruleChain(chains []string) string {
+	if len(chains) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(chains[len(chains)-1])
+}
@@ -0,0 +1,62 @@
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+func TestChainsAreExitFirst(t *testing.T) {
+	want := []string{"HK-01", "Auto", "Proxy"}
+	tests := []struct {
+		name string
+		got  []string
+	}{
+		{"clash", clashChains([]string{"HK-01", " Auto ", "", "Proxy"})},
+		{"surge decision path", surgeChains("HK-01", "Proxy", []string{"[Rule] Policy decision path: Proxy -> Auto -> HK-01"})},
+		{"surge path printed exit-first", surgeChains("HK-01", "Proxy", []string{"[Rule] Policy decision path: HK-01 -> Auto -> Proxy"})},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, want) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, want, tt.got)
+		}
+	}
+
+	if got := surgeChains("HK-01", "Proxy", nil); !reflect.DeepEqual(got, []string{"HK-01", "Proxy"}) {
+		t.Fatalf("expected policy then original policy without notes, got %v", got)
+	}
+	if got := surgeChains("DIRECT", "DIRECT", nil); !reflect.DeepEqual(got, []string{"DIRECT"}) {
+		t.Fatalf("expected a single DIRECT element, got %v", got)
+	}
+	if got := clashChains(nil); !reflect.DeepEqual(got, []string{"DIRECT"}) {
+		t.Fatalf("expected empty chains to default to DIRECT, got %v", got)
+	}
+	if exitChain(want) != "HK-01" || ruleChain(want) != "Proxy" {
+		t.Fatalf("expected exit HK-01 and rule policy Proxy, got %q and %q", exitChain(want), ruleChain(want))
+	}
+}
+
+func TestNormalizeChains(t *testing.T) {
+	long := strings.Repeat("x", domain.MaxChainLen+10)
+	many := make([]string, domain.MaxChains+3)
+	for i := range many {
+		many[i] = fmt.Sprintf("node-%d", i)
+	}
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, []string{"DIRECT"}},
+		{[]string{" ", ""}, []string{"DIRECT"}},
+		{[]string{" HK\x00-01 ", long}, []string{"HK-01", long[:domain.MaxChainLen]}},
+		{many, many[:domain.MaxChains]},
+	}
+	for _, tt := range tests {
+		if got := NormalizeChains(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("NormalizeChains(%q) = %q, expected %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxClashLogPaths bounds the policy paths read from /logs that no polled
+// connection has claimed yet; the oldest is dropped first.
+const maxClashLogPaths = 4096
+
+// clashLogRegex matches the line Clash and mihomo log for each new
+// connection, e.g. "[TCP] 192.168.1.2:52344(chrome) --> www.google.com:443
+// match DomainSuffix(google.com) using Proxy[HK-01]", capturing the source
+// address, the destination and the policy path.
+var clashLogRegex = regexp.MustCompile(`^\[(?:TCP|UDP)\] (\S+?)(?:\(.*?\))? --> (\S+)(?: match .+?| doesn't match any rule)? using (.+)$`)
+
+// clashLogPaths holds the policy paths read from /logs, keyed by connection
+// source address and destination port until a polled connection claims one,
+// then by connection ID for as long as the connection is listed.
+type clashLogPaths struct {
+	mu    sync.Mutex
+	paths map[string][]string
+	order []string // keys of paths, oldest at next
+	next  int
+	byID  map[string][]string
+	seen  map[string][]string // byID of the poll in progress
+}
+
+func newClashLogPaths() *clashLogPaths {
+	return &clashLogPaths{
+		paths: make(map[string][]string),
+		order: make([]string, maxClashLogPaths),
+		byID:  make(map[string][]string),
+	}
+}
+
+func (p *clashLogPaths) add(key string, path []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.paths[key]; !ok {
+		delete(p.paths, p.order[p.next])
+		p.order[p.next] = key
+		p.next = (p.next + 1) % len(p.order)
+	}
+	p.paths[key] = path
+}
+
+func (p *clashLogPaths) beginPoll() {
+	p.mu.Lock()
+	p.seen = make(map[string][]string, len(p.byID))
+	p.mu.Unlock()
+}
+
+// match returns the logged policy path of connection id, or nil.
+func (p *clashLogPaths) match(id, key string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path, ok := p.byID[id]
+	if !ok {
+		if path, ok = p.paths[key]; !ok {
+			return nil
+		}
+		// Its slot in order is reused in time.
+		delete(p.paths, key)
+	}
+	p.seen[id] = path
+	return path
+}
+
+// endPoll forgets the paths of connections the finished poll did not list.
+func (p *clashLogPaths) endPoll() {
+	p.mu.Lock()
+	p.byID, p.seen = p.seen, nil
+	p.mu.Unlock()
+}
+
+// clashLogKey identifies a connection in both /logs and /connections.
+func clashLogKey(source, destPort string) string {
+	return source + " " + destPort
+}
+
+// parseClashLogLine returns the source address, destination port and
+// rule-first policy path of a connection log line. Clash logs a chain of
+// several policies as "Rule[Exit]", naming only its two ends.
+func parseClashLogLine(line string) (key string, path []string, ok bool) {
+	m := clashLogRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return "", nil, false
+	}
+	_, port, err := net.SplitHostPort(m[2])
+	if err != nil {
+		return "", nil, false
+	}
+	using := strings.TrimSpace(m[3])
+	if rule, exit, found := strings.Cut(using, "["); found && strings.HasSuffix(exit, "]") {
+		path = []string{rule, strings.TrimSuffix(exit, "]")}
+	} else {
+		path = []string{using}
+	}
+	return clashLogKey(m[1], port), path, true
+}
+
+// SetClashLogs enables chains from /logs; see FollowClashLogs.
+func (c *Client) SetClashLogs(enabled bool) {
+	c.logPaths = nil
+	if enabled {
+		c.logPaths = newClashLogPaths()
+	}
+}
+
+// FollowClashLogs streams /logs until ctx is done or the stream fails, and
+// keeps the policy path logged for each new connection. Collect then uses it
+// for a connection whose /connections chains are shorter, as with gateways
+// that report only the exit. /logs streams one JSON line per log entry to a
+// plain GET, so no WebSocket is needed; the request timeout does not apply.
+func (c *Client) FollowClashLogs(ctx context.Context) error {
+	if c.Type() != "clash" || c.logPaths == nil {
+		return errors.New("clash logs are not enabled")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/logs?level=info", nil)
+	if err != nil {
+		return err
+	}
+	c.authorize(req)
+	stream := *c.httpClient
+	stream.Timeout = 0
+	resp, err := stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Path: "/logs", Code: resp.StatusCode, Body: string(msg)}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var entry struct {
+			Payload string `json:"payload"`
+		}
+		if err := dec.Decode(&entry); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("clash /logs error: %w", err)
+		}
+		if key, path, ok := parseClashLogLine(entry.Payload); ok {
+			c.logPaths.add(key, path)
+		}
+	}
+}
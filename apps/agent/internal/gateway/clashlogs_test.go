@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseClashLogLine(t *testing.T) {
+	cases := []struct {
+		line string
+		key  string
+		path []string
+	}{
+		{"[TCP] 192.168.1.2:52344 --> www.google.com:443 match DomainSuffix(google.com) using Proxy[HK-01]", "192.168.1.2:52344 443", []string{"Proxy", "HK-01"}},
+		{"[TCP] 192.168.1.2:52345(chrome) --> 1.1.1.1:853 match IPCIDR(1.1.1.0/24) using DIRECT", "192.168.1.2:52345 853", []string{"DIRECT"}},
+		{"[UDP] [fd00::2]:5353 --> example.com:443 doesn't match any rule using Auto[JP]", "[fd00::2]:5353 443", []string{"Auto", "JP"}},
+		{"[TCP] 10.0.0.2:40000 --> example.com:80 using GLOBAL", "10.0.0.2:40000 80", []string{"GLOBAL"}},
+	}
+	for _, tc := range cases {
+		key, path, ok := parseClashLogLine(tc.line)
+		if !ok || key != tc.key || !reflect.DeepEqual(path, tc.path) {
+			t.Errorf("parseClashLogLine(%q) = %q, %v, %v; want %q, %v", tc.line, key, path, ok, tc.key, tc.path)
+		}
+	}
+	if _, _, ok := parseClashLogLine("[TCP] dial Proxy (match DomainSuffix/google.com) error: timeout"); ok {
+		t.Error("expected a dial error line to be ignored")
+	}
+}
+
+func TestClashLogsFillShortChains(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logs":
+			_, _ = w.Write([]byte(`{"type":"info","payload":"[TCP] 192.168.1.2:52344 --> www.google.com:443 match DomainSuffix(google.com) using Proxy[HK-01]"}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "/connections":
+			_, _ = w.Write([]byte(`{"connections":[
+				{"id":"a","chains":["HK-01"],"rule":"DomainSuffix","rulePayload":"google.com","metadata":{"host":"www.google.com","sourceIP":"192.168.1.2","sourcePort":"52344","destinationPort":"443"}},
+				{"id":"b","chains":["DIRECT"],"rule":"Match","metadata":{"host":"example.com","sourceIP":"192.168.1.2","sourcePort":"52399","destinationPort":"443"}}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetClashLogs(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- client.FollowClashLogs(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.logPaths.mu.Lock()
+		n := len(client.logPaths.paths)
+		client.logPaths.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the log line")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		snapshots, err := client.Collect(ctx)
+		if err != nil {
+			t.Fatalf("Collect returned error: %v", err)
+		}
+		if want := []string{"HK-01", "Proxy"}; !reflect.DeepEqual(snapshots[0].Chains, want) {
+			t.Fatalf("poll %d: expected chains %v from the log, got %v", i, want, snapshots[0].Chains)
+		}
+		if want := []string{"DIRECT"}; !reflect.DeepEqual(snapshots[1].Chains, want) {
+			t.Fatalf("poll %d: expected unlogged chains kept, got %v", i, snapshots[1].Chains)
+		}
+	}
+}
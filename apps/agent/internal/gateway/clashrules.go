@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"strings"
+	"unicode"
+)
+
+// clashRuleKeywords maps the rule type names Clash and mihomo report in
+// /rules to the keywords used in their config files. Names that are not a
+// plain CamelCase split of the keyword are listed; the rest are derived by
+// clashRuleKeyword.
+var clashRuleKeywords = map[string]string{
+	"GeoIP":            "GEOIP",
+	"GeoSite":          "GEOSITE",
+	"SrcGeoIP":         "SRC-GEOIP",
+	"IPCIDR":           "IP-CIDR",
+	"IPCIDR6":          "IP-CIDR6",
+	"SrcIPCIDR":        "SRC-IP-CIDR",
+	"IPSuffix":         "IP-SUFFIX",
+	"SrcIPSuffix":      "SRC-IP-SUFFIX",
+	"IPASN":            "IP-ASN",
+	"SrcIPASN":         "SRC-IP-ASN",
+	"IPSet":            "IPSET",
+	"DSCP":             "DSCP",
+	"Uid":              "UID",
+	"SubRules":         "SUB-RULE",
+	"ProcessNameRegex": "PROCESS-NAME-REGEX",
+	"ProcessPathRegex": "PROCESS-PATH-REGEX",
+}
+
+// clashRuleKeyword returns the config keyword for a /rules type, e.g.
+// DOMAIN-SUFFIX for DomainSuffix. Types already in keyword form (AND, OR,
+// NOT, or a core that reports them that way) are returned as they are.
+func clashRuleKeyword(typ string) string {
+	if kw, ok := clashRuleKeywords[typ]; ok {
+		return kw
+	}
+	if strings.ToUpper(typ) == typ {
+		return typ
+	}
+	var b strings.Builder
+	for i, r := range typ {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('-')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// clashRuleRaw rebuilds the config line for a Clash rule, such as
+// DOMAIN-SUFFIX,example.com,Proxy or MATCH,DIRECT, so Clash rules carry Raw
+// like Surge's do. Rule options such as no-resolve are not reported by /rules
+// and so are not part of it.
+func clashRuleRaw(typ, payload, proxy string) string {
+	kw := clashRuleKeyword(typ)
+	if payload == "" {
+		return kw + "," + proxy
+	}
+	return kw + "," + payload + "," + proxy
+}
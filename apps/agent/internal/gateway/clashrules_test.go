@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClashRuleRaw(t *testing.T) {
+	cases := []struct {
+		typ, payload, proxy string
+		want                string
+	}{
+		{"Domain", "example.com", "Proxy", "DOMAIN,example.com,Proxy"},
+		{"DomainSuffix", "example.com", "Proxy", "DOMAIN-SUFFIX,example.com,Proxy"},
+		{"DomainKeyword", "google", "Proxy", "DOMAIN-KEYWORD,google,Proxy"},
+		{"DomainRegex", `^ad\.`, "REJECT", `DOMAIN-REGEX,^ad\.,REJECT`},
+		{"GeoSite", "cn", "DIRECT", "GEOSITE,cn,DIRECT"},
+		{"GeoIP", "CN", "DIRECT", "GEOIP,CN,DIRECT"},
+		{"SrcGeoIP", "CN", "DIRECT", "SRC-GEOIP,CN,DIRECT"},
+		{"IPCIDR", "10.0.0.0/8", "DIRECT", "IP-CIDR,10.0.0.0/8,DIRECT"},
+		{"IPCIDR6", "fd00::/8", "DIRECT", "IP-CIDR6,fd00::/8,DIRECT"},
+		{"SrcIPCIDR", "192.168.1.0/24", "DIRECT", "SRC-IP-CIDR,192.168.1.0/24,DIRECT"},
+		{"IPSuffix", "8.8.8.8/24", "Proxy", "IP-SUFFIX,8.8.8.8/24,Proxy"},
+		{"IPASN", "13335", "Proxy", "IP-ASN,13335,Proxy"},
+		{"SrcPort", "7777", "DIRECT", "SRC-PORT,7777,DIRECT"},
+		{"DstPort", "443", "Proxy", "DST-PORT,443,Proxy"},
+		{"InPort", "7890", "Proxy", "IN-PORT,7890,Proxy"},
+		{"ProcessName", "curl", "DIRECT", "PROCESS-NAME,curl,DIRECT"},
+		{"ProcessPath", "/usr/bin/curl", "DIRECT", "PROCESS-PATH,/usr/bin/curl,DIRECT"},
+		{"ProcessNameRegex", "^curl$", "DIRECT", "PROCESS-NAME-REGEX,^curl$,DIRECT"},
+		{"RuleSet", "streaming", "Media", "RULE-SET,streaming,Media"},
+		{"Network", "udp", "DIRECT", "NETWORK,udp,DIRECT"},
+		{"Uid", "1000", "DIRECT", "UID,1000,DIRECT"},
+		{"SubRules", "sub", "Proxy", "SUB-RULE,sub,Proxy"},
+		{"AND", "((NETWORK,UDP),(DST-PORT,443))", "REJECT", "AND,((NETWORK,UDP),(DST-PORT,443)),REJECT"},
+		{"DOMAIN-SUFFIX", "example.com", "Proxy", "DOMAIN-SUFFIX,example.com,Proxy"},
+		{"Match", "", "Proxy", "MATCH,Proxy"},
+	}
+	for _, tc := range cases {
+		if got := clashRuleRaw(tc.typ, tc.payload, tc.proxy); got != tc.want {
+			t.Errorf("clashRuleRaw(%q, %q, %q) = %q, want %q", tc.typ, tc.payload, tc.proxy, got, tc.want)
+		}
+	}
+}
+
+func TestClashConfigSnapshotIncludesRawRules(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/rules":
+			_, _ = w.Write([]byte(`{"rules":[{"type":"DomainSuffix","payload":"example.com","proxy":"Proxy"},{"type":"Match","payload":"","proxy":"DIRECT"}]}`))
+		case "/proxies":
+			_, _ = w.Write([]byte(`{"proxies":{}}`))
+		case "/providers/proxies":
+			_, _ = w.Write([]byte(`{"providers":{}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	snap, err := client.GetConfigSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	if len(snap.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(snap.Rules))
+	}
+	first := snap.Rules[0]
+	if first.Type != "DomainSuffix" || first.Payload != "example.com" || first.Proxy != "Proxy" {
+		t.Fatalf("parsed fields changed: %+v", first)
+	}
+	if first.Raw != "DOMAIN-SUFFIX,example.com,Proxy" {
+		t.Fatalf("unexpected raw %q", first.Raw)
+	}
+	if got := snap.Rules[1].Raw; got != "MATCH,DIRECT" {
+		t.Fatalf("unexpected raw for MATCH %q", got)
+	}
+}
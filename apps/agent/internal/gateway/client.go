@@ -4,60 +4,152 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"regexp"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/foru17/neko-master/apps/agent/internal/domain"
 )
 
-var (
-	domainPattern   = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
-	policyPathRegex = regexp.MustCompile(`\[Rule\] Policy decision path: (.+)`)
-)
-
 type Client struct {
 	httpClient  *http.Client
-	gatewayType string
+	gatewayType atomic.Value // string; set once more by DetectType
 	endpoint    string
 	token       string
+	basicUser   string
+	basicPass   string
+	surgePaths  []string
+	providers   string // policy-state grouping, see SetPolicyProviders
+	flavor      string // Clash-compatible app, see SetFlavor
+	recorder    *Recorder
+	surgeGroups surgeGroupCache
+	logPaths    *clashLogPaths // nil unless SetClashLogs
+
+	maxResponseBytes int64
+	skipUnchanged    bool
+	body             bytes.Buffer      // last response, reused across polls
+	bodyHashes       map[string]uint64 // per path, to spot unchanged responses
+
+	// mihomo extended API, see DetectCore. The no* flags are set once an
+	// endpoint returns 404.
+	meta        atomic.Bool
+	noGroupAPI  atomic.Bool
+	noMemoryAPI atomic.Bool
+	// singBox adjusts the Clash API decoding to sing-box's, set by the
+	// singbox gateway type or by DetectCore.
+	singBox atomic.Bool
 }
 
 func NewClient(httpClient *http.Client, gatewayType, endpoint, token string) *Client {
-	return &Client{
-		httpClient:  httpClient,
-		gatewayType: gatewayType,
-		endpoint:    endpoint,
-		token:       token,
+	c := &Client{
+		httpClient: httpClient,
+		endpoint:   endpoint,
+		token:      token,
+	}
+	c.gatewayType.Store(gatewayType)
+	if gatewayType == "singbox" {
+		// sing-box speaks the Clash API, with differences handled per call.
+		c.gatewayType.Store("clash")
+		c.singBox.Store(true)
+	}
+	return c
+}
+
+// SetBasicAuth makes the client send HTTP Basic credentials on every gateway
+// request instead of the bearer token / x-key header.
+func (c *Client) SetBasicAuth(user, pass string) {
+	c.basicUser = user
+	c.basicPass = pass
+}
+
+// SetSurgeRequestSource selects which Surge request lists are polled:
+// "recent" (the default; completed and in-progress requests), "active"
+// (in-progress only) or "both". Counters are cumulative per request ID in all
+// of them, so the runner's delta tracking applies unchanged; with "both" a
+// request listed twice is reported once with its larger counters.
+func (c *Client) SetSurgeRequestSource(source string) {
+	switch source {
+	case "active":
+		c.surgePaths = []string{"/v1/requests/active"}
+	case "both":
+		c.surgePaths = []string{"/v1/requests/active", "/v1/requests/recent"}
+	default:
+		c.surgePaths = []string{"/v1/requests/recent"}
+	}
+}
+
+// SetMaxResponseBytes caps the size of a connection list response; a larger
+// one fails the poll with a *TruncatedError. Zero means no cap.
+func (c *Client) SetMaxResponseBytes(n int64) {
+	c.maxResponseBytes = n
+}
+
+// SetSkipUnchanged makes Collect return ErrUnchanged instead of decoding a
+// response byte-identical to the previous poll's.
+func (c *Client) SetSkipUnchanged(skip bool) {
+	c.skipUnchanged = skip
+}
+
+// authorize applies the configured gateway credentials to req.
+func (c *Client) authorize(req *http.Request) {
+	if c.basicUser != "" {
+		req.SetBasicAuth(c.basicUser, c.basicPass)
+		return
+	}
+	if c.token == "" {
+		return
+	}
+	switch c.Type() {
+	case "surge":
+		req.Header.Set("X-Key", c.token)
+	case "quanx":
+		req.Header.Set(quanxTokenHeader, c.token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+c.token)
 	}
 }
 
 func (c *Client) Collect(ctx context.Context) ([]domain.FlowSnapshot, error) {
-	if c.gatewayType == "clash" {
+	if c.Type() == TypeAuto {
+		return nil, ErrTypeUndetected
+	}
+	switch c.Type() {
+	case "clash":
 		return c.collectClash(ctx)
+	case "quanx":
+		return c.collectQuanX(ctx)
 	}
 	return c.collectSurge(ctx)
 }
 
-type clashConnectionsResponse struct {
-	Connections []struct {
-		ID          string   `json:"id"`
-		Upload      float64  `json:"upload"`
-		Download    float64  `json:"download"`
-		Rule        string   `json:"rule"`
-		RulePayload string   `json:"rulePayload"`
-		Chains      []string `json:"chains"`
-		Metadata    struct {
-			Host          string `json:"host"`
-			SniffHost     string `json:"sniffHost"`
-			DestinationIP string `json:"destinationIP"`
-			SourceIP      string `json:"sourceIP"`
-		} `json:"metadata"`
-	} `json:"connections"`
+// clashConnection is one element of the /connections array. Stash and
+// Shadowrocket send some counters as strings and null for empty chains or
+// metadata, hence the flexible types.
+type clashConnection struct {
+	ID          flexibleID         `json:"id"`
+	Upload      flexibleInt64      `json:"upload"`
+	Download    flexibleInt64      `json:"download"`
+	Rule        string             `json:"rule"`
+	RulePayload string             `json:"rulePayload"`
+	Chains      flexibleStringList `json:"chains"`
+	Metadata    struct {
+		Host          string     `json:"host"`
+		SniffHost     string     `json:"sniffHost"`
+		DestinationIP string     `json:"destinationIP"`
+		SourceIP      string     `json:"sourceIP"`
+		SourcePort    flexibleID `json:"sourcePort"`
+		DNSMode       string     `json:"dnsMode"`
+		SpecialProxy  string     `json:"specialProxy"`
+		Network       string     `json:"network"`
+		DestPort      flexibleID `json:"destinationPort"`
+	} `json:"metadata"`
 }
 
 type flexibleID string
@@ -121,6 +213,44 @@ func (v *flexibleFloat64) UnmarshalJSON(data []byte) error {
 	return fmt.Errorf("unsupported numeric value: %s", string(trimmed))
 }
 
+// flexibleInt64 decodes byte counters given as JSON numbers or numeric
+// strings. Integers are parsed exactly, since a float64 only holds integers
+// up to 2^53 exactly; fractions, exponents ("1.23e+09") and values beyond
+// int64 go through toInt64.
+type flexibleInt64 int64
+
+func (v *flexibleInt64) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		*v = 0
+		return nil
+	}
+
+	var numVal json.Number
+	if err := json.Unmarshal(trimmed, &numVal); err != nil {
+		var strVal string
+		if err := json.Unmarshal(trimmed, &strVal); err != nil {
+			return fmt.Errorf("unsupported numeric value: %s", string(trimmed))
+		}
+		numVal = json.Number(strings.TrimSpace(strVal))
+		if numVal == "" {
+			*v = 0
+			return nil
+		}
+	}
+
+	if i, err := numVal.Int64(); err == nil {
+		*v = flexibleInt64(max(i, 0))
+		return nil
+	}
+	f, err := numVal.Float64()
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("invalid numeric value: %s", string(trimmed))
+	}
+	*v = flexibleInt64(toInt64(f))
+	return nil
+}
+
 type flexibleStringList []string
 
 func (v *flexibleStringList) UnmarshalJSON(data []byte) error {
@@ -147,24 +277,28 @@ func (v *flexibleStringList) UnmarshalJSON(data []byte) error {
 		return nil
 	}
 
-	return fmt.Errorf("unsupported notes value: %s", string(trimmed))
+	return fmt.Errorf("unsupported string list value: %s", string(trimmed))
 }
 
-type surgeRequestsResponse struct {
-	Requests []struct {
-		ID                 flexibleID         `json:"id"`
-		RemoteHost         string             `json:"remoteHost"`
-		RemoteAddress      string             `json:"remoteAddress"`
-		LocalAddress       string             `json:"localAddress"`
-		SourceAddress      string             `json:"sourceAddress"`
-		PolicyName         string             `json:"policyName"`
-		OriginalPolicyName string             `json:"originalPolicyName"`
-		Rule               string             `json:"rule"`
-		Notes              flexibleStringList `json:"notes"`
-		OutBytes           flexibleFloat64    `json:"outBytes"`
-		InBytes            flexibleFloat64    `json:"inBytes"`
-		Time               flexibleFloat64    `json:"time"`
-	} `json:"requests"`
+// surgeRequest is one element of a /v1/requests/* array.
+type surgeRequest struct {
+	ID                 flexibleID         `json:"id"`
+	RemoteHost         string             `json:"remoteHost"`
+	RemoteAddress      string             `json:"remoteAddress"`
+	LocalAddress       string             `json:"localAddress"`
+	SourceAddress      string             `json:"sourceAddress"`
+	PolicyName         string             `json:"policyName"`
+	OriginalPolicyName string             `json:"originalPolicyName"`
+	Rule               string             `json:"rule"`
+	Notes              flexibleStringList `json:"notes"`
+	Method             string             `json:"method"`
+	Failed             json.RawMessage    `json:"failed"`
+	OutBytes           flexibleInt64      `json:"outBytes"`
+	InBytes            flexibleInt64      `json:"inBytes"`
+	OutCurrentSpeed    flexibleFloat64    `json:"outCurrentSpeed"`
+	InCurrentSpeed     flexibleFloat64    `json:"inCurrentSpeed"`
+	Time               flexibleFloat64    `json:"time"`
+	ProcessPath        json.RawMessage    `json:"processPath"` // Surge for Mac only
 }
 
 func (c *Client) collectClash(ctx context.Context) ([]domain.FlowSnapshot, error) {
@@ -173,11 +307,9 @@ func (c *Client) collectClash(ctx context.Context) ([]domain.FlowSnapshot, error
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
-	if c.token != "" {
-		req.Header.Set("Authorization", "Bearer "+c.token)
-	}
+	c.authorize(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, "/connections")
 	if err != nil {
 		return nil, err
 	}
@@ -188,97 +320,195 @@ func (c *Client) collectClash(ctx context.Context) ([]domain.FlowSnapshot, error
 		return nil, fmt.Errorf("gateway http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
-	var payload clashConnectionsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return nil, fmt.Errorf("decode clash response: %w", err)
+	body, unchanged, err := c.readBody(resp.Body, "/connections")
+	if err != nil {
+		return nil, fmt.Errorf("read clash response: %w", err)
+	}
+	if unchanged {
+		return nil, ErrUnchanged
 	}
 
 	nowMs := time.Now().UnixMilli()
-	snapshots := make([]domain.FlowSnapshot, 0, len(payload.Connections))
-	for _, item := range payload.Connections {
-		id := strings.TrimSpace(item.ID)
+	singBox := c.singBox.Load()
+	logPaths := c.logPaths
+	if logPaths != nil {
+		logPaths.beginPoll()
+	}
+	var snapshots []domain.FlowSnapshot
+	err = decodeArrayField(bytes.NewReader(body), "connections", func(_ int, dec *json.Decoder) error {
+		var item clashConnection
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		id := strings.TrimSpace(string(item.ID))
 		if id == "" {
-			continue
+			return nil
+		}
+		chains := clashChains(item.Chains)
+		rule, rulePayload := strings.TrimSpace(item.Rule), strings.TrimSpace(item.RulePayload)
+		if singBox {
+			chains = singBoxChains(item.Chains)
+			rule, rulePayload = singBoxRule(rule)
+		}
+		if logPaths != nil {
+			source := net.JoinHostPort(strings.TrimSpace(item.Metadata.SourceIP), strings.TrimSpace(string(item.Metadata.SourcePort)))
+			key := clashLogKey(source, strings.TrimSpace(string(item.Metadata.DestPort)))
+			// Rule[Exit] in the log is unambiguous, so no exit to orient by.
+			if path := logPaths.match(id, key); len(path) > len(chains) {
+				chains = policyPathChains(path, "")
+			}
 		}
-		domainName := strings.TrimSpace(item.Metadata.Host)
+		domainName, hostSource := strings.TrimSpace(item.Metadata.Host), domain.HostSourceDNS
 		if domainName == "" {
-			domainName = strings.TrimSpace(item.Metadata.SniffHost)
+			domainName, hostSource = strings.TrimSpace(item.Metadata.SniffHost), domain.HostSourceSniff
 		}
+		if domainName == "" || isIPHost(domainName) {
+			hostSource = domain.HostSourceIP
+		}
+		domainASCII := ""
+		if display, ascii, ok := domainForms(domainName); ok {
+			domainName, domainASCII = display, ascii
+		}
+		transport, app := classifyTraffic(item.Metadata.Network, parsePort(string(item.Metadata.DestPort)))
 		snapshots = append(snapshots, domain.FlowSnapshot{
-			ID:          id,
-			Domain:      domainName,
-			IP:          strings.TrimSpace(item.Metadata.DestinationIP),
-			SourceIP:    strings.TrimSpace(item.Metadata.SourceIP),
-			Chains:      normalizeChains(item.Chains),
-			Rule:        defaultString(strings.TrimSpace(item.Rule), "Match"),
-			RulePayload: strings.TrimSpace(item.RulePayload),
-			Upload:      toInt64(item.Upload),
-			Download:    toInt64(item.Download),
-			TimestampMs: nowMs,
+			ID:           id,
+			Domain:       domainName,
+			DomainASCII:  domainASCII,
+			HostSource:   hostSource,
+			IP:           strings.TrimSpace(item.Metadata.DestinationIP),
+			SourceIP:     strings.TrimSpace(item.Metadata.SourceIP),
+			DNSMode:      normalizeDNSMode(item.Metadata.DNSMode),
+			SpecialProxy: strings.TrimSpace(item.Metadata.SpecialProxy),
+			Transport:    transport,
+			AppProtocol:  app,
+			Blocked:      isRejectChain(chains),
+			Chains:       chains,
+			Rule:         defaultString(rule, "Match"),
+			RulePayload:  rulePayload,
+			Upload:       int64(item.Upload),
+			Download:     int64(item.Download),
+			TimestampMs:  nowMs,
 		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode clash response: %w", incomplete("/connections", len(body), err))
+	}
+	if logPaths != nil {
+		logPaths.endPoll()
 	}
-
 	return snapshots, nil
 }
 
 func (c *Client) collectSurge(ctx context.Context) ([]domain.FlowSnapshot, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/v1/requests/recent", nil)
+	paths := c.surgePaths
+	if len(paths) == 0 {
+		paths = []string{"/v1/requests/recent"}
+	}
+	if len(paths) == 1 {
+		snapshots, unchanged, err := c.collectSurgePath(ctx, paths[0], false)
+		if unchanged {
+			return nil, ErrUnchanged
+		}
+		return snapshots, err
+	}
+
+	// Every list is decoded, since one that changed needs the others too.
+	var merged []domain.FlowSnapshot
+	index := make(map[string]int)
+	allUnchanged := true
+	for _, path := range paths {
+		snapshots, unchanged, err := c.collectSurgePath(ctx, path, true)
+		if err != nil {
+			return nil, err
+		}
+		allUnchanged = allUnchanged && unchanged
+		for _, s := range snapshots {
+			i, ok := index[s.ID]
+			if !ok {
+				index[s.ID] = len(merged)
+				merged = append(merged, s)
+				continue
+			}
+			if s.Upload+s.Download > merged[i].Upload+merged[i].Download {
+				merged[i] = s
+			}
+		}
+	}
+	if allUnchanged {
+		return nil, ErrUnchanged
+	}
+	return merged, nil
+}
+
+// collectSurgePath polls one request list. An unchanged response is only
+// decoded with decodeUnchanged.
+func (c *Client) collectSurgePath(ctx context.Context, path string, decodeUnchanged bool) ([]domain.FlowSnapshot, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+path, nil)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	req.Header.Set("Accept", "application/json")
-	if c.token != "" {
-		req.Header.Set("x-key", c.token)
-	}
+	c.authorize(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, path)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, fmt.Errorf("gateway http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return nil, false, fmt.Errorf("gateway http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	body, unchanged, err := c.readBody(resp.Body, path)
 	if err != nil {
-		return nil, fmt.Errorf("read surge response: %w", err)
+		return nil, false, fmt.Errorf("read surge response: %w", err)
 	}
-
-	var payload surgeRequestsResponse
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return nil, fmt.Errorf("decode surge response: %w (debug: %s)", err, inspectSurgeDecodeError(body))
+	if unchanged && !decodeUnchanged {
+		return nil, true, nil
 	}
 
 	nowMs := time.Now().UnixMilli()
-	snapshots := make([]domain.FlowSnapshot, 0, len(payload.Requests))
-	for _, reqItem := range payload.Requests {
+	var snapshots []domain.FlowSnapshot
+	err = decodeArrayField(bytes.NewReader(body), "requests", func(i int, dec *json.Decoder) error {
+		// Elements are decoded in two steps so a field of an unexpected
+		// type can be described in the error.
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var reqItem surgeRequest
+		if err := json.Unmarshal(raw, &reqItem); err != nil {
+			return fmt.Errorf("%w (debug: %s)", err, inspectSurgeRequest(i, raw))
+		}
 		id := strings.TrimSpace(string(reqItem.ID))
 		if id == "" {
-			continue
+			return nil
 		}
 
 		remoteHost := strings.TrimSpace(reqItem.RemoteHost)
-		remoteAddress := strings.TrimSpace(strings.Split(remoteAddressFirst(reqItem.RemoteAddress), " ")[0])
+		remoteAddresses := parseRemoteAddresses(reqItem.RemoteAddress)
 		hostWithoutPort := extractHost(remoteHost)
+		sourceIP := extractHost(defaultString(strings.TrimSpace(reqItem.LocalAddress), strings.TrimSpace(reqItem.SourceAddress)))
 
-		domainName := ""
-		if isDomainName(remoteHost) {
-			domainName = hostWithoutPort
-		}
+		domainName, domainASCII, _ := domainForms(remoteHost)
 		ip := ""
 		if isIPHost(remoteHost) {
 			ip = hostWithoutPort
-		} else if isIPHost(remoteAddress) {
-			ip = extractHost(remoteAddress)
+		} else if n := len(remoteAddresses); n > 0 {
+			// Surge lists the address it settled on after failed happy
+			// eyeballs attempts and fake-IP hops, so the last entry has the
+			// family of the outbound connection; the client's family says
+			// nothing about it.
+			ip = selectRemoteAddress(remoteAddresses, remoteAddresses[n-1])
 		}
 
-		sourceIP := extractHost(defaultString(strings.TrimSpace(reqItem.LocalAddress), strings.TrimSpace(reqItem.SourceAddress)))
-		chains := convertSurgeChains(reqItem.PolicyName, reqItem.OriginalPolicyName, []string(reqItem.Notes))
-		rule := defaultString(strings.TrimSpace(lastChain(chains)), defaultString(strings.TrimSpace(reqItem.OriginalPolicyName), "Match"))
+		chains := surgeChains(reqItem.PolicyName, reqItem.OriginalPolicyName, []string(reqItem.Notes))
+		rule := defaultString(ruleChain(chains), defaultString(strings.TrimSpace(reqItem.OriginalPolicyName), "Match"))
 		rulePayload := strings.TrimSpace(reqItem.Rule)
+		transport, app := classifyTraffic(surgeNetwork(reqItem.Method), hostPort(remoteHost), reqItem.Notes...)
 
 		timestampMs := nowMs
 		if reqItem.Time > 0 {
@@ -286,55 +516,51 @@ func (c *Client) collectSurge(ctx context.Context) ([]domain.FlowSnapshot, error
 		}
 
 		snapshots = append(snapshots, domain.FlowSnapshot{
-			ID:          id,
-			Domain:      domainName,
-			IP:          ip,
-			SourceIP:    sourceIP,
-			Chains:      chains,
-			Rule:        defaultString(rule, "Match"),
-			RulePayload: rulePayload,
-			Upload:      toInt64(float64(reqItem.OutBytes)),
-			Download:    toInt64(float64(reqItem.InBytes)),
-			TimestampMs: timestampMs,
+			ID:               id,
+			Domain:           domainName,
+			DomainASCII:      domainASCII,
+			IP:               ip,
+			SourceIP:         sourceIP,
+			RemoteAddrs:      remoteAddresses,
+			Chains:           chains,
+			Rule:             defaultString(rule, "Match"),
+			RulePayload:      rulePayload,
+			Upload:           int64(reqItem.OutBytes),
+			Download:         int64(reqItem.InBytes),
+			UploadSpeedBps:   toInt64(float64(reqItem.OutCurrentSpeed)),
+			DownloadSpeedBps: toInt64(float64(reqItem.InCurrentSpeed)),
+			Transport:        transport,
+			AppProtocol:      app,
+			Process:          surgeProcessName(reqItem.ProcessPath),
+			Blocked:          isRejectPolicy(reqItem.PolicyName) || isTruthy(reqItem.Failed),
+			TimestampMs:      timestampMs,
 		})
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("decode surge response: %w", incomplete(path, len(body), err))
 	}
-
-	return snapshots, nil
-}
-
-func normalizeChains(chains []string) []string {
-	if len(chains) == 0 {
-		return []string{"DIRECT"}
-	}
-	out := make([]string, 0, len(chains))
-	for _, chain := range chains {
-		trimmed := strings.TrimSpace(chain)
-		if trimmed == "" {
-			continue
-		}
-		out = append(out, trimmed)
-		if len(out) >= 12 {
-			break
-		}
-	}
-	if len(out) == 0 {
-		return []string{"DIRECT"}
-	}
-	return out
+	return snapshots, unchanged, nil
 }
 
-func lastChain(chains []string) string {
-	if len(chains) == 0 {
+// surgeProcessName returns the executable name from a Surge processPath such
+// as "/Applications/Safari.app/Contents/MacOS/Safari". A missing or non-string
+// value yields "" rather than failing the whole response.
+func surgeProcessName(raw json.RawMessage) string {
+	var p string
+	if len(raw) == 0 || json.Unmarshal(raw, &p) != nil {
 		return ""
 	}
-	return strings.TrimSpace(chains[len(chains)-1])
+	p = strings.TrimRight(strings.TrimSpace(p), "/")
+	return p[strings.LastIndex(p, "/")+1:]
 }
 
 func toInt64(v float64) int64 {
 	if v <= 0 {
 		return 0
 	}
-	if v > float64(^uint64(0)>>1) {
+	// float64(MaxInt64) rounds up to 2^63, which does not fit in an int64.
+	if v >= float64(^uint64(0)>>1) {
 		return int64(^uint64(0) >> 1)
 	}
 	return int64(v)
@@ -347,14 +573,9 @@ func defaultString(v string, fallback string) string {
 	return strings.TrimSpace(v)
 }
 
-func remoteAddressFirst(v string) string {
-	parts := strings.Split(v, ",")
-	if len(parts) == 0 {
-		return ""
-	}
-	return strings.TrimSpace(parts[0])
-}
-
+// extractHost strips an optional port and brackets from hostWithPort. IP
+// addresses are returned in canonical form without zone identifiers, with
+// IPv4-mapped IPv6 unmapped, so "[fe80::1%en0]:54321" becomes "fe80::1".
 func extractHost(hostWithPort string) string {
 	hostWithPort = strings.TrimSpace(hostWithPort)
 	if hostWithPort == "" {
@@ -364,121 +585,93 @@ func extractHost(hostWithPort string) string {
 	if strings.HasPrefix(hostWithPort, "[") {
 		closing := strings.Index(hostWithPort, "]")
 		if closing > 1 {
-			return hostWithPort[1:closing]
+			return canonicalHost(hostWithPort[1:closing])
 		}
 	}
 
+	if addr, ok := canonicalIP(hostWithPort); ok {
+		return addr
+	}
+
 	host, _, err := net.SplitHostPort(hostWithPort)
 	if err == nil {
-		return host
+		return canonicalHost(host)
 	}
 
-	return strings.TrimSpace(hostWithPort)
-}
-
-func isIPHost(host string) bool {
-	h := extractHost(host)
-	if h == "" {
-		return false
+	// Unbracketed IPv6 with a port, such as "::ffff:10.0.0.1:80". A zoned
+	// "fe80::1%en0:54321" already parsed above, the port landing in the
+	// dropped zone.
+	if i := strings.LastIndexByte(hostWithPort, ':'); i > 0 && isPort(hostWithPort[i+1:]) {
+		if addr, ok := canonicalIP(hostWithPort[:i]); ok {
+			return addr
+		}
 	}
-	ip := net.ParseIP(h)
-	return ip != nil
+
+	return hostWithPort
 }
 
-func isDomainName(host string) bool {
-	h := extractHost(host)
-	if h == "" {
-		return false
-	}
-	if isIPHost(h) {
-		return false
-	}
-	return domainPattern.MatchString(h)
+// normalizeDNSMode maps mihomo's dnsMode spellings ("fake-ip", "FakeIP") to
+// a single lower-case form such as "fakeip".
+func normalizeDNSMode(mode string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(mode), "-", ""))
 }
 
-func convertSurgeChains(policyName string, originalPolicyName string, notes []string) []string {
-	if fromNotes := extractPolicyPathFromNotes(notes); len(fromNotes) >= 2 {
-		return fromNotes
+func canonicalHost(host string) string {
+	if addr, ok := canonicalIP(host); ok {
+		return addr
 	}
+	return host
+}
 
-	chains := make([]string, 0, 2)
-	if p := strings.TrimSpace(policyName); p != "" {
-		chains = append(chains, p)
-	}
-	o := strings.TrimSpace(originalPolicyName)
-	if o != "" && o != strings.TrimSpace(policyName) {
-		chains = append(chains, o)
-	}
-	if len(chains) == 0 {
-		return []string{"DIRECT"}
+func canonicalIP(s string) (string, bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
 	}
-	return chains
+	return addr.Unmap().WithZone("").String(), true
 }
 
-func extractPolicyPathFromNotes(notes []string) []string {
-	if len(notes) == 0 {
-		return nil
+func isPort(s string) bool {
+	if s == "" || len(s) > 5 {
+		return false
 	}
-	for _, note := range notes {
-		m := policyPathRegex.FindStringSubmatch(note)
-		if len(m) < 2 {
-			continue
-		}
-		segments := strings.Split(m[1], " -> ")
-		cleaned := make([]string, 0, len(segments))
-		for _, segment := range segments {
-			s := strings.TrimSpace(segment)
-			if s != "" {
-				cleaned = append(cleaned, s)
-			}
-		}
-		if len(cleaned) >= 2 {
-			for i, j := 0, len(cleaned)-1; i < j; i, j = i+1, j-1 {
-				cleaned[i], cleaned[j] = cleaned[j], cleaned[i]
-			}
-			return cleaned
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-func inspectSurgeDecodeError(body []byte) string {
-	if len(body) == 0 {
-		return "empty response body"
-	}
-
-	var root map[string]json.RawMessage
-	if err := json.Unmarshal(body, &root); err != nil {
-		return "invalid json: " + truncateForLog(string(bytes.TrimSpace(body)), 240)
-	}
-
-	rawRequests, ok := root["requests"]
-	if !ok {
-		keys := make([]string, 0, len(root))
-		for k := range root {
-			keys = append(keys, k)
-		}
-		return "missing requests field, available keys: " + strings.Join(keys, ",")
+func isIPHost(host string) bool {
+	h := extractHost(host)
+	if h == "" {
+		return false
 	}
+	ip := net.ParseIP(h)
+	return ip != nil
+}
 
-	var requests []map[string]json.RawMessage
-	if err := json.Unmarshal(rawRequests, &requests); err != nil {
-		return "requests is not array: " + truncateForLog(string(bytes.TrimSpace(rawRequests)), 240)
+// inspectSurgeRequest describes the id of the request element that failed
+// to decode, the field whose type Surge versions disagree on most.
+func inspectSurgeRequest(i int, raw json.RawMessage) string {
+	name := "first request"
+	if i > 0 {
+		name = fmt.Sprintf("request #%d", i+1)
 	}
-	if len(requests) == 0 {
-		return "requests array is empty"
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &request); err != nil {
+		return name + " is not an object: " + truncateForLog(string(bytes.TrimSpace(raw)), 240)
 	}
-
-	rawID, ok := requests[0]["id"]
+	rawID, ok := request["id"]
 	if !ok {
-		keys := make([]string, 0, len(requests[0]))
-		for k := range requests[0] {
+		keys := make([]string, 0, len(request))
+		for k := range request {
 			keys = append(keys, k)
 		}
-		return "first request missing id, available keys: " + strings.Join(keys, ",")
+		return name + " missing id, available keys: " + strings.Join(keys, ",")
 	}
-
-	return "first request id type=" + detectJSONType(rawID) + " value=" + truncateForLog(string(bytes.TrimSpace(rawID)), 80)
+	return name + " id type=" + detectJSONType(rawID) + " value=" + truncateForLog(string(bytes.TrimSpace(rawID)), 80)
 }
 
 func detectJSONType(raw json.RawMessage) string {
@@ -1,7 +1,12 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -25,6 +30,8 @@ func TestCollectSurgeSupportsFlexibleFields(t *testing.T) {
 					"notes": "single-note",
 					"outBytes": "100.9",
 					"inBytes": 200,
+					"outCurrentSpeed": 10,
+					"inCurrentSpeed": "20.5",
 					"time": "1700000000123"
 				}
 			]
@@ -54,11 +61,40 @@ func TestCollectSurgeSupportsFlexibleFields(t *testing.T) {
 	if s.Download != 200 {
 		t.Fatalf("expected download 200, got %d", s.Download)
 	}
+	if s.UploadSpeedBps != 10 || s.DownloadSpeedBps != 20 {
+		t.Fatalf("expected speeds 10/20, got %d/%d", s.UploadSpeedBps, s.DownloadSpeedBps)
+	}
 	if s.TimestampMs != 1700000000123 {
 		t.Fatalf("expected timestamp 1700000000123, got %d", s.TimestampMs)
 	}
 }
 
+func TestCollectSurgeProcessName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"requests": [
+			{"id": 1, "remoteHost": "a.example:443", "pid": 812, "processPath": "/Applications/Safari.app/Contents/MacOS/Safari"},
+			{"id": 2, "remoteHost": "b.example:443"},
+			{"id": 3, "remoteHost": "c.example:443", "processPath": 42}
+		]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "surge", server.URL+"/v1/requests/recent", "")
+	snapshots, err := client.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("expected 3 snapshots, got %d", len(snapshots))
+	}
+	for i, want := range []string{"Safari", "", ""} {
+		if got := snapshots[i].Process; got != want {
+			t.Fatalf("snapshot %d: expected process %q, got %q", i, want, got)
+		}
+	}
+}
+
 func TestCollectSurgeDecodeErrorIncludesDebugHint(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -80,3 +116,416 @@ func TestCollectSurgeDecodeErrorIncludesDebugHint(t *testing.T) {
 		t.Fatalf("expected debug id type hint, got: %s", msg)
 	}
 }
+
+func TestCollectRejectsResponseOverLimit(t *testing.T) {
+	body := `{"requests":[{"id":1,"remoteHost":"example.com:443","outBytes":10,"inBytes":20}]}`
+	client := NewClient(&http.Client{Transport: staticBody(body)}, "surge", "http://gateway.test", "")
+
+	client.SetMaxResponseBytes(int64(len(body)))
+	if snapshots, err := client.Collect(context.Background()); err != nil || len(snapshots) != 1 {
+		t.Fatalf("expected a response at the limit to decode, got %d snapshots, %v", len(snapshots), err)
+	}
+
+	client.SetMaxResponseBytes(int64(len(body)) - 1)
+	_, err := client.Collect(context.Background())
+	var truncated *TruncatedError
+	if !errors.As(err, &truncated) || truncated.Path != "/v1/requests/recent" {
+		t.Fatalf("expected a TruncatedError for /v1/requests/recent, got %v", err)
+	}
+}
+
+func TestCollectReportsResponseEndedEarly(t *testing.T) {
+	full := `{"requests":[{"id":1,"remoteHost":"example.com:443","outBytes":10,"inBytes":20},{"id":2,"remoteHost":"example.org:443"}]}`
+	for _, cut := range []int{len(full) - 1, 70, 0} {
+		client := NewClient(&http.Client{Transport: staticBody(full[:cut])}, "surge", "http://gateway.test", "")
+		_, err := client.Collect(context.Background())
+		var incomplete *IncompleteError
+		if !errors.As(err, &incomplete) || incomplete.Path != "/v1/requests/recent" || incomplete.Read != cut {
+			t.Fatalf("cut at %d: expected an IncompleteError after %d bytes, got %v", cut, cut, err)
+		}
+	}
+
+	// A malformed response is not reported as an early end.
+	client := NewClient(&http.Client{Transport: staticBody(`{"requests":[}`)}, "surge", "http://gateway.test", "")
+	_, err := client.Collect(context.Background())
+	var incomplete *IncompleteError
+	if err == nil || errors.As(err, &incomplete) {
+		t.Fatalf("expected a plain decode error, got %v", err)
+	}
+}
+
+func TestCollectSkipsUnchangedResponse(t *testing.T) {
+	body := `{"uploadTotal":10,"connections":[{"id":"a","upload":10,"download":20,"metadata":{"host":"example.com"}}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetSkipUnchanged(true)
+	if snapshots, err := client.Collect(context.Background()); err != nil || len(snapshots) != 1 {
+		t.Fatalf("first poll: got %d snapshots, %v", len(snapshots), err)
+	}
+	if _, err := client.Collect(context.Background()); !errors.Is(err, ErrUnchanged) {
+		t.Fatalf("expected ErrUnchanged for an identical response, got %v", err)
+	}
+	body = strings.Replace(body, `"upload":10`, `"upload":15`, 1)
+	snapshots, err := client.Collect(context.Background())
+	if err != nil || len(snapshots) != 1 || snapshots[0].Upload != 15 {
+		t.Fatalf("expected the changed response decoded, got %+v, %v", snapshots, err)
+	}
+}
+
+func TestCollectClashUsesBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"connections":[]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetBasicAuth("admin", "secret")
+	if _, err := client.Collect(context.Background()); err != nil {
+		t.Fatalf("Collect with basic auth returned error: %v", err)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, r.Method+" "+r.URL.EscapedPath()+" "+string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.Client(), "clash", server.URL, "").CloseConnection(context.Background(), "a/b"); err != nil {
+		t.Fatalf("clash CloseConnection returned error: %v", err)
+	}
+	if err := NewClient(server.Client(), "surge", server.URL, "").CloseConnection(context.Background(), "42"); err != nil {
+		t.Fatalf("surge CloseConnection returned error: %v", err)
+	}
+
+	want := []string{"DELETE /connections/a%2Fb ", `POST /v1/requests/kill {"id":42}`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected requests %q, got %q", want, got)
+	}
+}
+
+func TestClientUsesEndpointPathPrefix(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"connections":[],"requests":[]}`))
+	}))
+	defer server.Close()
+
+	if _, err := NewClient(server.Client(), "clash", server.URL+"/clash", "").Collect(context.Background()); err != nil {
+		t.Fatalf("clash Collect returned error: %v", err)
+	}
+	if _, err := NewClient(server.Client(), "surge", server.URL+"/surge", "").Collect(context.Background()); err != nil {
+		t.Fatalf("surge Collect returned error: %v", err)
+	}
+
+	want := []string{"/clash/connections", "/surge/v1/requests/recent"}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected requests %v, got %v", want, paths)
+	}
+}
+
+func TestCollectSurgePicksEstablishedRemoteAddress(t *testing.T) {
+	// A failed IPv6 attempt listed before the IPv4 address used, a fake-IP
+	// hop before the real address, a proxied request whose remoteAddress only
+	// names the proxy hop, and an IPv4 client whose request left over IPv6.
+	server, _ := newFixtureServer(t, "surge")
+	client := NewClient(server.Client(), "surge", server.URL, "")
+	snapshots, err := client.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	want := map[string]string{
+		"1201": "23.215.0.136",
+		"1202": "140.82.112.6",
+		"1203": "10.0.0.2",
+		"1204": "1.1.1.1",
+		"1205": "2607:f8b0:4005:80f::2004",
+	}
+	if len(snapshots) != len(want) {
+		t.Fatalf("expected %d snapshots, got %d", len(want), len(snapshots))
+	}
+	for _, s := range snapshots {
+		if s.IP != want[s.ID] {
+			t.Fatalf("request %s: expected ip %s, got %q (from %v)", s.ID, want[s.ID], s.IP, s.RemoteAddrs)
+		}
+	}
+	if got := snapshots[0].RemoteAddrs; len(got) != 2 || got[0] != "2600:1406:3a00:21::173e:2e65" {
+		t.Fatalf("expected full remote address list to be kept, got %v", got)
+	}
+}
+
+func TestSelectRemoteAddress(t *testing.T) {
+	cases := []struct {
+		addrs []string
+		hint  string
+		want  string
+	}{
+		{nil, "", ""},
+		{[]string{"10.0.0.1"}, "", "10.0.0.1"},
+		{[]string{"10.0.0.1", "fe80::1", "93.184.216.34"}, "", "93.184.216.34"},
+		{[]string{"2001:4860:4860::8888", "8.8.8.8"}, "192.168.1.2", "8.8.8.8"},
+		{[]string{"8.8.8.8", "2001:4860:4860::8888"}, "2001:db8::2", "2001:4860:4860::8888"},
+		{[]string{"fd00::1", "8.8.8.8"}, "fe80::1", "fd00::1"},
+		{[]string{"100.64.0.1", "198.19.0.1"}, "", "100.64.0.1"},
+	}
+	for _, tc := range cases {
+		if got := selectRemoteAddress(tc.addrs, tc.hint); got != tc.want {
+			t.Fatalf("selectRemoteAddress(%v, %q) = %q, expected %q", tc.addrs, tc.hint, got, tc.want)
+		}
+	}
+}
+
+func TestCollectClashCapturesDNSModeAndSpecialProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"connections":[{"id":"c1","upload":1,"download":2,"chains":["Proxy"],"metadata":{"destinationIP":"198.18.0.7","destinationPort":"443","network":"udp","dnsMode":"fake-ip","specialProxy":"dns-hijack"}}]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	snapshots, err := client.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].DNSMode != "fakeip" || snapshots[0].SpecialProxy != "dns-hijack" {
+		t.Fatalf("expected dnsMode fakeip and specialProxy dns-hijack, got %+v", snapshots)
+	}
+	if snapshots[0].Transport != "udp" || snapshots[0].AppProtocol != "quic" {
+		t.Fatalf("expected udp/quic, got %q/%q", snapshots[0].Transport, snapshots[0].AppProtocol)
+	}
+}
+
+func TestCollectSurgeRequestSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/requests/active":
+			_, _ = w.Write([]byte(`{"requests":[{"id":1,"remoteHost":"a.com:443","outBytes":500,"inBytes":900},{"id":2,"remoteHost":"b.com:443","outBytes":10,"inBytes":10}]}`))
+		case "/v1/requests/recent":
+			_, _ = w.Write([]byte(`{"requests":[{"id":1,"remoteHost":"a.com:443","outBytes":400,"inBytes":800},{"id":3,"remoteHost":"c.com:443","outBytes":7,"inBytes":7}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cases := map[string][]string{
+		"recent": {"1", "3"},
+		"active": {"1", "2"},
+		"both":   {"1", "2", "3"},
+	}
+	for source, want := range cases {
+		client := NewClient(server.Client(), "surge", server.URL, "")
+		client.SetSurgeRequestSource(source)
+		snapshots, err := client.Collect(context.Background())
+		if err != nil {
+			t.Fatalf("%s: Collect returned error: %v", source, err)
+		}
+		var ids []string
+		for _, s := range snapshots {
+			ids = append(ids, s.ID)
+			if s.ID == "1" && source != "recent" && s.Upload != 500 {
+				t.Fatalf("%s: expected the active (larger) counters for request 1, got %d", source, s.Upload)
+			}
+		}
+		if strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: expected requests %v, got %v", source, want, ids)
+		}
+	}
+}
+
+func TestCollectDetectsRejectedConnections(t *testing.T) {
+	clash := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"connections":[
+			{"id":"a","chains":["REJECT-DROP","Ads"],"metadata":{"host":"ads.example"}},
+			{"id":"b","chains":["Proxy"],"metadata":{"host":"example.com"}}
+		]}`))
+	}))
+	defer clash.Close()
+	snapshots, err := NewClient(clash.Client(), "clash", clash.URL, "").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if !snapshots[0].Blocked || snapshots[1].Blocked {
+		t.Fatalf("expected only the REJECT-DROP connection to be blocked, got %v/%v", snapshots[0].Blocked, snapshots[1].Blocked)
+	}
+
+	surge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"requests":[
+			{"id":1,"remoteHost":"ads.example:443","policyName":"REJECT-TINYGIF"},
+			{"id":2,"remoteHost":"down.example:443","policyName":"Proxy","failed":1},
+			{"id":3,"remoteHost":"example.com:443","policyName":"Proxy","failed":false}
+		]}`))
+	}))
+	defer surge.Close()
+	snapshots, err = NewClient(surge.Client(), "surge", surge.URL, "").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if !snapshots[0].Blocked || !snapshots[1].Blocked || snapshots[2].Blocked {
+		t.Fatalf("expected requests 1 and 2 to be blocked, got %v/%v/%v", snapshots[0].Blocked, snapshots[1].Blocked, snapshots[2].Blocked)
+	}
+}
+
+func TestGetClashMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configs" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"port":7890,"mixed-port":7891,"mode":"Global","log-level":"info"}`))
+	}))
+	defer server.Close()
+
+	mode, err := NewClient(server.Client(), "clash", server.URL, "").GetClashMode(context.Background())
+	if err != nil {
+		t.Fatalf("GetClashMode returned error: %v", err)
+	}
+	if mode != "global" {
+		t.Fatalf("expected mode global, got %q", mode)
+	}
+	if _, err := NewClient(server.Client(), "surge", server.URL, "").GetClashMode(context.Background()); err == nil {
+		t.Fatalf("expected an error for a surge gateway")
+	}
+}
+
+func TestFlexibleInt64KeepsLargeCountersExact(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want int64
+	}{
+		{`9007199254740993`, 9007199254740993}, // 2^53+1, not representable as float64
+		{`"9007199254740993"`, 9007199254740993},
+		{`9223372036854775807`, 9223372036854775807},
+		{`9223372036854775808`, 9223372036854775807},
+		{`1e400`, 9223372036854775807},
+		{`1.23e+09`, 1230000000},
+		{`"1.5e3"`, 1500},
+		{`100.9`, 100},
+		{`-5`, 0},
+		{`""`, 0},
+		{`null`, 0},
+	}
+	for _, tc := range cases {
+		var v flexibleInt64
+		if err := json.Unmarshal([]byte(tc.raw), &v); err != nil {
+			t.Fatalf("unmarshal %s returned error: %v", tc.raw, err)
+		}
+		if int64(v) != tc.want {
+			t.Fatalf("unmarshal %s: expected %d, got %d", tc.raw, tc.want, int64(v))
+		}
+	}
+	var v flexibleInt64
+	if err := json.Unmarshal([]byte(`"lots"`), &v); err == nil {
+		t.Fatalf("expected an error for a non-numeric string")
+	}
+}
+
+func TestCollectClashKeepsCountersAbove2To53(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"connections":[{"id":"c1","upload":9007199254740993,"download":"18014398509481985","chains":["DIRECT"],"metadata":{"host":"example.com"}}]}`))
+	}))
+	defer server.Close()
+
+	snapshots, err := NewClient(server.Client(), "clash", server.URL, "").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Upload != 9007199254740993 || snapshots[0].Download != 18014398509481985 {
+		t.Fatalf("expected exact counters, got %+v", snapshots)
+	}
+}
+
+func TestCollectClashReportsHostSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"connections":[
+			{"id":"dns","chains":["DIRECT"],"metadata":{"host":"example.com","sniffHost":"cdn.example.com","destinationIP":"93.184.216.34"}},
+			{"id":"sniff","chains":["DIRECT"],"metadata":{"host":"","sniffHost":"example.org","destinationIP":"93.184.216.35"}},
+			{"id":"ip","chains":["DIRECT"],"metadata":{"destinationIP":"93.184.216.36"}}
+		]}`))
+	}))
+	defer server.Close()
+
+	snapshots, err := NewClient(server.Client(), "clash", server.URL, "").Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	got := make(map[string]string, len(snapshots))
+	for _, s := range snapshots {
+		got[s.ID] = s.HostSource
+	}
+	want := map[string]string{"dns": "dns", "sniff": "sniff", "ip": "ip"}
+	for id, source := range want {
+		if got[id] != source {
+			t.Fatalf("expected hostSource %q for %s, got %q", source, id, got[id])
+		}
+	}
+}
+
+type staticBody []byte
+
+func (b staticBody) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
+
+// BenchmarkCollectLargeResponse decodes a 50k-connection /connections and
+// /v1/requests/recent response.
+func BenchmarkCollectLargeResponse(b *testing.B) {
+	const n = 50000
+	var clash, surge bytes.Buffer
+	clash.WriteString(`{"downloadTotal":1,"uploadTotal":1,"connections":[`)
+	surge.WriteString(`{"requests":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			clash.WriteByte(',')
+			surge.WriteByte(',')
+		}
+		fmt.Fprintf(&clash, `{"id":"conn-%d","upload":%d,"download":%d,"rule":"DomainSuffix","rulePayload":"example.com","chains":["HK-01","Proxy"],`+
+			`"metadata":{"host":"host-%d.example.com","destinationIP":"203.0.113.7","sourceIP":"192.168.1.20","network":"tcp","destinationPort":"443"}}`, i, i*10, i*100, i)
+		fmt.Fprintf(&surge, `{"id":%d,"remoteHost":"host-%d.example.com:443","remoteAddress":"203.0.113.7","localAddress":"192.168.1.20:50000",`+
+			`"policyName":"HK-01","originalPolicyName":"Proxy","rule":"DOMAIN-SUFFIX,example.com","notes":["[TCP] connected"],"method":"TCP","outBytes":%d,"inBytes":%d,"time":1700000000000}`, i, i, i*10, i*100)
+	}
+	clash.WriteString(`]}`)
+	surge.WriteString(`]}`)
+
+	for _, tc := range []struct {
+		name, gatewayType, path string
+		body                    []byte
+	}{
+		{"clash", "clash", "", clash.Bytes()},
+		{"surge", "surge", "/v1/requests/recent", surge.Bytes()},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			client := NewClient(&http.Client{Transport: staticBody(tc.body)}, tc.gatewayType, "http://gateway.test", "")
+			b.SetBytes(int64(len(tc.body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				snapshots, err := client.Collect(context.Background())
+				if err != nil || len(snapshots) != n {
+					b.Fatalf("Collect returned %d snapshots, %v", len(snapshots), err)
+				}
+			}
+		})
+	}
+}
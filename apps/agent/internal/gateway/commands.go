@@ -0,0 +1,89 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// CloseConnection terminates an active connection on the gateway. Clash uses
+// DELETE /connections/{id}; Surge uses POST /v1/requests/kill. Quantumult X
+// has no known endpoint for it.
+func (c *Client) CloseConnection(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.New("connection id is required")
+	}
+	if c.Type() == TypeAuto {
+		return ErrTypeUndetected
+	}
+	if c.Type() == "clash" {
+		return c.send(ctx, http.MethodDelete, "/connections/"+url.PathEscape(id), nil)
+	}
+	if c.Type() == "quanx" {
+		return errors.New("closing connections is not supported on quanx")
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid surge request id %q", id)
+	}
+	return c.send(ctx, http.MethodPost, "/v1/requests/kill", map[string]int64{"id": n})
+}
+
+// SetGroupSelection switches the active proxy of a selector group. Clash uses
+// PUT /proxies/{group}; Surge uses POST /v1/policy_groups/select. Quantumult
+// X has no known endpoint for it.
+func (c *Client) SetGroupSelection(ctx context.Context, group, proxy string) error {
+	if group == "" || proxy == "" {
+		return errors.New("group and proxy are required")
+	}
+	if c.Type() == TypeAuto {
+		return ErrTypeUndetected
+	}
+	if c.Type() == "clash" {
+		return c.send(ctx, http.MethodPut, "/proxies/"+url.PathEscape(group), map[string]string{"name": proxy})
+	}
+	if c.Type() == "quanx" {
+		return errors.New("selecting a policy is not supported on quanx")
+	}
+	return c.send(ctx, http.MethodPost, "/v1/policy_groups/select", map[string]string{"group_name": group, "policy": proxy})
+}
+
+// send issues a write request with an optional JSON body and discards the
+// response, returning an error for non-2xx statuses.
+func (c *Client) send(ctx context.Context, method, path string, payload interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req)
+
+	resp, err := c.do(req, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("gateway %s %s returned %d: %s", method, path, resp.StatusCode, string(msg))
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return nil
+}
@@ -6,14 +6,20 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"sort"
 
 	"github.com/foru17/neko-master/apps/agent/internal/domain"
 )
 
 func (c *Client) GetConfigSnapshot(ctx context.Context) (*domain.GatewayConfigSnapshot, error) {
-	if c.gatewayType == "clash" {
+	if c.Type() == TypeAuto {
+		return nil, ErrTypeUndetected
+	}
+	switch c.Type() {
+	case "clash":
 		return c.getClashConfig(ctx)
+	case "quanx":
+		return c.getQuanXConfig(ctx)
 	}
 	return c.getSurgeConfig(ctx)
 }
@@ -23,15 +29,9 @@ func (c *Client) getJSON(ctx context.Context, path string, out interface{}) erro
 	if err != nil {
 		return err
 	}
-	if c.token != "" {
-		if c.gatewayType == "surge" {
-			req.Header.Set("X-Key", c.token)
-		} else {
-			req.Header.Set("Authorization", "Bearer "+c.token)
-		}
-	}
+	c.authorize(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req, path)
 	if err != nil {
 		return err
 	}
@@ -39,7 +39,7 @@ func (c *Client) getJSON(ctx context.Context, path string, out interface{}) erro
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("gateway %s returned %d: %s", path, resp.StatusCode, string(msg))
+		return &StatusError{Path: path, Code: resp.StatusCode, Body: string(msg)}
 	}
 
 	return json.NewDecoder(resp.Body).Decode(out)
@@ -68,19 +68,12 @@ func (c *Client) getClashConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 		return nil, fmt.Errorf("clash /proxies error: %w", err)
 	}
 
-	var providersData struct {
-		Providers map[string]struct {
-			Name    string `json:"name"`
-			Type    string `json:"type"`
-			Proxies []struct {
-				Name string `json:"name"`
-				Type string `json:"type"`
-				Now  string `json:"now"`
-			} `json:"proxies"`
-		} `json:"providers"`
-	}
-	if err := c.getJSON(ctx, "/providers/proxies", &providersData); err != nil {
-		fmt.Printf("[agent] warning: /providers/proxies not available: %v\n", err)
+	var providers map[string]domain.GatewayProvider
+	if c.hasProviders() {
+		var err error
+		if providers, err = c.clashProviders(ctx); err != nil {
+			fmt.Printf("[agent] warning: /providers/proxies not available: %v\n", err)
+		}
 	}
 
 	snap := &domain.GatewayConfigSnapshot{
@@ -94,6 +87,7 @@ func (c *Client) getClashConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 			Type:    r.Type,
 			Payload: r.Payload,
 			Proxy:   r.Proxy,
+			Raw:     clashRuleRaw(r.Type, r.Payload, r.Proxy),
 		}
 	}
 
@@ -105,20 +99,8 @@ func (c *Client) getClashConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 		}
 	}
 
-	for k, v := range providersData.Providers {
-		proxies := make([]domain.GatewayProxy, len(v.Proxies))
-		for i, p := range v.Proxies {
-			proxies[i] = domain.GatewayProxy{
-				Name: p.Name,
-				Type: p.Type,
-				Now:  p.Now,
-			}
-		}
-		snap.Providers[k] = domain.GatewayProvider{
-			Name:    v.Name,
-			Type:    v.Type,
-			Proxies: proxies,
-		}
+	for k, v := range providers {
+		snap.Providers[k] = v
 	}
 
 	return snap, nil
@@ -127,9 +109,21 @@ func (c *Client) getClashConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 // GetPolicyStateSnapshot returns only the dynamic policy selection state (now field)
 // This is much lighter than GetConfigSnapshot as it doesn't fetch rules
 func (c *Client) GetPolicyStateSnapshot(ctx context.Context) (*domain.PolicyStateSnapshot, error) {
-	if c.gatewayType == "clash" {
+	if c.Type() == TypeAuto {
+		return nil, ErrTypeUndetected
+	}
+	if c.Type() == "clash" {
+		if c.providers == PolicyProvidersProvider {
+			return c.getClashProviderPolicyState(ctx)
+		}
+		if c.meta.Load() && !c.noGroupAPI.Load() {
+			return c.getMihomoPolicyState(ctx)
+		}
 		return c.getClashPolicyState(ctx)
 	}
+	if c.Type() == "quanx" {
+		return c.getQuanXPolicyState(ctx)
+	}
 	return c.getSurgePolicyState(ctx)
 }
 
@@ -155,31 +149,11 @@ func (c *Client) getSurgePolicyState(ctx context.Context) (*domain.PolicyStateSn
 		}
 	}
 
-	// Build provider proxies slice for policy groups
-	providerProxies := make([]domain.GatewayProxy, 0, len(policiesData.PolicyGroups))
-
-	// Fetch current selection for each policy group
-	// Surge uses /v1/policy_groups/select?group_name=xxx endpoint
-	for _, g := range policiesData.PolicyGroups {
-		var groupDetail struct {
-			Type   string `json:"type"`
-			Policy string `json:"policy"`
-		}
-		query := url.Values{}
-		query.Set("group_name", g)
-		if err := c.getJSON(ctx, "/v1/policy_groups/select?"+query.Encode(), &groupDetail); err != nil {
-			fmt.Printf("[agent] warning: failed to get policy detail for %s: %v\n", g, err)
-		}
-		snap.Proxies[g] = domain.GatewayProxy{
-			Name: g,
-			Type: groupDetail.Type,
-			Now:  groupDetail.Policy,
-		}
-		providerProxies = append(providerProxies, domain.GatewayProxy{
-			Name: g,
-			Type: groupDetail.Type,
-			Now:  groupDetail.Policy,
-		})
+	// Fetch current selection for each policy group; group types come from
+	// the cache that config sync refreshes
+	providerProxies := c.surgeGroupSelections(ctx, policiesData.PolicyGroups, false)
+	for _, group := range providerProxies {
+		snap.Proxies[group.Name] = group
 	}
 
 	// Create default provider
@@ -226,8 +200,10 @@ func (c *Client) getClashPolicyState(ctx context.Context) (*domain.PolicyStateSn
 		providerProxies[p.Type] = append(providerProxies[p.Type], proxy)
 	}
 
-	// Create providers by type
+	// Create providers by type. The buckets fill in map iteration order, so
+	// sort them to keep the snapshot hash and the master's diff stable.
 	for typ, proxies := range providerProxies {
+		sortProxiesByName(proxies)
 		snap.Providers[typ] = domain.GatewayProvider{
 			Name:    typ,
 			Type:    typ,
@@ -289,32 +265,11 @@ func (c *Client) getSurgeConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 		}
 	}
 
-	// Build provider proxies slice for policy groups
-	providerProxies := make([]domain.GatewayProxy, 0, len(policiesData.PolicyGroups))
-	
-	// Fetch current selection for each policy group
-	// Surge uses /v1/policy_groups/select?group_name=xxx endpoint
-	for _, g := range policiesData.PolicyGroups {
-		var groupDetail struct {
-			Type   string `json:"type"`
-			Policy string `json:"policy"`
-		}
-		query := url.Values{}
-		query.Set("group_name", g)
-		if err := c.getJSON(ctx, "/v1/policy_groups/select?"+query.Encode(), &groupDetail); err != nil {
-			fmt.Printf("[agent] warning: failed to get policy detail for %s: %v\n", g, err)
-		}
-		snap.Proxies[g] = domain.GatewayProxy{
-			Name: g,
-			Type: groupDetail.Type,
-			Now:  groupDetail.Policy,
-		}
-		// Also add to provider proxies for frontend compatibility
-		providerProxies = append(providerProxies, domain.GatewayProxy{
-			Name: g,
-			Type: groupDetail.Type,
-			Now:  groupDetail.Policy,
-		})
+	// Fetch current selection for each policy group, refreshing the cached
+	// group types; also added to provider proxies for frontend compatibility
+	providerProxies := c.surgeGroupSelections(ctx, policiesData.PolicyGroups, true)
+	for _, group := range providerProxies {
+		snap.Proxies[group.Name] = group
 	}
 	
 	// Create a default provider containing all policy groups
@@ -329,3 +284,9 @@ func (c *Client) getSurgeConfig(ctx context.Context) (*domain.GatewayConfigSnaps
 
 	return snap, nil
 }
+
+// sortProxiesByName orders proxies built from a map, whose iteration order
+// changes from run to run.
+func sortProxiesByName(proxies []domain.GatewayProxy) {
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Name < proxies[j].Name })
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestClashPolicyStateProvidersAreSorted(t *testing.T) {
+	entries := make([]string, 0, 40)
+	for i := 0; i < 40; i++ {
+		entries = append(entries, fmt.Sprintf(`"node-%02d":{"name":"node-%02d","type":"Shadowsocks"}`, i, i))
+	}
+	body := `{"proxies":{` + strings.Join(entries, ",") + `}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxies" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	var first []string
+	for i := 0; i < 5; i++ {
+		snap, err := client.GetPolicyStateSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+		}
+		provider := snap.Providers["Shadowsocks"]
+		names := make([]string, len(provider.Proxies))
+		for j, p := range provider.Proxies {
+			names[j] = p.Name
+		}
+		if len(names) != 40 || !sort.StringsAreSorted(names) {
+			t.Fatalf("expected 40 proxies sorted by name, got %v", names)
+		}
+		if first == nil {
+			first = names
+		} else if !reflect.DeepEqual(names, first) {
+			t.Fatalf("provider order changed between fetches: %v != %v", names, first)
+		}
+	}
+}
+
+func TestClashPolicyStateRealProviders(t *testing.T) {
+	withProviders := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/proxies":
+			_, _ = w.Write([]byte(`{"proxies":{
+				"Proxy":{"name":"Proxy","type":"Selector","now":"HK"},
+				"HK":{"name":"HK","type":"Shadowsocks"},
+				"JP":{"name":"JP","type":"Vmess"}}}`))
+		case r.URL.Path == "/providers/proxies" && withProviders:
+			_, _ = w.Write([]byte(`{"providers":{
+				"default":{"name":"default","type":"Proxy","proxies":[
+					{"name":"Proxy","type":"Selector","now":"JP"},
+					{"name":"HK","type":"Shadowsocks"}]},
+				"airport":{"name":"airport","type":"Proxy","proxies":[{"name":"JP","type":"Vmess"}]}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetPolicyProviders(PolicyProvidersProvider)
+	snap, err := client.GetPolicyStateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if len(snap.Proxies) != 3 || len(snap.Providers) != 2 {
+		t.Fatalf("expected 3 proxies in 2 providers, got %+v", snap)
+	}
+	def := snap.Providers["default"]
+	if len(def.Proxies) != 2 || def.Proxies[0].Name != "Proxy" || def.Proxies[1].Name != "HK" {
+		t.Fatalf("expected provider members in provider order, got %+v", def.Proxies)
+	}
+	if def.Proxies[0].Now != "HK" {
+		t.Fatalf("expected selection from /proxies, got %q", def.Proxies[0].Now)
+	}
+	if _, ok := snap.Providers["Shadowsocks"]; ok {
+		t.Fatalf("expected no type buckets, got %+v", snap.Providers)
+	}
+
+	withProviders = false
+	snap, err = client.GetPolicyStateSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if _, ok := snap.Providers["Shadowsocks"]; !ok {
+		t.Fatalf("expected type grouping without /providers/proxies, got %+v", snap.Providers)
+	}
+}
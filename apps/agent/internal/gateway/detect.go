@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TypeAuto is the gateway type of a client whose type DetectType has yet to
+// find out.
+const TypeAuto = "auto"
+
+// ErrTypeUndetected is returned by gateway requests made on a TypeAuto client
+// before DetectType has succeeded.
+var ErrTypeUndetected = errors.New("gateway type not detected yet")
+
+// typeProbe is one request DetectType tries, and the type it selects when the
+// response is a JSON object with field set.
+type typeProbe struct {
+	gatewayType string
+	path        string
+	field       string
+}
+
+// typeProbes are tried in order. Clash /version answers with "version" and
+// Surge /v1/outbound with the outbound "mode"; each is sent with the header
+// that gateway type authenticates with.
+var typeProbes = []typeProbe{
+	{gatewayType: "clash", path: "/version", field: "version"},
+	{gatewayType: "surge", path: "/v1/outbound", field: "mode"},
+}
+
+// DetectType probes a TypeAuto client's endpoint for the gateway behind it
+// and switches the client to the first type that answers sensibly, returning
+// it. sing-box answers as clash and is picked up by DetectCore later. The
+// error of a failed detection lists every probe and what it got. Until it
+// succeeds other gateway requests fail with ErrTypeUndetected, while Type may
+// be read concurrently. On a client of any other type it just returns that
+// type.
+func (c *Client) DetectType(ctx context.Context) (string, error) {
+	if c.Type() != TypeAuto {
+		return c.Type(), nil
+	}
+	tried := make([]string, 0, len(typeProbes))
+	for _, probe := range typeProbes {
+		err := c.probeType(ctx, probe)
+		if err == nil {
+			c.gatewayType.Store(probe.gatewayType)
+			return probe.gatewayType, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		tried = append(tried, fmt.Sprintf("%s %s: %v", probe.gatewayType, probe.path, err))
+	}
+	return "", fmt.Errorf("could not detect gateway type (%s)", strings.Join(tried, "; "))
+}
+
+func (c *Client) probeType(ctx context.Context, probe typeProbe) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+probe.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case c.basicUser != "":
+		req.SetBasicAuth(c.basicUser, c.basicPass)
+	case c.token != "" && probe.gatewayType == "surge":
+		req.Header.Set("X-Key", c.token)
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err != nil {
+		return fmt.Errorf("status %d, not a JSON object", resp.StatusCode)
+	}
+	if _, ok := body[probe.field]; !ok {
+		return fmt.Errorf("status %d, no %q field", resp.StatusCode, probe.field)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectTypeFindsSurge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/outbound" && r.Header.Get("X-Key") == "secret":
+			_, _ = w.Write([]byte(`{"mode":"rule"}`))
+		case r.URL.Path == "/v1/outbound":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), TypeAuto, server.URL, "secret")
+	if _, err := client.Collect(context.Background()); !errors.Is(err, ErrTypeUndetected) {
+		t.Fatalf("expected ErrTypeUndetected before detection, got %v", err)
+	}
+	got, err := client.DetectType(context.Background())
+	if err != nil || got != "surge" || client.Type() != "surge" {
+		t.Fatalf("expected surge, got %q (client %q), %v", got, client.Type(), err)
+	}
+}
+
+func TestDetectTypePrefersClash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" && r.Header.Get("Authorization") == "Bearer secret" {
+			_, _ = w.Write([]byte(`{"meta":true,"version":"v1.18.5"}`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), TypeAuto, server.URL, "secret")
+	if got, err := client.DetectType(context.Background()); err != nil || got != "clash" {
+		t.Fatalf("expected clash, got %q, %v", got, err)
+	}
+}
+
+func TestDetectTypeListsProbes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			_, _ = w.Write([]byte(`<html>dashboard</html>`))
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), TypeAuto, server.URL, "")
+	_, err := client.DetectType(context.Background())
+	if err == nil || client.Type() != TypeAuto {
+		t.Fatalf("expected detection to fail, got %v (client %q)", err, client.Type())
+	}
+	for _, want := range []string{"clash /version: status 200, not a JSON object", "surge /v1/outbound: status 403"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %q", want, err)
+		}
+	}
+
+	explicit := NewClient(server.Client(), "clash", server.URL, "")
+	if got, err := explicit.DetectType(context.Background()); err != nil || got != "clash" {
+		t.Fatalf("expected an explicit type kept without probing, got %q, %v", got, err)
+	}
+}
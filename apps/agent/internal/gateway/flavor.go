@@ -0,0 +1,27 @@
+package gateway
+
+// Clash-compatible apps selectable with SetFlavor. They serve Clash's paths
+// and their /connections responses decode like Clash's; what differs is
+// which of the optional endpoints they serve and how /version identifies
+// them.
+const (
+	// FlavorStash is Stash for iOS and macOS.
+	FlavorStash = "stash"
+	// FlavorShadowrocket is Shadowrocket's Clash-compatible API, which has
+	// no proxy providers.
+	FlavorShadowrocket = "shadowrocket"
+)
+
+// SetFlavor names the app behind a clash gateway. DetectCore then reports it
+// as the core instead of guessing from /version, so mihomo's extended
+// endpoints are never tried, and endpoints the app does not serve are
+// skipped rather than failing on every sync. No path is rewritten. An empty flavor means Clash or
+// one of its cores.
+func (c *Client) SetFlavor(flavor string) {
+	c.flavor = flavor
+}
+
+// hasProviders reports whether the gateway serves /providers/proxies.
+func (c *Client) hasProviders() bool {
+	return !c.singBox.Load() && c.flavor != FlavorShadowrocket
+}
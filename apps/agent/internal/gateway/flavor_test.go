@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestStashConnectionsDecode(t *testing.T) {
+	server, _ := newFixtureServer(t, "stash")
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetFlavor(FlavorStash)
+	ctx := context.Background()
+
+	core, err := client.DetectCore(ctx)
+	if err != nil {
+		t.Fatalf("DetectCore returned error: %v", err)
+	}
+	if core.Name() != "stash" || core.Version != "2.6.1" || core.Meta {
+		t.Fatalf("expected the stash flavor as core, got %+v", core)
+	}
+
+	snapshots, err := client.Collect(ctx)
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(snapshots))
+	}
+	apple := snapshots[0]
+	if apple.Domain != "www.apple.com" || apple.Upload != 2048 || apple.Download != 65536 {
+		t.Fatalf("expected string counters decoded, got %+v", apple)
+	}
+	if want := []string{"HK", "Proxy"}; !reflect.DeepEqual(apple.Chains, want) {
+		t.Fatalf("expected chains %v, got %v", want, apple.Chains)
+	}
+	bare := snapshots[1]
+	if bare.Domain != "" || !reflect.DeepEqual(bare.Chains, []string{"DIRECT"}) || bare.Rule != "Match" {
+		t.Fatalf("expected null metadata and chains tolerated, got %+v", bare)
+	}
+
+	snap, err := client.GetConfigSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	if len(snap.Rules) != 2 || snap.Rules[0].Raw != "DOMAIN-SUFFIX,apple.com,Proxy" {
+		t.Fatalf("unexpected rules %+v", snap.Rules)
+	}
+}
+
+func TestShadowrocketConnectionsDecode(t *testing.T) {
+	server, paths := newFixtureServer(t, "shadowrocket")
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetFlavor(FlavorShadowrocket)
+	client.SetPolicyProviders(PolicyProvidersProvider)
+	ctx := context.Background()
+
+	snapshots, err := client.Collect(ctx)
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the null element skipped, got %+v", snapshots)
+	}
+	got := snapshots[0]
+	if got.ID != "18" || got.Upload != 4096 || got.Download != 81920 {
+		t.Fatalf("unexpected snapshot %+v", got)
+	}
+	if !reflect.DeepEqual(got.Chains, []string{"PROXY"}) || got.RulePayload != "example.com" {
+		t.Fatalf("expected a single-string chain decoded, got %+v", got)
+	}
+
+	if _, err := client.GetConfigSnapshot(ctx); err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	snap, err := client.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if _, ok := snap.Providers["Selector"]; !ok {
+		t.Fatalf("expected the type grouping without providers, got %+v", snap.Providers)
+	}
+	if n := countPath(paths(), "/providers/proxies"); n != 0 {
+		t.Fatalf("expected /providers/proxies never requested, got %d", n)
+	}
+}
+
+func TestClashNullConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"downloadTotal":0,"uploadTotal":0,"connections":null}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	snapshots, err := client.Collect(context.Background())
+	if err != nil || len(snapshots) != 0 {
+		t.Fatalf("expected an idle gateway to yield no flows, got %v, %v", snapshots, err)
+	}
+}
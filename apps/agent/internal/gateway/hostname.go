@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxDomainLen is the longest DNS name in its ASCII (punycode) form.
+const maxDomainLen = 253
+
+// domainForms validates host as a DNS name and returns its display form, with
+// punycode labels decoded to Unicode, and its ASCII form when that differs
+// from the display form. The check is
+// deliberately permissive: underscores (service labels such as
+// _dns.resolver.arpa), single-label names and one trailing dot are accepted.
+func domainForms(host string) (display, ascii string, ok bool) {
+	h := strings.TrimSuffix(extractHost(host), ".")
+	if h == "" || isIPHost(h) {
+		return "", "", false
+	}
+
+	labels := strings.Split(h, ".")
+	displayLabels := make([]string, len(labels))
+	asciiLabels := make([]string, len(labels))
+	for i, label := range labels {
+		u, a, ok := labelForms(label)
+		if !ok {
+			return "", "", false
+		}
+		displayLabels[i], asciiLabels[i] = u, a
+	}
+	ascii = strings.Join(asciiLabels, ".")
+	if len(ascii) > maxDomainLen {
+		return "", "", false
+	}
+	display = strings.Join(displayLabels, ".")
+	if ascii == display {
+		ascii = ""
+	}
+	return display, ascii, true
+}
+
+func labelForms(label string) (display, ascii string, ok bool) {
+	display, ascii = label, label
+	if !isASCII(label) {
+		for _, r := range label {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != '-' && r != '_' {
+				return "", "", false
+			}
+		}
+		ascii = "xn--" + punycodeEncode(label)
+	} else if len(label) > 4 && strings.EqualFold(label[:4], "xn--") {
+		// IDNA labels are case-insensitive; decode the canonical lower case.
+		decoded, err := punycodeDecode(strings.ToLower(label[4:]))
+		if err != nil || decoded == "" {
+			return "", "", false
+		}
+		display = decoded
+	}
+
+	if len(ascii) == 0 || len(ascii) > 63 || ascii[0] == '-' || ascii[len(ascii)-1] == '-' {
+		return "", "", false
+	}
+	for i := 0; i < len(ascii); i++ {
+		c := ascii[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", "", false
+		}
+	}
+	return display, ascii, true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
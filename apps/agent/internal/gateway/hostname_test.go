@@ -0,0 +1,82 @@
+package gateway
+
+import "testing"
+
+func TestDomainFormsAcceptsOddButRealHostnames(t *testing.T) {
+	cases := []struct {
+		host    string
+		display string
+		ascii   string
+		ok      bool
+	}{
+		{host: "example.com:443", display: "example.com", ok: true},
+		{host: "example.com.", display: "example.com", ok: true},
+		{host: "_dns.resolver.arpa", display: "_dns.resolver.arpa", ok: true},
+		{host: "_spotify._tcp.local", display: "_spotify._tcp.local", ok: true},
+		{host: "nas", display: "nas", ok: true},
+		{host: "localhost.", display: "localhost", ok: true},
+		{host: "xn--mnchen-3ya.de", display: "münchen.de", ascii: "xn--mnchen-3ya.de", ok: true},
+		{host: "XN--BCHER-KVA.example", display: "bücher.example", ascii: "XN--BCHER-KVA.example", ok: true},
+		{host: "例え.jp:443", display: "例え.jp", ascii: "xn--r8jz45g.jp", ok: true},
+		{host: "中国", display: "中国", ascii: "xn--fiqs8s", ok: true},
+		{host: "1.1.1.1:53", ok: false},
+		{host: "[2001:db8::1]:443", ok: false},
+		{host: "", ok: false},
+		{host: ".", ok: false},
+		{host: "a..b", ok: false},
+		{host: "-bad.example", ok: false},
+		{host: "bad-.example", ok: false},
+		{host: "bad host.example", ok: false},
+		{host: "xn--.example", ok: false},
+		{host: "xn--a-ecp!.example", ok: false},
+		{host: "a" + string(make([]byte, 63)) + ".example", ok: false},
+	}
+	for _, tc := range cases {
+		display, ascii, ok := domainForms(tc.host)
+		if ok != tc.ok || display != tc.display || ascii != tc.ascii {
+			t.Fatalf("domainForms(%q) = %q, %q, %v; expected %q, %q, %v", tc.host, display, ascii, ok, tc.display, tc.ascii, tc.ok)
+		}
+	}
+}
+
+func TestPunycodeRoundTrip(t *testing.T) {
+	for _, label := range []string{"münchen", "bücher", "中国", "例え", "ليهمابتكلموشعربي؟"} {
+		encoded := punycodeEncode(label)
+		decoded, err := punycodeDecode(encoded)
+		if err != nil || decoded != label {
+			t.Fatalf("round trip of %q via %q gave %q, %v", label, encoded, decoded, err)
+		}
+	}
+	if got := punycodeEncode("ليهمابتكلموشعربي؟"); got != "egbpdaj6bu4bxfgehfvwxn" {
+		t.Fatalf("expected RFC 3492 sample encoding, got %q", got)
+	}
+}
+
+func TestExtractHostNormalizesAddressForms(t *testing.T) {
+	cases := map[string]string{
+		"[fe80::1%en0]:54321":       "fe80::1",
+		"[fe80::1%en0]":             "fe80::1",
+		"fe80::1%en0":               "fe80::1",
+		"fe80::1%en0:54321":         "fe80::1",
+		"[2001:db8::1]:443":         "2001:db8::1",
+		"[2001:DB8:0:0:0:0:0:1]":    "2001:db8::1",
+		"2001:0db8:0000:0000::0001": "2001:db8::1",
+		"::ffff:192.0.2.1":          "192.0.2.1",
+		"[::ffff:192.0.2.1]:8080":   "192.0.2.1",
+		"::ffff:10.0.0.1:80":        "10.0.0.1",
+		"192.0.2.1:443":             "192.0.2.1",
+		" 192.0.2.1 ":               "192.0.2.1",
+		"example.com:443":           "example.com",
+		"example.com":               "example.com",
+		"[::1]":                     "::1",
+		"":                          "",
+	}
+	for in, want := range cases {
+		if got := extractHost(in); got != want {
+			t.Fatalf("extractHost(%q) = %q, expected %q", in, got, want)
+		}
+	}
+	if !isIPHost("[fe80::1%en0]:54321") {
+		t.Fatal("expected zoned link-local source to be recognised as an IP")
+	}
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// memorySamples bounds how many one-second /memory samples CoreMemory waits
+// for. mihomo always sends 0 first, so the second is the first real reading.
+const memorySamples = 2
+
+// ErrNoExtendedAPI is returned for mihomo-only queries against a core that
+// lacks the endpoint: plain Clash, Surge, or a mihomo build without it.
+var ErrNoExtendedAPI = errors.New("gateway core has no extended API")
+
+// CoreInfo describes the Clash core behind the gateway, from /version.
+type CoreInfo struct {
+	Version string
+	// Meta is set for mihomo (Clash Meta), which also serves /group and
+	// /memory.
+	Meta bool
+	// SingBox is set for sing-box's Clash API.
+	SingBox bool
+	// Flavor is the app set with SetFlavor, if any.
+	Flavor string
+}
+
+// Name returns the flavor, "singbox", "mihomo" or "clash".
+func (i CoreInfo) Name() string {
+	switch {
+	case i.Flavor != "":
+		return i.Flavor
+	case i.SingBox:
+		return "singbox"
+	case i.Meta:
+		return "mihomo"
+	}
+	return "clash"
+}
+
+// DetectCore reads /version and, when it reports mihomo, switches the client
+// to mihomo's extended endpoints; each falls back to the plain Clash path for
+// good once it returns 404. sing-box, which also claims meta, switches it to
+// sing-box decoding instead, and a flavor set with SetFlavor is reported as
+// is. Only Clash gateways have /version.
+func (c *Client) DetectCore(ctx context.Context) (CoreInfo, error) {
+	if c.Type() != "clash" {
+		return CoreInfo{}, fmt.Errorf("%s gateway has no /version endpoint", c.Type())
+	}
+	var version struct {
+		Version string `json:"version"`
+		Meta    bool   `json:"meta"`
+	}
+	if err := c.getJSON(ctx, "/version", &version); err != nil {
+		return CoreInfo{}, fmt.Errorf("clash /version error: %w", err)
+	}
+	info := CoreInfo{Version: version.Version, Meta: version.Meta}
+	if c.flavor != "" {
+		info.Meta, info.Flavor = false, c.flavor
+	} else if strings.HasPrefix(version.Version, "sing-box") {
+		info.Meta, info.SingBox = false, true
+		c.singBox.Store(true)
+	}
+	c.meta.Store(info.Meta)
+	return info, nil
+}
+
+// CoreMemory returns mihomo's memory in use in bytes. /memory streams a
+// sample every second, so this takes a second or two.
+func (c *Client) CoreMemory(ctx context.Context) (int64, error) {
+	if !c.meta.Load() || c.noMemoryAPI.Load() {
+		return 0, ErrNoExtendedAPI
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/memory", nil)
+	if err != nil {
+		return 0, err
+	}
+	c.authorize(req)
+	resp, err := c.do(req, "/memory")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		c.noMemoryAPI.Store(true)
+		return 0, ErrNoExtendedAPI
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, &StatusError{Path: "/memory", Code: resp.StatusCode, Body: string(msg)}
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	var sample struct {
+		InUse int64 `json:"inuse"`
+	}
+	for i := 0; i < memorySamples && sample.InUse == 0; i++ {
+		if err := dec.Decode(&sample); err != nil {
+			return 0, fmt.Errorf("mihomo /memory error: %w", err)
+		}
+	}
+	return sample.InUse, nil
+}
+
+// getMihomoPolicyState is getClashPolicyState with the providers taken from
+// mihomo's /group: one per policy group, typed as the group and listing its
+// members in profile order, instead of the proxies bucketed by type.
+func (c *Client) getMihomoPolicyState(ctx context.Context) (*domain.PolicyStateSnapshot, error) {
+	var groupsData struct {
+		Proxies []struct {
+			Name string   `json:"name"`
+			Type string   `json:"type"`
+			Now  string   `json:"now"`
+			All  []string `json:"all"`
+		} `json:"proxies"`
+	}
+	if err := c.getJSON(ctx, "/group", &groupsData); err != nil {
+		if isNotFound(err) {
+			c.noGroupAPI.Store(true)
+			return c.getClashPolicyState(ctx)
+		}
+		return nil, fmt.Errorf("mihomo /group error: %w", err)
+	}
+
+	var proxiesData struct {
+		Proxies map[string]struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Now  string `json:"now"`
+		} `json:"proxies"`
+	}
+	if err := c.getJSON(ctx, "/proxies", &proxiesData); err != nil {
+		return nil, fmt.Errorf("clash /proxies error: %w", err)
+	}
+
+	snap := &domain.PolicyStateSnapshot{
+		Proxies:   make(map[string]domain.GatewayProxy, len(proxiesData.Proxies)),
+		Providers: make(map[string]domain.GatewayProvider, len(groupsData.Proxies)),
+	}
+	for name, p := range proxiesData.Proxies {
+		snap.Proxies[name] = domain.GatewayProxy{Name: p.Name, Type: p.Type, Now: p.Now}
+	}
+	for _, g := range groupsData.Proxies {
+		members := make([]domain.GatewayProxy, 0, len(g.All))
+		for _, name := range g.All {
+			member, ok := snap.Proxies[name]
+			if !ok {
+				member = domain.GatewayProxy{Name: name}
+			}
+			members = append(members, member)
+		}
+		snap.Providers[g.Name] = domain.GatewayProvider{Name: g.Name, Type: g.Type, Proxies: members}
+	}
+	return snap, nil
+}
@@ -0,0 +1,150 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+const mihomoProxies = `{"proxies":{
+	"Proxy":{"name":"Proxy","type":"Selector","now":"Auto"},
+	"Auto":{"name":"Auto","type":"URLTest","now":"HK"},
+	"HK":{"name":"HK","type":"Shadowsocks"},
+	"JP":{"name":"JP","type":"Vmess"},
+	"DIRECT":{"name":"DIRECT","type":"Direct"}}}`
+
+func newMihomoServer(t *testing.T, version string, extended bool) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/version":
+			_, _ = w.Write([]byte(version))
+		case r.URL.Path == "/proxies":
+			_, _ = w.Write([]byte(mihomoProxies))
+		case r.URL.Path == "/group" && extended:
+			_, _ = w.Write([]byte(`{"proxies":[
+				{"name":"Proxy","type":"Selector","now":"Auto","all":["Auto","JP","DIRECT"]},
+				{"name":"Auto","type":"URLTest","now":"HK","all":["HK","JP"]}]}`))
+		case r.URL.Path == "/memory" && extended:
+			// mihomo streams a sample a second, the first always 0.
+			_, _ = w.Write([]byte("{\"inuse\":0,\"oslimit\":0}\n"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("{\"inuse\":52428800,\"oslimit\":0}\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func countPath(paths []string, path string) int {
+	n := 0
+	for _, p := range paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMihomoPolicyStateUsesGroups(t *testing.T) {
+	server, _ := newMihomoServer(t, `{"meta":true,"version":"v1.18.5"}`, true)
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	ctx := context.Background()
+
+	core, err := client.DetectCore(ctx)
+	if err != nil {
+		t.Fatalf("DetectCore returned error: %v", err)
+	}
+	if core.Name() != "mihomo" || core.Version != "v1.18.5" {
+		t.Fatalf("expected mihomo v1.18.5, got %+v", core)
+	}
+
+	snap, err := client.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if len(snap.Proxies) != 5 || snap.Proxies["Proxy"].Now != "Auto" {
+		t.Fatalf("expected every proxy from /proxies, got %+v", snap.Proxies)
+	}
+	if len(snap.Providers) != 2 {
+		t.Fatalf("expected one provider per group, got %+v", snap.Providers)
+	}
+	proxy := snap.Providers["Proxy"]
+	if proxy.Type != "Selector" || len(proxy.Proxies) != 3 {
+		t.Fatalf("unexpected Proxy group %+v", proxy)
+	}
+	if m := proxy.Proxies[0]; m.Name != "Auto" || m.Type != "URLTest" || m.Now != "HK" {
+		t.Fatalf("expected members in profile order with their types, got %+v", proxy.Proxies)
+	}
+	if snap.Providers["Auto"].Type != "URLTest" {
+		t.Fatalf("unexpected Auto group %+v", snap.Providers["Auto"])
+	}
+
+	inUse, err := client.CoreMemory(ctx)
+	if err != nil || inUse != 52428800 {
+		t.Fatalf("expected the first non-zero /memory sample, got %d, %v", inUse, err)
+	}
+}
+
+func TestMihomoFallsBackWhenExtendedAPIMissing(t *testing.T) {
+	server, paths := newMihomoServer(t, `{"meta":true,"version":"v1.14.0"}`, false)
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	ctx := context.Background()
+	if _, err := client.DetectCore(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		snap, err := client.GetPolicyStateSnapshot(ctx)
+		if err != nil {
+			t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+		}
+		// The plain Clash providers, bucketed by proxy type.
+		if _, ok := snap.Providers["Selector"]; !ok || len(snap.Proxies) != 5 {
+			t.Fatalf("expected the plain Clash snapshot, got %+v", snap.Providers)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := client.CoreMemory(ctx); !errors.Is(err, ErrNoExtendedAPI) {
+			t.Fatalf("expected ErrNoExtendedAPI, got %v", err)
+		}
+	}
+	got := paths()
+	if countPath(got, "/group") != 1 || countPath(got, "/memory") != 1 {
+		t.Fatalf("expected each missing endpoint tried once, got %v", got)
+	}
+}
+
+func TestPlainClashNeverUsesExtendedAPI(t *testing.T) {
+	server, paths := newMihomoServer(t, `{"version":"1.18.0","premium":true}`, true)
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	ctx := context.Background()
+	core, err := client.DetectCore(ctx)
+	if err != nil || core.Name() != "clash" {
+		t.Fatalf("expected plain clash, got %+v, %v", core, err)
+	}
+	if _, err := client.GetPolicyStateSnapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreMemory(ctx); !errors.Is(err, ErrNoExtendedAPI) {
+		t.Fatalf("expected ErrNoExtendedAPI, got %v", err)
+	}
+	if got := paths(); countPath(got, "/group")+countPath(got, "/memory") != 0 {
+		t.Fatalf("expected no mihomo endpoints requested, got %v", got)
+	}
+}
@@ -0,0 +1,23 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// GetClashMode returns Clash's routing mode from /configs: "rule", "global" or
+// "direct". In the latter two rules are not evaluated at all. Older Clash
+// builds capitalise the mode, so it is lowercased.
+func (c *Client) GetClashMode(ctx context.Context) (string, error) {
+	if c.Type() != "clash" {
+		return "", fmt.Errorf("%s gateway has no /configs endpoint", c.Type())
+	}
+	var configs struct {
+		Mode string `json:"mode"`
+	}
+	if err := c.getJSON(ctx, "/configs", &configs); err != nil {
+		return "", fmt.Errorf("clash /configs error: %w", err)
+	}
+	return strings.ToLower(strings.TrimSpace(configs.Mode)), nil
+}
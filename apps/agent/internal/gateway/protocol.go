@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Transport and application protocol labels set on snapshots.
+const (
+	transportTCP = "tcp"
+	transportUDP = "udp"
+
+	appQUIC  = "quic"
+	appHTTPS = "https"
+	appHTTP  = "http"
+	appSTUN  = "stun"
+	appDNS   = "dns"
+)
+
+// classifyTraffic derives the transport and a best-effort application
+// protocol from the gateway's network field, the destination port and any
+// free-form hints such as Surge notes. QUIC is assumed for UDP to port 443.
+func classifyTraffic(network string, port int, hints ...string) (transport, app string) {
+	switch strings.ToLower(strings.TrimSpace(network)) {
+	case "tcp":
+		transport = transportTCP
+	case "udp":
+		transport = transportUDP
+	}
+
+	for _, hint := range hints {
+		h := strings.ToLower(hint)
+		switch {
+		case strings.Contains(h, "quic"):
+			return defaultString(transport, transportUDP), appQUIC
+		case strings.Contains(h, "stun"):
+			return defaultString(transport, transportUDP), appSTUN
+		}
+	}
+
+	switch {
+	case port == 53:
+		app = appDNS
+	case port == 3478 || port == 19302:
+		app = appSTUN
+	case port == 443 && transport == transportUDP:
+		app = appQUIC
+	case port == 443 || port == 8443:
+		app = appHTTPS
+	case port == 80 || port == 8080:
+		app = appHTTP
+	}
+	return transport, app
+}
+
+// hostPort returns the numeric port of a "host:port" string, or 0.
+func hostPort(hostWithPort string) int {
+	_, p, err := net.SplitHostPort(strings.TrimSpace(hostWithPort))
+	if err != nil {
+		return 0
+	}
+	return parsePort(p)
+}
+
+func parsePort(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 || n > 65535 {
+		return 0
+	}
+	return n
+}
+
+// surgeNetwork maps Surge's request method to a transport: "UDP" and "TCP"
+// are raw sessions, anything else (GET, CONNECT, ...) runs over TCP.
+func surgeNetwork(method string) string {
+	m := strings.ToUpper(strings.TrimSpace(method))
+	switch {
+	case m == "":
+		return ""
+	case m == "UDP":
+		return transportUDP
+	default:
+		return transportTCP
+	}
+}
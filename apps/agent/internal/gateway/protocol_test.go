@@ -0,0 +1,51 @@
+package gateway
+
+import "testing"
+
+func TestClassifyTraffic(t *testing.T) {
+	cases := []struct {
+		network   string
+		port      int
+		hints     []string
+		transport string
+		app       string
+	}{
+		{"udp", 443, nil, "udp", "quic"},
+		{"UDP", 443, nil, "udp", "quic"},
+		{"tcp", 443, nil, "tcp", "https"},
+		{"tcp", 80, nil, "tcp", "http"},
+		{"udp", 53, nil, "udp", "dns"},
+		{"tcp", 53, nil, "tcp", "dns"},
+		{"udp", 3478, nil, "udp", "stun"},
+		{"udp", 51820, nil, "udp", ""},
+		{"tcp", 22, nil, "tcp", ""},
+		{"", 443, nil, "", "https"},
+		{"", 0, nil, "", ""},
+		{"", 8443, []string{"[QUIC] session established"}, "udp", "quic"},
+		{"udp", 40000, []string{"STUN binding request"}, "udp", "stun"},
+	}
+	for _, tc := range cases {
+		transport, app := classifyTraffic(tc.network, tc.port, tc.hints...)
+		if transport != tc.transport || app != tc.app {
+			t.Fatalf("classifyTraffic(%q, %d, %v) = %q, %q; expected %q, %q", tc.network, tc.port, tc.hints, transport, app, tc.transport, tc.app)
+		}
+	}
+}
+
+func TestSurgeNetworkAndHostPort(t *testing.T) {
+	if got := surgeNetwork("UDP"); got != "udp" {
+		t.Fatalf("expected udp, got %q", got)
+	}
+	if got := surgeNetwork("CONNECT"); got != "tcp" {
+		t.Fatalf("expected tcp, got %q", got)
+	}
+	if got := surgeNetwork(""); got != "" {
+		t.Fatalf("expected unknown network, got %q", got)
+	}
+	if got := hostPort("[2001:db8::1]:443"); got != 443 {
+		t.Fatalf("expected port 443, got %d", got)
+	}
+	if got := hostPort("example.com"); got != 0 {
+		t.Fatalf("expected no port, got %d", got)
+	}
+}
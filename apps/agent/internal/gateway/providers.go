@@ -0,0 +1,98 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// Policy-state provider groupings for SetPolicyProviders.
+const (
+	// PolicyProvidersType groups every proxy by its proxy type, or on mihomo
+	// lists each policy group with its members.
+	PolicyProvidersType = "type"
+	// PolicyProvidersProvider reports the real proxy providers from
+	// /providers/proxies, as the config snapshot does.
+	PolicyProvidersProvider = "provider"
+)
+
+// SetPolicyProviders selects how Clash policy-state snapshots group proxies
+// into providers: PolicyProvidersType (the default) or
+// PolicyProvidersProvider.
+func (c *Client) SetPolicyProviders(mode string) {
+	c.providers = mode
+}
+
+// clashProviders reads the proxy providers and their members, in each
+// provider's order, from /providers/proxies.
+func (c *Client) clashProviders(ctx context.Context) (map[string]domain.GatewayProvider, error) {
+	var providersData struct {
+		Providers map[string]struct {
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			Proxies []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+				Now  string `json:"now"`
+			} `json:"proxies"`
+		} `json:"providers"`
+	}
+	if err := c.getJSON(ctx, "/providers/proxies", &providersData); err != nil {
+		return nil, err
+	}
+	providers := make(map[string]domain.GatewayProvider, len(providersData.Providers))
+	for k, v := range providersData.Providers {
+		proxies := make([]domain.GatewayProxy, len(v.Proxies))
+		for i, p := range v.Proxies {
+			proxies[i] = domain.GatewayProxy{Name: p.Name, Type: p.Type, Now: p.Now}
+		}
+		providers[k] = domain.GatewayProvider{Name: v.Name, Type: v.Type, Proxies: proxies}
+	}
+	return providers, nil
+}
+
+// getClashProviderPolicyState is getClashPolicyState with the real proxy
+// providers instead of proxies bucketed by type. Member selections come from
+// the same /proxies read as the proxies map, so the two agree. A gateway
+// without /providers/proxies (sing-box, Shadowrocket, some Clash builds)
+// gets the type grouping.
+func (c *Client) getClashProviderPolicyState(ctx context.Context) (*domain.PolicyStateSnapshot, error) {
+	if !c.hasProviders() {
+		return c.getClashPolicyState(ctx)
+	}
+	providers, err := c.clashProviders(ctx)
+	if err != nil {
+		if isNotFound(err) {
+			return c.getClashPolicyState(ctx)
+		}
+		return nil, fmt.Errorf("clash /providers/proxies error: %w", err)
+	}
+
+	var proxiesData struct {
+		Proxies map[string]struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+			Now  string `json:"now"`
+		} `json:"proxies"`
+	}
+	if err := c.getJSON(ctx, "/proxies", &proxiesData); err != nil {
+		return nil, fmt.Errorf("clash /proxies error: %w", err)
+	}
+
+	snap := &domain.PolicyStateSnapshot{
+		Proxies:   make(map[string]domain.GatewayProxy, len(proxiesData.Proxies)),
+		Providers: providers,
+	}
+	for name, p := range proxiesData.Proxies {
+		snap.Proxies[name] = domain.GatewayProxy{Name: p.Name, Type: p.Type, Now: p.Now}
+	}
+	for _, provider := range providers {
+		for i, member := range provider.Proxies {
+			if p, ok := snap.Proxies[member.Name]; ok {
+				provider.Proxies[i].Now = p.Now
+			}
+		}
+	}
+	return snap, nil
+}
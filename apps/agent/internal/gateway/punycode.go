@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"errors"
+	"strings"
+)
+
+// Punycode (RFC 3492) parameters.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+// punycodeDecode decodes the part of an IDNA label after the "xn--" prefix.
+func punycodeDecode(s string) (string, error) {
+	var out []rune
+	rest := s
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= 0x80 {
+				return "", errPunycode
+			}
+			out = append(out, rune(s[i]))
+		}
+		rest = s[b+1:]
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos := 0; pos < len(rest); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(rest) {
+				return "", errPunycode
+			}
+			digit := punyDigitValue(rest[pos])
+			pos++
+			if digit < 0 || digit > (1<<30-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		size := len(out) + 1
+		bias = punyAdapt(i-oldi, size, oldi == 0)
+		n += i / size
+		i %= size
+		if n > 0x10FFFF {
+			return "", errPunycode
+		}
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+	}
+	return string(out), nil
+}
+
+// punycodeEncode encodes a label for use after the "xn--" prefix.
+func punycodeEncode(s string) string {
+	runes := []rune(s)
+	var out strings.Builder
+	for _, r := range runes {
+		if r < 0x80 {
+			out.WriteByte(byte(r))
+		}
+	}
+	basic := out.Len()
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return out.String()
+}
+
+func punyThreshold(k, bias int) int {
+	switch t := k - bias; {
+	case t < punyTMin:
+		return punyTMin
+	case t > punyTMax:
+		return punyTMax
+	default:
+		return t
+	}
+}
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDigitValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a')
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A')
+	}
+	return -1
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// Quantumult X's local HTTP API is undocumented. The paths, the token header
+// and the response shapes below are the ones modelled by the hand-written
+// fixtures in testdata/quanx, not checked against a device; see the README
+// there.
+const (
+	quanxConnectionsPath = "/v1/connections"
+	quanxPoliciesPath    = "/v1/policies"
+	quanxFiltersPath     = "/v1/filters"
+	quanxTokenHeader     = "X-Token"
+)
+
+// quanxConnection is one element of the /v1/connections array. Counters are
+// cumulative for the session, like Clash's, so deltas work the same way.
+type quanxConnection struct {
+	ID            flexibleID         `json:"id"`
+	Host          string             `json:"host"`
+	RemoteAddress string             `json:"remote_address"`
+	SourceAddress string             `json:"source_address"`
+	Protocol      string             `json:"protocol"`
+	Filter        string             `json:"filter"` // the matching filter line
+	Route         flexibleStringList `json:"route"`  // filter policy first, server last
+	BytesOut      flexibleInt64      `json:"bytes_out"`
+	BytesIn       flexibleInt64      `json:"bytes_in"`
+}
+
+// quanxPolicies is the /v1/policies response: the policy groups with their
+// current selection, and the servers they choose from.
+type quanxPolicies struct {
+	Policies []struct {
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+		Selected string `json:"selected"`
+	} `json:"policies"`
+	Servers []struct {
+		Name     string `json:"name"`
+		Protocol string `json:"protocol"`
+	} `json:"servers"`
+}
+
+// quanxFilterTypes maps Quantumult X filter types to the Clash rule names
+// the master groups by. Types without a Clash counterpart are kept as given.
+var quanxFilterTypes = map[string]string{
+	"host":         "Domain",
+	"host-suffix":  "DomainSuffix",
+	"host-keyword": "DomainKeyword",
+	"ip-cidr":      "IPCIDR",
+	"ip6-cidr":     "IPCIDR6",
+	"geoip":        "GeoIP",
+	"final":        "Match",
+}
+
+// quanxPolicyTypes maps Quantumult X policy types to Clash group types.
+var quanxPolicyTypes = map[string]string{
+	"static":                "Selector",
+	"available":             "Fallback",
+	"round-robin":           "LoadBalance",
+	"dest-hash":             "LoadBalance",
+	"url-latency-benchmark": "URLTest",
+}
+
+// quanxFilter splits a filter line such as "host-suffix, apple.com, direct"
+// into a Clash rule name, its payload and the policy. "final, proxy" has no
+// payload.
+func quanxFilter(line string) (rule, payload, policy string) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	typ := strings.ToLower(parts[0])
+	if typ == "" {
+		return "Match", "", ""
+	}
+	rule = typ
+	if mapped, ok := quanxFilterTypes[typ]; ok {
+		rule = mapped
+	}
+	switch {
+	case typ == "final" && len(parts) >= 2:
+		return rule, "", parts[1]
+	case len(parts) >= 3:
+		return rule, parts[1], parts[2]
+	case len(parts) == 2:
+		return rule, parts[1], ""
+	}
+	return rule, "", ""
+}
+
+func (c *Client) collectQuanX(ctx context.Context) ([]domain.FlowSnapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+quanxConnectionsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	c.authorize(req)
+
+	resp, err := c.do(req, quanxConnectionsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("gateway http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	body, unchanged, err := c.readBody(resp.Body, quanxConnectionsPath)
+	if err != nil {
+		return nil, fmt.Errorf("read quanx response: %w", err)
+	}
+	if unchanged {
+		return nil, ErrUnchanged
+	}
+
+	nowMs := time.Now().UnixMilli()
+	var snapshots []domain.FlowSnapshot
+	err = decodeArrayField(bytes.NewReader(body), "connections", func(_ int, dec *json.Decoder) error {
+		var item quanxConnection
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		id := strings.TrimSpace(string(item.ID))
+		if id == "" {
+			return nil
+		}
+		// The route runs from the filter's policy to the server, so it is
+		// reversed to put the exit first.
+		chains := NormalizeChains(reverseChains(item.Route))
+		rule, rulePayload, _ := quanxFilter(item.Filter)
+
+		host := strings.TrimSpace(item.Host)
+		domainName, hostSource := host, domain.HostSourceDNS
+		if domainName == "" || isIPHost(domainName) {
+			domainName, hostSource = "", domain.HostSourceIP
+		}
+		domainASCII := ""
+		if display, ascii, ok := domainForms(domainName); ok {
+			domainName, domainASCII = display, ascii
+		}
+		transport, app := classifyTraffic(item.Protocol, hostPort(item.RemoteAddress))
+		snapshots = append(snapshots, domain.FlowSnapshot{
+			ID:          id,
+			Domain:      domainName,
+			DomainASCII: domainASCII,
+			HostSource:  hostSource,
+			IP:          extractHost(item.RemoteAddress),
+			SourceIP:    extractHost(item.SourceAddress),
+			Transport:   transport,
+			AppProtocol: app,
+			Blocked:     isRejectChain(chains),
+			Chains:      chains,
+			Rule:        rule,
+			RulePayload: rulePayload,
+			Upload:      int64(item.BytesOut),
+			Download:    int64(item.BytesIn),
+			TimestampMs: nowMs,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decode quanx response: %w", incomplete(quanxConnectionsPath, len(body), err))
+	}
+	return snapshots, nil
+}
+
+// quanxProxies returns the servers and policy groups of /v1/policies keyed
+// by name, groups carrying their current selection as Now.
+func (c *Client) quanxProxies(ctx context.Context) (map[string]domain.GatewayProxy, error) {
+	var data quanxPolicies
+	if err := c.getJSON(ctx, quanxPoliciesPath, &data); err != nil {
+		return nil, fmt.Errorf("quanx %s error: %w", quanxPoliciesPath, err)
+	}
+	proxies := make(map[string]domain.GatewayProxy, len(data.Servers)+len(data.Policies))
+	for _, s := range data.Servers {
+		name := strings.TrimSpace(s.Name)
+		if name == "" {
+			continue
+		}
+		proxies[name] = domain.GatewayProxy{Name: name, Type: defaultString(s.Protocol, "Proxy")}
+	}
+	for _, p := range data.Policies {
+		name := strings.TrimSpace(p.Name)
+		if name == "" {
+			continue
+		}
+		typ := strings.ToLower(strings.TrimSpace(p.Type))
+		if mapped, ok := quanxPolicyTypes[typ]; ok {
+			typ = mapped
+		}
+		proxies[name] = domain.GatewayProxy{Name: name, Type: typ, Now: strings.TrimSpace(p.Selected)}
+	}
+	return proxies, nil
+}
+
+// getQuanXConfig maps the filter lines to rules and the policies to proxies.
+// Quantumult X has no proxy providers, so Providers is empty, not nil, to
+// keep the snapshot hash stable.
+func (c *Client) getQuanXConfig(ctx context.Context) (*domain.GatewayConfigSnapshot, error) {
+	var filtersData struct {
+		Filters []string `json:"filters"`
+	}
+	if err := c.getJSON(ctx, quanxFiltersPath, &filtersData); err != nil {
+		return nil, fmt.Errorf("quanx %s error: %w", quanxFiltersPath, err)
+	}
+	proxies, err := c.quanxProxies(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &domain.GatewayConfigSnapshot{
+		Rules:     make([]domain.GatewayRule, 0, len(filtersData.Filters)),
+		Proxies:   proxies,
+		Providers: make(map[string]domain.GatewayProvider),
+	}
+	for _, line := range filtersData.Filters {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule, payload, policy := quanxFilter(line)
+		snap.Rules = append(snap.Rules, domain.GatewayRule{Type: rule, Payload: payload, Proxy: policy, Raw: line})
+	}
+	return snap, nil
+}
+
+func (c *Client) getQuanXPolicyState(ctx context.Context) (*domain.PolicyStateSnapshot, error) {
+	proxies, err := c.quanxProxies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.PolicyStateSnapshot{
+		Proxies:   proxies,
+		Providers: make(map[string]domain.GatewayProvider),
+	}, nil
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+func TestQuanXFilter(t *testing.T) {
+	cases := []struct {
+		line, rule, payload, policy string
+	}{
+		{"host-suffix, apple.com, direct", "DomainSuffix", "apple.com", "direct"},
+		{"HOST-KEYWORD,youtube,Streaming", "DomainKeyword", "youtube", "Streaming"},
+		{"ip-cidr, 10.0.0.0/8, direct, no-resolve", "IPCIDR", "10.0.0.0/8", "direct"},
+		{"user-agent, Instagram*, Proxy", "user-agent", "Instagram*", "Proxy"},
+		{"final, Proxy", "Match", "", "Proxy"},
+		{"", "Match", "", ""},
+	}
+	for _, tc := range cases {
+		rule, payload, policy := quanxFilter(tc.line)
+		if rule != tc.rule || payload != tc.payload || policy != tc.policy {
+			t.Errorf("quanxFilter(%q) = %q, %q, %q, want %q, %q, %q", tc.line, rule, payload, policy, tc.rule, tc.payload, tc.policy)
+		}
+	}
+}
+
+func TestQuanXCollect(t *testing.T) {
+	server, _ := newFixtureServer(t, "quanx")
+	client := NewClient(server.Client(), "quanx", server.URL, "")
+
+	snapshots, err := client.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 4 {
+		t.Fatalf("expected 4 connections with an id, got %d", len(snapshots))
+	}
+
+	apple := snapshots[0]
+	if apple.Domain != "www.apple.com" || apple.HostSource != domain.HostSourceDNS || apple.IP != "17.253.144.10" || apple.SourceIP != "192.168.1.23" {
+		t.Fatalf("unexpected addresses %+v", apple)
+	}
+	if apple.Rule != "DomainSuffix" || apple.RulePayload != "apple.com" || !reflect.DeepEqual(apple.Chains, []string{"direct"}) {
+		t.Fatalf("unexpected rule or chains %+v", apple)
+	}
+	if apple.Upload != 2048 || apple.Download != 65536 || apple.Transport != transportTCP || apple.AppProtocol != appHTTPS {
+		t.Fatalf("unexpected counters or protocol %+v", apple)
+	}
+
+	youtube := snapshots[1]
+	if want := []string{"HK-01", "Proxy", "Streaming"}; !reflect.DeepEqual(youtube.Chains, want) {
+		t.Fatalf("expected exit-first chains %v, got %v", want, youtube.Chains)
+	}
+	if youtube.Upload != 15360 || youtube.Download != 1048576 || youtube.AppProtocol != appQUIC {
+		t.Fatalf("expected string counters and QUIC decoded, got %+v", youtube)
+	}
+
+	ipOnly := snapshots[2]
+	if ipOnly.Domain != "" || ipOnly.HostSource != domain.HostSourceIP || ipOnly.IP != "2606:4700:4700::1111" || ipOnly.SourceIP != "fe80::1c2b:3a4d:5e6f:7a8b" {
+		t.Fatalf("unexpected IP-only snapshot %+v", ipOnly)
+	}
+	if ipOnly.Rule != "Match" || ipOnly.RulePayload != "" {
+		t.Fatalf("expected final to report as Match, got %q %q", ipOnly.Rule, ipOnly.RulePayload)
+	}
+
+	if blocked := snapshots[3]; !blocked.Blocked || blocked.IP != "" {
+		t.Fatalf("expected the reject route marked blocked, got %+v", blocked)
+	}
+}
+
+func TestQuanXConfigAndPolicyState(t *testing.T) {
+	server, paths := newFixtureServer(t, "quanx")
+	client := NewClient(server.Client(), "quanx", server.URL, "")
+	ctx := context.Background()
+
+	snap, err := client.GetConfigSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	if len(snap.Rules) != 6 {
+		t.Fatalf("expected the 6 non-empty filters, got %+v", snap.Rules)
+	}
+	if r := snap.Rules[2]; r.Type != "IPCIDR" || r.Payload != "10.0.0.0/8" || r.Proxy != "direct" || r.Raw != "ip-cidr, 10.0.0.0/8, direct" {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+	if r := snap.Rules[5]; r.Type != "Match" || r.Proxy != "Proxy" {
+		t.Fatalf("unexpected final rule %+v", r)
+	}
+	wantProxies := map[string]domain.GatewayProxy{
+		"Proxy":     {Name: "Proxy", Type: "Selector", Now: "HK-01"},
+		"Streaming": {Name: "Streaming", Type: "Selector", Now: "Proxy"},
+		"Auto":      {Name: "Auto", Type: "URLTest", Now: "JP-01"},
+		"Home":      {Name: "Home", Type: "ssid", Now: "direct"},
+		"HK-01":     {Name: "HK-01", Type: "shadowsocks"},
+		"JP-01":     {Name: "JP-01", Type: "vmess"},
+	}
+	if !reflect.DeepEqual(snap.Proxies, wantProxies) {
+		t.Fatalf("unexpected proxies:\n got %+v\nwant %+v", snap.Proxies, wantProxies)
+	}
+	if snap.Providers == nil || len(snap.Providers) != 0 {
+		t.Fatalf("expected empty, non-nil providers, got %#v", snap.Providers)
+	}
+
+	state, err := client.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if !reflect.DeepEqual(state.Proxies, wantProxies) || state.Providers == nil || len(state.Providers) != 0 {
+		t.Fatalf("unexpected policy state %+v", state)
+	}
+
+	for _, p := range paths() {
+		if p != quanxFiltersPath && p != quanxPoliciesPath {
+			t.Fatalf("expected only quanx paths requested, got %v", paths())
+		}
+	}
+}
+
+func TestQuanXSendsTokenHeader(t *testing.T) {
+	var header, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, auth = r.Header.Get(quanxTokenHeader), r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"connections":[]}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "quanx", server.URL, "secret")
+	if _, err := client.Collect(context.Background()); err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if header != "secret" || auth != "" {
+		t.Fatalf("expected the token in %s only, got %q and Authorization %q", quanxTokenHeader, header, auth)
+	}
+	if err := client.CloseConnection(context.Background(), "3f1c2a90"); err == nil {
+		t.Fatal("expected closing a connection to be unsupported")
+	}
+}
+
+func TestQuanXRecordingReplays(t *testing.T) {
+	server, _ := newFixtureServer(t, "quanx")
+	dir := t.TempDir()
+	rec, err := NewRecorder(dir, 1<<20, t.Logf)
+	if err != nil {
+		t.Fatalf("NewRecorder returned error: %v", err)
+	}
+	client := NewClient(server.Client(), "quanx", server.URL, "")
+	client.SetRecorder(rec)
+	if _, err := client.Collect(context.Background()); err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+
+	replay, err := NewReplayClient(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplayClient returned error: %v", err)
+	}
+	if replay.Type() != "quanx" {
+		t.Fatalf("expected the recorded gateway type quanx, got %q", replay.Type())
+	}
+	snapshots, err := replay.Collect(context.Background())
+	if err != nil || len(snapshots) != 4 {
+		t.Fatalf("expected the 4 recorded connections, got %d, %v", len(snapshots), err)
+	}
+}
@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// recordManifest lists the recorded responses in the order they were
+	// received, one JSON object per line.
+	recordManifest = "manifest.jsonl"
+	// maxRecordedBody caps a single recorded body; the rest is dropped and the
+	// entry marked truncated.
+	maxRecordedBody = 32 << 20
+)
+
+// recordEntry is one manifest line. Only the body is written to File;
+// request and response headers, which carry the gateway credentials, never
+// are.
+type recordEntry struct {
+	TimeMs    int64  `json:"timeMs"`
+	File      string `json:"file"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	URL       string `json:"url"`
+	Status    int    `json:"status"`
+	Bytes     int64  `json:"bytes"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Recorder writes every raw gateway response body to a directory for offline
+// debugging, dropping the oldest recordings once they exceed maxBytes.
+type Recorder struct {
+	dir      string
+	maxBytes int64
+	logf     func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	entries []recordEntry
+	total   int64
+	seq     int
+}
+
+// NewRecorder creates dir if needed and continues an existing recording in it.
+// Failures to save a recording are reported through logf.
+func NewRecorder(dir string, maxBytes int64, logf func(format string, args ...interface{})) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	rec := &Recorder{dir: dir, maxBytes: maxBytes, logf: logf}
+	entries, err := readRecordManifest(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		rec.total += e.Bytes
+	}
+	rec.entries = entries
+	return rec, nil
+}
+
+// SetRecorder makes the client record every gateway response through rec.
+func (c *Client) SetRecorder(rec *Recorder) {
+	c.recorder = rec
+}
+
+// do sends req and, when recording, tees the response body so it is saved
+// once the caller closes it. path is the API path without the endpoint prefix.
+func (c *Client) do(req *http.Request, path string) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil || c.recorder == nil {
+		return resp, err
+	}
+	resp.Body = &recordingBody{
+		rec:   c.recorder,
+		body:  resp.Body,
+		entry: recordEntry{Method: req.Method, Path: path, URL: redactURL(req.URL), Status: resp.StatusCode},
+	}
+	return resp, nil
+}
+
+type recordingBody struct {
+	rec   *Recorder
+	body  io.ReadCloser
+	buf   bytes.Buffer
+	entry recordEntry
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if room := maxRecordedBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+		b.entry.Truncated = b.entry.Truncated || n > room
+	} else if n > 0 {
+		b.entry.Truncated = true
+	}
+	return n, err
+}
+
+// Close reads what the caller left unread, e.g. whitespace after a decoded
+// JSON value, so the recording holds the whole body, and then saves it.
+func (b *recordingBody) Close() error {
+	_, _ = io.Copy(io.Discard, io.LimitReader(b, maxRecordedBody))
+	err := b.body.Close()
+	b.entry.Bytes = int64(b.buf.Len())
+	if recErr := b.rec.save(b.entry, b.buf.Bytes()); recErr != nil {
+		// Recording is a debugging aid; never fail the request over it.
+		b.rec.logf("recording gateway %s failed: %v", b.entry.Path, recErr)
+	}
+	return err
+}
+
+func (r *Recorder) save(entry recordEntry, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.seq++
+	entry.TimeMs = now.UnixMilli()
+	entry.File = fmt.Sprintf("%s-%06d-%s.json", now.UTC().Format("20060102T150405.000Z"), r.seq, recordFileSlug(entry.Path))
+	if err := os.WriteFile(filepath.Join(r.dir, entry.File), body, 0o600); err != nil {
+		return err
+	}
+	r.entries = append(r.entries, entry)
+	r.total += entry.Bytes
+
+	if r.total <= r.maxBytes {
+		return appendRecordManifest(r.dir, entry)
+	}
+	drop := 0
+	for r.total > r.maxBytes && drop < len(r.entries)-1 {
+		os.Remove(filepath.Join(r.dir, r.entries[drop].File))
+		r.total -= r.entries[drop].Bytes
+		drop++
+	}
+	r.entries = append([]recordEntry(nil), r.entries[drop:]...)
+	return writeRecordManifest(r.dir, r.entries)
+}
+
+// recordFileSlug turns an API path into a file name fragment, e.g.
+// "/v1/requests/recent" into "v1-requests-recent".
+func recordFileSlug(path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	slug := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, path)
+	slug = strings.Trim(slug, "-")
+	if slug == "" {
+		return "root"
+	}
+	return slug
+}
+
+// redactURL drops userinfo and the values of query parameters, where some
+// controllers accept their secret.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery != "" {
+		query := redacted.Query()
+		for key := range query {
+			query.Set(key, "redacted")
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+func readRecordManifest(dir string) ([]recordEntry, error) {
+	f, err := os.Open(filepath.Join(dir, recordManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []recordEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %w", recordManifest, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func appendRecordManifest(dir string, entry recordEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, recordManifest), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeRecordManifest replaces the manifest after old entries were pruned.
+func writeRecordManifest(dir string, entries []recordEntry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := filepath.Join(dir, recordManifest+".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, recordManifest))
+}
@@ -0,0 +1,24 @@
+package gateway
+
+import (
+	"bytes"
+	"strings"
+)
+
+// isRejectPolicy reports whether name is one of the built-in reject policies
+// (REJECT, REJECT-DROP, REJECT-TINYGIF, REJECT-NO-DROP, ...).
+func isRejectPolicy(name string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(name)), "REJECT")
+}
+
+// isRejectChain reports whether a connection's exit-first chain ended in a
+// reject policy.
+func isRejectChain(chains []string) bool {
+	return isRejectPolicy(exitChain(chains))
+}
+
+// isTruthy interprets a loosely typed JSON flag (true, 1, "true").
+func isTruthy(raw []byte) bool {
+	v := bytes.Trim(bytes.TrimSpace(raw), `"`)
+	return bytes.EqualFold(v, []byte("true")) || bytes.Equal(v, []byte("1"))
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// nonPublicPrefixes are ranges that look routable to netip but never identify
+// the real remote end: CGNAT and the benchmarking range Surge uses for fake IPs.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// parseRemoteAddresses splits Surge's comma-separated remoteAddress (happy
+// eyeballs attempts or chained hops, each optionally followed by a note such
+// as "(Proxy)") into canonical IP addresses, dropping anything that is not one.
+func parseRemoteAddresses(v string) []string {
+	var addrs []string
+	for _, part := range strings.Split(v, ",") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		if addr, ok := canonicalIP(extractHost(fields[0])); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// selectRemoteAddress picks the address most likely used by the established
+// connection: among those matching familyHint ("" when unknown, else any
+// address of the outbound connection's family) the first publicly routable
+// one, then the first of that family, then the first overall.
+func selectRemoteAddress(addrs []string, familyHint string) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	candidates := addrs
+	if hint, err := netip.ParseAddr(familyHint); err == nil {
+		var same []string
+		for _, a := range addrs {
+			if addr, err := netip.ParseAddr(a); err == nil && addr.Is4() == hint.Unmap().Is4() {
+				same = append(same, a)
+			}
+		}
+		if len(same) > 0 {
+			candidates = same
+		}
+	}
+	for _, a := range candidates {
+		if addr, err := netip.ParseAddr(a); err == nil && isPublicAddr(addr) {
+			return a
+		}
+	}
+	return candidates[0]
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReplayFinished is returned by Collect once a replayed recording has no
+// gateway polls left.
+var ErrReplayFinished = errors.New("replay finished")
+
+// NewReplayClient returns a client that answers from a recording made with
+// --record-dir instead of a live gateway. Responses are played back in the
+// order they were recorded and go through the same decoders as live ones, so
+// everything downstream of Collect behaves as it did when recording.
+//
+// Each Collect consumes the next recorded poll. With speed > 0 a poll is not
+// served before its recorded offset from the first poll, divided by speed,
+// has elapsed; with 0 polls are served as fast as they are requested. Other
+// endpoints (rules, policies, ...) answer with their latest recording made
+// before the current poll.
+func NewReplayClient(dir string, speed float64) (*Client, error) {
+	entries, err := readRecordManifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("replay %s: %w", dir, err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].TimeMs < entries[j].TimeMs })
+
+	gatewayType := ""
+	var active, recent bool
+	for _, e := range entries {
+		switch {
+		case e.Path == "/connections":
+			gatewayType = "clash"
+		case e.Path == quanxConnectionsPath:
+			gatewayType = "quanx"
+		case e.Path == "/v1/requests/active":
+			gatewayType, active = "surge", true
+		case e.Path == "/v1/requests/recent":
+			gatewayType, recent = "surge", true
+		}
+	}
+	if gatewayType == "" {
+		return nil, fmt.Errorf("replay %s: no gateway polls recorded", dir)
+	}
+
+	rt := &replayTransport{dir: dir, entries: entries, speed: speed}
+	c := NewClient(&http.Client{Transport: rt}, gatewayType, "http://replay.invalid", "")
+	switch {
+	case active && recent:
+		c.SetSurgeRequestSource("both")
+	case active:
+		c.SetSurgeRequestSource("active")
+	default:
+		c.SetSurgeRequestSource("recent")
+	}
+	return c, nil
+}
+
+// Type returns the gateway type the client decodes: clash or surge, or
+// TypeAuto until DetectType succeeds. It is safe to call while DetectType
+// runs.
+func (c *Client) Type() string {
+	return c.gatewayType.Load().(string)
+}
+
+func isPollPath(path string) bool {
+	return path == "/connections" || path == quanxConnectionsPath || strings.HasPrefix(path, "/v1/requests/")
+}
+
+type replayTransport struct {
+	dir     string
+	entries []recordEntry
+	speed   float64
+
+	mu     sync.Mutex
+	next   int // index of the first entry not yet replayed
+	start  time.Time
+	baseMs int64
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	path := req.URL.RequestURI()
+
+	t.mu.Lock()
+	idx := -1
+	if isPollPath(path) {
+		for i := t.next; i < len(t.entries); i++ {
+			if t.entries[i].Path == path {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			t.mu.Unlock()
+			return nil, ErrReplayFinished
+		}
+		t.next = idx + 1
+	} else {
+		for i := range t.entries {
+			if t.entries[i].Path != path {
+				continue
+			}
+			if idx >= 0 && i >= t.next {
+				break
+			}
+			idx = i
+		}
+	}
+	var wait time.Duration
+	if idx >= 0 && isPollPath(path) && t.speed > 0 {
+		if t.start.IsZero() {
+			t.start, t.baseMs = time.Now(), t.entries[idx].TimeMs
+		}
+		offset := time.Duration(float64(t.entries[idx].TimeMs-t.baseMs)/t.speed) * time.Millisecond
+		wait = time.Until(t.start.Add(offset))
+	}
+	t.mu.Unlock()
+
+	if idx < 0 {
+		return replayResponse(req, http.StatusNotFound, []byte("not recorded")), nil
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	entry := t.entries[idx]
+	body, err := os.ReadFile(filepath.Join(t.dir, entry.File))
+	if err != nil {
+		return nil, fmt.Errorf("replay %s: %w", entry.File, err)
+	}
+	return replayResponse(req, entry.Status, body), nil
+}
+
+func replayResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
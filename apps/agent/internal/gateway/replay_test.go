@@ -0,0 +1,104 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordClash records polls of a fake Clash controller whose only connection
+// grows by 100 bytes per poll, plus one /rules response after the first poll.
+func recordClash(t *testing.T, polls int) string {
+	t.Helper()
+	upload := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/connections":
+			upload += 100
+			fmt.Fprintf(w, `{"connections":[{"id":"c1","upload":%d,"download":0,"chains":["DIRECT"],"metadata":{"host":"example.com"}}]}`, upload)
+		case "/rules":
+			_, _ = w.Write([]byte(`{"rules":[{"type":"Match","payload":"","proxy":"DIRECT"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	rec, err := NewRecorder(dir, 1<<20, t.Logf)
+	if err != nil {
+		t.Fatalf("NewRecorder returned error: %v", err)
+	}
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	client.SetRecorder(rec)
+	for i := 0; i < polls; i++ {
+		if _, err := client.Collect(context.Background()); err != nil {
+			t.Fatalf("Collect returned error: %v", err)
+		}
+		if i == 0 {
+			_, _ = client.GetConfigSnapshot(context.Background())
+		}
+	}
+	return dir
+}
+
+func TestReplayClientPlaysBackRecordedPolls(t *testing.T) {
+	dir := recordClash(t, 3)
+	client, err := NewReplayClient(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplayClient returned error: %v", err)
+	}
+	if client.Type() != "clash" {
+		t.Fatalf("expected the recorded gateway type clash, got %q", client.Type())
+	}
+
+	for want := int64(100); want <= 300; want += 100 {
+		snapshots, err := client.Collect(context.Background())
+		if err != nil {
+			t.Fatalf("Collect returned error: %v", err)
+		}
+		if len(snapshots) != 1 || snapshots[0].Upload != want || snapshots[0].Domain != "example.com" {
+			t.Fatalf("expected upload %d, got %+v", want, snapshots)
+		}
+	}
+	if _, err := client.Collect(context.Background()); !errors.Is(err, ErrReplayFinished) {
+		t.Fatalf("expected ErrReplayFinished, got %v", err)
+	}
+
+	// /rules was recorded, /proxies was not.
+	if _, err := client.GetConfigSnapshot(context.Background()); err == nil || !strings.Contains(err.Error(), "returned 404") {
+		t.Fatalf("expected the unrecorded /proxies to answer 404, got %v", err)
+	}
+}
+
+func TestReplayClientScalesTime(t *testing.T) {
+	dir := recordClash(t, 2)
+	rt := mustReplayTransport(t, dir)
+	rt.entries[len(rt.entries)-1].TimeMs = rt.entries[0].TimeMs + 400
+	rt.speed = 4
+
+	client := NewClient(&http.Client{Transport: rt}, "clash", "http://replay.invalid", "")
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Collect(context.Background()); err != nil {
+			t.Fatalf("Collect returned error: %v", err)
+		}
+	}
+	if took := time.Since(start); took < 90*time.Millisecond || took > time.Second {
+		t.Fatalf("expected the second poll after ~100ms (400ms at 4x), took %v", took)
+	}
+}
+
+func mustReplayTransport(t *testing.T, dir string) *replayTransport {
+	t.Helper()
+	client, err := NewReplayClient(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplayClient returned error: %v", err)
+	}
+	return client.httpClient.Transport.(*replayTransport)
+}
@@ -0,0 +1,28 @@
+package gateway
+
+import (
+	"strings"
+)
+
+// singBoxRule splits the rule sing-box reports for a connection, such as
+// "domain_suffix=example.com => route(Proxy)" or "rule_set=[geosite-cn] =>
+// direct", into a rule type and payload the way Clash reports them, since
+// sing-box has no rulePayload. The outbound after "=>" is already in the
+// chains. A connection no rule matched ("final") is Clash's Match. Rules
+// with several conditions keep them all as the payload, under the first
+// condition's type.
+func singBoxRule(raw string) (rule, payload string) {
+	cond, _, _ := strings.Cut(raw, "=>")
+	cond = strings.TrimSpace(cond)
+	if cond == "" || cond == "final" {
+		return "Match", ""
+	}
+	key, value, ok := strings.Cut(cond, "=")
+	if !ok {
+		return cond, ""
+	}
+	if strings.Contains(value, "=") {
+		return key, cond
+	}
+	return key, strings.Trim(value, "[]")
+}
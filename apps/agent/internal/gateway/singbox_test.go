@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newFixtureServer serves the responses in testdata/<dir>, one file per API
+// path, and 404 for anything else.
+func newFixtureServer(t *testing.T, dir string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		body, err := os.ReadFile(filepath.Join("testdata", dir, strings.TrimPrefix(r.URL.Path, "/")+".json"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestSingBoxRule(t *testing.T) {
+	cases := []struct {
+		raw, rule, payload string
+	}{
+		{"domain_suffix=example.com => route(Proxy)", "domain_suffix", "example.com"},
+		{"rule_set=[geosite-cn geoip-cn] => direct", "rule_set", "geosite-cn geoip-cn"},
+		{"ip_is_private=true network=tcp => route(direct)", "ip_is_private", "ip_is_private=true network=tcp"},
+		{"final", "Match", ""},
+		{"", "Match", ""},
+	}
+	for _, tc := range cases {
+		if rule, payload := singBoxRule(tc.raw); rule != tc.rule || payload != tc.payload {
+			t.Errorf("singBoxRule(%q) = %q, %q, want %q, %q", tc.raw, rule, payload, tc.rule, tc.payload)
+		}
+	}
+}
+
+func TestSingBoxDetectedAndDecoded(t *testing.T) {
+	server, paths := newFixtureServer(t, "singbox")
+	client := NewClient(server.Client(), "clash", server.URL, "")
+	ctx := context.Background()
+
+	core, err := client.DetectCore(ctx)
+	if err != nil {
+		t.Fatalf("DetectCore returned error: %v", err)
+	}
+	if core.Name() != "singbox" || core.Meta {
+		t.Fatalf("expected sing-box rather than mihomo, got %+v", core)
+	}
+
+	snapshots, err := client.Collect(ctx)
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("expected 3 connections, got %d", len(snapshots))
+	}
+	google := snapshots[0]
+	if want := []string{"HK-01", "Auto", "Proxy"}; !reflect.DeepEqual(google.Chains, want) {
+		t.Fatalf("expected exit-first chains %v, got %v", want, google.Chains)
+	}
+	if google.Rule != "rule_set" || google.RulePayload != "geosite-google" {
+		t.Fatalf("unexpected rule %q payload %q", google.Rule, google.RulePayload)
+	}
+	if google.Domain != "www.google.com" || google.Upload != 1520 || google.Download != 48211 {
+		t.Fatalf("unexpected snapshot %+v", google)
+	}
+	dns := snapshots[1]
+	if dns.ID != "1024" || dns.Rule != "Match" || dns.Upload != 88 || dns.Download != 9120 {
+		t.Fatalf("expected numeric id and string counters decoded, got %+v", dns)
+	}
+
+	if _, err := client.GetConfigSnapshot(ctx); err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	if _, err := client.GetPolicyStateSnapshot(ctx); err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	for _, p := range paths() {
+		if p == "/providers/proxies" || p == "/group" {
+			t.Fatalf("expected no request to %s on sing-box, got %v", p, paths())
+		}
+	}
+}
+
+func TestSingBoxGatewayType(t *testing.T) {
+	server, _ := newFixtureServer(t, "singbox")
+	client := NewClient(server.Client(), "singbox", server.URL, "")
+	if client.Type() != "clash" {
+		t.Fatalf("expected sing-box to use the Clash API, got %q", client.Type())
+	}
+	snapshots, err := client.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect returned error: %v", err)
+	}
+	if got := snapshots[0].Chains[0]; got != "HK-01" {
+		t.Fatalf("expected sing-box decoding without detection, exit %q", got)
+	}
+}
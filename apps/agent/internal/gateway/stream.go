@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+)
+
+// ErrUnchanged is returned by Collect when the gateway's response is
+// byte-identical to the previous poll's: no counter moved and no connection
+// came or went, so there is nothing to decode.
+var ErrUnchanged = errors.New("gateway response unchanged since the last poll")
+
+// TruncatedError is returned when a gateway response is larger than the
+// limit set with SetMaxResponseBytes. Nothing from such a poll is used.
+type TruncatedError struct {
+	Path  string
+	Limit int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("gateway response %s truncated: larger than %d bytes", e.Path, e.Limit)
+}
+
+// StatusError is returned when a gateway API request gets a non-2xx reply.
+type StatusError struct {
+	Path string
+	Code int
+	Body string // first KiB of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("gateway %s returned %d: %s", e.Path, e.Code, e.Body)
+}
+
+// isNotFound reports whether err is a 404 from the gateway, which for an
+// optional endpoint means the core does not have it.
+func isNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// IncompleteError is returned when a gateway response ends before its JSON
+// is complete: the gateway closed a response sent without Content-Length, or
+// cut a chunked one short. Unlike a *TruncatedError it is not caused by the
+// agent's limit, and unlike a malformed response the bytes received were
+// valid so far.
+type IncompleteError struct {
+	Path string
+	Read int // bytes received
+	Err  error
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("gateway response %s ended after %d bytes, before its JSON was complete: %v", e.Path, e.Read, e.Err)
+}
+
+func (e *IncompleteError) Unwrap() error { return e.Err }
+
+// incomplete returns err as an *IncompleteError when it means the response
+// ran out mid-JSON after read bytes.
+func incomplete(path string, read int, err error) error {
+	// Decoder.Token reports running out between tokens as a SyntaxError.
+	var syntax *json.SyntaxError
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &syntax) && syntax.Error() == "unexpected end of JSON input" {
+		return &IncompleteError{Path: path, Read: read, Err: err}
+	}
+	return err
+}
+
+// limitedBody fails with a *TruncatedError once more than limit bytes are
+// read, and on every read after. Unlike io.LimitReader, hitting the limit is
+// an error rather than a silent end of input.
+type limitedBody struct {
+	r     io.Reader
+	read  int64
+	limit int64
+	path  string
+	err   error
+}
+
+func (c *Client) responseReader(body io.Reader, path string) io.Reader {
+	if c.maxResponseBytes <= 0 {
+		return body
+	}
+	return &limitedBody{r: body, limit: c.maxResponseBytes, path: path}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	if b.read+int64(n) > b.limit {
+		// Never hand the decoder bytes past the limit, so an oversized
+		// response cannot decode successfully.
+		n = int(b.limit - b.read)
+		b.read = b.limit
+		b.err = &TruncatedError{Path: b.path, Limit: b.limit}
+		return n, b.err
+	}
+	b.read += int64(n)
+	return n, err
+}
+
+// readBody reads a connection list response into the client's buffer and,
+// with SetSkipUnchanged, reports whether it hashes the same as the previous
+// response for path. The buffer is only valid until the next call.
+func (c *Client) readBody(body io.Reader, path string) ([]byte, bool, error) {
+	c.body.Reset()
+	if _, err := c.body.ReadFrom(c.responseReader(body, path)); err != nil {
+		return nil, false, incomplete(path, c.body.Len(), err)
+	}
+	if !c.skipUnchanged {
+		return c.body.Bytes(), false, nil
+	}
+	h := fnv.New64a()
+	h.Write(c.body.Bytes())
+	sum := h.Sum64()
+	if c.bodyHashes == nil {
+		c.bodyHashes = make(map[string]uint64)
+	}
+	prev, ok := c.bodyHashes[path]
+	c.bodyHashes[path] = sum
+	return c.body.Bytes(), ok && prev == sum, nil
+}
+
+// decodeArrayField streams the array under key in a top-level JSON object,
+// calling each with the decoder positioned at every element in turn, so a
+// large response is never held in memory as a whole. Other keys are skipped;
+// a missing or null array yields no elements.
+func decodeArrayField(r io.Reader, key string, each func(i int, dec *json.Decoder) error) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if name, _ := tok.(string); name != key {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			continue
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return fmt.Errorf("%s is not an array", key)
+		}
+		for i := 0; dec.More(); i++ {
+			if err := each(i, dec); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
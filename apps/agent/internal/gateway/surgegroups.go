@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/foru17/neko-master/apps/agent/internal/domain"
+)
+
+// surgeGroupCache keeps the last known type and selection of each Surge
+// policy group. A group's type only changes with the Surge profile, so the
+// policy-state loop reuses the cached value and config sync refreshes it. The
+// selection is refreshed on every successful fetch and stands in for a failed
+// one, so a transient error reports the group as it was rather than with no
+// selection.
+type surgeGroupCache struct {
+	mu         sync.Mutex
+	types      map[string]string
+	selections map[string]string
+}
+
+// resolve returns the type to report for group given the type the gateway
+// just returned (empty when the fetch failed or Surge omitted it). With
+// refresh a non-empty fetched type replaces the cached one; otherwise the
+// cached type wins and the fetched one only fills a missing entry.
+func (t *surgeGroupCache) resolve(group, fetched string, refresh bool) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cached, ok := t.types[group]
+	if ok && (!refresh || fetched == "") {
+		return cached
+	}
+	if fetched == "" {
+		return ""
+	}
+	if t.types == nil {
+		t.types = make(map[string]string)
+	}
+	t.types[group] = fetched
+	return fetched
+}
+
+// selection returns the selection to report for group: the fetched one,
+// which is cached, or after a failed fetch the last one cached.
+func (t *surgeGroupCache) selection(group, fetched string, ok bool) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !ok {
+		return t.selections[group]
+	}
+	if t.selections == nil {
+		t.selections = make(map[string]string)
+	}
+	t.selections[group] = fetched
+	return fetched
+}
+
+// retain drops cached groups that are no longer in the profile.
+func (t *surgeGroupCache) retain(groups []string) {
+	keep := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		keep[g] = struct{}{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for g := range t.types {
+		if _, ok := keep[g]; !ok {
+			delete(t.types, g)
+		}
+	}
+	for g := range t.selections {
+		if _, ok := keep[g]; !ok {
+			delete(t.selections, g)
+		}
+	}
+}
+
+// surgeGroupSelections fetches the current selection of each policy group
+// from /v1/policy_groups/select, which returns only the selected policy, and
+// takes the group type from the cache. Config sync passes refresh so the
+// types it reads replace the cached ones. A group whose fetch fails keeps its
+// last known selection.
+func (c *Client) surgeGroupSelections(ctx context.Context, groups []string, refresh bool) []domain.GatewayProxy {
+	out := make([]domain.GatewayProxy, 0, len(groups))
+	for _, g := range groups {
+		var groupDetail struct {
+			Type   string `json:"type"`
+			Policy string `json:"policy"`
+		}
+		query := url.Values{}
+		query.Set("group_name", g)
+		err := c.getJSON(ctx, "/v1/policy_groups/select?"+query.Encode(), &groupDetail)
+		if err != nil {
+			fmt.Printf("[agent] warning: failed to get policy detail for %s: %v\n", g, err)
+			groupDetail.Type = ""
+		}
+		out = append(out, domain.GatewayProxy{
+			Name: g,
+			Type: c.surgeGroups.resolve(g, groupDetail.Type, refresh),
+			Now:  c.surgeGroups.selection(g, groupDetail.Policy, err == nil),
+		})
+	}
+	if refresh {
+		c.surgeGroups.retain(groups)
+	}
+	return out
+}
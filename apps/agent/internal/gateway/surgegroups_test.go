@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSurgePolicyStateUsesCachedGroupTypes(t *testing.T) {
+	var mu sync.Mutex
+	groupType := "select"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/rules":
+			_, _ = w.Write([]byte(`{"rules":["FINAL,Proxy"]}`))
+		case "/v1/policies":
+			_, _ = w.Write([]byte(`{"policy-groups":["Proxy"],"proxies":["HK"]}`))
+		case "/v1/policy_groups/select":
+			mu.Lock()
+			typ := groupType
+			mu.Unlock()
+			fmt.Fprintf(w, `{"type":%q,"policy":"HK"}`, typ)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "surge", server.URL, "")
+	ctx := context.Background()
+	groupTypeOf := func() string {
+		t.Helper()
+		snap, err := client.GetPolicyStateSnapshot(ctx)
+		if err != nil {
+			t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+		}
+		if got := snap.Proxies["Proxy"].Now; got != "HK" {
+			t.Fatalf("expected selection HK, got %q", got)
+		}
+		return snap.Proxies["Proxy"].Type
+	}
+
+	if got := groupTypeOf(); got != "select" {
+		t.Fatalf("expected type from the first fetch, got %q", got)
+	}
+
+	mu.Lock()
+	groupType = ""
+	mu.Unlock()
+	if got := groupTypeOf(); got != "select" {
+		t.Fatalf("expected cached type when Surge omits it, got %q", got)
+	}
+
+	mu.Lock()
+	groupType = "url-test"
+	mu.Unlock()
+	if got := groupTypeOf(); got != "select" {
+		t.Fatalf("expected policy-state loop to keep the cached type, got %q", got)
+	}
+
+	snap, err := client.GetConfigSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetConfigSnapshot returned error: %v", err)
+	}
+	if got := snap.Proxies["Proxy"].Type; got != "url-test" {
+		t.Fatalf("expected config sync to refresh the type, got %q", got)
+	}
+	if got := groupTypeOf(); got != "url-test" {
+		t.Fatalf("expected refreshed type in policy state, got %q", got)
+	}
+}
+
+func TestSurgePolicyStateKeepsSelectionWhenGroupFetchFails(t *testing.T) {
+	var mu sync.Mutex
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/policies":
+			_, _ = w.Write([]byte(`{"policy-groups":["Proxy","Streaming"],"proxies":["HK"]}`))
+		case "/v1/policy_groups/select":
+			mu.Lock()
+			fail := failing && r.URL.Query().Get("group_name") == "Proxy"
+			mu.Unlock()
+			if fail {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`{"type":"select","policy":"HK"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.Client(), "surge", server.URL, "")
+	ctx := context.Background()
+	before, err := client.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	after, err := client.GetPolicyStateSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("GetPolicyStateSnapshot returned error: %v", err)
+	}
+	if got := after.Proxies["Proxy"]; got.Now != "HK" || got.Type != "select" {
+		t.Fatalf("expected the last known Proxy group, got %+v", got)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatal("expected a failed group fetch to leave the snapshot unchanged")
+	}
+}
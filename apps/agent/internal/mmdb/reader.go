@@ -0,0 +1,373 @@
+// Package mmdb is a small read-only MaxMind DB (GeoLite2 / GeoIP2 .mmdb)
+// reader. It loads the whole file into memory and decodes records into
+// generic Go values, which is all the agent needs for country and ASN
+// enrichment without pulling in third-party dependencies.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const dataSectionSeparator = 16
+
+// Metadata holds the fields of the database metadata map the reader uses.
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+type Reader struct {
+	tree       []byte
+	data       []byte
+	meta       Metadata
+	nodeBytes  uint
+	ipv4Start  uint
+	recordSize uint
+}
+
+// Open reads and parses the database at path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses an in-memory database.
+func FromBytes(buf []byte) (*Reader, error) {
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, errors.New("mmdb: metadata marker not found")
+	}
+	metaStart := idx + len(metadataMarker)
+	d := decoder{buf: buf[metaStart:]}
+	raw, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: decode metadata: %w", err)
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+
+	meta := Metadata{
+		NodeCount:    uint(toUint64(m["node_count"])),
+		RecordSize:   uint(toUint64(m["record_size"])),
+		IPVersion:    uint(toUint64(m["ip_version"])),
+		BuildEpoch:   toUint64(m["build_epoch"]),
+		DatabaseType: fmt.Sprint(m["database_type"]),
+	}
+	switch meta.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", meta.RecordSize)
+	}
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", meta.IPVersion)
+	}
+
+	nodeBytes := meta.RecordSize / 4
+	treeSize := meta.NodeCount * nodeBytes
+	if treeSize+dataSectionSeparator > uint(idx) {
+		return nil, errors.New("mmdb: search tree exceeds file size")
+	}
+
+	r := &Reader{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+dataSectionSeparator : idx],
+		meta:       meta,
+		nodeBytes:  nodeBytes,
+		recordSize: meta.RecordSize,
+	}
+	if meta.IPVersion == 6 {
+		// IPv4 addresses live under ::/96; find that node once.
+		node := uint(0)
+		for i := 0; i < 96 && node < meta.NodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *Reader) Metadata() Metadata {
+	return r.meta
+}
+
+// Lookup returns the decoded record for addr, or ok=false when the address is
+// not covered by the database.
+func (r *Reader) Lookup(addr netip.Addr) (value interface{}, ok bool, err error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint(0)
+	if addr.Is4() {
+		a := addr.As4()
+		ip = a[:]
+		node = r.ipv4Start
+	} else {
+		if r.meta.IPVersion == 4 {
+			return nil, false, nil
+		}
+		a := addr.As16()
+		ip = a[:]
+	}
+
+	bitCount := len(ip) * 8
+	for i := 0; i < bitCount && node < r.meta.NodeCount; i++ {
+		bit := (ip[i>>3] >> (7 - uint(i&7))) & 1
+		node = r.readRecord(node, uint(bit))
+	}
+
+	switch {
+	case node == r.meta.NodeCount:
+		return nil, false, nil
+	case node < r.meta.NodeCount:
+		return nil, false, errors.New("mmdb: invalid search tree")
+	}
+
+	offset := node - r.meta.NodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, false, errors.New("mmdb: data pointer out of range")
+	}
+	d := decoder{buf: r.data}
+	value, _, err = d.decode(offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (r *Reader) readRecord(node, bit uint) uint {
+	b := r.tree[node*r.nodeBytes : (node+1)*r.nodeBytes]
+	switch r.recordSize {
+	case 24:
+		o := bit * 3
+		return uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		o := bit * 4
+		return uint(binary.BigEndian.Uint32(b[o : o+4]))
+	}
+}
+
+// Path walks nested maps, e.g. Path(v, "country", "iso_code").
+func Path(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+type decoder struct {
+	buf []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDecodeDepth bounds how deeply maps, arrays and pointers may nest, so a
+// corrupt file whose pointers form a loop fails instead of overflowing the
+// stack. Real databases nest a handful of levels.
+const maxDecodeDepth = 512
+
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+func (d *decoder) decodeAt(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("mmdb: data nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errors.New("mmdb: unexpected end of data")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeAt(ptr, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errors.New("mmdb: unexpected end of data")
+		}
+		typ = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, errors.New("mmdb: unexpected end of data")
+		}
+		extra := uint(0)
+		for _, c := range d.buf[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case typeMap, typeArray:
+		// Every entry takes at least one byte, so a larger count can only
+		// come from a corrupt file and must not size the allocation.
+		if size > uint(len(d.buf))-offset {
+			return nil, 0, errors.New("mmdb: container size exceeds data")
+		}
+	}
+	switch typ {
+	case typeMap:
+		out := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("mmdb: non-string map key")
+			}
+			v, next2, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			out[key] = v
+			offset = next2
+		}
+		return out, offset, nil
+	case typeArray:
+		out := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			out = append(out, v)
+			offset = next
+		}
+		return out, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("mmdb: unexpected end of data")
+	}
+	raw := d.buf[offset : offset+size]
+	next := offset + size
+	switch typ {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes:
+		return append([]byte(nil), raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("mmdb: invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("mmdb: invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		v := uint64(0)
+		for _, c := range raw {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		v := uint32(0)
+		for _, c := range raw {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(raw), next, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint((ctrl>>3)&0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("mmdb: unexpected end of data")
+	}
+	b := d.buf[offset : offset+n]
+	vvv := uint(ctrl & 0x7)
+	var ptr uint
+	switch n {
+	case 1:
+		ptr = vvv<<8 | uint(b[0])
+	case 2:
+		ptr = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		ptr = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		ptr = uint(binary.BigEndian.Uint32(b))
+	}
+	return ptr, offset + n, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		if n > 0 {
+			return uint64(n)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package mmdb
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+func mmdbMap(n int) []byte {
+	return []byte{0xe0 | byte(n)}
+}
+
+// buildTestDB returns an IPv4 database with 24-bit records where 1.0.0.0/8
+// maps to {"country": {"iso_code": "JP"}} and everything else is absent.
+func buildTestDB(t *testing.T) []byte {
+	t.Helper()
+	const nodeCount = 8
+	const prefix = byte(1)
+
+	// Data section: "JP" at offset 0, then the record that points back at it.
+	var data []byte
+	data = append(data, mmdbString("JP")...)
+	recordOffset := len(data)
+	data = append(data, mmdbMap(1)...)
+	data = append(data, mmdbString("country")...)
+	data = append(data, mmdbMap(1)...)
+	data = append(data, mmdbString("iso_code")...)
+	data = append(data, 0x20, 0x00) // pointer to offset 0
+
+	put24 := func(b []byte, v int) {
+		b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+	}
+	tree := make([]byte, nodeCount*6)
+	for i := 0; i < nodeCount; i++ {
+		bit := int(prefix>>(7-i)) & 1
+		next := i + 1
+		if i == nodeCount-1 {
+			next = nodeCount + dataSectionSeparator + recordOffset
+		}
+		node := tree[i*6 : i*6+6]
+		put24(node[bit*3:], next)
+		put24(node[(1-bit)*3:], nodeCount)
+	}
+
+	var buf []byte
+	buf = append(buf, tree...)
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, mmdbMap(4)...)
+	buf = append(buf, mmdbString("node_count")...)
+	buf = append(buf, 0xc1, nodeCount)
+	buf = append(buf, mmdbString("record_size")...)
+	buf = append(buf, 0xa1, 24)
+	buf = append(buf, mmdbString("ip_version")...)
+	buf = append(buf, 0xa1, 4)
+	buf = append(buf, mmdbString("database_type")...)
+	buf = append(buf, mmdbString("Test-Country")...)
+	return buf
+}
+
+func TestReaderLookup(t *testing.T) {
+	r, err := FromBytes(buildTestDB(t))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if got := r.Metadata().DatabaseType; got != "Test-Country" {
+		t.Fatalf("expected database type Test-Country, got %q", got)
+	}
+
+	rec, ok, err := r.Lookup(netip.MustParseAddr("1.2.3.4"))
+	if err != nil || !ok {
+		t.Fatalf("expected 1.2.3.4 to be found, got ok=%v err=%v", ok, err)
+	}
+	if code := Path(rec, "country", "iso_code"); code != "JP" {
+		t.Fatalf("expected JP, got %v", code)
+	}
+
+	if _, ok, err := r.Lookup(netip.MustParseAddr("2.2.3.4")); err != nil || ok {
+		t.Fatalf("expected 2.2.3.4 to be absent, got ok=%v err=%v", ok, err)
+	}
+	if _, ok, err := r.Lookup(netip.MustParseAddr("2001:db8::1")); err != nil || ok {
+		t.Fatalf("expected IPv6 lookup in IPv4 database to miss, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestFromBytesRejectsMissingMetadata(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err == nil {
+		t.Fatal("expected error for data without metadata")
+	}
+}
+
+func TestReaderRejectsCorruptData(t *testing.T) {
+	// Turn the "JP" string into a pointer to itself.
+	buf := buildTestDB(t)
+	data := 8*6 + dataSectionSeparator
+	buf[data], buf[data+1] = 0x20, 0x00
+	r, err := FromBytes(buf)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, _, err := r.Lookup(netip.MustParseAddr("1.2.3.4")); err == nil {
+		t.Fatal("expected a pointer loop to fail the lookup")
+	}
+
+	for name, raw := range map[string][]byte{
+		"map":   {0xff, 0xff, 0xff, 0xff},       // map of 16843036 entries
+		"array": {0x1f, 0x04, 0xff, 0xff, 0xff}, // array of 16843036 elements
+	} {
+		d := decoder{buf: raw}
+		if _, _, err := d.decode(0); err == nil {
+			t.Fatalf("expected an oversized %s to fail", name)
+		}
+	}
+}
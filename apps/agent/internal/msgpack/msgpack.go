@@ -0,0 +1,180 @@
+// Package msgpack implements the small subset of MessagePack the agent needs
+// to encode report payloads: nil, bool, integers, float64, strings, arrays and
+// string-keyed maps. Encoding is append-style so callers control allocation.
+package msgpack
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// ContentType is the media type used for MessagePack request bodies.
+const ContentType = "application/msgpack"
+
+func AppendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func AppendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= 0 && v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v >= 0 && v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v >= 0 && v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	case v >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+func AppendFloat64(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+func AppendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func AppendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+func AppendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func AppendStringArray(b []byte, values []string) []byte {
+	b = AppendArrayHeader(b, len(values))
+	for _, v := range values {
+		b = AppendString(b, v)
+	}
+	return b
+}
+
+// MapWriter appends a map whose entry count is patched in by End, so callers
+// can emit omitempty fields without counting them up front. It always uses
+// the map16 header, which every MessagePack decoder accepts.
+type MapWriter struct {
+	buf   []byte
+	start int
+	n     int
+}
+
+func BeginMap(b []byte) *MapWriter {
+	return &MapWriter{buf: append(b, 0xde, 0, 0), start: len(b)}
+}
+
+func (w *MapWriter) String(key, v string) {
+	w.key(key)
+	w.buf = AppendString(w.buf, v)
+}
+
+func (w *MapWriter) StringOmitEmpty(key, v string) {
+	if v != "" {
+		w.String(key, v)
+	}
+}
+
+func (w *MapWriter) Int(key string, v int64) {
+	w.key(key)
+	w.buf = AppendInt(w.buf, v)
+}
+
+func (w *MapWriter) IntOmitEmpty(key string, v int64) {
+	if v != 0 {
+		w.Int(key, v)
+	}
+}
+
+func (w *MapWriter) Float64OmitEmpty(key string, v float64) {
+	if v != 0 {
+		w.key(key)
+		w.buf = AppendFloat64(w.buf, v)
+	}
+}
+
+func (w *MapWriter) BoolOmitEmpty(key string, v bool) {
+	if v {
+		w.key(key)
+		w.buf = AppendBool(w.buf, v)
+	}
+}
+
+// Strings writes a string slice, encoding nil as nil like encoding/json.
+func (w *MapWriter) Strings(key string, v []string) {
+	w.key(key)
+	if v == nil {
+		w.buf = AppendNil(w.buf)
+		return
+	}
+	w.buf = AppendStringArray(w.buf, v)
+}
+
+func (w *MapWriter) StringsOmitEmpty(key string, v []string) {
+	if len(v) > 0 {
+		w.Strings(key, v)
+	}
+}
+
+// Raw writes key followed by an already-encoded value.
+func (w *MapWriter) Raw(key string, appendValue func([]byte) []byte) {
+	w.key(key)
+	w.buf = appendValue(w.buf)
+}
+
+func (w *MapWriter) key(k string) {
+	w.n++
+	w.buf = AppendString(w.buf, k)
+}
+
+// End patches the entry count and returns the extended buffer.
+func (w *MapWriter) End() []byte {
+	w.buf[w.start+1] = byte(w.n >> 8)
+	w.buf[w.start+2] = byte(w.n)
+	return w.buf
+}
@@ -0,0 +1,161 @@
+package msgpack_test
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/foru17/neko-master/apps/agent/internal/msgpack"
+	"github.com/foru17/neko-master/apps/agent/internal/msgpack/msgpacktest"
+)
+
+func decode(t *testing.T, b []byte) interface{} {
+	t.Helper()
+	v, err := msgpacktest.Decode(b)
+	if err != nil {
+		t.Fatalf("decode % x: %v", b, err)
+	}
+	return v
+}
+
+func TestAppendScalars(t *testing.T) {
+	if b := msgpack.AppendNil(nil); len(b) != 1 || b[0] != 0xc0 || decode(t, b) != nil {
+		t.Fatalf("unexpected nil encoding % x", b)
+	}
+	for _, v := range []bool{false, true} {
+		if got := decode(t, msgpack.AppendBool(nil, v)); got != v {
+			t.Fatalf("bool %v decoded as %v", v, got)
+		}
+	}
+	for _, v := range []float64{0, -1.5, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1)} {
+		if got := decode(t, msgpack.AppendFloat64(nil, v)); got != v {
+			t.Fatalf("float64 %v decoded as %v", v, got)
+		}
+	}
+}
+
+func TestAppendIntBoundaries(t *testing.T) {
+	cases := []struct {
+		v    int64
+		head byte
+		size int
+	}{
+		{0, 0x00, 1},
+		{math.MaxInt8, 0x7f, 1},
+		{math.MaxInt8 + 1, 0xcc, 2},
+		{math.MaxUint8, 0xcc, 2},
+		{math.MaxUint8 + 1, 0xcd, 3},
+		{math.MaxUint16, 0xcd, 3},
+		{math.MaxUint16 + 1, 0xce, 5},
+		{math.MaxUint32, 0xce, 5},
+		{math.MaxUint32 + 1, 0xcf, 9},
+		{math.MaxInt64, 0xcf, 9},
+		{-1, 0xff, 1},
+		{-32, 0xe0, 1},
+		{-33, 0xd0, 2},
+		{math.MinInt8, 0xd0, 2},
+		{math.MinInt8 - 1, 0xd1, 3},
+		{math.MinInt16, 0xd1, 3},
+		{math.MinInt16 - 1, 0xd2, 5},
+		{math.MinInt32, 0xd2, 5},
+		{math.MinInt32 - 1, 0xd3, 9},
+		{math.MinInt64, 0xd3, 9},
+	}
+	for _, tc := range cases {
+		b := msgpack.AppendInt(nil, tc.v)
+		if len(b) != tc.size || b[0] != tc.head {
+			t.Fatalf("AppendInt(%d) = % x, expected %d bytes starting 0x%02x", tc.v, b, tc.size, tc.head)
+		}
+		if got := decode(t, b); got != tc.v {
+			t.Fatalf("AppendInt(%d) decoded as %v", tc.v, got)
+		}
+	}
+}
+
+func TestAppendStringLengths(t *testing.T) {
+	cases := []struct {
+		n      int
+		head   byte
+		header int
+	}{
+		{0, 0xa0, 1},
+		{31, 0xbf, 1},
+		{32, 0xd9, 2},
+		{math.MaxUint8, 0xd9, 2},
+		{math.MaxUint8 + 1, 0xda, 3},
+		{math.MaxUint16, 0xda, 3},
+		{math.MaxUint16 + 1, 0xdb, 5},
+	}
+	for _, tc := range cases {
+		s := strings.Repeat("x", tc.n)
+		b := msgpack.AppendString(nil, s)
+		if len(b) != tc.header+tc.n || b[0] != tc.head {
+			t.Fatalf("AppendString of %d bytes has header % x, expected %d bytes starting 0x%02x", tc.n, b[:min(len(b), 5)], tc.header, tc.head)
+		}
+		if got := decode(t, b); got != s {
+			t.Fatalf("string of %d bytes decoded to %d bytes", tc.n, len(got.(string)))
+		}
+	}
+}
+
+func TestAppendContainerHeaders(t *testing.T) {
+	cases := []struct {
+		n          int
+		array, obj byte
+	}{
+		{0, 0x90, 0x80},
+		{15, 0x9f, 0x8f},
+		{16, 0xdc, 0xde},
+		{math.MaxUint16, 0xdc, 0xde},
+		{math.MaxUint16 + 1, 0xdd, 0xdf},
+	}
+	for _, tc := range cases {
+		values := make([]string, tc.n)
+		b := msgpack.AppendStringArray(nil, values)
+		if b[0] != tc.array {
+			t.Fatalf("array of %d starts 0x%02x, expected 0x%02x", tc.n, b[0], tc.array)
+		}
+		if got := decode(t, b).([]interface{}); len(got) != tc.n {
+			t.Fatalf("array of %d decoded with %d elements", tc.n, len(got))
+		}
+		if b := msgpack.AppendMapHeader(nil, tc.n); b[0] != tc.obj {
+			t.Fatalf("map of %d starts 0x%02x, expected 0x%02x", tc.n, b[0], tc.obj)
+		}
+	}
+}
+
+func TestMapWriter(t *testing.T) {
+	if got := decode(t, msgpack.BeginMap(nil).End()); !reflect.DeepEqual(got, map[string]interface{}{}) {
+		t.Fatalf("expected an empty map, got %#v", got)
+	}
+
+	w := msgpack.BeginMap([]byte{0xc0})
+	w.String("s", "v")
+	w.StringOmitEmpty("empty", "")
+	w.Int("i", -7)
+	w.IntOmitEmpty("zero", 0)
+	w.Float64OmitEmpty("f", 0.25)
+	w.BoolOmitEmpty("b", true)
+	w.BoolOmitEmpty("false", false)
+	w.Strings("nil", nil)
+	w.Strings("list", []string{"a", "b"})
+	w.StringsOmitEmpty("none", []string{})
+	w.Raw("raw", func(b []byte) []byte { return msgpack.AppendInt(b, 1) })
+	b := w.End()
+	if b[0] != 0xc0 {
+		t.Fatalf("expected the map appended after the existing bytes, got % x", b)
+	}
+	want := map[string]interface{}{
+		"s":    "v",
+		"i":    int64(-7),
+		"f":    0.25,
+		"b":    true,
+		"nil":  nil,
+		"list": []interface{}{"a", "b"},
+		"raw":  int64(1),
+	}
+	if got := decode(t, b[1:]); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected map:\n got %#v\nwant %#v", got, want)
+	}
+}
@@ -12,30 +12,105 @@ import (
 
 	"github.com/foru17/neko-master/apps/agent/internal/agent"
 	"github.com/foru17/neko-master/apps/agent/internal/config"
+	"github.com/foru17/neko-master/apps/agent/internal/gateway"
 )
 
 func main() {
-	cfg, err := config.Parse(os.Args[1:])
+	cmd, cfg, err := config.ParseCommand(os.Args[1:])
 	if err != nil {
 		switch {
 		case errors.Is(err, config.ErrHelp):
-			fmt.Fprint(os.Stderr, config.Usage())
+			fmt.Fprint(os.Stderr, config.CommandUsage(cmd))
 			return
 		case errors.Is(err, config.ErrVersion):
 			fmt.Println(config.AgentVersion)
 			return
+		case errors.Is(err, config.ErrPrintConfig):
+			printConfig(cfg)
+			return
 		default:
 			log.Fatalf("config error: %v", err)
 		}
 	}
 
+	switch cmd {
+	case config.CommandVersion:
+		fmt.Println(config.AgentVersion)
+		return
+	case config.CommandDumpConfig:
+		os.Stdout.Write(cfg.EffectiveYAML())
+		return
+	}
+
 	if !cfg.LogEnabled {
 		log.SetOutput(io.Discard)
 	}
+	for _, w := range cfg.Warnings() {
+		log.Printf("config warning: %s", w)
+	}
 
-	runner := agent.NewRunner(cfg)
+	var opts []agent.Option
+	if cfg.GatewayType == config.GatewayReplay {
+		client, err := gateway.NewReplayClient(cfg.ReplayDir, cfg.ReplaySpeed)
+		if err != nil {
+			log.Fatalf("config error: %v", err)
+		}
+		opts = append(opts, agent.WithGatewayClient(client))
+	}
+
+	runner := agent.NewRunner(cfg, opts...)
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	runner.Run(ctx)
+	if cmd == config.CommandDeadLetterReplay {
+		summary, err := runner.ReplayDeadLetters(ctx)
+		fmt.Println(summary)
+		if err != nil || len(summary.Rejected) > 0 {
+			cancel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "neko-agent: %v\n", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cmd == config.CommandCheck {
+		if !agent.WriteCheckResults(os.Stdout, runner.Check(ctx)) {
+			cancel()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Once {
+		summary, err := runner.RunOnce(ctx)
+		fmt.Println(summary)
+		if err != nil {
+			cancel()
+			fmt.Fprintf(os.Stderr, "neko-agent: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := runner.Run(ctx); err != nil {
+		cancel()
+		fmt.Fprintf(os.Stderr, "neko-agent: %v\n", err)
+		os.Exit(1)
+	}
+
+	if exe := runner.PendingRestart(); exe != "" {
+		if err := agent.Reexec(exe); err != nil {
+			log.Fatalf("self-update re-exec failed: %v", err)
+		}
+	}
+}
+
+func printConfig(cfg config.Config) {
+	out, err := cfg.EffectiveJSON()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	fmt.Println(string(out))
 }